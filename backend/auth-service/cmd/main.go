@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"github.com/Blxssy/social-media/auth-service/internal/app"
 	"github.com/Blxssy/social-media/auth-service/internal/config"
 	"github.com/Blxssy/social-media/auth-service/internal/storage"
@@ -15,27 +16,90 @@ import (
 
 func main() {
 	godotenv.Load()
-	token.InitJWTKey()
 
 	cfg := config.LoadConfig()
 
 	logger := logger.SetupLogger(cfg.Env)
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(cfg, logger, os.Args[2:]); err != nil {
+			logger.Error("Failure migrating database", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		return
+	}
+
 	logger.Info("cfg", slog.Any("cfg", cfg))
 
+	keyring, err := token.LoadKeyring(cfg.Token.Signing.KeysDir, cfg.Token.Signing.Algorithm, cfg.Token.RefreshTokenTTL)
+	if err != nil {
+		logger.Error("Failure loading signing keys")
+		panic(err)
+	}
+
+	tokens, err := token.NewIssuer(keyring, token.Options{
+		Issuer:     cfg.Token.Issuer,
+		Audience:   cfg.Token.Audience,
+		AccessTTL:  cfg.Token.AccessTokenTTL,
+		RefreshTTL: cfg.Token.RefreshTokenTTL,
+		Leeway:     cfg.Token.Leeway,
+	})
+	if err != nil {
+		logger.Error("Failure configuring tokens")
+		panic(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if cfg.Token.Signing.RotationInterval > 0 {
+		go keyring.RunRotation(ctx, cfg.Token.Signing.RotationInterval, logger)
+	}
+
 	store := storage.NewStorage(logger, cfg)
 
-	application := app.New(logger, cfg.GRPC.Port, store)
+	hasher, err := app.NewPasswordHasher(cfg.Auth.PasswordHashing)
+	if err != nil {
+		logger.Error("Failure configuring password hashing")
+		panic(err)
+	}
+
+	// "main seed" seeds even where seeding on startup is disabled.
+	if len(os.Args) > 1 && os.Args[1] == "seed" {
+		if err := runSeed(ctx, logger, cfg, store, hasher); err != nil {
+			logger.Error("Failure seeding database", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cfg.Seed.Enabled {
+		if err := runSeed(ctx, logger, cfg, store, hasher); err != nil {
+			logger.Error("Failure seeding database", slog.String("error", err.Error()))
+			panic(err)
+		}
+	}
+
+	application := app.New(logger, cfg, store, tokens)
 
 	go func() {
 		application.GRPCServer.MustRun()
 	}()
 
+	if application.HTTPServer != nil {
+		go func() {
+			application.HTTPServer.MustRun()
+		}()
+	}
+
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
 
 	<-stop
 
+	if application.HTTPServer != nil {
+		application.HTTPServer.Stop()
+	}
 	application.GRPCServer.Stop()
 	logger.Info("Gracefully stopped")
 }
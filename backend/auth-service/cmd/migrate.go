@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Blxssy/social-media/auth-service/internal/config"
+	"github.com/Blxssy/social-media/auth-service/internal/storage"
+	"github.com/Blxssy/social-media/auth-service/internal/storage/migrations"
+)
+
+const migrateUsage = "usage: main migrate up|down|status"
+
+// runMigrate implements the "migrate" subcommand: "up" applies pending
+// migrations and creates the default roles, "down" rolls back the latest
+// migration and "status" lists them.
+func runMigrate(cfg *config.Config, logger *slog.Logger, args []string) error {
+	if len(args) != 1 {
+		return errors.New(migrateUsage)
+	}
+
+	db, err := storage.ConnectDatabase(cfg)
+	if err != nil {
+		return err
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	defer sqlDB.Close()
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		applied, err := migrations.Up(ctx, sqlDB)
+		if err != nil {
+			return err
+		}
+		for _, m := range applied {
+			logger.Info("Applied migration", slog.Int64("version", m.Version), slog.String("name", m.Name))
+		}
+		if len(applied) == 0 {
+			logger.Info("Database is up to date")
+		}
+		if err := storage.SeedRoles(db); err != nil {
+			return err
+		}
+	case "down":
+		m, err := migrations.Down(ctx, sqlDB)
+		if err != nil {
+			return err
+		}
+		logger.Info("Rolled back migration", slog.Int64("version", m.Version), slog.String("name", m.Name))
+	case "status":
+		statuses, err := migrations.List(ctx, sqlDB)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, s := range statuses {
+			appliedAt := "pending"
+			if s.AppliedAt != nil {
+				appliedAt = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+		}
+		return w.Flush()
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	return nil
+}
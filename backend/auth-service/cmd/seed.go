@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/Blxssy/social-media/auth-service/internal/config"
+	"github.com/Blxssy/social-media/auth-service/internal/seed"
+	"github.com/Blxssy/social-media/auth-service/internal/storage"
+	"github.com/Blxssy/social-media/auth-service/internal/validation"
+	"github.com/Blxssy/social-media/auth-service/pkg/password"
+)
+
+// runSeed seeds the database, holding the admin password to the password
+// policy new passwords have to satisfy.
+func runSeed(ctx context.Context, logger *slog.Logger, cfg *config.Config, store storage.Storage, hasher password.Hasher) error {
+	passwords, err := validation.NewPasswordPolicy(cfg.Auth.PasswordPolicy)
+	if err != nil {
+		return err
+	}
+
+	return seed.Run(ctx, logger, cfg.Seed, store, hasher, passwords)
+}
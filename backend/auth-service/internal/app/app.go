@@ -1,25 +1,192 @@
 package app
 
 import (
+	"fmt"
+	"github.com/Blxssy/social-media/auth-service/internal/config"
 	"github.com/Blxssy/social-media/auth-service/internal/services/auth"
+	"github.com/Blxssy/social-media/auth-service/internal/services/oauth"
 	"github.com/Blxssy/social-media/auth-service/internal/storage"
+	"github.com/Blxssy/social-media/auth-service/internal/validation"
+	"github.com/Blxssy/social-media/auth-service/pkg/mailer"
+	"github.com/Blxssy/social-media/auth-service/pkg/oidc"
+	"github.com/Blxssy/social-media/auth-service/pkg/password"
+	"github.com/Blxssy/social-media/auth-service/pkg/ratelimit"
+	"github.com/Blxssy/social-media/auth-service/pkg/token"
 	"log/slog"
+	"net/http"
+	"time"
 
 	grpcapp "github.com/Blxssy/social-media/auth-service/internal/app/grpc"
+	httpapp "github.com/Blxssy/social-media/auth-service/internal/app/http"
+	authgrpc "github.com/Blxssy/social-media/auth-service/internal/grpc/auth"
 )
 
+// identityProviderTimeout bounds fetching the keys of an identity provider.
+const identityProviderTimeout = 10 * time.Second
+
 type App struct {
 	GRPCServer *grpcapp.App
+	HTTPServer *httpapp.App
 	Storage    storage.Storage
 }
 
-func New(log *slog.Logger, grpcPort int, storage storage.Storage) *App {
-	authService := auth.New(log, storage, storage, storage)
+// New builds the application. The HTTP server is only created when an HTTP
+// port is configured.
+func New(log *slog.Logger, cfg *config.Config, storage storage.Storage, tokens *token.Issuer) *App {
+	mail, err := newMailer(cfg.Mail)
+	if err != nil {
+		panic(err)
+	}
+
+	hasher, err := NewPasswordHasher(cfg.Auth.PasswordHashing)
+	if err != nil {
+		panic(err)
+	}
+
+	authService := auth.New(
+		log,
+		cfg.Auth,
+		storage,
+		newIdentityProviders(log, cfg.Auth.IdentityProviders),
+		mail,
+		hasher,
+		tokens,
+	)
+
+	limiter := newRateLimiter(log, cfg)
+
+	passwords, err := validation.NewPasswordPolicy(cfg.Auth.PasswordPolicy)
+	if err != nil {
+		panic(err)
+	}
+	if n := passwords.BreachListSize(); n > 0 {
+		log.Info("breach list loaded", slog.Int("passwords", n))
+	}
+
+	grpcApp := grpcapp.New(log, authService, passwords, limiter, cfg.GRPC.Port)
 
-	grpcApp := grpcapp.New(log, authService, grpcPort)
+	var httpApp *httpapp.App
+	if cfg.HTTP.Port != 0 {
+		oauthService := oauth.New(log, cfg.OAuth, storage, tokens)
+
+		httpApp = httpapp.New(
+			log,
+			authService,
+			oauthService,
+			authgrpc.NewVerifier(authService),
+			limiter,
+			cfg.Token.Issuer,
+			cfg.OAuth,
+			cfg.HTTP.Port,
+		)
+	}
 
 	return &App{
 		GRPCServer: grpcApp,
+		HTTPServer: httpApp,
 		Storage:    storage,
 	}
 }
+
+// NewPasswordHasher builds the configured password hasher. Hashes of the
+// other algorithm remain valid, so switching algorithms needs no migration.
+func NewPasswordHasher(cfg config.PasswordHashing) (password.Hasher, error) {
+	argon := password.NewArgon2id(password.Argon2id{
+		Memory:      cfg.Argon2id.Memory,
+		Iterations:  cfg.Argon2id.Iterations,
+		Parallelism: cfg.Argon2id.Parallelism,
+		SaltLength:  cfg.Argon2id.SaltLength,
+		KeyLength:   cfg.Argon2id.KeyLength,
+	})
+	bcrypt := password.NewBcrypt(cfg.Bcrypt.Cost)
+
+	switch cfg.Algorithm {
+	case "", "argon2id":
+		return password.NewChain(argon, bcrypt), nil
+	case "bcrypt":
+		return password.NewChain(bcrypt, argon), nil
+	default:
+		return nil, fmt.Errorf("unknown password hashing algorithm %q", cfg.Algorithm)
+	}
+}
+
+func newMailer(cfg config.Mail) (mailer.Mailer, error) {
+	switch cfg.Driver {
+	case "smtp":
+		return mailer.NewSMTP(cfg.SMTP.Host, cfg.SMTP.Port, cfg.SMTP.Username, cfg.SMTP.Password, cfg.From, cfg.SMTP.Timeout), nil
+	case "file":
+		return mailer.NewFile(cfg.Dir, cfg.From)
+	default:
+		return mailer.NewMemory(), nil
+	}
+}
+
+// newIdentityProviders builds the verifiers of the configured identity
+// providers. Providers without a client id are not set up yet and skipped.
+func newIdentityProviders(log *slog.Logger, cfg []config.IdentityProvider) map[string]auth.IDTokenVerifier {
+	client := &http.Client{Timeout: identityProviderTimeout}
+
+	providers := make(map[string]auth.IDTokenVerifier, len(cfg))
+	for _, p := range cfg {
+		if p.ClientID == "" {
+			log.Warn("identity provider has no client id, skipped", slog.String("provider", p.Name))
+			continue
+		}
+		if _, ok := providers[p.Name]; ok {
+			panic(fmt.Sprintf("identity provider %q configured twice", p.Name))
+		}
+
+		provider, err := oidc.NewProvider(oidc.Config{
+			Issuer:   p.Issuer,
+			ClientID: p.ClientID,
+			JWKSURL:  p.JWKSURL,
+			Leeway:   p.Leeway,
+		}, client)
+		if err != nil {
+			panic(fmt.Sprintf("identity provider %q: %v", p.Name, err))
+		}
+		providers[p.Name] = provider
+	}
+
+	return providers
+}
+
+// newRateLimiter builds the rate limiter of the gRPC and HTTP servers from
+// config. It returns nil when no limit is configured.
+func newRateLimiter(log *slog.Logger, cfg *config.Config) *ratelimit.Limiter {
+	rules := make(map[string]ratelimit.Rule, len(cfg.RateLimit.Methods))
+	for _, rule := range cfg.RateLimit.Methods {
+		rules[rule.Method] = rateLimitRule(rule)
+	}
+
+	defaultRule := rateLimitRule(cfg.RateLimit.Default)
+	if defaultRule.Limit.Unlimited() && len(rules) == 0 {
+		return nil
+	}
+
+	var store ratelimit.Store
+	switch cfg.RateLimit.Store {
+	case "redis":
+		store = ratelimit.NewRedisStore(storage.NewRedisClient(cfg.Redis))
+	default:
+		store = ratelimit.NewMemoryStore()
+	}
+
+	limiter, err := ratelimit.New(log, store, defaultRule, rules)
+	if err != nil {
+		panic(fmt.Sprintf("rate limit: %v", err))
+	}
+
+	return limiter
+}
+
+func rateLimitRule(rule config.RateLimitRule) ratelimit.Rule {
+	return ratelimit.Rule{
+		Key: rule.Key,
+		Limit: ratelimit.Limit{
+			Rate:   rule.Rate,
+			Period: rule.Period,
+			Burst:  rule.Burst,
+		},
+	}
+}
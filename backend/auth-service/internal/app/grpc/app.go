@@ -8,6 +8,9 @@ import (
 	"net"
 
 	authgrpc "github.com/Blxssy/social-media/auth-service/internal/grpc/auth"
+	"github.com/Blxssy/social-media/auth-service/internal/validation"
+	"github.com/Blxssy/social-media/auth-service/pkg/authn"
+	"github.com/Blxssy/social-media/auth-service/pkg/ratelimit"
 )
 
 type App struct {
@@ -16,11 +19,36 @@ type App struct {
 	port       int
 }
 
-func New(log *slog.Logger, authService authgrpc.Auth, port int) *App {
-	gGRPCServer := grpc.NewServer()
+// New creates the gRPC server. The rate limiter runs in two stages around
+// authentication: calls are limited by IP before their credentials are
+// checked, and by caller once the caller is known. A nil limiter disables
+// rate limiting.
+func New(log *slog.Logger, authService authgrpc.Auth, passwords *validation.PasswordPolicy, limiter *ratelimit.Limiter, port int) *App {
+	verifier := authgrpc.NewVerifier(authService)
+	authInterceptor := authn.NewInterceptor(verifier, verifier, authgrpc.Methods, authn.Public)
+
+	unary := []grpc.UnaryServerInterceptor{authInterceptor.UnaryServerInterceptor()}
+	stream := []grpc.StreamServerInterceptor{authInterceptor.StreamServerInterceptor()}
+	if limiter != nil {
+		unary = []grpc.UnaryServerInterceptor{
+			limiter.UnaryServerInterceptor(),
+			authInterceptor.UnaryServerInterceptor(),
+			limiter.CallerUnaryServerInterceptor(),
+		}
+		stream = []grpc.StreamServerInterceptor{
+			limiter.StreamServerInterceptor(),
+			authInterceptor.StreamServerInterceptor(),
+			limiter.CallerStreamServerInterceptor(),
+		}
+	}
+
+	gGRPCServer := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...),
+	)
 	reflection.Register(gGRPCServer)
 
-	authgrpc.Register(gGRPCServer, authService)
+	authgrpc.Register(gGRPCServer, log, authService, passwords)
 
 	return &App{
 		log,
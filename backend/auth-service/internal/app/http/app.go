@@ -0,0 +1,86 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/Blxssy/social-media/auth-service/internal/config"
+	"github.com/Blxssy/social-media/auth-service/internal/http/oauth"
+	"github.com/Blxssy/social-media/auth-service/internal/http/wellknown"
+	"github.com/Blxssy/social-media/auth-service/pkg/authn"
+	"github.com/Blxssy/social-media/auth-service/pkg/ratelimit"
+)
+
+const (
+	readHeaderTimeout = 5 * time.Second
+	shutdownTimeout   = 10 * time.Second
+)
+
+type App struct {
+	log        *slog.Logger
+	httpServer *http.Server
+	port       int
+}
+
+func New(
+	log *slog.Logger,
+	authService wellknown.JWKSProvider,
+	oauthService oauth.OAuth,
+	verifier authn.Verifier,
+	limiter *ratelimit.Limiter,
+	issuer string,
+	oauthCfg config.OAuth,
+	port int,
+) *App {
+	mux := http.NewServeMux()
+
+	wellknown.Register(mux, authService)
+	oauth.Register(mux, log, oauthService, verifier, limiter, issuer, oauthCfg)
+
+	return &App{
+		log: log,
+		httpServer: &http.Server{
+			Addr:              fmt.Sprintf(":%d", port),
+			Handler:           mux,
+			ReadHeaderTimeout: readHeaderTimeout,
+		},
+		port: port,
+	}
+}
+
+// MustRun runs HTTP server and panics if any error occurs.
+func (a *App) MustRun() {
+	if err := a.Run(); err != nil {
+		panic(err)
+	}
+}
+
+// Run runs HTTP server.
+func (a *App) Run() error {
+	const op = "httpapp.Run"
+
+	a.log.Info("http server started", slog.String("addr", a.httpServer.Addr))
+
+	if err := a.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// Stop stops HTTP server.
+func (a *App) Stop() {
+	const op = "httpapp.Stop"
+
+	a.log.With(slog.String("op", op)).
+		Info("stopping HTTP server", slog.Int("port", a.port))
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	a.httpServer.Shutdown(ctx)
+}
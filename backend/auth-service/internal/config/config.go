@@ -1,20 +1,34 @@
 package config
 
 import (
+	"fmt"
+	"log/slog"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	Env      string     `yaml:"env" envDefault:"local"`
-	Database Database   `yaml:"database"`
-	GRPC     GRPCConfig `yaml:"grpc"`
-	Redis    Redis      `yaml:"redis"`
-	Token    Token      `yaml:"token"`
+	Env       string     `yaml:"env" envDefault:"local"`
+	Database  Database   `yaml:"database"`
+	GRPC      GRPCConfig `yaml:"grpc"`
+	HTTP      HTTPConfig `yaml:"http"`
+	Redis     Redis      `yaml:"redis"`
+	Token     Token      `yaml:"token"`
+	Auth      Auth       `yaml:"auth"`
+	Mail      Mail       `yaml:"mail"`
+	RateLimit RateLimit  `yaml:"rateLimit"`
+	Seed      Seed       `yaml:"seed"`
+	OAuth     OAuth      `yaml:"oauth"`
 }
 
+// Database configures Postgres. With Migration set, pending migrations are
+// applied on startup; otherwise run "main migrate up" before deploying.
 type Database struct {
 	Dialect   string `yaml:"dialect" default:"postgres"`
 	Host      string `yaml:"host" default:"localhost"`
@@ -30,14 +44,216 @@ type GRPCConfig struct {
 	Timeout time.Duration `yaml:"timeout"`
 }
 
+// HTTPConfig configures the HTTP server serving the /.well-known and OAuth
+// endpoints. A zero port disables it.
+type HTTPConfig struct {
+	Port int `yaml:"port"`
+}
+
+// RateLimit configures the rate limiter of the gRPC and HTTP servers. Store
+// is "memory" or "redis"; only the Redis store shares limits between
+// replicas. Methods override Default for single full method names such as
+// "/auth.AuthService/Register" or HTTP routes such as "POST /oauth/token".
+type RateLimit struct {
+	Store   string          `yaml:"store"`
+	Default RateLimitRule   `yaml:"default"`
+	Methods []RateLimitRule `yaml:"methods"`
+}
+
+// RateLimitRule allows Rate requests per Period, with bursts of up to Burst
+// (Rate when zero), per caller identified by Key: "ip", "user" or "api_key".
+// A zero Rate disables limiting.
+type RateLimitRule struct {
+	Method string        `yaml:"method"`
+	Key    string        `yaml:"key"`
+	Rate   int           `yaml:"rate"`
+	Period time.Duration `yaml:"period"`
+	Burst  int           `yaml:"burst"`
+}
+
+// Seed configures the users created on startup. Outside the prod environment
+// it defaults to enabled; in prod it has to be enabled explicitly. The admin
+// is only created when Admin.Email is set. FixturesFile lists further users
+// with known passwords, so it only defaults to configs/fixtures.yaml in the
+// local environment.
+type Seed struct {
+	Enabled      bool      `yaml:"enabled"`
+	Admin        SeedAdmin `yaml:"admin"`
+	FixturesFile string    `yaml:"fixturesFile"`
+}
+
+// SeedAdmin is the bootstrap admin. Password may also be set through
+// SEED_ADMIN_PASSWORD or read from PasswordFile.
+type SeedAdmin struct {
+	Username     string `yaml:"username"`
+	Email        string `yaml:"email"`
+	Password     string
+	PasswordFile string `yaml:"passwordFile"`
+}
+
+// OAuth configures the OAuth 2.1 provider. Authorization requests are
+// redirected to ConsentURL, the page of the web app where the signed in user
+// approves them, with the request parameters appended. Scopes lists every
+// scope clients may be registered for; list openid, profile and email to
+// offer OpenID Connect. MaxClientsPerUser caps the clients a user may
+// register; zero means no limit.
+type OAuth struct {
+	ConsentURL        string        `yaml:"consentURL"`
+	CodeTTL           time.Duration `yaml:"codeTTL"`
+	Scopes            []OAuthScope  `yaml:"scopes"`
+	MaxClientsPerUser int           `yaml:"maxClientsPerUser"`
+}
+
+type OAuthScope struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+}
+
 type Redis struct {
 	Host string `yaml:"host"`
 	Port int    `yaml:"port"`
 }
 
+// Token configures the issued tokens. Issuer and Audience become the iss and
+// aud claims and are required on every token presented. Leeway is the clock
+// skew tolerated when checking exp, nbf and iat.
 type Token struct {
-	accessTokenTTL  time.Duration `yaml:"accessTokenTTL"`
-	refreshTokenTTL time.Duration `yaml:"refreshTokenTTL"`
+	Issuer          string        `yaml:"issuer"`
+	Audience        string        `yaml:"audience"`
+	AccessTokenTTL  time.Duration `yaml:"accessTokenTTL"`
+	RefreshTokenTTL time.Duration `yaml:"refreshTokenTTL"`
+	Leeway          time.Duration `yaml:"leeway"`
+	Signing         Signing       `yaml:"signing"`
+}
+
+// Signing configures the asymmetric keys tokens are signed with. Keys are
+// PEM files in KeysDir named after their kid. A zero RotationInterval
+// disables scheduled rotation.
+type Signing struct {
+	Algorithm        string        `yaml:"algorithm"`
+	KeysDir          string        `yaml:"keysDir"`
+	RotationInterval time.Duration `yaml:"rotationInterval"`
+}
+
+// Auth configures account policies. VerifyEmailURL and ResetPasswordURL are
+// format strings the emailed token is substituted into.
+type Auth struct {
+	RequireEmailVerification bool               `yaml:"requireEmailVerification"`
+	EmailVerificationTTL     time.Duration      `yaml:"emailVerificationTTL"`
+	VerifyEmailURL           string             `yaml:"verifyEmailURL"`
+	PasswordResetTTL         time.Duration      `yaml:"passwordResetTTL"`
+	ResetPasswordURL         string             `yaml:"resetPasswordURL"`
+	MFAIssuer                string             `yaml:"mfaIssuer"`
+	MFATicketTTL             time.Duration      `yaml:"mfaTicketTTL"`
+	LoginThrottle            LoginThrottle      `yaml:"loginThrottle"`
+	PasswordPolicy           PasswordPolicy     `yaml:"passwordPolicy"`
+	PasswordHashing          PasswordHashing    `yaml:"passwordHashing"`
+	APIKeys                  APIKeys            `yaml:"apiKeys"`
+	IdentityProviders        []IdentityProvider `yaml:"identityProviders"`
+}
+
+// IdentityProvider is an external OpenID Connect provider users may sign in
+// with, such as Google. Name identifies it in requests. ClientID is the id
+// this service is registered with at the provider; its ID tokens have to be
+// addressed to it. JWKSURL is looked up in the discovery document of Issuer
+// when empty.
+type IdentityProvider struct {
+	Name     string        `yaml:"name"`
+	Issuer   string        `yaml:"issuer"`
+	ClientID string        `yaml:"clientID"`
+	JWKSURL  string        `yaml:"jwksURL"`
+	Leeway   time.Duration `yaml:"leeway"`
+}
+
+// APIKeys limits the API keys of a user. MaxPerUser counts keys that are not
+// revoked; zero means no limit.
+type APIKeys struct {
+	MaxPerUser int `yaml:"maxPerUser"`
+}
+
+// PasswordPolicy applies to new passwords. MaxBytes is capped at bcrypt's
+// limit of 72 bytes, which is also the default.
+type PasswordPolicy struct {
+	MinLength     int        `yaml:"minLength"`
+	MaxBytes      int        `yaml:"maxBytes"`
+	RequireUpper  bool       `yaml:"requireUpper"`
+	RequireLower  bool       `yaml:"requireLower"`
+	RequireDigit  bool       `yaml:"requireDigit"`
+	RequireSymbol bool       `yaml:"requireSymbol"`
+	BreachList    BreachList `yaml:"breachList"`
+}
+
+// PasswordHashing selects the algorithm new password hashes are made with,
+// "argon2id" or "bcrypt". Hashes of the other algorithm, or made with other
+// parameters, are still accepted and replaced on the user's next login.
+type PasswordHashing struct {
+	Algorithm string         `yaml:"algorithm"`
+	Argon2id  Argon2idParams `yaml:"argon2id"`
+	Bcrypt    BcryptParams   `yaml:"bcrypt"`
+}
+
+// Argon2idParams are the Argon2id cost parameters. Memory is in KiB.
+type Argon2idParams struct {
+	Memory      uint32 `yaml:"memory"`
+	Iterations  uint32 `yaml:"iterations"`
+	Parallelism uint8  `yaml:"parallelism"`
+	SaltLength  uint32 `yaml:"saltLength"`
+	KeyLength   uint32 `yaml:"keyLength"`
+}
+
+type BcryptParams struct {
+	Cost int `yaml:"cost"`
+}
+
+// BreachList is a local file of passwords that must not be used. Format is
+// "plain" (one password per line) or "sha1" (SHA-1 digests with optional
+// ":count", as downloaded from Have I Been Pwned). An empty Path disables
+// the check unless MinPasswords is set: then the list is required and must
+// hold at least that many passwords. Outside the local environment
+// MinPasswords defaults to 100000, so the sample list in data/ is refused
+// there; data/README.md describes how to get a real one.
+type BreachList struct {
+	Path         string `yaml:"path"`
+	Format       string `yaml:"format"`
+	MinCount     int    `yaml:"minCount"`
+	MinPasswords int    `yaml:"minPasswords"`
+}
+
+// LoginThrottle limits failed logins per account and per client IP within a
+// sliding Window. After FreeAttempts failures every further attempt has to
+// wait BaseDelay, doubled per failure up to MaxDelay; after MaxAttempts
+// failures logins are locked for LockoutDuration.
+type LoginThrottle struct {
+	Window          time.Duration `yaml:"window"`
+	BaseDelay       time.Duration `yaml:"baseDelay"`
+	MaxDelay        time.Duration `yaml:"maxDelay"`
+	LockoutDuration time.Duration `yaml:"lockoutDuration"`
+	Account         ThrottleLimit `yaml:"account"`
+	IP              ThrottleLimit `yaml:"ip"`
+}
+
+type ThrottleLimit struct {
+	FreeAttempts int `yaml:"freeAttempts"`
+	MaxAttempts  int `yaml:"maxAttempts"`
+}
+
+// Mail configures how emails are delivered. Driver is one of "smtp", "file"
+// (writes .eml files to Dir) or "memory".
+type Mail struct {
+	Driver string `yaml:"driver"`
+	From   string `yaml:"from"`
+	Dir    string `yaml:"dir"`
+	SMTP   SMTP   `yaml:"smtp"`
+}
+
+// SMTP is the server emails are sent through. Timeout bounds the delivery
+// of one email, on top of the deadline of the request sending it.
+type SMTP struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string
+	Timeout  time.Duration `yaml:"timeout"`
 }
 
 func LoadConfig() *Config {
@@ -52,11 +268,85 @@ func LoadConfig() *Config {
 	}
 
 	viper.SetDefault("Database.Password", os.Getenv("DB_PASSWORD"))
+	viper.SetDefault("Mail.SMTP.Password", os.Getenv("SMTP_PASSWORD"))
+	viper.SetDefault("Seed.Admin.Password", os.Getenv("SEED_ADMIN_PASSWORD"))
+	if viper.GetString("env") != "prod" {
+		viper.SetDefault("Seed.Enabled", true)
+	}
+	if viper.GetString("env") == "local" {
+		viper.SetDefault("Seed.FixturesFile", "./configs/fixtures.yaml")
+	}
+	if viper.GetString("env") != "local" {
+		viper.SetDefault("Auth.PasswordPolicy.BreachList.MinPasswords", 100000)
+	}
+	viper.SetDefault("Token.AccessTokenTTL", "15m")
+	viper.SetDefault("Token.RefreshTokenTTL", "7d")
+	viper.SetDefault("Token.Leeway", "30s")
+	viper.SetDefault("OAuth.CodeTTL", "1m")
+	viper.SetDefault("Mail.SMTP.Timeout", "10s")
 
 	var cfg Config
-	if err := viper.Unmarshal(&cfg); err != nil {
+	err := viper.Unmarshal(&cfg, viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		stringToDurationHook,
+		mapstructure.StringToSliceHookFunc(","),
+	)))
+	if err != nil {
 		panic(err)
 	}
 
 	return &cfg
 }
+
+// redacted replaces secrets in logged config.
+const redacted = "REDACTED"
+
+// LogValue logs the config with its secrets redacted.
+func (c *Config) LogValue() slog.Value {
+	cfg := *c
+	cfg.Database.Password = redact(cfg.Database.Password)
+	cfg.Seed.Admin.Password = redact(cfg.Seed.Admin.Password)
+	cfg.Mail.SMTP.Password = redact(cfg.Mail.SMTP.Password)
+
+	return slog.AnyValue(cfg)
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+// ParseDuration is time.ParseDuration with an added "d" unit of 24 hours, as
+// in "7d" or "1d12h".
+func ParseDuration(s string) (time.Duration, error) {
+	days, rest, ok := strings.Cut(s, "d")
+	if !ok {
+		return time.ParseDuration(s)
+	}
+
+	n, err := strconv.Atoi(days)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+
+	d := time.Duration(n) * 24 * time.Hour
+	if rest != "" {
+		r, err := time.ParseDuration(rest)
+		if err != nil || r < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		d += r
+	}
+
+	return d, nil
+}
+
+// stringToDurationHook decodes durations in config with ParseDuration.
+func stringToDurationHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if from.Kind() != reflect.String || to != reflect.TypeOf(time.Duration(0)) {
+		return data, nil
+	}
+
+	return ParseDuration(data.(string))
+}
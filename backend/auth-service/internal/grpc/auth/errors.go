@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	authservice "github.com/Blxssy/social-media/auth-service/internal/services/auth"
+	"github.com/Blxssy/social-media/auth-service/internal/validation"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// errorDomain is the google.rpc.ErrorInfo domain of every error the
+// AuthService returns.
+const errorDomain = "auth.social-media"
+
+// Reasons are machine readable and stable, unlike status messages.
+const (
+	reasonValidationFailed   = "VALIDATION_FAILED"
+	reasonPermissionDenied   = "PERMISSION_DENIED"
+	reasonInvalidCredentials = "INVALID_CREDENTIALS"
+	reasonInvalidToken       = "INVALID_TOKEN"
+	reasonTokenReused        = "TOKEN_REUSED"
+	reasonEmailNotVerified   = "EMAIL_NOT_VERIFIED"
+	reasonUserExists         = "USER_EXISTS"
+	reasonUserNotFound       = "USER_NOT_FOUND"
+	reasonSessionNotFound    = "SESSION_NOT_FOUND"
+	reasonRoleNotFound       = "ROLE_NOT_FOUND"
+	reasonMFAAlreadyEnabled  = "MFA_ALREADY_ENABLED"
+	reasonMFANotEnrolled     = "MFA_NOT_ENROLLED"
+	reasonInvalidMFACode     = "INVALID_MFA_CODE"
+	reasonTooManyAttempts    = "TOO_MANY_ATTEMPTS"
+	reasonAPIKeyNotFound     = "API_KEY_NOT_FOUND"
+	reasonAPIKeyLimit        = "API_KEY_LIMIT"
+	reasonScopeNotAllowed    = "SCOPE_NOT_ALLOWED"
+	reasonUnknownProvider    = "UNKNOWN_PROVIDER"
+	reasonIdentityConflict   = "IDENTITY_CONFLICT"
+	reasonUnverifiedEmail    = "UNVERIFIED_EMAIL"
+	reasonIdentityExists     = "IDENTITY_EXISTS"
+	reasonIdentityNotFound   = "IDENTITY_NOT_FOUND"
+	reasonLastSignInMethod   = "LAST_SIGN_IN_METHOD"
+	reasonInternal           = "INTERNAL"
+)
+
+type domainError struct {
+	err     error
+	code    codes.Code
+	reason  string
+	message string
+}
+
+var domainErrors = []domainError{
+	{authservice.ErrInvalidCredentials, codes.Unauthenticated, reasonInvalidCredentials, "invalid email or password"},
+	{authservice.ErrInvalidToken, codes.Unauthenticated, reasonInvalidToken, "invalid token"},
+	{authservice.ErrTokenReused, codes.Unauthenticated, reasonTokenReused, "refresh token reused"},
+	{authservice.ErrEmailNotVerified, codes.FailedPrecondition, reasonEmailNotVerified, "email is not verified"},
+	{authservice.ErrUserExists, codes.AlreadyExists, reasonUserExists, "user already exists"},
+	{authservice.ErrUserNotFound, codes.NotFound, reasonUserNotFound, "user not found"},
+	{authservice.ErrSessionNotFound, codes.NotFound, reasonSessionNotFound, "session not found"},
+	{authservice.ErrRoleNotFound, codes.NotFound, reasonRoleNotFound, "role not found"},
+	{authservice.ErrMFAAlreadyEnabled, codes.FailedPrecondition, reasonMFAAlreadyEnabled, "two-factor authentication already enabled"},
+	{authservice.ErrMFANotEnrolled, codes.FailedPrecondition, reasonMFANotEnrolled, "two-factor authentication not enrolled"},
+	{authservice.ErrInvalidMFACode, codes.Unauthenticated, reasonInvalidMFACode, "invalid two-factor code"},
+	{authservice.ErrAPIKeyNotFound, codes.NotFound, reasonAPIKeyNotFound, "api key not found"},
+	{authservice.ErrAPIKeyLimit, codes.FailedPrecondition, reasonAPIKeyLimit, "too many api keys"},
+	{authservice.ErrScopeNotAllowed, codes.PermissionDenied, reasonScopeNotAllowed, "only admins may grant this scope"},
+	{authservice.ErrUnknownProvider, codes.InvalidArgument, reasonUnknownProvider, "unknown identity provider"},
+	{authservice.ErrIdentityConflict, codes.FailedPrecondition, reasonIdentityConflict, "an account with this email exists; sign in and link the identity"},
+	{authservice.ErrUnverifiedEmail, codes.FailedPrecondition, reasonUnverifiedEmail, "the identity provider has not verified your email"},
+	{authservice.ErrIdentityExists, codes.AlreadyExists, reasonIdentityExists, "identity already linked"},
+	{authservice.ErrIdentityNotFound, codes.NotFound, reasonIdentityNotFound, "identity not found"},
+	{authservice.ErrLastSignInMethod, codes.FailedPrecondition, reasonLastSignInMethod, "set a password before unlinking the last identity"},
+}
+
+// toStatus maps an error of the service to a gRPC status with an ErrorInfo
+// detail. Errors that already are statuses pass through. Anything unexpected
+// is logged and reported as Internal without its message, which may expose
+// internals.
+func (s *ServerAPI) toStatus(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	var throttled *authservice.ThrottledError
+	if errors.As(err, &throttled) {
+		return newStatus(codes.ResourceExhausted, reasonTooManyAttempts, "too many login attempts",
+			&errdetails.RetryInfo{RetryDelay: durationpb.New(throttled.RetryAfter.Round(time.Second))},
+		)
+	}
+
+	for _, e := range domainErrors {
+		if errors.Is(err, e.err) {
+			return newStatus(e.code, e.reason, e.message)
+		}
+	}
+
+	s.log.Error("request failed", slog.String("error", err.Error()))
+
+	return newStatus(codes.Internal, reasonInternal, "internal error")
+}
+
+// violations collects every invalid field of a request, so they are all
+// reported in one InvalidArgument status.
+type violations []*errdetails.BadRequest_FieldViolation
+
+func (v *violations) add(field string, description string) {
+	*v = append(*v, &errdetails.BadRequest_FieldViolation{
+		Field:       field,
+		Description: description,
+	})
+}
+
+func (v *violations) addAll(field string, descriptions []string) {
+	for _, description := range descriptions {
+		v.add(field, description)
+	}
+}
+
+// email normalizes the address in place or adds a violation.
+func (v *violations) email(field string, email *string) {
+	normalized, err := validation.NormalizeEmail(*email)
+	if err != nil {
+		v.add(field, err.Error())
+		return
+	}
+	*email = normalized
+}
+
+func (v violations) err() error {
+	if len(v) == 0 {
+		return nil
+	}
+
+	return newStatus(codes.InvalidArgument, reasonValidationFailed, v[0].Description,
+		&errdetails.BadRequest{FieldViolations: v},
+	)
+}
+
+func newStatus(code codes.Code, reason string, message string, details ...protoadapt.MessageV1) error {
+	st := status.New(code, message)
+
+	details = append([]protoadapt.MessageV1{&errdetails.ErrorInfo{
+		Reason: reason,
+		Domain: errorDomain,
+	}}, details...)
+
+	detailed, err := st.WithDetails(details...)
+	if err != nil {
+		return st.Err()
+	}
+
+	return detailed.Err()
+}
@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/Blxssy/social-media/auth-service/api/auth"
+	"github.com/Blxssy/social-media/auth-service/internal/config"
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	authservice "github.com/Blxssy/social-media/auth-service/internal/services/auth"
+	"github.com/Blxssy/social-media/auth-service/internal/storage"
+	"github.com/Blxssy/social-media/auth-service/internal/validation"
+	"github.com/Blxssy/social-media/auth-service/pkg/password"
+)
+
+// statusDetails returns the ErrorInfo and BadRequest details of err, which
+// must be a status.
+func statusDetails(t *testing.T, err error) (*status.Status, *errdetails.ErrorInfo, *errdetails.BadRequest) {
+	t.Helper()
+
+	st, ok := status.FromError(err)
+	if !ok {
+		t.Fatalf("%v is not a status", err)
+	}
+
+	var info *errdetails.ErrorInfo
+	var badRequest *errdetails.BadRequest
+	for _, d := range st.Details() {
+		switch d := d.(type) {
+		case *errdetails.ErrorInfo:
+			info = d
+		case *errdetails.BadRequest:
+			badRequest = d
+		}
+	}
+	if info == nil {
+		t.Fatalf("status %v has no ErrorInfo", st)
+	}
+	if info.GetDomain() != errorDomain {
+		t.Errorf("domain = %q, want %q", info.GetDomain(), errorDomain)
+	}
+
+	return st, info, badRequest
+}
+
+func TestToStatusDomainErrors(t *testing.T) {
+	s, _ := newTestServer()
+	reasons := make(map[string]bool)
+
+	for _, e := range domainErrors {
+		t.Run(e.reason, func(t *testing.T) {
+			if reasons[e.reason] {
+				t.Errorf("reason %s is used twice", e.reason)
+			}
+			reasons[e.reason] = true
+
+			// Services wrap their errors with the operation.
+			st, info, badRequest := statusDetails(t, s.toStatus(fmt.Errorf("auth.Op: %w", e.err)))
+			if st.Code() != e.code {
+				t.Errorf("code = %v, want %v", st.Code(), e.code)
+			}
+			if info.GetReason() != e.reason {
+				t.Errorf("reason = %q, want %q", info.GetReason(), e.reason)
+			}
+			if st.Message() != e.message {
+				t.Errorf("message = %q, want %q", st.Message(), e.message)
+			}
+			if badRequest != nil {
+				t.Errorf("unexpected field violations %v", badRequest.GetFieldViolations())
+			}
+		})
+	}
+}
+
+func TestToStatusThrottled(t *testing.T) {
+	s, _ := newTestServer()
+
+	st, info, _ := statusDetails(t, s.toStatus(&authservice.ThrottledError{RetryAfter: 1400 * time.Millisecond}))
+	if st.Code() != codes.ResourceExhausted || info.GetReason() != reasonTooManyAttempts {
+		t.Fatalf("status = %v %s, want ResourceExhausted %s", st.Code(), info.GetReason(), reasonTooManyAttempts)
+	}
+
+	var retry *errdetails.RetryInfo
+	for _, d := range st.Details() {
+		if r, ok := d.(*errdetails.RetryInfo); ok {
+			retry = r
+		}
+	}
+	if retry == nil || retry.GetRetryDelay().AsDuration() != time.Second {
+		t.Errorf("retry info = %v, want a delay of 1s", retry)
+	}
+}
+
+func TestToStatusInternal(t *testing.T) {
+	s, _ := newTestServer()
+
+	err := s.toStatus(fmt.Errorf("auth.Login: %w", errors.New("dial tcp 10.0.0.5:5432: connection refused")))
+	st, info, _ := statusDetails(t, err)
+	if st.Code() != codes.Internal || info.GetReason() != reasonInternal {
+		t.Errorf("status = %v %s, want Internal %s", st.Code(), info.GetReason(), reasonInternal)
+	}
+	if strings.Contains(st.Message(), "10.0.0.5") {
+		t.Errorf("message %q exposes the cause", st.Message())
+	}
+}
+
+func TestToStatusPassesStatusesThrough(t *testing.T) {
+	s, _ := newTestServer()
+
+	want := newStatus(codes.PermissionDenied, reasonPermissionDenied, "no")
+	if got := s.toStatus(want); got != want {
+		t.Errorf("toStatus = %v, want %v", got, want)
+	}
+}
+
+func TestValidationStatus(t *testing.T) {
+	s, _ := newTestServer()
+	policy, err := validation.NewPasswordPolicy(config.PasswordPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.passwords = policy
+
+	_, err = s.Login(context.Background(), &pb.LoginRequest{Email: "not an email"})
+	st, info, badRequest := statusDetails(t, err)
+	if st.Code() != codes.InvalidArgument || info.GetReason() != reasonValidationFailed {
+		t.Fatalf("status = %v %s, want InvalidArgument %s", st.Code(), info.GetReason(), reasonValidationFailed)
+	}
+
+	var fields []string
+	for _, v := range badRequest.GetFieldViolations() {
+		fields = append(fields, v.GetField())
+		if v.GetDescription() == "" {
+			t.Errorf("violation of %s has no description", v.GetField())
+		}
+	}
+	if strings.Join(fields, ",") != "email,password" {
+		t.Errorf("violations of %v, want email and password", fields)
+	}
+	if st.Message() != badRequest.GetFieldViolations()[0].GetDescription() {
+		t.Errorf("message = %q, want the first violation", st.Message())
+	}
+}
+
+// loginStore has a single user and nothing else. The other methods of
+// authservice.Store are left nil.
+type loginStore struct {
+	authservice.Store
+	user *models.User
+}
+
+func (s *loginStore) User(ctx context.Context, email string) (*models.User, error) {
+	if email != s.user.Email {
+		return nil, storage.ErrUserNotFound
+	}
+	return s.user, nil
+}
+
+func TestLoginUnknownEmailLooksLikeWrongPassword(t *testing.T) {
+	hasher := password.NewBcrypt(4)
+	hash, err := hasher.Hash("Correct-Horse-7")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := &loginStore{user: &models.User{Email: "alice@example.com", PassHash: hash}}
+	policy, err := validation.NewPasswordPolicy(config.PasswordPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ServerAPI{
+		log:       log,
+		auth:      authservice.New(log, config.Auth{}, store, nil, nil, hasher, nil),
+		passwords: policy,
+	}
+
+	ctx := context.Background()
+	_, wrongPassword := s.Login(ctx, &pb.LoginRequest{Email: "alice@example.com", Password: "Wrong-Horse-7"})
+	_, unknownEmail := s.Login(ctx, &pb.LoginRequest{Email: "mallory@example.com", Password: "Wrong-Horse-7"})
+
+	st, info, _ := statusDetails(t, wrongPassword)
+	if st.Code() != codes.Unauthenticated || info.GetReason() != reasonInvalidCredentials {
+		t.Fatalf("wrong password: status = %v %s, want Unauthenticated %s", st.Code(), info.GetReason(), reasonInvalidCredentials)
+	}
+
+	// Anything telling the two apart would let callers find out who has an
+	// account.
+	if !proto.Equal(status.Convert(wrongPassword).Proto(), status.Convert(unknownEmail).Proto()) {
+		t.Errorf("unknown email %v differs from wrong password %v", unknownEmail, wrongPassword)
+	}
+}
@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"github.com/Blxssy/social-media/auth-service/pkg/authn"
+)
+
+// Methods is the policy of every AuthService method; a test keeps it in
+// sync with the service. Account and session management needs a signed in
+// user, so neither API keys nor tokens of OAuth clients can be used for it.
+// Staff tools need a permission of the caller's roles; RevokeSession and
+// ListRoles check theirs in the handler, where they only apply to other
+// users.
+var Methods = authn.Methods{
+	"/auth.AuthService/Register":              authn.Public,
+	"/auth.AuthService/Login":                 authn.Public,
+	"/auth.AuthService/Refresh":               authn.Public,
+	"/auth.AuthService/GetJWKS":               authn.Public,
+	"/auth.AuthService/SendVerificationEmail": authn.Public,
+	"/auth.AuthService/ConfirmEmail":          authn.Public,
+	"/auth.AuthService/RequestPasswordReset":  authn.Public,
+	"/auth.AuthService/ResetPassword":         authn.Public,
+	"/auth.AuthService/VerifyMFA":             authn.Public,
+	"/auth.AuthService/ListIdentityProviders": authn.Public,
+	"/auth.AuthService/FederatedLogin":        authn.Public,
+	"/auth.AuthService/Logout":                authn.Session,
+	"/auth.AuthService/LogoutAll":             authn.Session,
+	"/auth.AuthService/ListSessions":          authn.Session,
+	"/auth.AuthService/RevokeSession":         authn.Session,
+	"/auth.AuthService/ChangePassword":        authn.Session,
+	"/auth.AuthService/ChangeEmail":           authn.Session,
+	"/auth.AuthService/EnrollTOTP":            authn.Session,
+	"/auth.AuthService/ConfirmTOTP":           authn.Session,
+	"/auth.AuthService/DisableTOTP":           authn.Session,
+	"/auth.AuthService/CreateAPIKey":          authn.Session,
+	"/auth.AuthService/ListAPIKeys":           authn.Session,
+	"/auth.AuthService/RevokeAPIKey":          authn.Session,
+	"/auth.AuthService/LinkIdentity":          authn.Session,
+	"/auth.AuthService/UnlinkIdentity":        authn.Session,
+	"/auth.AuthService/ListIdentities":        authn.Session,
+	"/auth.AuthService/ClearLoginLockout":     authn.Permission(models.PermissionLoginsUnlock),
+	"/auth.AuthService/AssignRole":            authn.Permission(models.PermissionRolesManage),
+	"/auth.AuthService/RevokeRole":            authn.Permission(models.PermissionRolesManage),
+	"/auth.AuthService/ListRoles":             authn.Authenticated,
+	"/auth.AuthService/Introspect":            authn.Service,
+	"/auth.AuthService/IsAdmin":               authn.Authenticated,
+	"/auth.AuthService/CheckPermission":       authn.Authenticated,
+}
+
+// Verifier verifies access tokens and API keys in process, including the
+// revocation check, for the auth interceptor of the auth-service itself.
+type Verifier struct {
+	auth Auth
+}
+
+func NewVerifier(auth Auth) *Verifier {
+	return &Verifier{auth: auth}
+}
+
+// HasPermission checks the permission against the roles the user has now,
+// which only users signed in to our own apps carry.
+func (v *Verifier) HasPermission(ctx context.Context, p *authn.Principal, permission string) (bool, error) {
+	if !p.FirstParty() {
+		return false, nil
+	}
+
+	return v.auth.CheckPermission(ctx, p.UserID, permission)
+}
+
+func (v *Verifier) Verify(ctx context.Context, accessToken string) (*authn.Principal, error) {
+	if strings.HasPrefix(accessToken, models.APIKeyPrefix) {
+		key, err := v.auth.AuthenticateAPIKey(ctx, accessToken)
+		if err != nil {
+			return nil, err
+		}
+
+		p := &authn.Principal{
+			UserID:  key.UserID,
+			Scopes:  key.Scopes,
+			APIKey:  true,
+			TokenID: key.Prefix,
+		}
+		if key.ExpiresAt != nil {
+			p.ExpiresAt = *key.ExpiresAt
+		}
+		return p, nil
+	}
+
+	claims, err := v.auth.Authenticate(ctx, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return &authn.Principal{
+		UserID:    claims.UserID,
+		Roles:     claims.Roles,
+		Scopes:    strings.Fields(claims.Scope),
+		Client:    claims.ForClient(),
+		ClientID:  claims.ClientID,
+		SessionID: claims.FamilyID,
+		TokenID:   claims.Id,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+	}, nil
+}
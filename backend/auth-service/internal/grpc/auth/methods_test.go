@@ -0,0 +1,109 @@
+package auth_test
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/Blxssy/social-media/auth-service/api/auth"
+	authgrpc "github.com/Blxssy/social-media/auth-service/internal/grpc/auth"
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	authservice "github.com/Blxssy/social-media/auth-service/internal/services/auth"
+	"github.com/Blxssy/social-media/auth-service/pkg/authn"
+	"github.com/Blxssy/social-media/auth-service/pkg/token"
+)
+
+func TestMethodsCoverService(t *testing.T) {
+	prefix := "/" + pb.AuthService_ServiceDesc.ServiceName + "/"
+
+	served := make(map[string]bool)
+	for _, m := range pb.AuthService_ServiceDesc.Methods {
+		served[prefix+m.MethodName] = true
+	}
+	for _, s := range pb.AuthService_ServiceDesc.Streams {
+		served[prefix+s.StreamName] = true
+	}
+
+	// A new method must be given a policy rather than fall back to the
+	// default one.
+	for method := range served {
+		if _, ok := authgrpc.Methods[method]; !ok {
+			t.Errorf("%s has no policy", method)
+		}
+	}
+
+	for method := range authgrpc.Methods {
+		if !served[method] {
+			t.Errorf("%s has a policy but is not an AuthService method", method)
+		}
+	}
+}
+
+const (
+	staffAPIKey = models.APIKeyPrefix + "0123abcd_secret"
+	staffToken  = "access-token"
+)
+
+// staffAuth knows one API key and one access token, both of a user with
+// every permission. The other methods of Auth are left nil.
+type staffAuth struct {
+	authgrpc.Auth
+}
+
+func (staffAuth) AuthenticateAPIKey(ctx context.Context, key string) (*models.APIKey, error) {
+	if key != staffAPIKey {
+		return nil, authservice.ErrInvalidToken
+	}
+	return &models.APIKey{UserID: 1, Prefix: key[:12], Scopes: []string{"posts:read"}}, nil
+}
+
+func (staffAuth) Authenticate(ctx context.Context, accessToken string) (*token.Claims, error) {
+	if accessToken != staffToken {
+		return nil, authservice.ErrInvalidToken
+	}
+	return &token.Claims{UserID: 1, Type: token.TypeAccess, FamilyID: "s1", Roles: []string{models.RoleSupport}}, nil
+}
+
+func (staffAuth) CheckPermission(ctx context.Context, userID uint, permission string) (bool, error) {
+	return true, nil
+}
+
+func TestVerifierRejectsAPIKeysOnSessionMethods(t *testing.T) {
+	verifier := authgrpc.NewVerifier(staffAuth{})
+	interceptor := authn.NewInterceptor(verifier, verifier, authgrpc.Methods, authn.Session).UnaryServerInterceptor()
+
+	prefix := "/" + pb.AuthService_ServiceDesc.ServiceName + "/"
+	tests := []struct {
+		method string
+		md     metadata.MD
+		want   codes.Code
+	}{
+		// The key of a user can't manage the account it acts for, nor mint
+		// more keys.
+		{method: "CreateAPIKey", md: metadata.Pairs(authn.APIKeyHeader, staffAPIKey), want: codes.PermissionDenied},
+		{method: "RevokeAPIKey", md: metadata.Pairs("authorization", "Bearer "+staffAPIKey), want: codes.PermissionDenied},
+		{method: "ChangePassword", md: metadata.Pairs(authn.APIKeyHeader, staffAPIKey), want: codes.PermissionDenied},
+		// Nor use the permissions of its owner.
+		{method: "ClearLoginLockout", md: metadata.Pairs(authn.APIKeyHeader, staffAPIKey), want: codes.PermissionDenied},
+		{method: "ListRoles", md: metadata.Pairs(authn.APIKeyHeader, staffAPIKey), want: codes.OK},
+		{method: "CreateAPIKey", md: metadata.Pairs(authn.APIKeyHeader, models.APIKeyPrefix+"0123abcd_forged"), want: codes.Unauthenticated},
+		{method: "CreateAPIKey", md: metadata.Pairs("authorization", "Bearer "+staffToken), want: codes.OK},
+		{method: "ClearLoginLockout", md: metadata.Pairs("authorization", "Bearer "+staffToken), want: codes.OK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+"/"+tt.want.String(), func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), tt.md)
+			_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: prefix + tt.method}, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return nil, nil
+			})
+			if code := status.Code(err); code != tt.want {
+				t.Errorf("code = %v, want %v (err %v)", code, tt.want, err)
+			}
+		})
+	}
+}
@@ -3,9 +3,20 @@ package auth
 import (
 	"context"
 	"errors"
+	"log/slog"
+	"net"
+	"time"
+
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 
 	pb "github.com/Blxssy/social-media/auth-service/api/auth"
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	authservice "github.com/Blxssy/social-media/auth-service/internal/services/auth"
+	"github.com/Blxssy/social-media/auth-service/internal/validation"
+	"github.com/Blxssy/social-media/auth-service/pkg/authn"
+	"github.com/Blxssy/social-media/auth-service/pkg/token"
 	"google.golang.org/grpc"
 )
 
@@ -14,50 +25,96 @@ const (
 )
 
 type Auth interface {
-	Register(ctx context.Context, username, email, password string) (string, string, error)
-	Login(ctx context.Context, email, password string) (string, string, error)
+	Register(ctx context.Context, username, email, password string, client models.ClientInfo) (string, string, error)
+	Login(ctx context.Context, email, password string, client models.ClientInfo) (string, string, string, error)
 	IsAdmin(ctx context.Context, userID int) (bool, error)
+	Refresh(ctx context.Context, refreshToken string, client models.ClientInfo) (string, string, error)
+	Authenticate(ctx context.Context, accessToken string) (*token.Claims, error)
+	Logout(ctx context.Context, principal *authn.Principal) error
+	LogoutAll(ctx context.Context, principal *authn.Principal) error
+	Introspect(ctx context.Context, tokenString string, tokenTypeHint string) (*models.TokenInfo, error)
+	JWKS(ctx context.Context) (token.JSONWebKeySet, error)
+	ListSessions(ctx context.Context, userID uint) ([]*models.Session, error)
+	RevokeSession(ctx context.Context, userID uint, sessionID string) error
+	RevokeAnySession(ctx context.Context, sessionID string) error
+	SendVerificationEmail(ctx context.Context, email string) error
+	ConfirmEmail(ctx context.Context, verificationToken string) error
+	RequestPasswordReset(ctx context.Context, email string) error
+	ResetPassword(ctx context.Context, resetToken string, newPassword string) error
+	ChangePassword(ctx context.Context, userID uint, sessionID string, currentPassword string, newPassword string) error
+	ChangeEmail(ctx context.Context, userID uint, password string, newEmail string) error
+	EnrollTOTP(ctx context.Context, userID uint) (string, string, error)
+	ConfirmTOTP(ctx context.Context, userID uint, code string) ([]string, error)
+	DisableTOTP(ctx context.Context, userID uint, password string, code string) error
+	VerifyMFA(ctx context.Context, ticket string, code string, client models.ClientInfo) (string, string, error)
+	ClearLoginLockout(ctx context.Context, email string, ip string) error
+	AssignRole(ctx context.Context, userID uint, role string) error
+	RevokeRole(ctx context.Context, userID uint, role string) error
+	ListRoles(ctx context.Context, userID uint) ([]*models.Role, error)
+	CheckPermission(ctx context.Context, userID uint, permission string) (bool, error)
+	CreateAPIKey(ctx context.Context, userID uint, name string, scopes []string, expiresAt time.Time) (string, *models.APIKey, error)
+	ListAPIKeys(ctx context.Context, userID uint) ([]*models.APIKey, error)
+	RevokeAPIKey(ctx context.Context, userID uint, keyID uint) error
+	AuthenticateAPIKey(ctx context.Context, key string) (*models.APIKey, error)
+	IdentityProviders() []string
+	FederatedLogin(ctx context.Context, provider string, idToken string, nonce string, client models.ClientInfo) (string, string, string, error)
+	LinkIdentity(ctx context.Context, userID uint, provider string, idToken string, nonce string) (*models.Identity, error)
+	UnlinkIdentity(ctx context.Context, userID uint, provider string) error
+	ListIdentities(ctx context.Context, userID uint) ([]*models.Identity, error)
 }
 
 type ServerAPI struct {
 	pb.UnimplementedAuthServiceServer
-	auth Auth
+	log       *slog.Logger
+	auth      Auth
+	passwords *validation.PasswordPolicy
 }
 
-func Register(grpcServer *grpc.Server, auth Auth) {
-	pb.RegisterAuthServiceServer(grpcServer, &ServerAPI{auth: auth})
+func Register(grpcServer *grpc.Server, log *slog.Logger, auth Auth, passwords *validation.PasswordPolicy) {
+	pb.RegisterAuthServiceServer(grpcServer, &ServerAPI{log: log, auth: auth, passwords: passwords})
 }
 
 func (s *ServerAPI) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.RegisterResponse, error) {
-	if err := validateRegister(req); err != nil {
+	if err := s.validateRegister(req); err != nil {
 		return nil, err
 	}
 
-	accessToken, refreshToken, err := s.auth.Register(ctx, req.GetUsername(), req.GetEmail(), req.GetPassword())
+	accessToken, refreshToken, err := s.auth.Register(ctx, req.GetUsername(), req.GetEmail(), req.GetPassword(), clientInfo(ctx))
 	if err != nil {
-		return nil, err
+		return nil, s.toStatus(err)
 	}
-	md := metadata.Pairs("authorization", "Bearer "+accessToken)
-	metadata.NewOutgoingContext(context.Background(), md)
+
+	// Hand the access token back the way authenticated calls send it, so
+	// clients can copy the header as is.
+	if accessToken != "" {
+		md := metadata.Pairs("authorization", "Bearer "+accessToken)
+		if err := grpc.SetHeader(ctx, md); err != nil {
+			return nil, s.toStatus(err)
+		}
+	}
+
 	return &pb.RegisterResponse{
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
+		AccessToken:               accessToken,
+		RefreshToken:              refreshToken,
+		EmailVerificationRequired: accessToken == "",
 	}, nil
 }
 
 func (s *ServerAPI) Login(ctx context.Context, req *pb.LoginRequest) (*pb.LoginResponse, error) {
-	if err := validateLogin(req); err != nil {
+	if err := s.validateLogin(req); err != nil {
 		return nil, err
 	}
 
-	accessToken, refreshToken, err := s.auth.Login(ctx, req.GetEmail(), req.GetPassword())
+	accessToken, refreshToken, mfaTicket, err := s.auth.Login(ctx, req.GetEmail(), req.GetPassword(), clientInfo(ctx))
 	if err != nil {
-		return nil, err
+		return nil, s.toStatus(err)
 	}
 
 	return &pb.LoginResponse{
 		AccessToken:  accessToken,
 		RefreshToken: refreshToken,
+		MfaRequired:  mfaTicket != "",
+		MfaTicket:    mfaTicket,
 	}, nil
 }
 
@@ -66,42 +123,624 @@ func (s *ServerAPI) IsAdmin(ctx context.Context, req *pb.IsAdminRequest) (*pb.Is
 		return nil, err
 	}
 
+	principal, err := authn.Require(ctx)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	if principal.UserID != uint(req.GetUserId()) && !principal.IsService() {
+		return nil, newStatus(codes.PermissionDenied, reasonPermissionDenied, "other users can't be checked")
+	}
+
 	isAdmin, err := s.auth.IsAdmin(ctx, int(req.GetUserId()))
 	if err != nil {
-		return nil, err
+		return nil, s.toStatus(err)
 	}
 
 	return &pb.IsAdminResponse{IsAdmin: isAdmin}, nil
 }
 
-func validateRegister(req *pb.RegisterRequest) error {
-	if req.GetEmail() == "" {
-		return errors.New("missing email")
+func (s *ServerAPI) Refresh(ctx context.Context, req *pb.RefreshRequest) (*pb.RefreshResponse, error) {
+	if err := validateRefresh(req); err != nil {
+		return nil, err
+	}
+
+	accessToken, refreshToken, err := s.auth.Refresh(ctx, req.GetRefreshToken(), clientInfo(ctx))
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	return &pb.RefreshResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+func (s *ServerAPI) Logout(ctx context.Context, req *pb.LogoutRequest) (*pb.LogoutResponse, error) {
+	principal, err := authn.Require(ctx)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	if err := s.auth.Logout(ctx, principal); err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	return &pb.LogoutResponse{}, nil
+}
+
+func (s *ServerAPI) LogoutAll(ctx context.Context, req *pb.LogoutAllRequest) (*pb.LogoutAllResponse, error) {
+	principal, err := authn.Require(ctx)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	if err := s.auth.LogoutAll(ctx, principal); err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	return &pb.LogoutAllResponse{}, nil
+}
+
+func (s *ServerAPI) Introspect(ctx context.Context, req *pb.IntrospectRequest) (*pb.IntrospectResponse, error) {
+	if err := validateIntrospect(req); err != nil {
+		return nil, err
+	}
+
+	info, err := s.auth.Introspect(ctx, req.GetToken(), req.GetTokenTypeHint())
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	if !info.Active {
+		return &pb.IntrospectResponse{Revoked: info.Revoked}, nil
+	}
+
+	return &pb.IntrospectResponse{
+		Active:    true,
+		UserId:    int64(info.UserID),
+		IsAdmin:   info.IsAdmin,
+		TokenType: info.TokenType,
+		Jti:       info.TokenID,
+		SessionId: info.SessionID,
+		Iat:       info.IssuedAt.Unix(),
+		Exp:       unixOrZero(info.ExpiresAt),
+		Roles:     info.Roles,
+		Scopes:    info.Scopes,
+		ClientId:  info.ClientID,
+		Sub:       info.Subject,
+	}, nil
+}
+
+func (s *ServerAPI) GetJWKS(ctx context.Context, req *pb.GetJWKSRequest) (*pb.GetJWKSResponse, error) {
+	set, err := s.auth.JWKS(ctx)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	keys := make([]*pb.JSONWebKey, 0, len(set.Keys))
+	for _, key := range set.Keys {
+		keys = append(keys, &pb.JSONWebKey{
+			Kty: key.Kty,
+			Kid: key.Kid,
+			Use: key.Use,
+			Alg: key.Alg,
+			Crv: key.Crv,
+			X:   key.X,
+			N:   key.N,
+			E:   key.E,
+		})
+	}
+
+	return &pb.GetJWKSResponse{Keys: keys}, nil
+}
+
+func (s *ServerAPI) ListSessions(ctx context.Context, req *pb.ListSessionsRequest) (*pb.ListSessionsResponse, error) {
+	principal, err := authn.Require(ctx)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	sessions, err := s.auth.ListSessions(ctx, principal.UserID)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	resp := &pb.ListSessionsResponse{Sessions: make([]*pb.Session, 0, len(sessions))}
+	for _, session := range sessions {
+		resp.Sessions = append(resp.Sessions, &pb.Session{
+			Id:         session.ID,
+			UserAgent:  session.UserAgent,
+			Ip:         session.IP,
+			CreatedAt:  session.CreatedAt.Unix(),
+			LastUsedAt: session.LastUsedAt.Unix(),
+			Current:    session.ID == principal.SessionID,
+			ClientId:   session.ClientID,
+		})
+	}
+
+	return resp, nil
+}
+
+func (s *ServerAPI) RevokeSession(ctx context.Context, req *pb.RevokeSessionRequest) (*pb.RevokeSessionResponse, error) {
+	if err := validateRevokeSession(req); err != nil {
+		return nil, err
+	}
+
+	principal, err := authn.Require(ctx)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	err = s.auth.RevokeSession(ctx, principal.UserID, req.GetSessionId())
+	if errors.Is(err, authservice.ErrSessionNotFound) {
+		// Not a session of the caller: staff may end it all the same.
+		allowed, permErr := s.hasPermission(ctx, principal, models.PermissionSessionsRevoke)
+		if permErr != nil {
+			return nil, s.toStatus(permErr)
+		}
+		if allowed {
+			err = s.auth.RevokeAnySession(ctx, req.GetSessionId())
+		}
+	}
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	return &pb.RevokeSessionResponse{}, nil
+}
+
+func (s *ServerAPI) SendVerificationEmail(ctx context.Context, req *pb.SendVerificationEmailRequest) (*pb.SendVerificationEmailResponse, error) {
+	if err := validateSendVerificationEmail(req); err != nil {
+		return nil, err
+	}
+
+	if err := s.auth.SendVerificationEmail(ctx, req.GetEmail()); err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	return &pb.SendVerificationEmailResponse{}, nil
+}
+
+func (s *ServerAPI) ConfirmEmail(ctx context.Context, req *pb.ConfirmEmailRequest) (*pb.ConfirmEmailResponse, error) {
+	if err := validateConfirmEmail(req); err != nil {
+		return nil, err
+	}
+
+	if err := s.auth.ConfirmEmail(ctx, req.GetToken()); err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	return &pb.ConfirmEmailResponse{}, nil
+}
+
+func (s *ServerAPI) RequestPasswordReset(ctx context.Context, req *pb.RequestPasswordResetRequest) (*pb.RequestPasswordResetResponse, error) {
+	if err := validateRequestPasswordReset(req); err != nil {
+		return nil, err
+	}
+
+	if err := s.auth.RequestPasswordReset(ctx, req.GetEmail()); err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	return &pb.RequestPasswordResetResponse{}, nil
+}
+
+func (s *ServerAPI) ResetPassword(ctx context.Context, req *pb.ResetPasswordRequest) (*pb.ResetPasswordResponse, error) {
+	if err := s.validateResetPassword(req); err != nil {
+		return nil, err
+	}
+
+	if err := s.auth.ResetPassword(ctx, req.GetToken(), req.GetNewPassword()); err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	return &pb.ResetPasswordResponse{}, nil
+}
+
+func (s *ServerAPI) ChangePassword(ctx context.Context, req *pb.ChangePasswordRequest) (*pb.ChangePasswordResponse, error) {
+	if err := s.validateChangePassword(req); err != nil {
+		return nil, err
+	}
+
+	principal, err := authn.Require(ctx)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	err = s.auth.ChangePassword(ctx, principal.UserID, principal.SessionID, req.GetCurrentPassword(), req.GetNewPassword())
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	return &pb.ChangePasswordResponse{}, nil
+}
+
+func (s *ServerAPI) ChangeEmail(ctx context.Context, req *pb.ChangeEmailRequest) (*pb.ChangeEmailResponse, error) {
+	if err := validateChangeEmail(req); err != nil {
+		return nil, err
+	}
+
+	principal, err := authn.Require(ctx)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	if err := s.auth.ChangeEmail(ctx, principal.UserID, req.GetPassword(), req.GetNewEmail()); err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	return &pb.ChangeEmailResponse{}, nil
+}
+
+func (s *ServerAPI) EnrollTOTP(ctx context.Context, req *pb.EnrollTOTPRequest) (*pb.EnrollTOTPResponse, error) {
+	principal, err := authn.Require(ctx)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	secret, uri, err := s.auth.EnrollTOTP(ctx, principal.UserID)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	return &pb.EnrollTOTPResponse{
+		Secret:     secret,
+		OtpauthUri: uri,
+	}, nil
+}
+
+func (s *ServerAPI) ConfirmTOTP(ctx context.Context, req *pb.ConfirmTOTPRequest) (*pb.ConfirmTOTPResponse, error) {
+	if err := validateConfirmTOTP(req); err != nil {
+		return nil, err
+	}
+
+	principal, err := authn.Require(ctx)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	recoveryCodes, err := s.auth.ConfirmTOTP(ctx, principal.UserID, req.GetCode())
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	return &pb.ConfirmTOTPResponse{RecoveryCodes: recoveryCodes}, nil
+}
+
+func (s *ServerAPI) DisableTOTP(ctx context.Context, req *pb.DisableTOTPRequest) (*pb.DisableTOTPResponse, error) {
+	if err := validateDisableTOTP(req); err != nil {
+		return nil, err
+	}
+
+	principal, err := authn.Require(ctx)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	if err := s.auth.DisableTOTP(ctx, principal.UserID, req.GetPassword(), req.GetCode()); err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	return &pb.DisableTOTPResponse{}, nil
+}
+
+func (s *ServerAPI) VerifyMFA(ctx context.Context, req *pb.VerifyMFARequest) (*pb.VerifyMFAResponse, error) {
+	if err := validateVerifyMFA(req); err != nil {
+		return nil, err
+	}
+
+	accessToken, refreshToken, err := s.auth.VerifyMFA(ctx, req.GetMfaTicket(), req.GetCode(), clientInfo(ctx))
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	return &pb.VerifyMFAResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+func (s *ServerAPI) ClearLoginLockout(ctx context.Context, req *pb.ClearLoginLockoutRequest) (*pb.ClearLoginLockoutResponse, error) {
+	if err := validateClearLoginLockout(req); err != nil {
+		return nil, err
+	}
+
+	if err := s.auth.ClearLoginLockout(ctx, req.GetEmail(), req.GetIp()); err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	return &pb.ClearLoginLockoutResponse{}, nil
+}
+
+func (s *ServerAPI) AssignRole(ctx context.Context, req *pb.AssignRoleRequest) (*pb.AssignRoleResponse, error) {
+	if err := validateAssignRole(req); err != nil {
+		return nil, err
+	}
+
+	if err := s.auth.AssignRole(ctx, uint(req.GetUserId()), req.GetRole()); err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	return &pb.AssignRoleResponse{}, nil
+}
+
+func (s *ServerAPI) RevokeRole(ctx context.Context, req *pb.RevokeRoleRequest) (*pb.RevokeRoleResponse, error) {
+	if err := validateRevokeRole(req); err != nil {
+		return nil, err
+	}
+
+	if err := s.auth.RevokeRole(ctx, uint(req.GetUserId()), req.GetRole()); err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	return &pb.RevokeRoleResponse{}, nil
+}
+
+// ListRoles lists the roles of the caller. Other users' roles and the list of
+// every role need the users:read permission.
+func (s *ServerAPI) ListRoles(ctx context.Context, req *pb.ListRolesRequest) (*pb.ListRolesResponse, error) {
+	principal, err := authn.Require(ctx)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	if principal.UserID != uint(req.GetUserId()) {
+		allowed, err := s.hasPermission(ctx, principal, models.PermissionUsersRead)
+		if err != nil {
+			return nil, s.toStatus(err)
+		}
+		if !allowed {
+			return nil, newStatus(codes.PermissionDenied, reasonPermissionDenied, "roles of other users can't be listed")
+		}
+	}
+
+	roles, err := s.auth.ListRoles(ctx, uint(req.GetUserId()))
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	resp := &pb.ListRolesResponse{Roles: make([]*pb.Role, 0, len(roles))}
+	for _, role := range roles {
+		permissions := make([]string, 0, len(role.Permissions))
+		for _, permission := range role.Permissions {
+			permissions = append(permissions, permission.Name)
+		}
+
+		resp.Roles = append(resp.Roles, &pb.Role{
+			Name:        role.Name,
+			Description: role.Description,
+			Permissions: permissions,
+		})
+	}
+
+	return resp, nil
+}
+
+// CheckPermission answers for the caller itself; admins and services may ask
+// about any user.
+func (s *ServerAPI) CheckPermission(ctx context.Context, req *pb.CheckPermissionRequest) (*pb.CheckPermissionResponse, error) {
+	if err := validateCheckPermission(req); err != nil {
+		return nil, err
+	}
+
+	principal, err := authn.Require(ctx)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	if principal.UserID != uint(req.GetUserId()) && !principal.IsService() {
+		return nil, newStatus(codes.PermissionDenied, reasonPermissionDenied, "permissions of other users can't be checked")
 	}
 
-	if req.GetPassword() == "" {
-		return errors.New("missing password")
+	allowed, err := s.auth.CheckPermission(ctx, uint(req.GetUserId()), req.GetPermission())
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	return &pb.CheckPermissionResponse{Allowed: allowed}, nil
+}
+
+// hasPermission reports whether the roles of the principal grant
+// permission. Only users signed in to our own apps have roles.
+func (s *ServerAPI) hasPermission(ctx context.Context, principal *authn.Principal, permission string) (bool, error) {
+	if !principal.FirstParty() {
+		return false, nil
 	}
 
-	return nil
+	return s.auth.CheckPermission(ctx, principal.UserID, permission)
 }
 
-func validateLogin(req *pb.LoginRequest) error {
-	if req.GetEmail() == "" {
-		return errors.New("missing email")
+// clientInfo describes the caller by the address of its gRPC peer and the
+// user agent it sent.
+func clientInfo(ctx context.Context) models.ClientInfo {
+	var info models.ClientInfo
+
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		info.IP = p.Addr.String()
+		if host, _, err := net.SplitHostPort(info.IP); err == nil {
+			info.IP = host
+		}
 	}
 
-	if req.GetPassword() == "" {
-		return errors.New("missing password")
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("user-agent"); len(values) > 0 {
+			info.UserAgent = values[0]
+		}
 	}
 
-	return nil
+	return info
 }
 
-func validateIsAdmin(req *pb.IsAdminRequest) error {
-	if req.GetUserId() == emptyValue {
-		return errors.New("missing auth id")
+func (s *ServerAPI) CreateAPIKey(ctx context.Context, req *pb.CreateAPIKeyRequest) (*pb.CreateAPIKeyResponse, error) {
+	if err := validateCreateAPIKey(req); err != nil {
+		return nil, err
 	}
 
-	return nil
+	principal, err := authn.Require(ctx)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	var expiresAt time.Time
+	if req.GetExpiresAt() != 0 {
+		expiresAt = time.Unix(req.GetExpiresAt(), 0)
+	}
+
+	key, record, err := s.auth.CreateAPIKey(ctx, principal.UserID, req.GetName(), req.GetScopes(), expiresAt)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	return &pb.CreateAPIKeyResponse{
+		Key:    key,
+		ApiKey: apiKeyToPb(record),
+	}, nil
+}
+
+func (s *ServerAPI) ListAPIKeys(ctx context.Context, req *pb.ListAPIKeysRequest) (*pb.ListAPIKeysResponse, error) {
+	principal, err := authn.Require(ctx)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	keys, err := s.auth.ListAPIKeys(ctx, principal.UserID)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	resp := &pb.ListAPIKeysResponse{ApiKeys: make([]*pb.APIKey, 0, len(keys))}
+	for _, key := range keys {
+		resp.ApiKeys = append(resp.ApiKeys, apiKeyToPb(key))
+	}
+
+	return resp, nil
+}
+
+func (s *ServerAPI) RevokeAPIKey(ctx context.Context, req *pb.RevokeAPIKeyRequest) (*pb.RevokeAPIKeyResponse, error) {
+	if err := validateRevokeAPIKey(req); err != nil {
+		return nil, err
+	}
+
+	principal, err := authn.Require(ctx)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	if err := s.auth.RevokeAPIKey(ctx, principal.UserID, uint(req.GetId())); err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	return &pb.RevokeAPIKeyResponse{}, nil
+}
+
+func apiKeyToPb(key *models.APIKey) *pb.APIKey {
+	resp := &pb.APIKey{
+		Id:        int64(key.ID),
+		Name:      key.Name,
+		Prefix:    key.Prefix,
+		Scopes:    key.Scopes,
+		CreatedAt: key.CreatedAt.Unix(),
+	}
+	if key.ExpiresAt != nil {
+		resp.ExpiresAt = key.ExpiresAt.Unix()
+	}
+	if key.LastUsedAt != nil {
+		resp.LastUsedAt = key.LastUsedAt.Unix()
+	}
+
+	return resp
+}
+
+func (s *ServerAPI) ListIdentityProviders(ctx context.Context, req *pb.ListIdentityProvidersRequest) (*pb.ListIdentityProvidersResponse, error) {
+	return &pb.ListIdentityProvidersResponse{Providers: s.auth.IdentityProviders()}, nil
+}
+
+func (s *ServerAPI) FederatedLogin(ctx context.Context, req *pb.FederatedLoginRequest) (*pb.LoginResponse, error) {
+	if err := validateFederatedLogin(req); err != nil {
+		return nil, err
+	}
+
+	accessToken, refreshToken, mfaTicket, err := s.auth.FederatedLogin(ctx, req.GetProvider(), req.GetIdToken(), req.GetNonce(), clientInfo(ctx))
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	return &pb.LoginResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		MfaRequired:  mfaTicket != "",
+		MfaTicket:    mfaTicket,
+	}, nil
+}
+
+func (s *ServerAPI) LinkIdentity(ctx context.Context, req *pb.LinkIdentityRequest) (*pb.LinkIdentityResponse, error) {
+	if err := validateLinkIdentity(req); err != nil {
+		return nil, err
+	}
+
+	principal, err := authn.Require(ctx)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	identity, err := s.auth.LinkIdentity(ctx, principal.UserID, req.GetProvider(), req.GetIdToken(), req.GetNonce())
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	return &pb.LinkIdentityResponse{Identity: identityToPb(identity)}, nil
+}
+
+func (s *ServerAPI) UnlinkIdentity(ctx context.Context, req *pb.UnlinkIdentityRequest) (*pb.UnlinkIdentityResponse, error) {
+	if err := validateUnlinkIdentity(req); err != nil {
+		return nil, err
+	}
+
+	principal, err := authn.Require(ctx)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	if err := s.auth.UnlinkIdentity(ctx, principal.UserID, req.GetProvider()); err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	return &pb.UnlinkIdentityResponse{}, nil
+}
+
+func (s *ServerAPI) ListIdentities(ctx context.Context, req *pb.ListIdentitiesRequest) (*pb.ListIdentitiesResponse, error) {
+	principal, err := authn.Require(ctx)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	identities, err := s.auth.ListIdentities(ctx, principal.UserID)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	resp := &pb.ListIdentitiesResponse{Identities: make([]*pb.Identity, 0, len(identities))}
+	for _, identity := range identities {
+		resp.Identities = append(resp.Identities, identityToPb(identity))
+	}
+
+	return resp, nil
+}
+
+func identityToPb(identity *models.Identity) *pb.Identity {
+	return &pb.Identity{
+		Provider:  identity.Provider,
+		Subject:   identity.Subject,
+		Email:     identity.Email,
+		CreatedAt: identity.CreatedAt.Unix(),
+	}
+}
+
+// unixOrZero is the Unix time of t, or 0 for the zero time.
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
 }
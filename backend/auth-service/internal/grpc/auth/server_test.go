@@ -0,0 +1,229 @@
+package auth
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/Blxssy/social-media/auth-service/api/auth"
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	authservice "github.com/Blxssy/social-media/auth-service/internal/services/auth"
+	"github.com/Blxssy/social-media/auth-service/pkg/authn"
+)
+
+const (
+	userUID    = 1
+	otherUID   = 2
+	supportUID = 3
+)
+
+// fakeAuth answers the role and session calls of the handlers from memory.
+// The other methods of Auth are left nil.
+type fakeAuth struct {
+	Auth
+	// permissions granted to each user by their roles.
+	permissions map[uint][]string
+	// sessions maps each session to its user.
+	sessions map[string]uint
+	revoked  []string
+}
+
+func newFakeAuth() *fakeAuth {
+	return &fakeAuth{
+		permissions: map[uint][]string{
+			supportUID: {models.PermissionUsersRead, models.PermissionSessionsRevoke},
+		},
+		sessions: map[string]uint{"s1": userUID, "s2": otherUID},
+	}
+}
+
+func (f *fakeAuth) IsAdmin(ctx context.Context, userID int) (bool, error) {
+	return false, nil
+}
+
+func (f *fakeAuth) CheckPermission(ctx context.Context, userID uint, permission string) (bool, error) {
+	for _, p := range f.permissions[userID] {
+		if p == permission {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *fakeAuth) ListRoles(ctx context.Context, userID uint) ([]*models.Role, error) {
+	return nil, nil
+}
+
+func (f *fakeAuth) RevokeSession(ctx context.Context, userID uint, sessionID string) error {
+	if uid, ok := f.sessions[sessionID]; !ok || uid != userID {
+		return authservice.ErrSessionNotFound
+	}
+	return f.RevokeAnySession(ctx, sessionID)
+}
+
+func (f *fakeAuth) RevokeAnySession(ctx context.Context, sessionID string) error {
+	if _, ok := f.sessions[sessionID]; !ok {
+		return authservice.ErrSessionNotFound
+	}
+	delete(f.sessions, sessionID)
+	f.revoked = append(f.revoked, sessionID)
+	return nil
+}
+
+func newTestServer() (*ServerAPI, *fakeAuth) {
+	auth := newFakeAuth()
+	return &ServerAPI{log: slog.New(slog.NewTextHandler(io.Discard, nil)), auth: auth}, auth
+}
+
+var (
+	user        = &authn.Principal{UserID: userUID, SessionID: "s1"}
+	support     = &authn.Principal{UserID: supportUID, Roles: []string{models.RoleSupport}, SessionID: "s3"}
+	supportKey  = &authn.Principal{UserID: supportUID, APIKey: true}
+	serviceKey  = &authn.Principal{UserID: otherUID, APIKey: true, Scopes: []string{authn.ScopeIntrospect}}
+	thirdParty  = &authn.Principal{UserID: supportUID, ClientID: "app"}
+	clientOnly  = &authn.Principal{Client: true, ClientID: "service", Scopes: []string{authn.ScopeIntrospect}}
+	adminUser   = &authn.Principal{UserID: otherUID, Roles: []string{authn.RoleAdmin}, SessionID: "s2"}
+	noPrincipal *authn.Principal
+)
+
+func principalContext(p *authn.Principal) context.Context {
+	if p == nil {
+		return context.Background()
+	}
+	return authn.NewContext(context.Background(), p)
+}
+
+func TestCheckPermissionSelfOnly(t *testing.T) {
+	tests := []struct {
+		name      string
+		principal *authn.Principal
+		userID    int64
+		want      codes.Code
+	}{
+		{name: "own permissions", principal: user, userID: userUID, want: codes.OK},
+		{name: "other user", principal: user, userID: otherUID, want: codes.PermissionDenied},
+		{name: "staff asking about another user", principal: support, userID: userUID, want: codes.PermissionDenied},
+		{name: "admin", principal: adminUser, userID: userUID, want: codes.OK},
+		{name: "service api key", principal: serviceKey, userID: userUID, want: codes.OK},
+		{name: "service client", principal: clientOnly, userID: userUID, want: codes.OK},
+		{name: "anonymous", principal: noPrincipal, userID: userUID, want: codes.Unauthenticated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer()
+
+			_, err := s.CheckPermission(principalContext(tt.principal), &pb.CheckPermissionRequest{
+				UserId:     tt.userID,
+				Permission: models.PermissionUsersRead,
+			})
+			if code := status.Code(err); code != tt.want {
+				t.Errorf("code = %v, want %v (err %v)", code, tt.want, err)
+			}
+		})
+	}
+}
+
+func TestCheckPermissionAnswer(t *testing.T) {
+	s, _ := newTestServer()
+
+	resp, err := s.CheckPermission(principalContext(support), &pb.CheckPermissionRequest{
+		UserId:     supportUID,
+		Permission: models.PermissionSessionsRevoke,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.GetAllowed() {
+		t.Error("support is not allowed to revoke sessions")
+	}
+}
+
+func TestIsAdminSelfOnly(t *testing.T) {
+	tests := []struct {
+		name      string
+		principal *authn.Principal
+		userID    int64
+		want      codes.Code
+	}{
+		{name: "self", principal: user, userID: userUID, want: codes.OK},
+		{name: "other user", principal: user, userID: otherUID, want: codes.PermissionDenied},
+		{name: "admin", principal: adminUser, userID: userUID, want: codes.OK},
+		{name: "service api key", principal: serviceKey, userID: userUID, want: codes.OK},
+		{name: "anonymous", principal: noPrincipal, userID: userUID, want: codes.Unauthenticated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer()
+
+			_, err := s.IsAdmin(principalContext(tt.principal), &pb.IsAdminRequest{UserId: tt.userID})
+			if code := status.Code(err); code != tt.want {
+				t.Errorf("code = %v, want %v (err %v)", code, tt.want, err)
+			}
+		})
+	}
+}
+
+func TestListRolesPermission(t *testing.T) {
+	tests := []struct {
+		name      string
+		principal *authn.Principal
+		userID    int64
+		want      codes.Code
+	}{
+		{name: "own roles", principal: user, userID: userUID, want: codes.OK},
+		{name: "other user", principal: user, userID: otherUID, want: codes.PermissionDenied},
+		{name: "every role", principal: user, userID: 0, want: codes.PermissionDenied},
+		{name: "staff", principal: support, userID: userUID, want: codes.OK},
+		{name: "staff listing every role", principal: support, userID: 0, want: codes.OK},
+		{name: "staff api key", principal: supportKey, userID: userUID, want: codes.PermissionDenied},
+		{name: "staff via third-party app", principal: thirdParty, userID: userUID, want: codes.PermissionDenied},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer()
+
+			_, err := s.ListRoles(principalContext(tt.principal), &pb.ListRolesRequest{UserId: tt.userID})
+			if code := status.Code(err); code != tt.want {
+				t.Errorf("code = %v, want %v (err %v)", code, tt.want, err)
+			}
+		})
+	}
+}
+
+func TestRevokeSessionPermission(t *testing.T) {
+	tests := []struct {
+		name      string
+		principal *authn.Principal
+		sessionID string
+		want      codes.Code
+	}{
+		{name: "own session", principal: user, sessionID: "s1", want: codes.OK},
+		{name: "session of another user", principal: user, sessionID: "s2", want: codes.NotFound},
+		{name: "staff", principal: support, sessionID: "s2", want: codes.OK},
+		{name: "staff with an unknown session", principal: support, sessionID: "s9", want: codes.NotFound},
+		{name: "staff api key", principal: supportKey, sessionID: "s2", want: codes.NotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, auth := newTestServer()
+
+			_, err := s.RevokeSession(principalContext(tt.principal), &pb.RevokeSessionRequest{SessionId: tt.sessionID})
+			if code := status.Code(err); code != tt.want {
+				t.Fatalf("code = %v, want %v (err %v)", code, tt.want, err)
+			}
+
+			_, stillActive := auth.sessions[tt.sessionID]
+			if revoked := len(auth.revoked) == 1 && !stillActive; revoked != (tt.want == codes.OK) {
+				t.Errorf("revoked = %v (sessions revoked: %v)", revoked, auth.revoked)
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"time"
+	"unicode/utf8"
+
+	pb "github.com/Blxssy/social-media/auth-service/api/auth"
+	"github.com/Blxssy/social-media/auth-service/internal/validation"
+)
+
+// The validators report every invalid field of a request at once. Emails
+// are normalized in place, so handlers pass on the normalized address.
+
+func (s *ServerAPI) validateRegister(req *pb.RegisterRequest) error {
+	var v violations
+
+	v.email("email", &req.Email)
+	v.addAll("username", validation.CheckUsername(req.GetUsername()))
+	v.addAll("password", s.passwords.Check(req.GetPassword()))
+
+	return v.err()
+}
+
+func (s *ServerAPI) validateLogin(req *pb.LoginRequest) error {
+	var v violations
+
+	v.email("email", &req.Email)
+
+	if req.GetPassword() == "" {
+		v.add("password", "missing password")
+	} else if problem := s.passwords.CheckLength(req.GetPassword()); problem != "" {
+		v.add("password", problem)
+	}
+
+	return v.err()
+}
+
+func validateIsAdmin(req *pb.IsAdminRequest) error {
+	var v violations
+
+	if req.GetUserId() == emptyValue {
+		v.add("user_id", "missing user id")
+	}
+
+	return v.err()
+}
+
+func validateRefresh(req *pb.RefreshRequest) error {
+	var v violations
+
+	if req.GetRefreshToken() == "" {
+		v.add("refresh_token", "missing refresh token")
+	}
+
+	return v.err()
+}
+
+func validateIntrospect(req *pb.IntrospectRequest) error {
+	var v violations
+
+	if req.GetToken() == "" {
+		v.add("token", "missing token")
+	}
+
+	return v.err()
+}
+
+func validateRevokeSession(req *pb.RevokeSessionRequest) error {
+	var v violations
+
+	if req.GetSessionId() == "" {
+		v.add("session_id", "missing session id")
+	}
+
+	return v.err()
+}
+
+func validateSendVerificationEmail(req *pb.SendVerificationEmailRequest) error {
+	var v violations
+
+	v.email("email", &req.Email)
+
+	return v.err()
+}
+
+func validateConfirmEmail(req *pb.ConfirmEmailRequest) error {
+	var v violations
+
+	if req.GetToken() == "" {
+		v.add("token", "missing token")
+	}
+
+	return v.err()
+}
+
+func validateRequestPasswordReset(req *pb.RequestPasswordResetRequest) error {
+	var v violations
+
+	v.email("email", &req.Email)
+
+	return v.err()
+}
+
+func (s *ServerAPI) validateResetPassword(req *pb.ResetPasswordRequest) error {
+	var v violations
+
+	if req.GetToken() == "" {
+		v.add("token", "missing token")
+	}
+
+	v.addAll("new_password", s.passwords.Check(req.GetNewPassword()))
+
+	return v.err()
+}
+
+func (s *ServerAPI) validateChangePassword(req *pb.ChangePasswordRequest) error {
+	var v violations
+
+	v.addAll("new_password", s.passwords.Check(req.GetNewPassword()))
+
+	return v.err()
+}
+
+func validateChangeEmail(req *pb.ChangeEmailRequest) error {
+	var v violations
+
+	v.email("new_email", &req.NewEmail)
+
+	return v.err()
+}
+
+func validateConfirmTOTP(req *pb.ConfirmTOTPRequest) error {
+	var v violations
+
+	if req.GetCode() == "" {
+		v.add("code", "missing code")
+	}
+
+	return v.err()
+}
+
+func validateDisableTOTP(req *pb.DisableTOTPRequest) error {
+	var v violations
+
+	if req.GetCode() == "" {
+		v.add("code", "missing code")
+	}
+
+	return v.err()
+}
+
+func validateVerifyMFA(req *pb.VerifyMFARequest) error {
+	var v violations
+
+	if req.GetMfaTicket() == "" {
+		v.add("mfa_ticket", "missing mfa ticket")
+	}
+
+	if req.GetCode() == "" {
+		v.add("code", "missing code")
+	}
+
+	return v.err()
+}
+
+func validateClearLoginLockout(req *pb.ClearLoginLockoutRequest) error {
+	var v violations
+
+	if req.GetEmail() == "" && req.GetIp() == "" {
+		v.add("email", "missing email or ip")
+	}
+
+	if req.GetEmail() != "" {
+		v.email("email", &req.Email)
+	}
+
+	if req.GetIp() != "" && net.ParseIP(req.GetIp()) == nil {
+		v.add("ip", "invalid ip address")
+	}
+
+	return v.err()
+}
+
+func validateAssignRole(req *pb.AssignRoleRequest) error {
+	var v violations
+
+	if req.GetUserId() == emptyValue {
+		v.add("user_id", "missing user id")
+	}
+
+	if req.GetRole() == "" {
+		v.add("role", "missing role")
+	}
+
+	return v.err()
+}
+
+func validateRevokeRole(req *pb.RevokeRoleRequest) error {
+	var v violations
+
+	if req.GetUserId() == emptyValue {
+		v.add("user_id", "missing user id")
+	}
+
+	if req.GetRole() == "" {
+		v.add("role", "missing role")
+	}
+
+	return v.err()
+}
+
+func validateCheckPermission(req *pb.CheckPermissionRequest) error {
+	var v violations
+
+	if req.GetUserId() == emptyValue {
+		v.add("user_id", "missing user id")
+	}
+
+	if req.GetPermission() == "" {
+		v.add("permission", "missing permission")
+	}
+
+	return v.err()
+}
+
+const (
+	maxAPIKeyNameLength = 64
+	maxAPIKeyScopes     = 20
+)
+
+// scopePattern is resource:action, like the permission names.
+var scopePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*:[a-z][a-z0-9_]*$`)
+
+func validateCreateAPIKey(req *pb.CreateAPIKeyRequest) error {
+	var v violations
+
+	if req.GetName() == "" {
+		v.add("name", "missing name")
+	} else if utf8.RuneCountInString(req.GetName()) > maxAPIKeyNameLength {
+		v.add("name", fmt.Sprintf("name must be at most %d characters", maxAPIKeyNameLength))
+	}
+
+	if len(req.GetScopes()) == 0 {
+		v.add("scopes", "missing scopes")
+	} else if len(req.GetScopes()) > maxAPIKeyScopes {
+		v.add("scopes", fmt.Sprintf("at most %d scopes are allowed", maxAPIKeyScopes))
+	}
+
+	seen := make(map[string]bool, len(req.GetScopes()))
+	for i, scope := range req.GetScopes() {
+		field := fmt.Sprintf("scopes[%d]", i)
+		switch {
+		case !scopePattern.MatchString(scope):
+			v.add(field, "scope must look like resource:action")
+		case seen[scope]:
+			v.add(field, "duplicate scope")
+		}
+		seen[scope] = true
+	}
+
+	if req.GetExpiresAt() != 0 && !time.Unix(req.GetExpiresAt(), 0).After(time.Now()) {
+		v.add("expires_at", "expiry must be in the future")
+	}
+
+	return v.err()
+}
+
+func validateRevokeAPIKey(req *pb.RevokeAPIKeyRequest) error {
+	var v violations
+
+	if req.GetId() == emptyValue {
+		v.add("id", "missing api key id")
+	}
+
+	return v.err()
+}
+
+func validateFederatedLogin(req *pb.FederatedLoginRequest) error {
+	var v violations
+
+	if req.GetProvider() == "" {
+		v.add("provider", "missing provider")
+	}
+	if req.GetIdToken() == "" {
+		v.add("id_token", "missing id token")
+	}
+	if req.GetNonce() == "" {
+		v.add("nonce", "missing nonce")
+	}
+
+	return v.err()
+}
+
+func validateLinkIdentity(req *pb.LinkIdentityRequest) error {
+	var v violations
+
+	if req.GetProvider() == "" {
+		v.add("provider", "missing provider")
+	}
+	if req.GetIdToken() == "" {
+		v.add("id_token", "missing id token")
+	}
+	if req.GetNonce() == "" {
+		v.add("nonce", "missing nonce")
+	}
+
+	return v.err()
+}
+
+func validateUnlinkIdentity(req *pb.UnlinkIdentityRequest) error {
+	var v violations
+
+	if req.GetProvider() == "" {
+		v.add("provider", "missing provider")
+	}
+
+	return v.err()
+}
@@ -0,0 +1,559 @@
+// Package oauth serves the HTTP endpoints of the OAuth 2.1 provider.
+//
+// Clients use the authorization, token, revocation and userinfo endpoints
+// and the server metadata (RFC 8414), which is also served as the OpenID
+// Connect discovery document. The web app, with the access token of the
+// signed in user, registers clients, shows the consent page the
+// authorization endpoint redirects to and lets the user review and withdraw
+// consents.
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Blxssy/social-media/auth-service/internal/config"
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"github.com/Blxssy/social-media/auth-service/internal/services/oauth"
+	"github.com/Blxssy/social-media/auth-service/pkg/authn"
+	"github.com/Blxssy/social-media/auth-service/pkg/ratelimit"
+)
+
+const maxBodySize = 64 << 10
+
+// registerPattern is the route of client registration, whose rate limit
+// rule may be keyed by the signed in user.
+const registerPattern = "POST /oauth/register"
+
+type OAuth interface {
+	RegisterClient(ctx context.Context, ownerID uint, reg oauth.Registration) (*models.OAuthClient, string, error)
+	ValidateAuthorization(ctx context.Context, req oauth.AuthorizationRequest) (*oauth.Authorization, error)
+	ErrorRedirect(auth *oauth.Authorization, err error) string
+	Consented(ctx context.Context, userID uint, auth *oauth.Authorization) (bool, error)
+	Authorize(ctx context.Context, userID uint, req oauth.AuthorizationRequest, approved bool) (string, error)
+	Token(ctx context.Context, req oauth.TokenRequest) (*oauth.TokenResponse, error)
+	Revoke(ctx context.Context, clientID string, clientSecret string, token string) error
+	Consents(ctx context.Context, userID uint) ([]oauth.Consent, error)
+	RevokeConsent(ctx context.Context, userID uint, clientID string) error
+	Scopes(names []string) []config.OAuthScope
+	UserInfo(ctx context.Context, userID uint, clientID string, scopes []string) (*oauth.UserInfo, error)
+	SigningAlgorithm() string
+}
+
+type handler struct {
+	log        *slog.Logger
+	oauth      OAuth
+	verifier   authn.Verifier
+	limiter    *ratelimit.Limiter
+	issuer     string
+	consentURL string
+	scopes     []string
+}
+
+// Register adds the endpoints to mux. issuer is the base URL the endpoints
+// are advertised under in the server metadata. limiter limits every route by
+// its pattern; it may be nil.
+func Register(mux *http.ServeMux, log *slog.Logger, o OAuth, verifier authn.Verifier, limiter *ratelimit.Limiter, issuer string, cfg config.OAuth) {
+	h := &handler{
+		log:        log,
+		oauth:      o,
+		verifier:   verifier,
+		limiter:    limiter,
+		issuer:     issuer,
+		consentURL: cfg.ConsentURL,
+	}
+	for _, scope := range cfg.Scopes {
+		h.scopes = append(h.scopes, scope.Name)
+	}
+
+	handle := func(pattern string, handler http.HandlerFunc) {
+		mux.HandleFunc(pattern, limiter.HTTPMiddleware(pattern, handler))
+	}
+
+	handle("GET /.well-known/oauth-authorization-server", h.metadata)
+	handle("GET /.well-known/openid-configuration", h.openIDConfiguration)
+	handle(registerPattern, h.register)
+	handle("GET /oauth/authorize", h.authorize)
+	handle("GET /oauth/authorize/consent", h.getConsent)
+	handle("POST /oauth/authorize/consent", h.postConsent)
+	handle("POST /oauth/token", h.token)
+	handle("POST /oauth/revoke", h.revoke)
+	handle("GET /oauth/userinfo", h.userInfo)
+	handle("POST /oauth/userinfo", h.userInfo)
+	handle("GET /oauth/consents", h.listConsents)
+	handle("DELETE /oauth/consents/{client_id}", h.deleteConsent)
+}
+
+func (h *handler) metadata(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	writeJSON(w, http.StatusOK, h.serverMetadata())
+}
+
+// openIDConfiguration serves the OpenID Connect discovery document: the
+// server metadata plus what relying parties need to know about ID tokens
+// and userinfo.
+func (h *handler) openIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	metadata := h.serverMetadata()
+	metadata["userinfo_endpoint"] = strings.TrimSuffix(h.issuer, "/") + "/oauth/userinfo"
+	metadata["subject_types_supported"] = []string{"public"}
+	metadata["id_token_signing_alg_values_supported"] = []string{h.oauth.SigningAlgorithm()}
+	metadata["claims_supported"] = []string{
+		"sub", "iss", "aud", "exp", "iat", "nonce",
+		"email", "email_verified", "preferred_username",
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	writeJSON(w, http.StatusOK, metadata)
+}
+
+func (h *handler) serverMetadata() map[string]interface{} {
+	base := strings.TrimSuffix(h.issuer, "/")
+
+	return map[string]interface{}{
+		"issuer":                                         h.issuer,
+		"authorization_endpoint":                         base + "/oauth/authorize",
+		"token_endpoint":                                 base + "/oauth/token",
+		"revocation_endpoint":                            base + "/oauth/revoke",
+		"registration_endpoint":                          base + "/oauth/register",
+		"jwks_uri":                                       base + "/.well-known/jwks.json",
+		"scopes_supported":                               h.scopes,
+		"response_types_supported":                       []string{"code"},
+		"grant_types_supported":                          []string{models.GrantAuthorizationCode, models.GrantRefreshToken, models.GrantClientCredentials},
+		"code_challenge_methods_supported":               []string{oauth.PKCEMethodS256},
+		"token_endpoint_auth_methods_supported":          []string{"client_secret_basic", "client_secret_post", "none"},
+		"revocation_endpoint_auth_methods_supported":     []string{"client_secret_basic", "client_secret_post", "none"},
+		"authorization_response_iss_parameter_supported": true,
+	}
+}
+
+type registrationRequest struct {
+	ClientName              string   `json:"client_name"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	GrantTypes              []string `json:"grant_types"`
+	Scope                   string   `json:"scope"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+}
+
+// register registers a client owned by the signed in user (RFC 7591).
+func (h *handler) register(w http.ResponseWriter, r *http.Request) {
+	principal, ok := h.user(w, r)
+	if !ok {
+		return
+	}
+
+	if !h.limiter.AllowHTTPCaller(w, r, registerPattern, principal) {
+		return
+	}
+
+	var req registrationRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&req); err != nil {
+		h.writeError(w, &oauth.Error{Code: oauth.CodeInvalidClientMetadata, Description: "invalid JSON body"})
+		return
+	}
+
+	var public bool
+	switch req.TokenEndpointAuthMethod {
+	case "", "client_secret_basic", "client_secret_post":
+	case "none":
+		public = true
+	default:
+		h.writeError(w, &oauth.Error{Code: oauth.CodeInvalidClientMetadata, Description: "unsupported token_endpoint_auth_method"})
+		return
+	}
+
+	client, secret, err := h.oauth.RegisterClient(r.Context(), principal.UserID, oauth.Registration{
+		Name:         req.ClientName,
+		RedirectURIs: req.RedirectURIs,
+		GrantTypes:   req.GrantTypes,
+		Scopes:       strings.Fields(req.Scope),
+		Public:       public,
+	})
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"client_id":                  client.ClientID,
+		"client_id_issued_at":        client.CreatedAt.Unix(),
+		"client_name":                client.Name,
+		"redirect_uris":              client.RedirectURIs,
+		"grant_types":                client.GrantTypes,
+		"scope":                      strings.Join(client.Scopes, " "),
+		"token_endpoint_auth_method": "client_secret_basic",
+	}
+	if public {
+		resp["token_endpoint_auth_method"] = "none"
+	} else {
+		resp["client_secret"] = secret
+		resp["client_secret_expires_at"] = 0
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// authorize checks the authorization request and sends the user on to the
+// consent page of the web app, which signs the user in if needed.
+func (h *handler) authorize(w http.ResponseWriter, r *http.Request) {
+	auth, err := h.oauth.ValidateAuthorization(r.Context(), authorizationRequest(r.URL.Query()))
+	if err != nil {
+		if auth == nil {
+			h.writeError(w, err)
+			return
+		}
+		http.Redirect(w, r, h.oauth.ErrorRedirect(auth, err), http.StatusFound)
+		return
+	}
+
+	target, err := url.Parse(h.consentURL)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	target.RawQuery = r.URL.RawQuery
+
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+type scopeResponse struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// getConsent describes an authorization request for the consent page. The
+// web app may skip asking when consented is true.
+func (h *handler) getConsent(w http.ResponseWriter, r *http.Request) {
+	principal, ok := h.user(w, r)
+	if !ok {
+		return
+	}
+
+	auth, err := h.oauth.ValidateAuthorization(r.Context(), authorizationRequest(r.URL.Query()))
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	consented, err := h.oauth.Consented(r.Context(), principal.UserID, auth)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	scopes := make([]scopeResponse, 0, len(auth.Scopes))
+	for _, scope := range h.oauth.Scopes(auth.Scopes) {
+		scopes = append(scopes, scopeResponse{Name: scope.Name, Description: scope.Description})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"client_id":    auth.Client.ClientID,
+		"client_name":  auth.Client.Name,
+		"redirect_uri": auth.RedirectURI,
+		"scopes":       scopes,
+		"consented":    consented,
+	})
+}
+
+type consentRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+	Nonce               string `json:"nonce"`
+	Approved            bool   `json:"approved"`
+}
+
+// postConsent records the decision of the user and returns where the web app
+// has to send the user: back to the client, with a code or an error.
+func (h *handler) postConsent(w http.ResponseWriter, r *http.Request) {
+	principal, ok := h.user(w, r)
+	if !ok {
+		return
+	}
+
+	var req consentRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&req); err != nil {
+		h.writeError(w, &oauth.Error{Code: oauth.CodeInvalidRequest, Description: "invalid JSON body"})
+		return
+	}
+
+	redirect, err := h.oauth.Authorize(r.Context(), principal.UserID, oauth.AuthorizationRequest{
+		ResponseType:        req.ResponseType,
+		ClientID:            req.ClientID,
+		RedirectURI:         req.RedirectURI,
+		Scope:               req.Scope,
+		State:               req.State,
+		CodeChallenge:       req.CodeChallenge,
+		CodeChallengeMethod: req.CodeChallengeMethod,
+		Nonce:               req.Nonce,
+	}, req.Approved)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"redirect_uri": redirect})
+}
+
+func (h *handler) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, err := clientCredentials(w, r)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	resp, err := h.oauth.Token(r.Context(), oauth.TokenRequest{
+		GrantType:    r.PostForm.Get("grant_type"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Code:         r.PostForm.Get("code"),
+		RedirectURI:  r.PostForm.Get("redirect_uri"),
+		CodeVerifier: r.PostForm.Get("code_verifier"),
+		RefreshToken: r.PostForm.Get("refresh_token"),
+		Scope:        r.PostForm.Get("scope"),
+		Client:       clientInfo(r),
+	})
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	body := map[string]interface{}{
+		"access_token": resp.AccessToken,
+		"token_type":   resp.TokenType,
+		"expires_in":   int64(resp.ExpiresIn / time.Second),
+		"scope":        resp.Scope,
+	}
+	if resp.RefreshToken != "" {
+		body["refresh_token"] = resp.RefreshToken
+	}
+	if resp.IDToken != "" {
+		body["id_token"] = resp.IDToken
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, body)
+}
+
+// revoke revokes a token of the client (RFC 7009). It succeeds for unknown
+// tokens too.
+func (h *handler) revoke(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, err := clientCredentials(w, r)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	if err := h.oauth.Revoke(r.Context(), clientID, clientSecret, r.PostForm.Get("token")); err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// userInfo returns the claims about the user of the access token (OpenID
+// Connect Core section 5.3). Errors are reported in the WWW-Authenticate
+// header as RFC 6750 describes.
+func (h *handler) userInfo(w http.ResponseWriter, r *http.Request) {
+	scheme, accessToken, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || accessToken == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="oauth"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	principal, err := h.verifier.Verify(r.Context(), accessToken)
+	if err != nil || principal.APIKey || !principal.ActsForUser() {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="oauth", error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	info, err := h.oauth.UserInfo(r.Context(), principal.UserID, principal.ClientID, principal.Scopes)
+	if err != nil {
+		if errors.Is(err, oauth.ErrUserNotFound) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="oauth", error="invalid_token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if errors.Is(err, oauth.ErrInsufficientScope) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="oauth", error="insufficient_scope", scope="openid"`)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		h.writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, info)
+}
+
+type consentResponse struct {
+	ClientID   string   `json:"client_id"`
+	ClientName string   `json:"client_name"`
+	Scopes     []string `json:"scopes"`
+	GrantedAt  int64    `json:"granted_at"`
+}
+
+func (h *handler) listConsents(w http.ResponseWriter, r *http.Request) {
+	principal, ok := h.user(w, r)
+	if !ok {
+		return
+	}
+
+	consents, err := h.oauth.Consents(r.Context(), principal.UserID)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	resp := make([]consentResponse, 0, len(consents))
+	for _, c := range consents {
+		resp = append(resp, consentResponse{
+			ClientID:   c.Client.ClientID,
+			ClientName: c.Client.Name,
+			Scopes:     c.Consent.Scopes,
+			GrantedAt:  c.Consent.UpdatedAt.Unix(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"consents": resp})
+}
+
+func (h *handler) deleteConsent(w http.ResponseWriter, r *http.Request) {
+	principal, ok := h.user(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.oauth.RevokeConsent(r.Context(), principal.UserID, r.PathValue("client_id")); err != nil {
+		if errors.Is(err, oauth.ErrConsentNotFound) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not_found"})
+			return
+		}
+		h.writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// user authenticates the signed in user of the web app by the access token
+// of the request. API keys and tokens of OAuth clients are refused.
+func (h *handler) user(w http.ResponseWriter, r *http.Request) (*authn.Principal, bool) {
+	scheme, accessToken, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || accessToken == "" {
+		writeUnauthorized(w)
+		return nil, false
+	}
+
+	principal, err := h.verifier.Verify(r.Context(), accessToken)
+	if err != nil || !principal.FirstParty() {
+		writeUnauthorized(w)
+		return nil, false
+	}
+
+	return principal, true
+}
+
+func authorizationRequest(q url.Values) oauth.AuthorizationRequest {
+	return oauth.AuthorizationRequest{
+		ResponseType:        q.Get("response_type"),
+		ClientID:            q.Get("client_id"),
+		RedirectURI:         q.Get("redirect_uri"),
+		Scope:               q.Get("scope"),
+		State:               q.Get("state"),
+		CodeChallenge:       q.Get("code_challenge"),
+		CodeChallengeMethod: q.Get("code_challenge_method"),
+		Nonce:               q.Get("nonce"),
+	}
+}
+
+// clientCredentials parses the form of the request and returns the client
+// credentials, sent either with HTTP Basic authentication or in the form
+// (RFC 6749 section 2.3.1). Public clients only send their client_id.
+func clientCredentials(w http.ResponseWriter, r *http.Request) (string, string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	if err := r.ParseForm(); err != nil {
+		return "", "", &oauth.Error{Code: oauth.CodeInvalidRequest, Description: "invalid form body"}
+	}
+
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		return r.PostForm.Get("client_id"), r.PostForm.Get("client_secret"), nil
+	}
+
+	if r.PostForm.Get("client_secret") != "" {
+		return "", "", &oauth.Error{Code: oauth.CodeInvalidRequest, Description: "use only one client authentication method"}
+	}
+
+	id, err := url.QueryUnescape(id)
+	if err != nil {
+		return "", "", &oauth.Error{Code: oauth.CodeInvalidClient, Description: "invalid client credentials"}
+	}
+	secret, err = url.QueryUnescape(secret)
+	if err != nil {
+		return "", "", &oauth.Error{Code: oauth.CodeInvalidClient, Description: "invalid client credentials"}
+	}
+
+	return id, secret, nil
+}
+
+func clientInfo(r *http.Request) models.ClientInfo {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	return models.ClientInfo{
+		UserAgent: r.UserAgent(),
+		IP:        ip,
+	}
+}
+
+// writeError writes an OAuth error response. Unexpected errors are logged and
+// reported as server_error.
+func (h *handler) writeError(w http.ResponseWriter, err error) {
+	var oauthErr *oauth.Error
+	if !errors.As(err, &oauthErr) {
+		h.log.Error("oauth request failed", slog.String("error", err.Error()))
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	status := http.StatusBadRequest
+	if oauthErr.Code == oauth.CodeInvalidClient {
+		status = http.StatusUnauthorized
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, map[string]string{
+		"error":             oauthErr.Code,
+		"error_description": oauthErr.Description,
+	})
+}
+
+func writeUnauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="oauth"`)
+	writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_token"})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,536 @@
+package oauth_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Blxssy/social-media/auth-service/internal/config"
+	oauthhttp "github.com/Blxssy/social-media/auth-service/internal/http/oauth"
+	"github.com/Blxssy/social-media/auth-service/internal/http/wellknown"
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"github.com/Blxssy/social-media/auth-service/internal/services/oauth"
+	"github.com/Blxssy/social-media/auth-service/internal/services/oauth/oauthtest"
+	"github.com/Blxssy/social-media/auth-service/pkg/authn"
+	"github.com/Blxssy/social-media/auth-service/pkg/oidc"
+	"github.com/Blxssy/social-media/auth-service/pkg/token"
+)
+
+const (
+	redirectURI  = "https://client.example.com/callback"
+	codeVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+// testServer runs the OAuth endpoints and the JWKS on an httptest server,
+// backed by the real services and an in-memory store.
+type testServer struct {
+	*httptest.Server
+	tokens *token.Issuer
+	store  *oauthtest.MemoryStore
+	user   *models.User
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	keys, err := token.LoadKeyring(t.TempDir(), token.AlgorithmRS256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := token.NewIssuer(keys, token.Options{
+		Issuer:     srv.URL,
+		Audience:   "social-media",
+		AccessTTL:  15 * time.Minute,
+		RefreshTTL: time.Hour,
+		Leeway:     time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &models.User{Username: "alice", Email: "alice@example.com", EmailVerified: true}
+	user.ID = 42
+
+	store := oauthtest.NewMemoryStore(user)
+	cfg := config.OAuth{
+		ConsentURL:        "https://app.example.com/oauth/consent",
+		CodeTTL:           time.Minute,
+		MaxClientsPerUser: 3,
+		Scopes: []config.OAuthScope{
+			{Name: oauth.ScopeOpenID, Description: "Sign you in"},
+			{Name: oauth.ScopeProfile, Description: "See your username"},
+			{Name: oauth.ScopeEmail, Description: "See your email address"},
+		},
+	}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	o := oauth.New(log, cfg, store, tokens)
+
+	wellknown.Register(mux, jwksProvider{tokens})
+	oauthhttp.Register(mux, log, o, issuerVerifier{tokens}, nil, srv.URL, cfg)
+
+	return &testServer{Server: srv, tokens: tokens, store: store, user: user}
+}
+
+// userToken returns a first-party access token of the test user, as the web
+// app holds.
+func (s *testServer) userToken(t *testing.T) string {
+	t.Helper()
+
+	pair, err := s.tokens.GetNewTokens(s.user.ID, token.NewFamilyID(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair.AccessToken
+}
+
+// registerClient registers a public client through the registration
+// endpoint and returns its id.
+func (s *testServer) registerClient(t *testing.T) string {
+	t.Helper()
+
+	body := `{"client_name":"Test app","redirect_uris":["` + redirectURI + `"],"token_endpoint_auth_method":"none"}`
+	req, _ := http.NewRequest(http.MethodPost, s.URL+"/oauth/register", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+s.userToken(t))
+	req.Header.Set("Content-Type", "application/json")
+
+	var resp struct {
+		ClientID string `json:"client_id"`
+	}
+	s.do(t, req, http.StatusCreated, &resp)
+
+	return resp.ClientID
+}
+
+// authorize walks through the authorization endpoint and the consent of the
+// web app and returns the code the client is redirected back with.
+func (s *testServer) authorize(t *testing.T, clientID string, scope string, nonce string) string {
+	t.Helper()
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {clientID},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {scope},
+		"state":                 {"xyz"},
+		"code_challenge":        {pkceChallenge(codeVerifier)},
+		"code_challenge_method": {oauth.PKCEMethodS256},
+		"nonce":                 {nonce},
+	}
+
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := noRedirect.Get(s.URL + "/oauth/authorize?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: got status %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+	if loc := resp.Header.Get("Location"); !strings.HasPrefix(loc, "https://app.example.com/oauth/consent?") {
+		t.Fatalf("authorize: redirected to %q, want the consent page", loc)
+	}
+
+	consent, _ := json.Marshal(map[string]interface{}{
+		"response_type":         "code",
+		"client_id":             clientID,
+		"redirect_uri":          redirectURI,
+		"scope":                 scope,
+		"state":                 "xyz",
+		"code_challenge":        pkceChallenge(codeVerifier),
+		"code_challenge_method": oauth.PKCEMethodS256,
+		"nonce":                 nonce,
+		"approved":              true,
+	})
+	req, _ := http.NewRequest(http.MethodPost, s.URL+"/oauth/authorize/consent", strings.NewReader(string(consent)))
+	req.Header.Set("Authorization", "Bearer "+s.userToken(t))
+	req.Header.Set("Content-Type", "application/json")
+
+	var decision struct {
+		RedirectURI string `json:"redirect_uri"`
+	}
+	s.do(t, req, http.StatusOK, &decision)
+
+	back, err := url.Parse(decision.RedirectURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := back.Query()
+	if q.Get("state") != "xyz" || q.Get("iss") != s.URL || q.Get("code") == "" {
+		t.Fatalf("consent: redirected back to %q", decision.RedirectURI)
+	}
+
+	return q.Get("code")
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	IDToken      string `json:"id_token"`
+	Scope        string `json:"scope"`
+	Error        string `json:"error"`
+}
+
+func (s *testServer) exchange(t *testing.T, clientID string, code string, verifier string, wantStatus int) tokenResponse {
+	t.Helper()
+
+	return s.token(t, exchangeForm(clientID, code, verifier), wantStatus)
+}
+
+func exchangeForm(clientID string, code string, verifier string) url.Values {
+	return url.Values{
+		"grant_type":    {models.GrantAuthorizationCode},
+		"client_id":     {clientID},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {verifier},
+	}
+}
+
+// token posts form to the token endpoint.
+func (s *testServer) token(t *testing.T, form url.Values, wantStatus int) tokenResponse {
+	t.Helper()
+
+	req, _ := http.NewRequest(http.MethodPost, s.URL+"/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var resp tokenResponse
+	s.do(t, req, wantStatus, &resp)
+
+	return resp
+}
+
+func (s *testServer) do(t *testing.T, req *http.Request, wantStatus int, v interface{}) *http.Response {
+	t.Helper()
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != wantStatus {
+		t.Fatalf("%s %s: got status %d, want %d: %s", req.Method, req.URL.Path, resp.StatusCode, wantStatus, body)
+	}
+	if v != nil && len(body) > 0 {
+		if err := json.Unmarshal(body, v); err != nil {
+			t.Fatalf("%s %s: %v", req.Method, req.URL.Path, err)
+		}
+	}
+
+	return resp
+}
+
+func TestDiscovery(t *testing.T) {
+	s := newTestServer(t)
+
+	req, _ := http.NewRequest(http.MethodGet, s.URL+"/.well-known/openid-configuration", nil)
+	var doc map[string]interface{}
+	s.do(t, req, http.StatusOK, &doc)
+
+	want := map[string]string{
+		"issuer":                 s.URL,
+		"authorization_endpoint": s.URL + "/oauth/authorize",
+		"token_endpoint":         s.URL + "/oauth/token",
+		"userinfo_endpoint":      s.URL + "/oauth/userinfo",
+		"jwks_uri":               s.URL + "/.well-known/jwks.json",
+	}
+	for name, value := range want {
+		if doc[name] != value {
+			t.Errorf("%s = %v, want %q", name, doc[name], value)
+		}
+	}
+
+	if algs, _ := doc["id_token_signing_alg_values_supported"].([]interface{}); len(algs) != 1 || algs[0] != token.AlgorithmRS256 {
+		t.Errorf("id_token_signing_alg_values_supported = %v", doc["id_token_signing_alg_values_supported"])
+	}
+	if methods, _ := doc["code_challenge_methods_supported"].([]interface{}); len(methods) != 1 || methods[0] != oauth.PKCEMethodS256 {
+		t.Errorf("code_challenge_methods_supported = %v", doc["code_challenge_methods_supported"])
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	s := newTestServer(t)
+
+	req, _ := http.NewRequest(http.MethodGet, s.URL+"/.well-known/jwks.json", nil)
+	var set token.JSONWebKeySet
+	s.do(t, req, http.StatusOK, &set)
+
+	if len(set.Keys) != 1 {
+		t.Fatalf("got %d keys, want 1", len(set.Keys))
+	}
+	key := set.Keys[0]
+	if key.Kty != "RSA" || key.Alg != token.AlgorithmRS256 || key.Use != "sig" || key.Kid == "" || key.N == "" || key.E == "" {
+		t.Errorf("unexpected key %+v", key)
+	}
+}
+
+func TestRegisterClientLimit(t *testing.T) {
+	s := newTestServer(t)
+	for i := 0; i < 3; i++ {
+		s.registerClient(t)
+	}
+
+	body := `{"client_name":"One too many","redirect_uris":["` + redirectURI + `"],"token_endpoint_auth_method":"none"}`
+	req, _ := http.NewRequest(http.MethodPost, s.URL+"/oauth/register", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+s.userToken(t))
+	req.Header.Set("Content-Type", "application/json")
+
+	var resp tokenResponse
+	s.do(t, req, http.StatusBadRequest, &resp)
+	if resp.Error != oauth.CodeInvalidClientMetadata {
+		t.Errorf("error = %q, want %q", resp.Error, oauth.CodeInvalidClientMetadata)
+	}
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	s := newTestServer(t)
+	clientID := s.registerClient(t)
+
+	code := s.authorize(t, clientID, "openid email", "n-0S6_WzA2Mj")
+	resp := s.exchange(t, clientID, code, codeVerifier, http.StatusOK)
+
+	if resp.AccessToken == "" || resp.RefreshToken == "" || resp.IDToken == "" {
+		t.Fatalf("incomplete token response %+v", resp)
+	}
+	if resp.Scope != "openid email" {
+		t.Errorf("scope = %q, want %q", resp.Scope, "openid email")
+	}
+
+	// Verify the ID token as a relying party would, through discovery.
+	rp, err := oidc.NewProvider(oidc.Config{Issuer: s.URL, ClientID: clientID}, s.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := rp.Verify(context.Background(), resp.IDToken, "n-0S6_WzA2Mj")
+	if err != nil {
+		t.Fatalf("verify id token: %v", err)
+	}
+	if claims.Subject != strconv.FormatUint(uint64(s.user.ID), 10) {
+		t.Errorf("sub = %q, want %d", claims.Subject, s.user.ID)
+	}
+	if claims.Email != s.user.Email || !claims.EmailVerified {
+		t.Errorf("email = %q, verified %v", claims.Email, claims.EmailVerified)
+	}
+	if claims.PreferredUsername != "" {
+		t.Errorf("preferred_username released without the profile scope")
+	}
+
+	if _, err := rp.Verify(context.Background(), resp.IDToken, "another-nonce"); !errors.Is(err, oidc.ErrInvalidNonce) {
+		t.Errorf("verify with another nonce: got %v, want %v", err, oidc.ErrInvalidNonce)
+	}
+
+	other, err := oidc.NewProvider(oidc.Config{Issuer: s.URL, ClientID: "another-client"}, s.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Verify(context.Background(), resp.IDToken, "n-0S6_WzA2Mj"); !errors.Is(err, oidc.ErrInvalidAudience) {
+		t.Errorf("verify for another client: got %v, want %v", err, oidc.ErrInvalidAudience)
+	}
+
+	elsewhere, err := oidc.NewProvider(oidc.Config{
+		Issuer:   "https://elsewhere.example.com",
+		ClientID: clientID,
+		JWKSURL:  s.URL + "/.well-known/jwks.json",
+	}, s.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := elsewhere.Verify(context.Background(), resp.IDToken, "n-0S6_WzA2Mj"); !errors.Is(err, oidc.ErrInvalidIssuer) {
+		t.Errorf("verify for another issuer: got %v, want %v", err, oidc.ErrInvalidIssuer)
+	}
+
+	// The ID token is not an access token of this service.
+	if _, err := s.tokens.ParseClaims(resp.IDToken); err == nil {
+		t.Errorf("the id token was accepted as an access token")
+	}
+}
+
+func TestAuthorizationCodeWrongVerifier(t *testing.T) {
+	s := newTestServer(t)
+	clientID := s.registerClient(t)
+
+	code := s.authorize(t, clientID, "openid", "nonce")
+	resp := s.exchange(t, clientID, code, strings.Repeat("a", 43), http.StatusBadRequest)
+	if resp.Error != oauth.CodeInvalidGrant {
+		t.Errorf("error = %q, want %q", resp.Error, oauth.CodeInvalidGrant)
+	}
+
+	// The code was used up by the failed attempt.
+	resp = s.exchange(t, clientID, code, codeVerifier, http.StatusBadRequest)
+	if resp.Error != oauth.CodeInvalidGrant {
+		t.Errorf("error = %q, want %q", resp.Error, oauth.CodeInvalidGrant)
+	}
+}
+
+func TestAuthorizationCodeRedirectURI(t *testing.T) {
+	s := newTestServer(t)
+	clientID := s.registerClient(t)
+
+	tests := []struct {
+		name        string
+		redirectURI []string
+	}{
+		{"missing", nil},
+		{"empty", []string{""}},
+		{"different", []string{"https://client.example.com/other"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// authorize names the redirect URI, so the token request must
+			// repeat it.
+			form := exchangeForm(clientID, s.authorize(t, clientID, "openid", "nonce"), codeVerifier)
+			if tt.redirectURI == nil {
+				form.Del("redirect_uri")
+			} else {
+				form["redirect_uri"] = tt.redirectURI
+			}
+
+			resp := s.token(t, form, http.StatusBadRequest)
+			if resp.Error != oauth.CodeInvalidGrant {
+				t.Errorf("error = %q, want %q", resp.Error, oauth.CodeInvalidGrant)
+			}
+		})
+	}
+}
+
+func TestAuthorizationCodeReplay(t *testing.T) {
+	s := newTestServer(t)
+	clientID := s.registerClient(t)
+
+	code := s.authorize(t, clientID, "openid", "nonce")
+	first := s.exchange(t, clientID, code, codeVerifier, http.StatusOK)
+
+	resp := s.exchange(t, clientID, code, codeVerifier, http.StatusBadRequest)
+	if resp.Error != oauth.CodeInvalidGrant {
+		t.Errorf("error = %q, want %q", resp.Error, oauth.CodeInvalidGrant)
+	}
+
+	// Replaying the code ends the session the first exchange started.
+	claims, err := s.tokens.ParseClaims(first.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.store.HasSession(claims.FamilyID) {
+		t.Errorf("the session of the replayed code was not revoked")
+	}
+}
+
+func TestUserInfo(t *testing.T) {
+	s := newTestServer(t)
+	clientID := s.registerClient(t)
+
+	code := s.authorize(t, clientID, "openid profile", "nonce")
+	tokens := s.exchange(t, clientID, code, codeVerifier, http.StatusOK)
+
+	req, _ := http.NewRequest(http.MethodGet, s.URL+"/oauth/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+
+	var info oauth.UserInfo
+	resp := s.do(t, req, http.StatusOK, &info)
+
+	if info.Subject != strconv.FormatUint(uint64(s.user.ID), 10) || info.PreferredUsername != s.user.Username {
+		t.Errorf("unexpected claims %+v", info)
+	}
+	if info.Email != "" || info.EmailVerified != nil {
+		t.Errorf("email released without the email scope")
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", cc)
+	}
+}
+
+func TestUserInfoErrors(t *testing.T) {
+	s := newTestServer(t)
+	clientID := s.registerClient(t)
+
+	code := s.authorize(t, clientID, "profile", "")
+	withoutOpenID := s.exchange(t, clientID, code, codeVerifier, http.StatusOK)
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+		wantError     string
+	}{
+		{name: "no token", wantStatus: http.StatusUnauthorized},
+		{name: "invalid token", authorization: "Bearer not-a-token", wantStatus: http.StatusUnauthorized, wantError: "invalid_token"},
+		{name: "without openid", authorization: "Bearer " + withoutOpenID.AccessToken, wantStatus: http.StatusForbidden, wantError: "insufficient_scope"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, s.URL+"/oauth/userinfo", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+
+			resp := s.do(t, req, tt.wantStatus, nil)
+
+			challenge := resp.Header.Get("WWW-Authenticate")
+			if !strings.HasPrefix(challenge, "Bearer ") {
+				t.Errorf("WWW-Authenticate = %q", challenge)
+			}
+			if tt.wantError != "" && !strings.Contains(challenge, `error="`+tt.wantError+`"`) {
+				t.Errorf("WWW-Authenticate = %q, want error %q", challenge, tt.wantError)
+			}
+		})
+	}
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+type jwksProvider struct {
+	tokens *token.Issuer
+}
+
+func (p jwksProvider) JWKS(ctx context.Context) (token.JSONWebKeySet, error) {
+	return p.tokens.JWKS(), nil
+}
+
+// issuerVerifier turns access tokens into principals the way the gRPC
+// verifier does, without revocation.
+type issuerVerifier struct {
+	tokens *token.Issuer
+}
+
+func (v issuerVerifier) Verify(ctx context.Context, accessToken string) (*authn.Principal, error) {
+	claims, err := v.tokens.ParseClaims(accessToken)
+	if err != nil || claims.Type != token.TypeAccess {
+		return nil, authn.ErrInvalidToken
+	}
+
+	return &authn.Principal{
+		UserID:    claims.UserID,
+		Scopes:    strings.Fields(claims.Scope),
+		Client:    claims.ForClient(),
+		ClientID:  claims.ClientID,
+		SessionID: claims.FamilyID,
+		TokenID:   claims.Id,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+	}, nil
+}
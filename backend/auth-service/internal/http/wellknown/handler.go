@@ -0,0 +1,35 @@
+package wellknown
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/Blxssy/social-media/auth-service/pkg/token"
+)
+
+type JWKSProvider interface {
+	JWKS(ctx context.Context) (token.JSONWebKeySet, error)
+}
+
+type handler struct {
+	jwks JWKSProvider
+}
+
+func Register(mux *http.ServeMux, jwks JWKSProvider) {
+	h := &handler{jwks: jwks}
+
+	mux.HandleFunc("GET /.well-known/jwks.json", h.getJWKS)
+}
+
+func (h *handler) getJWKS(w http.ResponseWriter, r *http.Request) {
+	set, err := h.jwks.JWKS(r.Context())
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(set)
+}
@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// APIKeyPrefix starts every API key, telling them apart from JWTs.
+const APIKeyPrefix = "smk_"
+
+// APIKey is a long-lived credential of a user for bots and integrations.
+// Only the SHA-256 hash of the key is stored; Prefix is the public part the
+// key starts with, by which it is looked up and shown to its owner.
+type APIKey struct {
+	ID         uint `gorm:"primarykey"`
+	UserID     uint `gorm:"index"`
+	Name       string
+	Prefix     string `gorm:"uniqueIndex"`
+	KeyHash    string
+	Scopes     []string `gorm:"serializer:json"`
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+	CreatedAt  time.Time
+}
+
+// Active reports whether the key can still be used at now.
+func (k *APIKey) Active(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// Identity links a user to an account at an external OpenID Connect
+// provider, which identifies it by Subject. A user has at most one identity
+// per provider. Email is the address the provider reported when the
+// identity was linked.
+type Identity struct {
+	ID        uint   `gorm:"primarykey"`
+	UserID    uint   `gorm:"index"`
+	Provider  string `gorm:"uniqueIndex:idx_identities_provider_subject"`
+	Subject   string `gorm:"uniqueIndex:idx_identities_provider_subject"`
+	Email     string
+	CreatedAt time.Time
+}
@@ -0,0 +1,67 @@
+package models
+
+import "time"
+
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantRefreshToken      = "refresh_token"
+	GrantClientCredentials = "client_credentials"
+)
+
+// OAuthClient is a third-party application registered by a developer.
+// Confidential clients authenticate with a secret, of which only the SHA-256
+// hash is stored. Public clients, such as mobile and browser apps, can't keep
+// a secret and rely on PKCE alone. Scopes are the most the client may ask
+// for.
+type OAuthClient struct {
+	ID           uint   `gorm:"primarykey"`
+	ClientID     string `gorm:"uniqueIndex"`
+	SecretHash   string
+	Name         string
+	OwnerID      uint     `gorm:"index"`
+	RedirectURIs []string `gorm:"serializer:json"`
+	Scopes       []string `gorm:"serializer:json"`
+	GrantTypes   []string `gorm:"serializer:json"`
+	Public       bool
+	CreatedAt    time.Time
+}
+
+func (OAuthClient) TableName() string {
+	return "oauth_clients"
+}
+
+// OAuthConsent records the scopes a user granted to a client.
+type OAuthConsent struct {
+	UserID    uint     `gorm:"primaryKey"`
+	ClientID  string   `gorm:"primaryKey"`
+	Scopes    []string `gorm:"serializer:json"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (OAuthConsent) TableName() string {
+	return "oauth_consents"
+}
+
+// AuthorizationCode is what an authorization code stands for until the
+// client exchanges it for tokens. ExplicitRedirectURI is set when the
+// authorization request named RedirectURI rather than leaving it to the
+// single one the client registered.
+type AuthorizationCode struct {
+	ClientID            string `json:"client_id"`
+	UserID              uint   `json:"user_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	ExplicitRedirectURI bool   `json:"explicit_redirect_uri,omitempty"`
+	Scope               string `json:"scope"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+	Nonce               string `json:"nonce,omitempty"`
+}
+
+// ConsumedAuthorizationCode is kept once a code has been exchanged, so the
+// session it started, FamilyID, can be ended should the code be replayed.
+// FamilyID is empty when the exchange started no session.
+type ConsumedAuthorizationCode struct {
+	AuthorizationCode
+	FamilyID string
+}
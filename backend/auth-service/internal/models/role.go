@@ -0,0 +1,73 @@
+package models
+
+import "github.com/Blxssy/social-media/auth-service/pkg/authn"
+
+const (
+	RoleAdmin     = authn.RoleAdmin // the role authn grants admin access to
+	RoleModerator = "moderator"
+	RoleSupport   = "support"
+	RoleCreator   = "creator"
+)
+
+const (
+	PermissionUsersRead       = "users:read"
+	PermissionRolesManage     = "roles:manage"
+	PermissionLoginsUnlock    = "logins:unlock"
+	PermissionSessionsRevoke  = "sessions:revoke"
+	PermissionContentModerate = "content:moderate"
+	PermissionContentVerified = "content:verified"
+)
+
+// Role grants its permissions to every user it is assigned to.
+type Role struct {
+	ID          uint   `gorm:"primarykey"`
+	Name        string `gorm:"uniqueIndex"`
+	Description string
+	Permissions []Permission `gorm:"many2many:role_permissions"`
+}
+
+type Permission struct {
+	ID          uint   `gorm:"primarykey"`
+	Name        string `gorm:"uniqueIndex"`
+	Description string
+}
+
+// DefaultRoles are created when the database is migrated. The admin role has every permission.
+var DefaultRoles = []Role{
+	{
+		Name:        RoleAdmin,
+		Description: "Full access",
+		Permissions: []Permission{
+			{Name: PermissionUsersRead, Description: "View any user account"},
+			{Name: PermissionRolesManage, Description: "Assign and revoke roles"},
+			{Name: PermissionLoginsUnlock, Description: "Clear login lockouts"},
+			{Name: PermissionSessionsRevoke, Description: "Revoke sessions of any user"},
+			{Name: PermissionContentModerate, Description: "Hide and remove content of any user"},
+			{Name: PermissionContentVerified, Description: "Publish as a verified creator"},
+		},
+	},
+	{
+		Name:        RoleModerator,
+		Description: "Moderates content",
+		Permissions: []Permission{
+			{Name: PermissionUsersRead},
+			{Name: PermissionContentModerate},
+		},
+	},
+	{
+		Name:        RoleSupport,
+		Description: "Helps users with their accounts",
+		Permissions: []Permission{
+			{Name: PermissionUsersRead},
+			{Name: PermissionLoginsUnlock},
+			{Name: PermissionSessionsRevoke},
+		},
+	},
+	{
+		Name:        RoleCreator,
+		Description: "Verified creator",
+		Permissions: []Permission{
+			{Name: PermissionContentVerified},
+		},
+	},
+}
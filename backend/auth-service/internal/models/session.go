@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// Session is a device the user is signed in on. Its ID is the family id of
+// the refresh tokens issued to that device. Sessions of a third-party app
+// signed in through OAuth have the ClientID of the app.
+type Session struct {
+	ID         string
+	UserID     uint
+	ClientID   string
+	UserAgent  string
+	IP         string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+}
+
+// ClientInfo describes the client a request came from.
+type ClientInfo struct {
+	UserAgent string
+	IP        string
+}
@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// TokenInfo describes a token as reported by introspection (RFC 7662).
+// Scopes are only set for API keys and tokens of OAuth clients, ClientID only
+// for the latter. Subject is the user id, or token.ClientSubject of the
+// client for tokens of the client_credentials grant.
+type TokenInfo struct {
+	Active    bool
+	Revoked   bool
+	UserID    uint
+	Subject   string
+	IsAdmin   bool
+	Roles     []string
+	Scopes    []string
+	TokenType string
+	TokenID   string
+	ClientID  string
+	SessionID string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
@@ -1,14 +1,32 @@
 package models
 
 import (
+	"time"
+
 	"gorm.io/gorm"
 )
 
 type User struct {
 	gorm.Model
 
-	Username string
-	Email    string `gorm:"unique"`
-	PassHash string
-	IsAdmin  bool
+	Username      string
+	Email         string `gorm:"unique"`
+	EmailVerified bool
+	PassHash      string
+	// IsAdmin is kept in sync with the admin role for older readers of the
+	// column.
+	IsAdmin     bool
+	TOTPSecret  string
+	TOTPEnabled bool
+	Roles       []Role `gorm:"many2many:user_roles"`
+}
+
+// RecoveryCode is a one-time code that signs a user in instead of a TOTP code.
+// Only its SHA-256 hash is stored.
+type RecoveryCode struct {
+	ID        uint `gorm:"primarykey"`
+	UserID    uint `gorm:"index"`
+	CodeHash  string
+	UsedAt    *time.Time
+	CreatedAt time.Time
 }
@@ -0,0 +1,159 @@
+// Package seed creates the bootstrap admin and fixture users. Seeding is
+// idempotent: users whose email already exists are left untouched.
+package seed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/Blxssy/social-media/auth-service/internal/config"
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"github.com/Blxssy/social-media/auth-service/internal/storage"
+	"github.com/Blxssy/social-media/auth-service/internal/validation"
+	"github.com/Blxssy/social-media/auth-service/pkg/password"
+	"gopkg.in/yaml.v3"
+)
+
+type Store interface {
+	User(ctx context.Context, email string) (*models.User, error)
+	SaveUserWithRoles(ctx context.Context, user *models.User, roleNames []string) error
+}
+
+// User is a user to create, as listed in the fixtures file.
+type User struct {
+	Username      string   `yaml:"username"`
+	Email         string   `yaml:"email"`
+	Password      string   `yaml:"password"`
+	EmailVerified bool     `yaml:"emailVerified"`
+	Roles         []string `yaml:"roles"`
+}
+
+type fixtures struct {
+	Users []User `yaml:"users"`
+}
+
+// Run creates the configured admin, then the users of the fixtures file.
+// The admin is skipped with a warning when no password is configured for
+// it, and its password must satisfy passwords; the fixtures are development
+// users with well-known passwords anyway.
+func Run(ctx context.Context, log *slog.Logger, cfg config.Seed, store Store, hasher password.Hasher, passwords *validation.PasswordPolicy) error {
+	const op = "seed.Run"
+
+	log = log.With(slog.String("op", op))
+
+	if cfg.Admin.Email != "" {
+		admin, err := adminUser(cfg.Admin)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+
+		if admin.Password == "" {
+			log.Warn("admin not seeded: no password configured, set SEED_ADMIN_PASSWORD or seed.admin.passwordFile",
+				slog.String("email", cfg.Admin.Email),
+			)
+		} else if err := createUser(ctx, log, store, hasher, passwords, admin); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	if cfg.FixturesFile != "" {
+		users, err := loadFixtures(cfg.FixturesFile)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+
+		for _, user := range users {
+			if err := createUser(ctx, log, store, hasher, nil, user); err != nil {
+				return fmt.Errorf("%s: %w", op, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// adminUser builds the admin from config. The password is taken from the
+// config (or the SEED_ADMIN_PASSWORD environment variable) or, if that is
+// empty, from PasswordFile, such as a mounted Docker secret. It is empty if
+// neither is set.
+func adminUser(cfg config.SeedAdmin) (User, error) {
+	password := cfg.Password
+	if password == "" && cfg.PasswordFile != "" {
+		data, err := os.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return User{}, fmt.Errorf("read admin password: %w", err)
+		}
+		password = strings.TrimRight(string(data), "\r\n")
+	}
+
+	return User{
+		Username:      cfg.Username,
+		Email:         cfg.Email,
+		Password:      password,
+		EmailVerified: true,
+		Roles:         []string{models.RoleAdmin},
+	}, nil
+}
+
+func loadFixtures(path string) ([]User, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f fixtures
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	return f.Users, nil
+}
+
+// createUser creates user unless its email exists. If passwords is set, the
+// password of a user to create must satisfy it.
+func createUser(ctx context.Context, log *slog.Logger, store Store, hasher password.Hasher, passwords *validation.PasswordPolicy, user User) error {
+	email, err := validation.NormalizeEmail(user.Email)
+	if err != nil {
+		return fmt.Errorf("user %q: %w", user.Email, err)
+	}
+
+	_, err = store.User(ctx, email)
+	if err == nil {
+		log.Debug("seed user exists", slog.String("email", email))
+		return nil
+	}
+	if !errors.Is(err, storage.ErrUserNotFound) {
+		return err
+	}
+
+	if passwords != nil {
+		if problems := passwords.Check(user.Password); len(problems) > 0 {
+			return fmt.Errorf("user %q: %s", email, strings.Join(problems, "; "))
+		}
+	}
+
+	passHash, err := hasher.Hash(user.Password)
+	if err != nil {
+		return fmt.Errorf("user %q: %w", email, err)
+	}
+
+	// The user is created with its roles at once: a user created without
+	// them would be skipped as existing from then on.
+	created := &models.User{
+		Username:      user.Username,
+		Email:         email,
+		PassHash:      passHash,
+		EmailVerified: user.EmailVerified,
+	}
+	if err := store.SaveUserWithRoles(ctx, created, user.Roles); err != nil {
+		return fmt.Errorf("user %q: %w", email, err)
+	}
+
+	log.Info("seed user created", slog.String("email", email), slog.Any("roles", user.Roles))
+
+	return nil
+}
@@ -0,0 +1,252 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"github.com/Blxssy/social-media/auth-service/internal/storage"
+	"github.com/Blxssy/social-media/auth-service/pkg/authn"
+	"github.com/Blxssy/social-media/auth-service/pkg/token"
+)
+
+const (
+	// apiKeyIDSize is the number of random bytes of the public part of a key.
+	apiKeyIDSize = 4
+	// apiKeyAttempts is how many keys are generated before giving up on
+	// finding a prefix no other key has.
+	apiKeyAttempts = 3
+)
+
+type APIKeyStore interface {
+	SaveAPIKey(ctx context.Context, key *models.APIKey) error
+	APIKeys(ctx context.Context, uid uint) ([]*models.APIKey, error)
+	APIKeyByPrefix(ctx context.Context, prefix string) (*models.APIKey, error)
+	RevokeAPIKey(ctx context.Context, uid uint, id uint) error
+	TouchAPIKey(ctx context.Context, id uint, usedAt time.Time) error
+}
+
+// CreateAPIKey creates a key acting for the user within scopes and returns it
+// along with its record. A zero expiresAt means the key does not expire. The
+// key is only ever returned here; it is stored hashed. Only admins may create
+// keys with authn.ScopeIntrospect, which services introspect tokens with.
+func (a *Auth) CreateAPIKey(ctx context.Context, userID uint, name string, scopes []string, expiresAt time.Time) (string, *models.APIKey, error) {
+	const op = "auth.CreateAPIKey"
+
+	log := a.log.With(
+		slog.String("op", op),
+	)
+
+	if slices.Contains(scopes, authn.ScopeIntrospect) {
+		admin, err := a.isAdmin(ctx, userID)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s: %w", op, storageError(err))
+		}
+		if !admin {
+			return "", nil, ErrScopeNotAllowed
+		}
+	}
+
+	if limit := a.cfg.APIKeys.MaxPerUser; limit > 0 {
+		keys, err := a.apiKeys.APIKeys(ctx, userID)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s: %w", op, err)
+		}
+		if len(keys) >= limit {
+			return "", nil, ErrAPIKeyLimit
+		}
+	}
+
+	// The prefix is short enough to collide now and then; another key is
+	// generated when it does.
+	for attempt := 1; ; attempt++ {
+		key, prefix, err := newAPIKey()
+		if err != nil {
+			return "", nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		record := &models.APIKey{
+			UserID:  userID,
+			Name:    name,
+			Prefix:  prefix,
+			KeyHash: hashToken(key),
+			Scopes:  scopes,
+		}
+		if !expiresAt.IsZero() {
+			record.ExpiresAt = &expiresAt
+		}
+
+		if err := a.apiKeys.SaveAPIKey(ctx, record); err != nil {
+			if errors.Is(err, storage.ErrAPIKeyExists) && attempt < apiKeyAttempts {
+				continue
+			}
+			return "", nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		log.Info("api key created",
+			slog.Uint64("user_id", uint64(userID)),
+			slog.String("prefix", prefix),
+			slog.Any("scopes", scopes),
+		)
+
+		return key, record, nil
+	}
+}
+
+// ListAPIKeys returns the keys of the user that were not revoked.
+func (a *Auth) ListAPIKeys(ctx context.Context, userID uint) ([]*models.APIKey, error) {
+	const op = "auth.ListAPIKeys"
+
+	keys, err := a.apiKeys.APIKeys(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return keys, nil
+}
+
+// RevokeAPIKey revokes a key of the user. It stops working right away.
+func (a *Auth) RevokeAPIKey(ctx context.Context, userID uint, keyID uint) error {
+	const op = "auth.RevokeAPIKey"
+
+	if err := a.apiKeys.RevokeAPIKey(ctx, userID, keyID); err != nil {
+		return fmt.Errorf("%s: %w", op, storageError(err))
+	}
+
+	a.log.Info("api key revoked",
+		slog.String("op", op),
+		slog.Uint64("user_id", uint64(userID)),
+		slog.Uint64("key_id", uint64(keyID)),
+	)
+
+	return nil
+}
+
+// AuthenticateAPIKey checks an API key and returns its record. Unknown,
+// revoked and expired keys are ErrInvalidToken. The owner of a key with
+// authn.ScopeIntrospect must still be an admin, or the key loses the scope.
+func (a *Auth) AuthenticateAPIKey(ctx context.Context, key string) (*models.APIKey, error) {
+	const op = "auth.AuthenticateAPIKey"
+
+	prefix, ok := apiKeyPrefix(key)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	record, err := a.apiKeys.APIKeyByPrefix(ctx, prefix)
+	if err != nil {
+		if errors.Is(err, storage.ErrAPIKeyNotFound) {
+			return nil, ErrInvalidToken
+		}
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashToken(key)), []byte(record.KeyHash)) != 1 {
+		return nil, ErrInvalidToken
+	}
+
+	now := time.Now()
+	if !record.Active(now) {
+		return nil, ErrInvalidToken
+	}
+
+	if i := slices.Index(record.Scopes, authn.ScopeIntrospect); i >= 0 {
+		admin, err := a.isAdmin(ctx, record.UserID)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		if !admin {
+			a.log.Warn("api key of a former admin used without its introspect scope",
+				slog.String("op", op),
+				slog.String("prefix", record.Prefix),
+			)
+			record.Scopes = slices.Delete(slices.Clone(record.Scopes), i, i+1)
+		}
+	}
+
+	if err := a.apiKeys.TouchAPIKey(ctx, record.ID, now); err != nil {
+		a.log.Error("failed to record api key use",
+			slog.String("op", op),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return record, nil
+}
+
+// introspectAPIKey is Introspect for API keys. They carry scopes instead of
+// roles.
+func (a *Auth) introspectAPIKey(ctx context.Context, key string) (*models.TokenInfo, error) {
+	record, err := a.AuthenticateAPIKey(ctx, key)
+	if err != nil {
+		if errors.Is(err, ErrInvalidToken) {
+			return &models.TokenInfo{}, nil
+		}
+		return nil, err
+	}
+
+	info := &models.TokenInfo{
+		Active:    true,
+		UserID:    record.UserID,
+		Subject:   strconv.FormatUint(uint64(record.UserID), 10),
+		Scopes:    record.Scopes,
+		TokenType: token.TypeAPIKey,
+		TokenID:   record.Prefix,
+		IssuedAt:  record.CreatedAt,
+	}
+	if record.ExpiresAt != nil {
+		info.ExpiresAt = *record.ExpiresAt
+	}
+
+	return info, nil
+}
+
+// isAdmin reports whether the user has the admin role.
+func (a *Auth) isAdmin(ctx context.Context, userID uint) (bool, error) {
+	roles, err := a.roles.UserRoles(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return slices.Contains(roles, models.RoleAdmin), nil
+}
+
+// newAPIKey returns a key of the form smk_<id>_<secret> along with its
+// prefix smk_<id>.
+func newAPIKey() (string, string, error) {
+	id := make([]byte, apiKeyIDSize)
+	if _, err := rand.Read(id); err != nil {
+		return "", "", err
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	prefix := models.APIKeyPrefix + hex.EncodeToString(id)
+
+	return prefix + "_" + secret, prefix, nil
+}
+
+func apiKeyPrefix(key string) (string, bool) {
+	if !strings.HasPrefix(key, models.APIKeyPrefix) {
+		return "", false
+	}
+
+	prefixLen := len(models.APIKeyPrefix) + 2*apiKeyIDSize
+	if len(key) <= prefixLen+1 || key[prefixLen] != '_' {
+		return "", false
+	}
+
+	return key[:prefixLen], true
+}
@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"github.com/Blxssy/social-media/auth-service/internal/storage"
+	"github.com/Blxssy/social-media/auth-service/pkg/authn"
+)
+
+// memoryAPIKeys keeps API keys by prefix and records their uses.
+type memoryAPIKeys struct {
+	keys    []*models.APIKey
+	touched []uint
+}
+
+func (m *memoryAPIKeys) SaveAPIKey(ctx context.Context, key *models.APIKey) error {
+	if _, err := m.APIKeyByPrefix(ctx, key.Prefix); err == nil {
+		return storage.ErrAPIKeyExists
+	}
+	key.ID = uint(len(m.keys) + 1)
+	key.CreatedAt = time.Now()
+	m.keys = append(m.keys, key)
+	return nil
+}
+
+func (m *memoryAPIKeys) APIKeys(ctx context.Context, uid uint) ([]*models.APIKey, error) {
+	var keys []*models.APIKey
+	for _, key := range m.keys {
+		if key.UserID == uid && key.RevokedAt == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (m *memoryAPIKeys) APIKeyByPrefix(ctx context.Context, prefix string) (*models.APIKey, error) {
+	for _, key := range m.keys {
+		if key.Prefix == prefix {
+			// Like a database row, callers get their own copy.
+			k := *key
+			return &k, nil
+		}
+	}
+	return nil, storage.ErrAPIKeyNotFound
+}
+
+func (m *memoryAPIKeys) RevokeAPIKey(ctx context.Context, uid uint, id uint) error {
+	for _, key := range m.keys {
+		if key.UserID == uid && key.ID == id {
+			now := time.Now()
+			key.RevokedAt = &now
+			return nil
+		}
+	}
+	return storage.ErrAPIKeyNotFound
+}
+
+func (m *memoryAPIKeys) TouchAPIKey(ctx context.Context, id uint, usedAt time.Time) error {
+	m.touched = append(m.touched, id)
+	return nil
+}
+
+func newAPIKeysAuth() (*Auth, *memoryAPIKeys, *memoryRoles) {
+	keys := &memoryAPIKeys{}
+	roles := newMemoryRoles()
+
+	return &Auth{
+		log:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+		apiKeys: keys,
+		roles:   roles,
+	}, keys, roles
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	a, store, _ := newAPIKeysAuth()
+	ctx := context.Background()
+
+	key, record, err := a.CreateAPIKey(ctx, plainUID, "ci", []string{"posts:read"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix, secret := record.Prefix, strings.TrimPrefix(key, record.Prefix+"_")
+
+	revoked, revokedRecord, err := a.CreateAPIKey(ctx, plainUID, "revoked", nil, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.RevokeAPIKey(ctx, plainUID, revokedRecord.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	expired, _, err := a.CreateAPIKey(ctx, plainUID, "expired", nil, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{name: "empty", key: ""},
+		{name: "access token", key: "eyJhbGciOiJSUzI1NiJ9.e30.c2ln"},
+		{name: "without the smk_ prefix", key: strings.TrimPrefix(key, models.APIKeyPrefix)},
+		{name: "other prefix", key: "sk_live_" + strings.TrimPrefix(key, models.APIKeyPrefix)},
+		{name: "prefix only", key: prefix},
+		{name: "empty secret", key: prefix + "_"},
+		{name: "short id", key: prefix[:len(prefix)-1] + "_" + secret},
+		{name: "wrong separator", key: prefix + "-" + secret},
+		{name: "unknown prefix", key: models.APIKeyPrefix + "00000000_" + secret},
+		{name: "wrong secret", key: prefix + "_" + strings.Repeat("x", len(secret))},
+		{name: "truncated secret", key: key[:len(key)-1]},
+		{name: "revoked", key: revoked},
+		{name: "expired", key: expired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := a.AuthenticateAPIKey(ctx, tt.key)
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("AuthenticateAPIKey = %+v, %v, want ErrInvalidToken", got, err)
+			}
+		})
+	}
+	if len(store.touched) != 0 {
+		t.Errorf("rejected keys recorded as used: %v", store.touched)
+	}
+
+	got, err := a.AuthenticateAPIKey(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != record.ID || got.UserID != plainUID || !slices.Equal(got.Scopes, []string{"posts:read"}) {
+		t.Errorf("AuthenticateAPIKey = %+v, want the key of user %d", got, plainUID)
+	}
+	if !slices.Equal(store.touched, []uint{record.ID}) {
+		t.Errorf("used keys = %v, want [%d]", store.touched, record.ID)
+	}
+}
+
+func TestAuthenticateAPIKeyIntrospectScope(t *testing.T) {
+	a, store, roles := newAPIKeysAuth()
+	ctx := context.Background()
+
+	if _, _, err := a.CreateAPIKey(ctx, plainUID, "service", []string{authn.ScopeIntrospect}, time.Time{}); !errors.Is(err, ErrScopeNotAllowed) {
+		t.Fatalf("non-admin created an introspect key: err = %v", err)
+	}
+
+	scopes := []string{"posts:read", authn.ScopeIntrospect}
+	key, _, err := a.CreateAPIKey(ctx, staffUID, "service", scopes, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := a.AuthenticateAPIKey(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got.Scopes, scopes) {
+		t.Errorf("scopes of an admin's key = %v, want %v", got.Scopes, scopes)
+	}
+
+	// The owner is no admin anymore: the key keeps working without the scope.
+	roles.users[staffUID] = []string{models.RoleSupport}
+
+	got, err = a.AuthenticateAPIKey(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got.Scopes, []string{"posts:read"}) {
+		t.Errorf("scopes of a former admin's key = %v, want [posts:read]", got.Scopes)
+	}
+	if stored := store.keys[0].Scopes; !slices.Equal(stored, scopes) {
+		t.Errorf("stored scopes changed to %v", stored)
+	}
+}
@@ -2,24 +2,48 @@ package auth
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log/slog"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/Blxssy/social-media/auth-service/internal/config"
 	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"github.com/Blxssy/social-media/auth-service/internal/storage"
+	"github.com/Blxssy/social-media/auth-service/pkg/authn"
+	"github.com/Blxssy/social-media/auth-service/pkg/mailer"
+	"github.com/Blxssy/social-media/auth-service/pkg/password"
 	"github.com/Blxssy/social-media/auth-service/pkg/token"
-	"golang.org/x/crypto/bcrypt"
-)
-
-var (
-	ErrInvalidCredentials = errors.New("invalid credentials")
 )
 
 type Auth struct {
-	log         *slog.Logger
-	usrSaver    UserSaver
-	usrProvider UserProvider
-	tokenSaver  TokenSaver
+	log          *slog.Logger
+	cfg          config.Auth
+	usrSaver     UserSaver
+	usrProvider  UserProvider
+	usrUpdater   UserUpdater
+	tokenSaver   TokenSaver
+	tokenRotator TokenRotator
+	tokenRevoker TokenRevoker
+	sesProvider  SessionProvider
+	otTokens     OneTimeTokenStore
+	mfaStore     MFAStore
+	throttler    LoginThrottler
+	roles        RoleStore
+	apiKeys      APIKeyStore
+	identities   IdentityStore
+	providers    map[string]IDTokenVerifier
+	mailer       mailer.Mailer
+	hasher       password.Hasher
+	tokens       *token.Issuer
+	// dummyHash is verified against on logins with an unknown email.
+	dummyHash string
 }
 
 type UserSaver interface {
@@ -28,28 +52,102 @@ type UserSaver interface {
 
 type UserProvider interface {
 	User(ct context.Context, email string) (*models.User, error)
+	UserByID(ctx context.Context, uid uint) (*models.User, error)
 	IsAdmin(ct context.Context, userID int) (bool, error)
 }
 
+type UserUpdater interface {
+	VerifyEmail(ctx context.Context, uid uint, email string) error
+	UpdatePassword(ctx context.Context, uid uint, passHash []byte) error
+	ReplacePasswordHash(ctx context.Context, uid uint, oldHash []byte, newHash []byte) error
+	UpdateEmail(ctx context.Context, uid uint, email string) error
+}
+
 type TokenSaver interface {
-	SaveTokens(ctx context.Context, uid uint, accessToken string, refreshToken string) error
+	SaveTokens(ctx context.Context, session *models.Session, pair *token.Pair) error
+}
+
+type TokenRotator interface {
+	RotateRefreshToken(ctx context.Context, uid uint, sessionID string, oldID string, newID string, ip string) error
+}
+
+type TokenRevoker interface {
+	RevokeToken(ctx context.Context, tokenID string, ttl time.Duration) error
+	RevokeSession(ctx context.Context, uid uint, sessionID string) error
+	RevokeAllSessions(ctx context.Context, uid uint) error
+	IsTokenRevoked(ctx context.Context, tokenID string, sessionID string) (bool, error)
+}
+
+type SessionProvider interface {
+	Sessions(ctx context.Context, uid uint) ([]*models.Session, error)
+	Session(ctx context.Context, sessionID string) (*models.Session, error)
+	CurrentRefreshID(ctx context.Context, sessionID string) (string, error)
+}
+
+type OneTimeTokenStore interface {
+	SaveOneTimeToken(ctx context.Context, tokenID string, ttl time.Duration) error
+	ConsumeOneTimeToken(ctx context.Context, tokenID string) (bool, error)
+	SavePasswordResetToken(ctx context.Context, tokenHash string, uid uint, ttl time.Duration) error
+	ConsumePasswordResetToken(ctx context.Context, tokenHash string) (uint, error)
+}
+
+// Store is all the storage Auth needs; New hands each part of it to the
+// code that uses it.
+type Store interface {
+	UserSaver
+	UserProvider
+	UserUpdater
+	TokenSaver
+	TokenRotator
+	TokenRevoker
+	SessionProvider
+	OneTimeTokenStore
+	MFAStore
+	LoginThrottler
+	RoleStore
+	APIKeyStore
+	IdentityStore
 }
 
 func New(
 	log *slog.Logger,
-	usrSaver UserSaver,
-	usrProvider UserProvider,
-	tokenSaver TokenSaver,
+	cfg config.Auth,
+	store Store,
+	providers map[string]IDTokenVerifier,
+	mailer mailer.Mailer,
+	hasher password.Hasher,
+	tokens *token.Issuer,
 ) *Auth {
+	dummyHash, err := hasher.Hash("dummy password")
+	if err != nil {
+		panic(err)
+	}
+
 	return &Auth{
-		log:         log,
-		usrSaver:    usrSaver,
-		usrProvider: usrProvider,
-		tokenSaver:  tokenSaver,
+		log:          log,
+		cfg:          cfg,
+		usrSaver:     store,
+		usrProvider:  store,
+		usrUpdater:   store,
+		tokenSaver:   store,
+		tokenRotator: store,
+		tokenRevoker: store,
+		sesProvider:  store,
+		otTokens:     store,
+		mfaStore:     store,
+		throttler:    store,
+		roles:        store,
+		apiKeys:      store,
+		identities:   store,
+		providers:    providers,
+		mailer:       mailer,
+		hasher:       hasher,
+		tokens:       tokens,
+		dummyHash:    dummyHash,
 	}
 }
 
-func (a *Auth) Register(ctx context.Context, username, email, password string) (string, string, error) {
+func (a *Auth) Register(ctx context.Context, username, email, password string, client models.ClientInfo) (string, string, error) {
 	const op = "auth.Register"
 
 	log := a.log.With(
@@ -58,63 +156,748 @@ func (a *Auth) Register(ctx context.Context, username, email, password string) (
 	)
 	//log.Info("registering user")
 
-	passHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	passHash, err := a.hasher.Hash(password)
 	if err != nil {
 		log.Error("failed to generate password hash")
 
 		return "", "", fmt.Errorf("%s: %w", op, err)
 	}
 
-	user, err := a.usrSaver.SaveUser(ctx, username, email, passHash)
+	user, err := a.usrSaver.SaveUser(ctx, username, email, []byte(passHash))
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %w", op, storageError(err))
+	}
+
+	if err := a.sendVerificationEmail(ctx, user.ID, user.Email); err != nil {
+		log.Error("failed to send verification email", slog.String("error", err.Error()))
+	}
+
+	// Without a verified email the user may not sign in, so no session is
+	// started until the email is confirmed.
+	if a.cfg.RequireEmailVerification {
+		return "", "", nil
+	}
+
+	pair, err := a.startSession(ctx, user.ID, client)
+	if err != nil {
+		log.Error("failed to start session")
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return pair.AccessToken, pair.RefreshToken, nil
+}
+
+// Login checks the credentials and starts a session. For users with
+// two-factor authentication enabled no tokens are issued: the returned MFA
+// ticket has to be exchanged with VerifyMFA. Failed logins are throttled per
+// account and per client IP, see reserveLoginAttempt.
+func (a *Auth) Login(ctx context.Context, email, password string, client models.ClientInfo) (string, string, string, error) {
+	const op = "auth.Login"
+
+	log := a.log.With(
+		slog.String("op", op),
+		slog.String("email", email),
+	)
+
+	attempt, err := a.reserveLoginAttempt(ctx, email, client.IP)
+	if err != nil {
+		var throttled *ThrottledError
+		if errors.As(err, &throttled) {
+			return "", "", "", err
+		}
+		return "", "", "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	user, err := a.usrProvider.User(ctx, email)
+	if err != nil {
+		if !errors.Is(err, storage.ErrUserNotFound) {
+			a.releaseLoginAttempt(ctx, attempt)
+			return "", "", "", fmt.Errorf("%s: %w", op, err)
+		}
+
+		// Spend the time of a password check anyway, so unknown emails
+		// can't be told apart from wrong passwords by timing.
+		_, _ = a.hasher.Verify(password, a.dummyHash)
+
+		a.failLoginAttempt(ctx, attempt)
+		return "", "", "", ErrInvalidCredentials
+	}
+
+	if !a.checkPassword(user, password) {
+		a.failLoginAttempt(ctx, attempt)
+		return "", "", "", ErrInvalidCredentials
+	}
+
+	a.releaseLoginAttempt(ctx, attempt)
+	a.rehashPassword(ctx, user, password)
+
+	if a.cfg.RequireEmailVerification && !user.EmailVerified {
+		return "", "", "", ErrEmailNotVerified
+	}
+
+	if user.TOTPEnabled {
+		ticket, err := a.startMFA(ctx, user.ID)
+		if err != nil {
+			log.Error("failed to issue mfa ticket")
+			return "", "", "", fmt.Errorf("%s: %w", op, err)
+		}
+
+		return "", "", ticket, nil
+	}
+
+	// Users with two-factor authentication are only signed in, and their
+	// failures forgotten, once VerifyMFA accepts their code.
+	a.clearLoginFailures(ctx, email)
+
+	pair, err := a.startSession(ctx, user.ID, client)
+	if err != nil {
+		log.Error("failed to start session")
+		return "", "", "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return pair.AccessToken, pair.RefreshToken, "", nil
+}
+
+func (a *Auth) IsAdmin(ctx context.Context, userID int) (bool, error) {
+	const op = "auth.IsAdmin"
+
+	isAdmin, err := a.usrProvider.IsAdmin(ctx, userID)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, storageError(err))
+	}
+
+	return isAdmin, nil
+}
+
+// Refresh exchanges a refresh token for the next pair of its family and
+// invalidates the presented one. Presenting a refresh token that was already
+// rotated revokes the whole family and returns ErrTokenReused.
+func (a *Auth) Refresh(ctx context.Context, refreshToken string, client models.ClientInfo) (string, string, error) {
+	const op = "auth.Refresh"
+
+	log := a.log.With(
+		slog.String("op", op),
+	)
+
+	claims, err := a.tokens.ParseRefreshToken(refreshToken)
 	if err != nil {
+		return "", "", ErrInvalidToken
+	}
+
+	// Refresh tokens of OAuth clients are rotated at the token endpoint;
+	// here they would turn into tokens with the user's roles.
+	if claims.ClientID != "" {
+		return "", "", ErrInvalidToken
+	}
+
+	if err := a.checkRevoked(ctx, claims); err != nil {
 		return "", "", err
 	}
 
-	accessToken, refreshToken, err := token.GetNewTokens(user.ID)
+	// Roles are read again so changes reach the next access token.
+	roles, err := a.roles.UserRoles(ctx, claims.UserID)
 	if err != nil {
-		log.Error("failed to get new tokens")
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return "", "", ErrInvalidToken
+		}
 		return "", "", fmt.Errorf("%s: %w", op, err)
 	}
 
-	a.tokenSaver.SaveTokens(ctx, user.ID, accessToken, refreshToken)
+	pair, err := a.tokens.GetNewTokens(claims.UserID, claims.FamilyID, roles)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
 
-	return accessToken, refreshToken, nil
+	err = a.tokenRotator.RotateRefreshToken(ctx, claims.UserID, claims.FamilyID, claims.Id, pair.RefreshID, client.IP)
+	if err != nil {
+		if errors.Is(err, storage.ErrTokenNotFound) {
+			return "", "", ErrInvalidToken
+		}
+		if errors.Is(err, storage.ErrTokenReused) {
+			log.Warn("security event: refresh token reuse detected, token family revoked",
+				slog.String("event", "refresh_token_reuse"),
+				slog.Uint64("user_id", uint64(claims.UserID)),
+				slog.String("family_id", claims.FamilyID),
+				slog.String("jti", claims.Id),
+			)
+			return "", "", ErrTokenReused
+		}
+		log.Error("failed to rotate refresh token")
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return pair.AccessToken, pair.RefreshToken, nil
+}
+
+// Authenticate verifies an access token, including the revocation denylist,
+// and returns its claims.
+func (a *Auth) Authenticate(ctx context.Context, accessToken string) (*token.Claims, error) {
+	return a.verifyToken(ctx, accessToken, token.TypeAccess)
 }
 
-func (a *Auth) Login(ctx context.Context, email, password string) (string, string, error) {
+// Logout ends the session the access token belongs to and denies the token
+// itself right away.
+func (a *Auth) Logout(ctx context.Context, principal *authn.Principal) error {
+	const op = "auth.Logout"
+
+	if err := a.tokenRevoker.RevokeToken(ctx, principal.TokenID, time.Until(principal.ExpiresAt)); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	err := a.tokenRevoker.RevokeSession(ctx, principal.UserID, principal.SessionID)
+	if err != nil && !errors.Is(err, storage.ErrSessionNotFound) {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// LogoutAll ends every session of the user the access token belongs to.
+func (a *Auth) LogoutAll(ctx context.Context, principal *authn.Principal) error {
+	const op = "auth.LogoutAll"
+
+	if err := a.tokenRevoker.RevokeToken(ctx, principal.TokenID, time.Until(principal.ExpiresAt)); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := a.tokenRevoker.RevokeAllSessions(ctx, principal.UserID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// SendVerificationEmail (re)sends the email verification link. To not reveal
+// which emails are registered, unknown and already verified addresses are
+// silently ignored.
+func (a *Auth) SendVerificationEmail(ctx context.Context, email string) error {
+	const op = "auth.SendVerificationEmail"
+
 	user, err := a.usrProvider.User(ctx, email)
+	if err != nil || user.EmailVerified {
+		return nil
+	}
+
+	if err := a.sendVerificationEmail(ctx, user.ID, user.Email); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// ConfirmEmail consumes a verification token and marks the email it was sent
+// to as verified. For a token sent by ChangeEmail that address also becomes
+// the user's email.
+func (a *Auth) ConfirmEmail(ctx context.Context, verificationToken string) error {
+	const op = "auth.ConfirmEmail"
+
+	claims, err := a.tokens.ParseClaims(verificationToken)
+	if err != nil || claims.Id == "" {
+		return ErrInvalidToken
+	}
+
+	if claims.Type != token.TypeVerifyEmail && claims.Type != token.TypeChangeEmail {
+		return ErrInvalidToken
+	}
+
+	unused, err := a.otTokens.ConsumeOneTimeToken(ctx, claims.Id)
 	if err != nil {
-		return "", "", err
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if !unused {
+		return ErrInvalidToken
 	}
 
-	const op = "auth.Login"
+	if claims.Type == token.TypeChangeEmail {
+		err = a.usrUpdater.UpdateEmail(ctx, claims.UserID, claims.Email)
+	} else {
+		err = a.usrUpdater.VerifyEmail(ctx, claims.UserID, claims.Email)
+	}
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return ErrInvalidToken
+		}
+		if errors.Is(err, storage.ErrUserExists) {
+			return ErrUserExists
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// ChangePassword replaces the password of the user after checking the
+// current one, and signs the user out of every other session. Users created
+// from an identity provider have no password yet and set their first one
+// with the session alone. Wrong passwords count as failed logins of the
+// account.
+func (a *Auth) ChangePassword(ctx context.Context, userID uint, sessionID string, currentPassword string, newPassword string) error {
+	const op = "auth.ChangePassword"
 
 	log := a.log.With(
 		slog.String("op", op),
-		slog.String("email", email),
 	)
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.PassHash), []byte(password))
+	user, err := a.usrProvider.UserByID(ctx, userID)
 	if err != nil {
-		return "", "", ErrInvalidCredentials
+		return fmt.Errorf("%s: %w", op, storageError(err))
+	}
+
+	if err := a.checkAccount(ctx, user.Email, func() error {
+		if user.PassHash != "" && !a.checkPassword(user, currentPassword) {
+			return ErrInvalidCredentials
+		}
+		return nil
+	}); err != nil {
+		return err
 	}
 
-	accessToken, refreshToken, err := token.GetNewTokens(user.ID)
+	passHash, err := a.hasher.Hash(newPassword)
 	if err != nil {
-		log.Error("failed to get new tokens")
-		return "", "", fmt.Errorf("%s: %w", op, err)
+		log.Error("failed to generate password hash")
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := a.usrUpdater.UpdatePassword(ctx, userID, []byte(passHash)); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
 	}
 
-	a.tokenSaver.SaveTokens(ctx, user.ID, accessToken, refreshToken)
+	if err := a.revokeOtherSessions(ctx, userID, sessionID); err != nil {
+		log.Error("failed to revoke sessions")
+		return fmt.Errorf("%s: %w", op, err)
+	}
 
-	return accessToken, refreshToken, nil
+	return nil
 }
 
-func (a *Auth) IsAdmin(ctx context.Context, userID int) (bool, error) {
-	isAdmin, err := a.usrProvider.IsAdmin(ctx, userID)
+// ChangeEmail sends a verification link to the new address. The email is
+// only changed once the link is confirmed with ConfirmEmail. No link is sent
+// to an address another account has, but that is not reported, so the call
+// can't tell which addresses are registered. Users without a password, who
+// signed up with an identity provider, need only their session. Wrong
+// passwords count as failed logins of the account.
+func (a *Auth) ChangeEmail(ctx context.Context, userID uint, password string, newEmail string) error {
+	const op = "auth.ChangeEmail"
+
+	user, err := a.usrProvider.UserByID(ctx, userID)
 	if err != nil {
-		return false, err
+		return fmt.Errorf("%s: %w", op, storageError(err))
 	}
 
-	return isAdmin, nil
+	if err := a.checkAccount(ctx, user.Email, func() error {
+		if user.PassHash != "" && !a.checkPassword(user, password) {
+			return ErrInvalidCredentials
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	_, err = a.usrProvider.User(ctx, newEmail)
+	switch {
+	case err == nil:
+		a.log.Info("email change to a taken address ignored",
+			slog.String("op", op),
+			slog.Uint64("uid", uint64(userID)),
+		)
+		return nil
+	case !errors.Is(err, storage.ErrUserNotFound):
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := a.sendEmailToken(ctx, userID, token.TypeChangeEmail, newEmail); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// checkPassword reports whether password matches the stored hash of the
+// user. Users created from an identity provider have no password.
+func (a *Auth) checkPassword(user *models.User, password string) bool {
+	if user.PassHash == "" {
+		_, _ = a.hasher.Verify(password, a.dummyHash)
+		return false
+	}
+
+	ok, err := a.hasher.Verify(password, user.PassHash)
+	if err != nil {
+		a.log.Error("failed to verify password hash",
+			slog.Uint64("uid", uint64(user.ID)),
+			slog.String("error", err.Error()),
+		)
+		return false
+	}
+
+	return ok
+}
+
+// rehashPassword replaces the hash of a password that was just verified when
+// it was made with another algorithm or older parameters than configured.
+// Failing to do so does not fail the login; it is retried on the next one.
+func (a *Auth) rehashPassword(ctx context.Context, user *models.User, password string) {
+	if !a.hasher.NeedsRehash(user.PassHash) {
+		return
+	}
+
+	log := a.log.With(slog.Uint64("uid", uint64(user.ID)))
+
+	passHash, err := a.hasher.Hash(password)
+	if err != nil {
+		log.Error("failed to rehash password", slog.String("error", err.Error()))
+		return
+	}
+
+	// The old hash is passed along so a password changed in the meantime is
+	// not overwritten.
+	if err := a.usrUpdater.ReplacePasswordHash(ctx, user.ID, []byte(user.PassHash), []byte(passHash)); err != nil {
+		log.Error("failed to store rehashed password", slog.String("error", err.Error()))
+		return
+	}
+
+	user.PassHash = passHash
+	log.Info("password rehashed")
+}
+
+func (a *Auth) revokeOtherSessions(ctx context.Context, userID uint, currentSessionID string) error {
+	sessions, err := a.sesProvider.Sessions(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		if session.ID == currentSessionID {
+			continue
+		}
+
+		err := a.tokenRevoker.RevokeSession(ctx, userID, session.ID)
+		if err != nil && !errors.Is(err, storage.ErrSessionNotFound) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (a *Auth) sendVerificationEmail(ctx context.Context, userID uint, email string) error {
+	return a.sendEmailToken(ctx, userID, token.TypeVerifyEmail, email)
+}
+
+func (a *Auth) sendEmailToken(ctx context.Context, userID uint, tokenType string, email string) error {
+	verificationToken, id, err := a.tokens.NewVerificationToken(userID, tokenType, email, a.cfg.EmailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	if err := a.otTokens.SaveOneTimeToken(ctx, id, a.cfg.EmailVerificationTTL); err != nil {
+		return err
+	}
+
+	return a.mailer.Send(ctx, mailer.Message{
+		To:      email,
+		Subject: "Confirm your email",
+		Body: "Open the link below to confirm your email address:\n\n" +
+			fmt.Sprintf(a.cfg.VerifyEmailURL, verificationToken) + "\n",
+	})
+}
+
+// RequestPasswordReset emails a password reset link. To not reveal which
+// emails are registered, it succeeds whether or not the user exists.
+func (a *Auth) RequestPasswordReset(ctx context.Context, email string) error {
+	const op = "auth.RequestPasswordReset"
+
+	user, err := a.usrProvider.User(ctx, email)
+	if err != nil {
+		return nil
+	}
+
+	resetToken, err := randomToken()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	// Only the hash is stored, so a leaked Redis dump cannot reset passwords.
+	if err := a.otTokens.SavePasswordResetToken(ctx, hashToken(resetToken), user.ID, a.cfg.PasswordResetTTL); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = a.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: "Open the link below to choose a new password:\n\n" +
+			fmt.Sprintf(a.cfg.ResetPasswordURL, resetToken) + "\n\n" +
+			"If you did not ask to reset your password, ignore this email.\n",
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// ResetPassword consumes a password reset token, sets the new password and
+// signs the user out everywhere.
+func (a *Auth) ResetPassword(ctx context.Context, resetToken string, newPassword string) error {
+	const op = "auth.ResetPassword"
+
+	log := a.log.With(
+		slog.String("op", op),
+	)
+
+	uid, err := a.otTokens.ConsumePasswordResetToken(ctx, hashToken(resetToken))
+	if err != nil {
+		if errors.Is(err, storage.ErrTokenNotFound) {
+			return ErrInvalidToken
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	passHash, err := a.hasher.Hash(newPassword)
+	if err != nil {
+		log.Error("failed to generate password hash")
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := a.usrUpdater.UpdatePassword(ctx, uid, []byte(passHash)); err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return ErrInvalidToken
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := a.tokenRevoker.RevokeAllSessions(ctx, uid); err != nil {
+		log.Error("failed to revoke sessions")
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(resetToken string) string {
+	sum := sha256.Sum256([]byte(resetToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// ListSessions returns the devices the user is signed in on.
+func (a *Auth) ListSessions(ctx context.Context, userID uint) ([]*models.Session, error) {
+	const op = "auth.ListSessions"
+
+	sessions, err := a.sesProvider.Sessions(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return sessions, nil
+}
+
+// RevokeSession signs the user out of one of their sessions.
+func (a *Auth) RevokeSession(ctx context.Context, userID uint, sessionID string) error {
+	const op = "auth.RevokeSession"
+
+	if err := a.tokenRevoker.RevokeSession(ctx, userID, sessionID); err != nil {
+		if errors.Is(err, storage.ErrSessionNotFound) {
+			return ErrSessionNotFound
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// RevokeAnySession ends a session of whichever user it belongs to, for
+// staff with the sessions:revoke permission.
+func (a *Auth) RevokeAnySession(ctx context.Context, sessionID string) error {
+	const op = "auth.RevokeAnySession"
+
+	session, err := a.sesProvider.Session(ctx, sessionID)
+	if err != nil {
+		if errors.Is(err, storage.ErrSessionNotFound) {
+			return ErrSessionNotFound
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := a.RevokeSession(ctx, session.UserID, sessionID); err != nil {
+		return err
+	}
+
+	a.log.Info("security event: session revoked",
+		slog.String("event", "session_revoked"),
+		slog.Uint64("user_id", uint64(session.UserID)),
+		slog.String("session_id", sessionID),
+	)
+
+	return nil
+}
+
+// Introspect reports whether a token is currently active and, if so, who it
+// belongs to. Invalid tokens are not an error: they are reported as inactive.
+// A refresh token is only active while it is the current one of a live
+// session, so rotated ones and those of ended sessions are inactive. Roles
+// are the user's current ones rather than those in the token. API keys and
+// tokens of OAuth clients are reported with their scopes and no roles. The
+// type hint is accepted for RFC 7662 compatibility; every kind of token is
+// recognized by its format, so it does not change the lookup.
+func (a *Auth) Introspect(ctx context.Context, tokenString string, tokenTypeHint string) (*models.TokenInfo, error) {
+	const op = "auth.Introspect"
+
+	if strings.HasPrefix(tokenString, models.APIKeyPrefix) {
+		info, err := a.introspectAPIKey(ctx, tokenString)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		return info, nil
+	}
+
+	claims, err := a.tokens.ParseClaims(tokenString)
+	if err != nil || claims.Id == "" {
+		return &models.TokenInfo{}, nil
+	}
+
+	if claims.Type != token.TypeAccess && claims.Type != token.TypeRefresh {
+		return &models.TokenInfo{}, nil
+	}
+
+	if claims.UserID == 0 && !claims.ForClient() {
+		return &models.TokenInfo{}, nil
+	}
+
+	revoked, err := a.tokenRevoker.IsTokenRevoked(ctx, claims.Id, claims.FamilyID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if revoked {
+		return &models.TokenInfo{Revoked: true}, nil
+	}
+
+	if claims.Type == token.TypeRefresh {
+		current, err := a.sesProvider.CurrentRefreshID(ctx, claims.FamilyID)
+		if err != nil && !errors.Is(err, storage.ErrSessionNotFound) {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		if err != nil || current != claims.Id {
+			return &models.TokenInfo{}, nil
+		}
+	}
+
+	info := &models.TokenInfo{
+		Active:    true,
+		UserID:    claims.UserID,
+		Subject:   strconv.FormatUint(uint64(claims.UserID), 10),
+		TokenType: claims.Type,
+		TokenID:   claims.Id,
+		SessionID: claims.FamilyID,
+		IssuedAt:  time.Unix(claims.IssuedAt, 0),
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+	}
+
+	// Tokens of the client_credentials grant belong to no user.
+	if claims.ForClient() {
+		info.Subject = claims.Subject
+		info.ClientID = claims.ClientID
+		info.Scopes = strings.Fields(claims.Scope)
+		return info, nil
+	}
+
+	roles, err := a.roles.UserRoles(ctx, claims.UserID)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			// The user no longer exists, so the token does not identify anyone.
+			return &models.TokenInfo{}, nil
+		}
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// Third-party apps act within their scopes, not with the user's roles.
+	if claims.ClientID != "" {
+		info.ClientID = claims.ClientID
+		info.Scopes = strings.Fields(claims.Scope)
+		return info, nil
+	}
+
+	for _, role := range roles {
+		info.IsAdmin = info.IsAdmin || role == models.RoleAdmin
+	}
+	info.Roles = roles
+
+	return info, nil
+}
+
+// JWKS returns the public keys tokens are currently verified with.
+func (a *Auth) JWKS(ctx context.Context) (token.JSONWebKeySet, error) {
+	return a.tokens.JWKS(), nil
+}
+
+// startSession issues the first token pair of a new session.
+func (a *Auth) startSession(ctx context.Context, userID uint, client models.ClientInfo) (*token.Pair, error) {
+	roles, err := a.roles.UserRoles(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	pair, err := a.tokens.GetNewTokens(userID, token.NewFamilyID(), roles)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &models.Session{
+		ID:         pair.FamilyID,
+		UserID:     userID,
+		UserAgent:  client.UserAgent,
+		IP:         client.IP,
+		CreatedAt:  now,
+		LastUsedAt: now,
+	}
+
+	if err := a.tokenSaver.SaveTokens(ctx, session, pair); err != nil {
+		return nil, err
+	}
+
+	return pair, nil
+}
+
+func (a *Auth) verifyToken(ctx context.Context, tokenString string, tokenType string) (*token.Claims, error) {
+	claims, err := a.tokens.ParseClaims(tokenString)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if claims.Type != tokenType || claims.Id == "" {
+		return nil, ErrInvalidToken
+	}
+
+	// Tokens without a user must name their client as the subject.
+	if claims.UserID == 0 && !claims.ForClient() {
+		return nil, ErrInvalidToken
+	}
+
+	if err := a.checkRevoked(ctx, claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func (a *Auth) checkRevoked(ctx context.Context, claims *token.Claims) error {
+	const op = "auth.checkRevoked"
+
+	revoked, err := a.tokenRevoker.IsTokenRevoked(ctx, claims.Id, claims.FamilyID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if revoked {
+		return ErrInvalidToken
+	}
+
+	return nil
 }
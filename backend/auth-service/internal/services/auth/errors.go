@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"errors"
+
+	"github.com/Blxssy/social-media/auth-service/internal/storage"
+)
+
+// Domain errors of the service. Callers match them with errors.Is; the gRPC
+// layer maps each of them to a status code. Errors from storage that are not
+// translated into one of these are unexpected failures.
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrInvalidToken       = errors.New("invalid token")
+	ErrTokenReused        = errors.New("refresh token reused")
+	ErrSessionNotFound    = errors.New("session not found")
+	ErrEmailNotVerified   = errors.New("email not verified")
+	ErrUserExists         = errors.New("user already exists")
+	ErrUserNotFound       = errors.New("user not found")
+	ErrRoleNotFound       = errors.New("role not found")
+	ErrMFAAlreadyEnabled  = errors.New("two-factor authentication already enabled")
+	ErrMFANotEnrolled     = errors.New("two-factor authentication not enrolled")
+	ErrInvalidMFACode     = errors.New("invalid two-factor code")
+	ErrTooManyAttempts    = errors.New("too many login attempts")
+	ErrAPIKeyNotFound     = errors.New("api key not found")
+	ErrAPIKeyLimit        = errors.New("too many api keys")
+	ErrScopeNotAllowed    = errors.New("scope not allowed")
+	ErrUnknownProvider    = errors.New("unknown identity provider")
+	ErrIdentityConflict   = errors.New("identity can't be linked to an account automatically")
+	ErrUnverifiedEmail    = errors.New("identity provider has not verified the email")
+	ErrIdentityExists     = errors.New("identity already linked")
+	ErrIdentityNotFound   = errors.New("identity not found")
+	ErrLastSignInMethod   = errors.New("last sign-in method")
+)
+
+// storageError translates the errors of storage that callers can act on into
+// domain errors.
+func storageError(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrUserNotFound):
+		return ErrUserNotFound
+	case errors.Is(err, storage.ErrUserExists):
+		return ErrUserExists
+	case errors.Is(err, storage.ErrRoleNotFound):
+		return ErrRoleNotFound
+	case errors.Is(err, storage.ErrSessionNotFound):
+		return ErrSessionNotFound
+	case errors.Is(err, storage.ErrAPIKeyNotFound):
+		return ErrAPIKeyNotFound
+	case errors.Is(err, storage.ErrIdentityExists):
+		return ErrIdentityExists
+	case errors.Is(err, storage.ErrIdentityNotFound):
+		return ErrIdentityNotFound
+	default:
+		return err
+	}
+}
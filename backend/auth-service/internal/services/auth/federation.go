@@ -0,0 +1,352 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"github.com/Blxssy/social-media/auth-service/internal/storage"
+	"github.com/Blxssy/social-media/auth-service/internal/validation"
+	"github.com/Blxssy/social-media/auth-service/pkg/oidc"
+)
+
+type IdentityStore interface {
+	SaveIdentity(ctx context.Context, identity *models.Identity) error
+	SaveFederatedUser(ctx context.Context, user *models.User, identity *models.Identity) error
+	Identity(ctx context.Context, provider string, subject string) (*models.Identity, error)
+	Identities(ctx context.Context, uid uint) ([]*models.Identity, error)
+	DeleteIdentity(ctx context.Context, uid uint, provider string) error
+}
+
+// IDTokenVerifier verifies the ID tokens of an identity provider, see
+// oidc.Provider.
+type IDTokenVerifier interface {
+	Verify(ctx context.Context, rawIDToken string, nonce string) (*oidc.Claims, error)
+}
+
+// IdentityProviders returns the names of the configured identity providers.
+func (a *Auth) IdentityProviders() []string {
+	names := make([]string, 0, len(a.providers))
+	for name := range a.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// FederatedLogin signs a user in with an ID token of an identity provider,
+// obtained by the client with the nonce it sent to the provider. The user is
+// found by the linked identity; failing that, an account with the same
+// email is linked if both the provider and we verified that email, and
+// otherwise a new account without password is created if the provider
+// verified the email. Accounts whose email is taken but unverified on
+// either side are not linked: their owner has to sign in and link the
+// identity with LinkIdentity. Like Login it returns an MFA ticket instead
+// of tokens for users with two-factor authentication, and ID tokens that
+// don't verify are throttled per client IP as failed logins.
+func (a *Auth) FederatedLogin(ctx context.Context, provider string, idToken string, nonce string, client models.ClientInfo) (string, string, string, error) {
+	const op = "auth.FederatedLogin"
+
+	log := a.log.With(
+		slog.String("op", op),
+		slog.String("provider", provider),
+	)
+
+	attempt, err := a.reserveLoginAttempt(ctx, "", client.IP)
+	if err != nil {
+		var throttled *ThrottledError
+		if errors.As(err, &throttled) {
+			return "", "", "", err
+		}
+		return "", "", "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	claims, err := a.verifyIDToken(ctx, provider, idToken, nonce)
+	if err != nil {
+		a.failLoginAttempt(ctx, attempt)
+		return "", "", "", err
+	}
+	a.releaseLoginAttempt(ctx, attempt)
+
+	user, err := a.federatedUser(ctx, provider, claims)
+	if err != nil {
+		if errors.Is(err, ErrIdentityConflict) {
+			log.Info("identity not linked to existing account", slog.String("subject", claims.Subject))
+			return "", "", "", err
+		}
+		return "", "", "", fmt.Errorf("%s: %w", op, storageError(err))
+	}
+
+	if a.cfg.RequireEmailVerification && !user.EmailVerified {
+		return "", "", "", ErrEmailNotVerified
+	}
+
+	if user.TOTPEnabled {
+		ticket, err := a.startMFA(ctx, user.ID)
+		if err != nil {
+			log.Error("failed to issue mfa ticket")
+			return "", "", "", fmt.Errorf("%s: %w", op, err)
+		}
+
+		return "", "", ticket, nil
+	}
+
+	pair, err := a.startSession(ctx, user.ID, client)
+	if err != nil {
+		log.Error("failed to start session")
+		return "", "", "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return pair.AccessToken, pair.RefreshToken, "", nil
+}
+
+// federatedUser returns the user the identity of claims signs in as,
+// linking or creating one as FederatedLogin describes.
+func (a *Auth) federatedUser(ctx context.Context, provider string, claims *oidc.Claims) (*models.User, error) {
+	identity, err := a.identities.Identity(ctx, provider, claims.Subject)
+	if err == nil {
+		return a.usrProvider.UserByID(ctx, identity.UserID)
+	}
+	if !errors.Is(err, storage.ErrIdentityNotFound) {
+		return nil, err
+	}
+
+	if claims.Email == "" {
+		return nil, fmt.Errorf("%w: the identity provider reported no email", ErrIdentityConflict)
+	}
+
+	// Emails are stored normalized, so the one of the provider has to be
+	// too, or it would miss the account it belongs to.
+	email, err := validation.NormalizeEmail(claims.Email)
+	if err != nil {
+		return nil, fmt.Errorf("%w: the identity provider reported an invalid email: %v", ErrIdentityConflict, err)
+	}
+
+	identity = &models.Identity{
+		Provider: provider,
+		Subject:  claims.Subject,
+		Email:    email,
+	}
+
+	user, err := a.usrProvider.User(ctx, email)
+	switch {
+	case err == nil:
+		if !claims.EmailVerified || !user.EmailVerified {
+			return nil, ErrIdentityConflict
+		}
+
+		identity.UserID = user.ID
+		if err := a.identities.SaveIdentity(ctx, identity); err != nil {
+			return nil, err
+		}
+
+		a.log.Info("identity linked by verified email",
+			slog.Uint64("uid", uint64(user.ID)),
+			slog.String("provider", provider),
+		)
+
+		return user, nil
+
+	case errors.Is(err, storage.ErrUserNotFound):
+		// The account would hold an email nobody proved to own, and its
+		// owner could later not register or be linked with it.
+		if !claims.EmailVerified {
+			return nil, ErrUnverifiedEmail
+		}
+
+		username, err := federatedUsername(claims)
+		if err != nil {
+			return nil, err
+		}
+
+		user = &models.User{
+			Username:      username,
+			Email:         email,
+			EmailVerified: true,
+		}
+		if err := a.identities.SaveFederatedUser(ctx, user, identity); err != nil {
+			return nil, err
+		}
+
+		a.log.Info("user created from identity",
+			slog.Uint64("uid", uint64(user.ID)),
+			slog.String("provider", provider),
+		)
+
+		return user, nil
+
+	default:
+		return nil, err
+	}
+}
+
+// LinkIdentity links the identity an ID token of the provider stands for
+// to the signed in user, so the user can sign in with it.
+func (a *Auth) LinkIdentity(ctx context.Context, userID uint, provider string, idToken string, nonce string) (*models.Identity, error) {
+	const op = "auth.LinkIdentity"
+
+	claims, err := a.verifyIDToken(ctx, provider, idToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := a.identities.Identity(ctx, provider, claims.Subject)
+	if err == nil {
+		if existing.UserID != userID {
+			return nil, ErrIdentityExists
+		}
+		return existing, nil
+	}
+	if !errors.Is(err, storage.ErrIdentityNotFound) {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// The email of an identity is only informative here, so one that doesn't
+	// parse is dropped rather than failing the link.
+	email, err := validation.NormalizeEmail(claims.Email)
+	if err != nil {
+		email = ""
+	}
+
+	identity := &models.Identity{
+		UserID:   userID,
+		Provider: provider,
+		Subject:  claims.Subject,
+		Email:    email,
+	}
+	if err := a.identities.SaveIdentity(ctx, identity); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, storageError(err))
+	}
+
+	a.log.Info("identity linked",
+		slog.String("op", op),
+		slog.Uint64("uid", uint64(userID)),
+		slog.String("provider", provider),
+	)
+
+	return identity, nil
+}
+
+// UnlinkIdentity removes the identity of the provider from the user. The
+// last identity of a user without password can't be removed, or the user
+// could no longer sign in.
+func (a *Auth) UnlinkIdentity(ctx context.Context, userID uint, provider string) error {
+	const op = "auth.UnlinkIdentity"
+
+	user, err := a.usrProvider.UserByID(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, storageError(err))
+	}
+
+	if user.PassHash == "" {
+		identities, err := a.identities.Identities(ctx, userID)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		if len(identities) == 1 && identities[0].Provider == provider {
+			return ErrLastSignInMethod
+		}
+	}
+
+	if err := a.identities.DeleteIdentity(ctx, userID, provider); err != nil {
+		return fmt.Errorf("%s: %w", op, storageError(err))
+	}
+
+	a.log.Info("identity unlinked",
+		slog.String("op", op),
+		slog.Uint64("uid", uint64(userID)),
+		slog.String("provider", provider),
+	)
+
+	return nil
+}
+
+// ListIdentities returns the identities linked to the user.
+func (a *Auth) ListIdentities(ctx context.Context, userID uint) ([]*models.Identity, error) {
+	const op = "auth.ListIdentities"
+
+	identities, err := a.identities.Identities(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return identities, nil
+}
+
+func (a *Auth) verifyIDToken(ctx context.Context, provider string, idToken string, nonce string) (*oidc.Claims, error) {
+	verifier, ok := a.providers[provider]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+
+	claims, err := verifier.Verify(ctx, idToken, nonce)
+	if err != nil {
+		a.log.Info("identity provider token rejected",
+			slog.String("provider", provider),
+			slog.String("error", err.Error()),
+		)
+		return nil, ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+// federatedUsername picks a username for a user created from an identity:
+// the first of the preferred username, the name and the local part of the
+// email that passes validation.CheckUsername, as is or sanitized, or else a
+// generated one. Usernames need not be unique.
+func federatedUsername(claims *oidc.Claims) (string, error) {
+	local, _, _ := strings.Cut(claims.Email, "@")
+
+	for _, candidate := range []string{claims.PreferredUsername, claims.Name, local} {
+		if candidate == "" {
+			continue
+		}
+		if len(validation.CheckUsername(candidate)) == 0 {
+			return candidate, nil
+		}
+		if username := sanitizeUsername(candidate); len(validation.CheckUsername(username)) == 0 {
+			return username, nil
+		}
+	}
+
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return "user_" + hex.EncodeToString(b), nil
+}
+
+// sanitizeUsername turns spaces and dashes into underscores, drops the
+// other characters usernames can't have and trims the result to the length
+// and shape validation.CheckUsername requires.
+func sanitizeUsername(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'):
+			b.WriteRune(r)
+		case r == '.' && !strings.HasSuffix(b.String(), "."):
+			b.WriteRune(r)
+		case unicode.IsSpace(r) || r == '-':
+			b.WriteByte('_')
+		}
+	}
+
+	username := strings.TrimLeft(b.String(), "._")
+	if len(username) > validation.MaxUsernameLength {
+		username = username[:validation.MaxUsernameLength]
+	}
+
+	return strings.TrimRight(username, ".")
+}
@@ -0,0 +1,511 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+
+	"github.com/Blxssy/social-media/auth-service/internal/config"
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"github.com/Blxssy/social-media/auth-service/internal/storage"
+	"github.com/Blxssy/social-media/auth-service/internal/validation"
+	"github.com/Blxssy/social-media/auth-service/pkg/oidc"
+	"github.com/Blxssy/social-media/auth-service/pkg/token"
+)
+
+func TestFederatedUsername(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims oidc.Claims
+		want   string
+	}{
+		{
+			name:   "preferred username",
+			claims: oidc.Claims{PreferredUsername: "alice.w", Name: "Alice W", Email: "aw@example.com"},
+			want:   "alice.w",
+		},
+		{
+			name:   "name sanitized",
+			claims: oidc.Claims{Name: "Alice  Wonder-Land!", Email: "aw@example.com"},
+			want:   "Alice__Wonder_Land",
+		},
+		{
+			name:   "reserved preferred username",
+			claims: oidc.Claims{PreferredUsername: "admin", Email: "alice@example.com"},
+			want:   "alice",
+		},
+		{
+			name:   "email local part",
+			claims: oidc.Claims{Email: "a..lice+tag@example.com"},
+			want:   "a.licetag",
+		},
+		{
+			name:   "too long",
+			claims: oidc.Claims{PreferredUsername: strings.Repeat("a", 40)},
+			want:   strings.Repeat("a", validation.MaxUsernameLength),
+		},
+		{
+			name:   "leading dots and underscores",
+			claims: oidc.Claims{PreferredUsername: "._alice."},
+			want:   "alice",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := federatedUsername(&tt.claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("federatedUsername = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFederatedUsernameGenerated(t *testing.T) {
+	for _, claims := range []oidc.Claims{
+		{},
+		{PreferredUsername: "support", Name: "Root", Email: "admin@example.com"},
+		{Name: "李小龍", Email: "x@example.com"},
+	} {
+		got, err := federatedUsername(&claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(got, "user_") {
+			t.Errorf("federatedUsername(%+v) = %q, want a generated name", claims, got)
+		}
+		if problems := validation.CheckUsername(got); len(problems) > 0 {
+			t.Errorf("generated username %q is invalid: %v", got, problems)
+		}
+	}
+}
+
+const (
+	testProvider = "example"
+	testClientID = "social-media"
+	testKeyID    = "test-key"
+	testNonce    = "n-0S6_WzA2Mj"
+	testSubject  = "248289761001"
+)
+
+// issuer is an identity provider serving its discovery document and JWKS
+// on an httptest server.
+type issuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+}
+
+func newIssuer(t *testing.T) *issuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iss := &issuer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   iss.URL,
+			"jwks_uri": iss.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": testKeyID,
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+
+	iss.Server = httptest.NewServer(mux)
+	t.Cleanup(iss.Close)
+
+	return iss
+}
+
+// idToken returns an ID token of the issuer for the test subject with the
+// given email.
+func (iss *issuer) idToken(t *testing.T, email string, verified bool) string {
+	t.Helper()
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            iss.URL,
+		"sub":            testSubject,
+		"aud":            testClientID,
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          testNonce,
+		"email":          email,
+		"email_verified": verified,
+		"name":           "Alice Wonder",
+	}
+
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	tok.Header["kid"] = testKeyID
+
+	raw, err := tok.SignedString(iss.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return raw
+}
+
+// memoryIdentities keeps users and their identities, failing like storage
+// does for unknown ones. Users have no roles.
+type memoryIdentities struct {
+	RoleStore
+	MFAStore
+
+	users      map[uint]*models.User
+	identities []*models.Identity
+	sessions   int
+	tickets    int
+}
+
+func newMemoryIdentities(users ...*models.User) *memoryIdentities {
+	m := &memoryIdentities{users: map[uint]*models.User{}}
+	for i, user := range users {
+		user.ID = uint(i + 1)
+		m.users[user.ID] = user
+	}
+	return m
+}
+
+func (m *memoryIdentities) User(ctx context.Context, email string) (*models.User, error) {
+	for _, user := range m.users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return nil, storage.ErrUserNotFound
+}
+
+func (m *memoryIdentities) UserByID(ctx context.Context, uid uint) (*models.User, error) {
+	user, ok := m.users[uid]
+	if !ok {
+		return nil, storage.ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (m *memoryIdentities) IsAdmin(ctx context.Context, userID int) (bool, error) {
+	return false, nil
+}
+
+func (m *memoryIdentities) SaveIdentity(ctx context.Context, identity *models.Identity) error {
+	if _, err := m.Identity(ctx, identity.Provider, identity.Subject); err == nil {
+		return storage.ErrIdentityExists
+	}
+	m.identities = append(m.identities, identity)
+	return nil
+}
+
+func (m *memoryIdentities) SaveFederatedUser(ctx context.Context, user *models.User, identity *models.Identity) error {
+	user.ID = uint(len(m.users) + 1)
+	m.users[user.ID] = user
+	identity.UserID = user.ID
+	return m.SaveIdentity(ctx, identity)
+}
+
+func (m *memoryIdentities) Identity(ctx context.Context, provider string, subject string) (*models.Identity, error) {
+	for _, identity := range m.identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			return identity, nil
+		}
+	}
+	return nil, storage.ErrIdentityNotFound
+}
+
+func (m *memoryIdentities) Identities(ctx context.Context, uid uint) ([]*models.Identity, error) {
+	var identities []*models.Identity
+	for _, identity := range m.identities {
+		if identity.UserID == uid {
+			identities = append(identities, identity)
+		}
+	}
+	return identities, nil
+}
+
+func (m *memoryIdentities) DeleteIdentity(ctx context.Context, uid uint, provider string) error {
+	for i, identity := range m.identities {
+		if identity.UserID == uid && identity.Provider == provider {
+			m.identities = append(m.identities[:i], m.identities[i+1:]...)
+			return nil
+		}
+	}
+	return storage.ErrIdentityNotFound
+}
+
+func (m *memoryIdentities) UserRoles(ctx context.Context, uid uint) ([]string, error) {
+	return nil, nil
+}
+
+func (m *memoryIdentities) SaveTokens(ctx context.Context, session *models.Session, pair *token.Pair) error {
+	m.sessions++
+	return nil
+}
+
+func (m *memoryIdentities) SaveMFATicket(ctx context.Context, ticketHash string, uid uint, ttl time.Duration) error {
+	m.tickets++
+	return nil
+}
+
+func newFederatedAuth(t *testing.T, iss *issuer, store *memoryIdentities) *Auth {
+	t.Helper()
+
+	provider, err := oidc.NewProvider(oidc.Config{Issuer: iss.URL, ClientID: testClientID}, iss.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := token.LoadKeyring(t.TempDir(), token.AlgorithmRS256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := token.NewIssuer(keys, token.Options{
+		Issuer:     "https://auth.example.com",
+		Audience:   "social-media",
+		AccessTTL:  15 * time.Minute,
+		RefreshTTL: time.Hour,
+		Leeway:     time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Auth{
+		log:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+		cfg:         config.Auth{MFATicketTTL: 5 * time.Minute},
+		usrProvider: store,
+		tokenSaver:  store,
+		mfaStore:    store,
+		roles:       store,
+		identities:  store,
+		providers:   map[string]IDTokenVerifier{testProvider: provider},
+		tokens:      tokens,
+	}
+}
+
+func TestFederatedLogin(t *testing.T) {
+	const email = "alice@example.com"
+
+	tests := []struct {
+		name string
+		// user is the account already registered, if any.
+		user *models.User
+		// linked links the identity to user up front.
+		linked   bool
+		email    string
+		verified bool
+		wantErr  error
+		// wantUser is the email of the user signed in, wantCreated whether
+		// it was created for the identity.
+		wantUser    string
+		wantCreated bool
+		wantMFA     bool
+	}{
+		{
+			name:     "linked identity",
+			user:     &models.User{Email: email},
+			linked:   true,
+			email:    "someone.else@example.com",
+			wantUser: email,
+		},
+		{
+			name:     "both emails verified",
+			user:     &models.User{Email: email, EmailVerified: true},
+			email:    email,
+			verified: true,
+			wantUser: email,
+		},
+		{
+			name:     "email of the provider normalized",
+			user:     &models.User{Email: email, EmailVerified: true},
+			email:    "Alice@Example.COM",
+			verified: true,
+			wantUser: email,
+		},
+		{
+			name:     "email unverified by the provider",
+			user:     &models.User{Email: email, EmailVerified: true},
+			email:    email,
+			verified: false,
+			wantErr:  ErrIdentityConflict,
+		},
+		{
+			name:     "email unverified by us",
+			user:     &models.User{Email: email},
+			email:    email,
+			verified: true,
+			wantErr:  ErrIdentityConflict,
+		},
+		{
+			name:     "no email",
+			verified: true,
+			wantErr:  ErrIdentityConflict,
+		},
+		{
+			name:        "new user",
+			email:       email,
+			verified:    true,
+			wantUser:    email,
+			wantCreated: true,
+		},
+		{
+			name:     "new user with an unverified email",
+			email:    email,
+			verified: false,
+			wantErr:  ErrUnverifiedEmail,
+		},
+		{
+			name:     "two-factor authentication",
+			user:     &models.User{Email: email, EmailVerified: true, TOTPEnabled: true},
+			email:    email,
+			verified: true,
+			wantUser: email,
+			wantMFA:  true,
+		},
+	}
+
+	iss := newIssuer(t)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var store *memoryIdentities
+			if tt.user != nil {
+				store = newMemoryIdentities(tt.user)
+			} else {
+				store = newMemoryIdentities()
+			}
+			if tt.linked {
+				store.identities = append(store.identities, &models.Identity{UserID: tt.user.ID, Provider: testProvider, Subject: testSubject})
+			}
+
+			a := newFederatedAuth(t, iss, store)
+			linkedBefore := len(store.identities)
+
+			access, refresh, ticket, err := a.FederatedLogin(context.Background(), testProvider, iss.idToken(t, tt.email, tt.verified), testNonce, models.ClientInfo{IP: testIP})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if len(store.identities) != linkedBefore || len(store.users) > 1 {
+					t.Errorf("identities %d and users %d changed by a refused login", len(store.identities), len(store.users))
+				}
+				if store.sessions != 0 || store.tickets != 0 {
+					t.Errorf("signed in after a refused login")
+				}
+				return
+			}
+
+			if tt.wantMFA {
+				if ticket == "" || access != "" || refresh != "" || store.sessions != 0 {
+					t.Errorf("got tokens %t and ticket %q, want only a ticket", access != "", ticket)
+				}
+			} else if access == "" || refresh == "" || ticket != "" || store.sessions != 1 {
+				t.Errorf("got tokens %t and ticket %q, want only tokens", access != "", ticket)
+			}
+
+			identity, err := store.Identity(context.Background(), testProvider, testSubject)
+			if err != nil {
+				t.Fatalf("identity not linked: %v", err)
+			}
+			user := store.users[identity.UserID]
+			if user.Email != tt.wantUser {
+				t.Errorf("signed in as %q, want %q", user.Email, tt.wantUser)
+			}
+
+			if created := tt.user == nil; created != tt.wantCreated {
+				t.Errorf("user created = %v, want %v", created, tt.wantCreated)
+			}
+			if tt.wantCreated && (!user.EmailVerified || user.PassHash != "" || user.Username != "Alice_Wonder") {
+				t.Errorf("created user %+v, want a verified email, no password and a username from the name", user)
+			}
+		})
+	}
+}
+
+func TestFederatedLoginInvalidToken(t *testing.T) {
+	iss := newIssuer(t)
+	store := newMemoryIdentities()
+	a := newFederatedAuth(t, iss, store)
+	ctx := context.Background()
+
+	if _, _, _, err := a.FederatedLogin(ctx, testProvider, iss.idToken(t, testEmail, true), "other-nonce", models.ClientInfo{}); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("wrong nonce: err = %v, want ErrInvalidToken", err)
+	}
+	if _, _, _, err := a.FederatedLogin(ctx, "other", iss.idToken(t, testEmail, true), testNonce, models.ClientInfo{}); !errors.Is(err, ErrUnknownProvider) {
+		t.Errorf("unknown provider: err = %v, want ErrUnknownProvider", err)
+	}
+	if len(store.users) != 0 || len(store.identities) != 0 {
+		t.Errorf("users %d and identities %d created", len(store.users), len(store.identities))
+	}
+}
+
+func TestUnlinkIdentity(t *testing.T) {
+	tests := []struct {
+		name      string
+		passHash  string
+		providers []string
+		unlink    string
+		wantErr   error
+	}{
+		{name: "last identity without password", providers: []string{testProvider}, unlink: testProvider, wantErr: ErrLastSignInMethod},
+		{name: "another identity left", providers: []string{testProvider, "other"}, unlink: testProvider},
+		{name: "password left", passHash: "hash", providers: []string{testProvider}, unlink: testProvider},
+		{name: "not linked", passHash: "hash", providers: []string{"other"}, unlink: testProvider, wantErr: ErrIdentityNotFound},
+	}
+
+	iss := newIssuer(t)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := &models.User{Email: testEmail, EmailVerified: true, PassHash: tt.passHash}
+			store := newMemoryIdentities(user)
+			for _, provider := range tt.providers {
+				store.identities = append(store.identities, &models.Identity{UserID: user.ID, Provider: provider, Subject: testSubject})
+			}
+			a := newFederatedAuth(t, iss, store)
+
+			err := a.UnlinkIdentity(context.Background(), user.ID, tt.unlink)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+
+			identities, _ := store.Identities(context.Background(), user.ID)
+			want := len(tt.providers)
+			if err == nil {
+				want--
+			}
+			if len(identities) != want {
+				t.Errorf("%d identities left, want %d", len(identities), want)
+			}
+		})
+	}
+}
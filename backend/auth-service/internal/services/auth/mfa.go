@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"github.com/Blxssy/social-media/auth-service/internal/storage"
+	"github.com/Blxssy/social-media/auth-service/pkg/totp"
+)
+
+const (
+	recoveryCodeCount = 10
+	recoveryCodeSize  = 10
+
+	// totpSkew accepts codes of the neighbouring time steps to allow for
+	// clock drift on the user's device.
+	totpSkew = 1
+
+	mfaMaxAttempts = 5
+)
+
+type MFAStore interface {
+	SetTOTPSecret(ctx context.Context, uid uint, secret string) error
+	EnableTOTP(ctx context.Context, uid uint, codeHashes []string) error
+	DisableTOTP(ctx context.Context, uid uint) error
+	UseRecoveryCode(ctx context.Context, uid uint, codeHash string) (bool, error)
+	MarkTOTPUsed(ctx context.Context, uid uint, step int64, ttl time.Duration) (bool, error)
+	SaveMFATicket(ctx context.Context, ticketHash string, uid uint, ttl time.Duration) error
+	AttemptMFATicket(ctx context.Context, ticketHash string, maxAttempts int) (uint, bool, error)
+	ConsumeMFATicket(ctx context.Context, ticketHash string) (bool, error)
+}
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// EnrollTOTP generates a new TOTP secret for the user and returns it along
+// with the otpauth:// URI to enroll an authenticator app. Two-factor
+// authentication is enabled once a code is confirmed with ConfirmTOTP.
+func (a *Auth) EnrollTOTP(ctx context.Context, userID uint) (string, string, error) {
+	const op = "auth.EnrollTOTP"
+
+	user, err := a.usrProvider.UserByID(ctx, userID)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %w", op, storageError(err))
+	}
+
+	if user.TOTPEnabled {
+		return "", "", ErrMFAAlreadyEnabled
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := a.mfaStore.SetTOTPSecret(ctx, userID, secret); err != nil {
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return secret, totp.URI(a.cfg.MFAIssuer, user.Email, secret), nil
+}
+
+// ConfirmTOTP enables two-factor authentication once the user proves the
+// authenticator app works, and returns a fresh set of recovery codes. The
+// codes are only ever shown here.
+func (a *Auth) ConfirmTOTP(ctx context.Context, userID uint, code string) ([]string, error) {
+	const op = "auth.ConfirmTOTP"
+
+	user, err := a.usrProvider.UserByID(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, storageError(err))
+	}
+
+	if user.TOTPEnabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	if user.TOTPSecret == "" {
+		return nil, ErrMFANotEnrolled
+	}
+
+	ok, err := a.checkTOTP(ctx, user, code)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := a.mfaStore.EnableTOTP(ctx, userID, hashes); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return codes, nil
+}
+
+// DisableTOTP turns two-factor authentication off. Both the password and a
+// current TOTP or recovery code are required; users without a password, who
+// sign in with an identity provider, only need the code. Wrong passwords and
+// codes count as failed logins of the account.
+func (a *Auth) DisableTOTP(ctx context.Context, userID uint, password string, code string) error {
+	const op = "auth.DisableTOTP"
+
+	user, err := a.usrProvider.UserByID(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, storageError(err))
+	}
+
+	if !user.TOTPEnabled {
+		return ErrMFANotEnrolled
+	}
+
+	if err := a.checkAccount(ctx, user.Email, func() error {
+		if user.PassHash != "" && !a.checkPassword(user, password) {
+			return ErrInvalidCredentials
+		}
+
+		ok, err := a.checkSecondFactor(ctx, user, code)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		if !ok {
+			return ErrInvalidMFACode
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := a.mfaStore.DisableTOTP(ctx, userID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// VerifyMFA completes a login that returned an MFA ticket. The code is either
+// a TOTP code or one of the recovery codes. A ticket is single-use and is
+// dropped after too many wrong codes; each code uses up an attempt before it
+// is checked. Wrong codes also count as failed logins of the account, whose
+// failures are only forgotten once a code is accepted.
+func (a *Auth) VerifyMFA(ctx context.Context, ticket string, code string, client models.ClientInfo) (string, string, error) {
+	const op = "auth.VerifyMFA"
+
+	log := a.log.With(
+		slog.String("op", op),
+	)
+
+	ticketHash := hashToken(ticket)
+
+	uid, last, err := a.mfaStore.AttemptMFATicket(ctx, ticketHash, mfaMaxAttempts)
+	if err != nil {
+		if errors.Is(err, storage.ErrTokenNotFound) {
+			return "", "", ErrInvalidToken
+		}
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	user, err := a.usrProvider.UserByID(ctx, uid)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %w", op, storageError(err))
+	}
+
+	attempt, err := a.reserveLoginAttempt(ctx, user.Email, client.IP)
+	if err != nil {
+		var throttled *ThrottledError
+		if errors.As(err, &throttled) {
+			return "", "", err
+		}
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	ok, err := a.checkSecondFactor(ctx, user, code)
+	if err != nil {
+		a.releaseLoginAttempt(ctx, attempt)
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+	if !ok {
+		a.failLoginAttempt(ctx, attempt)
+		if last {
+			if _, err := a.mfaStore.ConsumeMFATicket(ctx, ticketHash); err != nil {
+				log.Error("failed to drop exhausted ticket")
+			}
+		}
+		return "", "", ErrInvalidMFACode
+	}
+
+	consumed, err := a.mfaStore.ConsumeMFATicket(ctx, ticketHash)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+	if !consumed {
+		a.releaseLoginAttempt(ctx, attempt)
+		return "", "", ErrInvalidToken
+	}
+
+	a.releaseLoginAttempt(ctx, attempt)
+	a.clearLoginFailures(ctx, user.Email)
+
+	pair, err := a.startSession(ctx, user.ID, client)
+	if err != nil {
+		log.Error("failed to start session")
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return pair.AccessToken, pair.RefreshToken, nil
+}
+
+// startMFA issues the ticket a login with two-factor authentication returns
+// instead of tokens.
+func (a *Auth) startMFA(ctx context.Context, userID uint) (string, error) {
+	ticket, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	if err := a.mfaStore.SaveMFATicket(ctx, hashToken(ticket), userID, a.cfg.MFATicketTTL); err != nil {
+		return "", err
+	}
+
+	return ticket, nil
+}
+
+func (a *Auth) checkSecondFactor(ctx context.Context, user *models.User, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if len(code) == totp.Digits {
+		return a.checkTOTP(ctx, user, code)
+	}
+
+	return a.mfaStore.UseRecoveryCode(ctx, user.ID, hashRecoveryCode(code))
+}
+
+// checkTOTP validates a TOTP code and makes sure it was not used before.
+func (a *Auth) checkTOTP(ctx context.Context, user *models.User, code string) (bool, error) {
+	step, ok := totp.Validate(user.TOTPSecret, code, time.Now(), totpSkew)
+	if !ok {
+		return false, nil
+	}
+
+	return a.mfaStore.MarkTOTPUsed(ctx, user.ID, step, time.Duration(2*totpSkew+1)*totp.Period)
+}
+
+// newRecoveryCodes returns recovery codes formatted as xxxxx-xxxxx along
+// with their hashes.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, recoveryCodeSize)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+
+		raw := strings.ToLower(recoveryEncoding.EncodeToString(b))[:recoveryCodeSize]
+		codes = append(codes, raw[:recoveryCodeSize/2]+"-"+raw[recoveryCodeSize/2:])
+		hashes = append(hashes, hashRecoveryCode(raw))
+	}
+
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes a recovery code the way the user may type it:
+// case and separators do not matter.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return hashToken(code)
+}
@@ -0,0 +1,304 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"github.com/Blxssy/social-media/auth-service/internal/storage"
+)
+
+const (
+	staffUID   = 1
+	plainUID   = 2
+	unknownUID = 99
+)
+
+// memoryRoles keeps the default roles and the roles of each user, failing
+// like storage does for unknown users and roles.
+type memoryRoles struct {
+	users map[uint][]string
+}
+
+func newMemoryRoles() *memoryRoles {
+	return &memoryRoles{users: map[uint][]string{
+		staffUID: {models.RoleAdmin, models.RoleSupport},
+		plainUID: {},
+	}}
+}
+
+func (m *memoryRoles) role(name string) (*models.Role, bool) {
+	for i := range models.DefaultRoles {
+		if models.DefaultRoles[i].Name == name {
+			return &models.DefaultRoles[i], true
+		}
+	}
+	return nil, false
+}
+
+func (m *memoryRoles) UserRoles(ctx context.Context, uid uint) ([]string, error) {
+	roles, ok := m.users[uid]
+	if !ok {
+		return nil, storage.ErrUserNotFound
+	}
+	return roles, nil
+}
+
+func (m *memoryRoles) Roles(ctx context.Context) ([]*models.Role, error) {
+	roles := make([]*models.Role, 0, len(models.DefaultRoles))
+	for i := range models.DefaultRoles {
+		roles = append(roles, &models.DefaultRoles[i])
+	}
+	return roles, nil
+}
+
+func (m *memoryRoles) RolesByName(ctx context.Context, names []string) ([]*models.Role, error) {
+	var roles []*models.Role
+	for _, name := range names {
+		if role, ok := m.role(name); ok {
+			roles = append(roles, role)
+		}
+	}
+	return roles, nil
+}
+
+func (m *memoryRoles) AssignRole(ctx context.Context, uid uint, roleName string) error {
+	roles, err := m.UserRoles(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if _, ok := m.role(roleName); !ok {
+		return storage.ErrRoleNotFound
+	}
+	for _, role := range roles {
+		if role == roleName {
+			return nil
+		}
+	}
+	m.users[uid] = append(roles, roleName)
+	return nil
+}
+
+func (m *memoryRoles) RevokeRole(ctx context.Context, uid uint, roleName string) error {
+	roles, err := m.UserRoles(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if _, ok := m.role(roleName); !ok {
+		return storage.ErrRoleNotFound
+	}
+	kept := []string{}
+	for _, role := range roles {
+		if role != roleName {
+			kept = append(kept, role)
+		}
+	}
+	m.users[uid] = kept
+	return nil
+}
+
+func (m *memoryRoles) HasPermission(ctx context.Context, uid uint, permission string) (bool, error) {
+	roles, err := m.UserRoles(ctx, uid)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range roles {
+		role, _ := m.role(name)
+		for _, p := range role.Permissions {
+			if p.Name == permission {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// sessionRevoker records the users whose sessions were all revoked.
+type sessionRevoker struct {
+	TokenRevoker
+	revokedAll []uint
+	err        error
+}
+
+func (r *sessionRevoker) RevokeAllSessions(ctx context.Context, uid uint) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.revokedAll = append(r.revokedAll, uid)
+	return nil
+}
+
+func newRolesAuth() (*Auth, *memoryRoles, *sessionRevoker) {
+	roles := newMemoryRoles()
+	revoker := &sessionRevoker{}
+
+	return &Auth{
+		log:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+		roles:        roles,
+		tokenRevoker: revoker,
+	}, roles, revoker
+}
+
+func TestAssignRole(t *testing.T) {
+	tests := []struct {
+		name    string
+		uid     uint
+		role    string
+		wantErr error
+	}{
+		{name: "assigned", uid: plainUID, role: models.RoleModerator},
+		{name: "already assigned", uid: staffUID, role: models.RoleAdmin},
+		{name: "unknown role", uid: plainUID, role: "owner", wantErr: ErrRoleNotFound},
+		{name: "unknown user", uid: unknownUID, role: models.RoleModerator, wantErr: ErrUserNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _, revoker := newRolesAuth()
+			ctx := context.Background()
+
+			err := a.AssignRole(ctx, tt.uid, tt.role)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			roles, err := a.ListRoles(ctx, tt.uid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !hasRole(roles, tt.role) {
+				t.Errorf("roles = %v, want %s among them", roleNames(roles), tt.role)
+			}
+
+			// Gaining a role waits for the next refresh.
+			if len(revoker.revokedAll) != 0 {
+				t.Errorf("sessions of %v revoked", revoker.revokedAll)
+			}
+		})
+	}
+}
+
+func TestRevokeRole(t *testing.T) {
+	tests := []struct {
+		name    string
+		uid     uint
+		role    string
+		wantErr error
+	}{
+		{name: "admin", uid: staffUID, role: models.RoleAdmin},
+		{name: "not assigned", uid: plainUID, role: models.RoleSupport},
+		{name: "unknown role", uid: staffUID, role: "owner", wantErr: ErrRoleNotFound},
+		{name: "unknown user", uid: unknownUID, role: models.RoleAdmin, wantErr: ErrUserNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _, revoker := newRolesAuth()
+			ctx := context.Background()
+
+			err := a.RevokeRole(ctx, tt.uid, tt.role)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if len(revoker.revokedAll) != 0 {
+					t.Errorf("sessions of %v revoked after a failed revoke", revoker.revokedAll)
+				}
+				return
+			}
+
+			roles, err := a.ListRoles(ctx, tt.uid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hasRole(roles, tt.role) {
+				t.Errorf("roles = %v, still with %s", roleNames(roles), tt.role)
+			}
+
+			// Access tokens still carry the role, so they must not outlive
+			// the revoke.
+			if len(revoker.revokedAll) != 1 || revoker.revokedAll[0] != tt.uid {
+				t.Errorf("sessions revoked for %v, want %d", revoker.revokedAll, tt.uid)
+			}
+		})
+	}
+}
+
+func TestRevokeRoleFailedSessionRevoke(t *testing.T) {
+	a, _, revoker := newRolesAuth()
+	revoker.err = errors.New("redis down")
+
+	// The caller has to retry: the user may still hold tokens with the role.
+	if err := a.RevokeRole(context.Background(), staffUID, models.RoleAdmin); !errors.Is(err, revoker.err) {
+		t.Errorf("err = %v, want %v", err, revoker.err)
+	}
+}
+
+func TestCheckPermission(t *testing.T) {
+	tests := []struct {
+		name       string
+		uid        uint
+		permission string
+		want       bool
+	}{
+		{name: "granted by a role", uid: staffUID, permission: models.PermissionLoginsUnlock, want: true},
+		{name: "granted by admin only", uid: staffUID, permission: models.PermissionRolesManage, want: true},
+		{name: "no roles", uid: plainUID, permission: models.PermissionUsersRead},
+		{name: "unknown permission", uid: staffUID, permission: "users:delete"},
+		{name: "unknown user", uid: unknownUID, permission: models.PermissionUsersRead},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _, _ := newRolesAuth()
+
+			got, err := a.CheckPermission(context.Background(), tt.uid, tt.permission)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("CheckPermission = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckPermissionAfterRevoke(t *testing.T) {
+	a, _, _ := newRolesAuth()
+	ctx := context.Background()
+
+	if err := a.RevokeRole(ctx, staffUID, models.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+
+	// Support still grants logins:unlock; roles:manage came with admin only.
+	if ok, _ := a.CheckPermission(ctx, staffUID, models.PermissionLoginsUnlock); !ok {
+		t.Error("logins:unlock lost with admin")
+	}
+	if ok, _ := a.CheckPermission(ctx, staffUID, models.PermissionRolesManage); ok {
+		t.Error("roles:manage kept after admin was revoked")
+	}
+}
+
+func hasRole(roles []*models.Role, name string) bool {
+	for _, role := range roles {
+		if role.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func roleNames(roles []*models.Role) []string {
+	names := make([]string, 0, len(roles))
+	for _, role := range roles {
+		names = append(names, role.Name)
+	}
+	return names
+}
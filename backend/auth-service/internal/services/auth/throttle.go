@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/Blxssy/social-media/auth-service/internal/config"
+)
+
+// ThrottledError is returned while logins are throttled. RetryAfter tells
+// when the next attempt will be accepted.
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrTooManyAttempts, e.RetryAfter)
+}
+
+func (e *ThrottledError) Unwrap() error {
+	return ErrTooManyAttempts
+}
+
+type LoginThrottler interface {
+	ReserveLoginAttempt(ctx context.Context, key string, cfg config.LoginThrottle, limit config.ThrottleLimit) (string, time.Duration, error)
+	ReleaseLoginAttempt(ctx context.Context, key string, id string) error
+	LoginFailures(ctx context.Context, key string, window time.Duration) (int, error)
+	LockLogin(ctx context.Context, key string, duration time.Duration) error
+	ClearLoginFailures(ctx context.Context, key string) error
+}
+
+type throttleKey struct {
+	key   string
+	limit config.ThrottleLimit
+}
+
+// loginAttempt is an attempt reserved with reserveLoginAttempt. It counts as
+// failed until releaseLoginAttempt says otherwise.
+type loginAttempt struct {
+	reserved []reservedAttempt
+}
+
+type reservedAttempt struct {
+	throttleKey
+	id string
+}
+
+// ClearLoginLockout lifts the lockout and forgets the failed logins of an
+// account, a client IP or both.
+func (a *Auth) ClearLoginLockout(ctx context.Context, email string, ip string) error {
+	const op = "auth.ClearLoginLockout"
+
+	for _, k := range a.throttleKeys(email, ip) {
+		if err := a.throttler.ClearLoginFailures(ctx, k.key); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	return nil
+}
+
+// reserveLoginAttempt returns a ThrottledError while the account or the
+// client IP is locked out or has to wait before the next attempt. Otherwise
+// it counts the attempt as failed until releaseLoginAttempt, so that
+// parallel attempts are throttled as if they had failed one after another.
+func (a *Auth) reserveLoginAttempt(ctx context.Context, email string, ip string) (*loginAttempt, error) {
+	attempt := &loginAttempt{}
+
+	cfg := a.cfg.LoginThrottle
+	if cfg.Window <= 0 {
+		return attempt, nil
+	}
+
+	for _, k := range a.throttleKeys(email, ip) {
+		id, wait, err := a.throttler.ReserveLoginAttempt(ctx, k.key, cfg, k.limit)
+		if err == nil && wait > 0 {
+			err = &ThrottledError{RetryAfter: wait}
+		}
+		if err != nil {
+			a.releaseLoginAttempt(ctx, attempt)
+			return nil, err
+		}
+
+		attempt.reserved = append(attempt.reserved, reservedAttempt{throttleKey: k, id: id})
+	}
+
+	return attempt, nil
+}
+
+// releaseLoginAttempt takes back an attempt that did not fail.
+func (a *Auth) releaseLoginAttempt(ctx context.Context, attempt *loginAttempt) {
+	for _, r := range attempt.reserved {
+		if err := a.throttler.ReleaseLoginAttempt(ctx, r.key, r.id); err != nil {
+			a.log.Error("failed to release login attempt", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// failLoginAttempt leaves the attempt counted as failed and locks the account
+// or the client IP out once they reach their limit.
+func (a *Auth) failLoginAttempt(ctx context.Context, attempt *loginAttempt) {
+	const op = "auth.failLoginAttempt"
+
+	cfg := a.cfg.LoginThrottle
+
+	log := a.log.With(
+		slog.String("op", op),
+	)
+
+	for _, r := range attempt.reserved {
+		if r.limit.MaxAttempts <= 0 {
+			continue
+		}
+
+		failures, err := a.throttler.LoginFailures(ctx, r.key, cfg.Window)
+		if err != nil {
+			log.Error("failed to count login failures", slog.String("error", err.Error()))
+			continue
+		}
+
+		if failures < r.limit.MaxAttempts {
+			continue
+		}
+
+		if err := a.throttler.LockLogin(ctx, r.key, cfg.LockoutDuration); err != nil {
+			log.Error("failed to lock login", slog.String("error", err.Error()))
+			continue
+		}
+
+		log.Warn("security event: too many failed logins, login locked",
+			slog.String("event", "login_lockout"),
+			slog.String("key", r.key),
+			slog.Int("failures", failures),
+		)
+	}
+}
+
+// checkAccount runs check, which verifies the password or second factor of a
+// signed-in user, as a login attempt of the account with email: it is
+// refused while logins of the account are throttled, and failing with
+// ErrInvalidCredentials or ErrInvalidMFACode counts as a failed login.
+// Holding an access token of the user is then no shortcut to guessing them.
+func (a *Auth) checkAccount(ctx context.Context, email string, check func() error) error {
+	const op = "auth.checkAccount"
+
+	attempt, err := a.reserveLoginAttempt(ctx, email, "")
+	if err != nil {
+		var throttled *ThrottledError
+		if errors.As(err, &throttled) {
+			return err
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = check()
+	if errors.Is(err, ErrInvalidCredentials) || errors.Is(err, ErrInvalidMFACode) {
+		a.failLoginAttempt(ctx, attempt)
+		return err
+	}
+	a.releaseLoginAttempt(ctx, attempt)
+
+	return err
+}
+
+// clearLoginFailures forgets the failed logins of an account after it signed
+// in. Failures of the client IP are kept, as they may belong to other accounts.
+func (a *Auth) clearLoginFailures(ctx context.Context, email string) {
+	if a.cfg.LoginThrottle.Window <= 0 {
+		return
+	}
+
+	if err := a.throttler.ClearLoginFailures(ctx, accountThrottleKey(email)); err != nil {
+		a.log.Error("failed to clear login failures", slog.String("error", err.Error()))
+	}
+}
+
+func (a *Auth) throttleKeys(email string, ip string) []throttleKey {
+	var keys []throttleKey
+
+	if email != "" {
+		keys = append(keys, throttleKey{key: accountThrottleKey(email), limit: a.cfg.LoginThrottle.Account})
+	}
+
+	if ip != "" {
+		keys = append(keys, throttleKey{key: "ip:" + ip, limit: a.cfg.LoginThrottle.IP})
+	}
+
+	return keys
+}
+
+func accountThrottleKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
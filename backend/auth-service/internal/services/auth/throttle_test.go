@@ -0,0 +1,235 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Blxssy/social-media/auth-service/internal/config"
+)
+
+const (
+	testEmail  = "alice@example.com"
+	testIP     = "192.0.2.1"
+	accountKey = "email:" + testEmail
+	ipKey      = "ip:" + testIP
+)
+
+// memoryThrottler counts reserved attempts as failures per key, as storage
+// does, without the delays.
+type memoryThrottler struct {
+	failures map[string]map[string]bool
+	locked   map[string]time.Duration
+	// wait is returned by ReserveLoginAttempt for a key.
+	wait map[string]time.Duration
+	next int
+}
+
+func newMemoryThrottler() *memoryThrottler {
+	return &memoryThrottler{
+		failures: map[string]map[string]bool{},
+		locked:   map[string]time.Duration{},
+		wait:     map[string]time.Duration{},
+	}
+}
+
+func (m *memoryThrottler) ReserveLoginAttempt(ctx context.Context, key string, cfg config.LoginThrottle, limit config.ThrottleLimit) (string, time.Duration, error) {
+	if d := m.locked[key]; d > 0 {
+		return "", d, nil
+	}
+	if d := m.wait[key]; d > 0 {
+		return "", d, nil
+	}
+
+	m.next++
+	id := strconv.Itoa(m.next)
+	if m.failures[key] == nil {
+		m.failures[key] = map[string]bool{}
+	}
+	m.failures[key][id] = true
+
+	return id, 0, nil
+}
+
+func (m *memoryThrottler) ReleaseLoginAttempt(ctx context.Context, key string, id string) error {
+	delete(m.failures[key], id)
+	return nil
+}
+
+func (m *memoryThrottler) LoginFailures(ctx context.Context, key string, window time.Duration) (int, error) {
+	return len(m.failures[key]), nil
+}
+
+func (m *memoryThrottler) LockLogin(ctx context.Context, key string, duration time.Duration) error {
+	m.locked[key] = duration
+	return nil
+}
+
+func (m *memoryThrottler) ClearLoginFailures(ctx context.Context, key string) error {
+	delete(m.failures, key)
+	delete(m.locked, key)
+	return nil
+}
+
+func newThrottledAuth(throttler LoginThrottler, cfg config.LoginThrottle) *Auth {
+	return &Auth{
+		log:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		cfg:       config.Auth{LoginThrottle: cfg},
+		throttler: throttler,
+	}
+}
+
+var testThrottle = config.LoginThrottle{
+	Window:          time.Hour,
+	BaseDelay:       time.Second,
+	MaxDelay:        time.Minute,
+	LockoutDuration: 15 * time.Minute,
+	Account:         config.ThrottleLimit{FreeAttempts: 1, MaxAttempts: 3},
+	IP:              config.ThrottleLimit{FreeAttempts: 1, MaxAttempts: 5},
+}
+
+func TestFailLoginAttemptLocksOut(t *testing.T) {
+	throttler := newMemoryThrottler()
+	a := newThrottledAuth(throttler, testThrottle)
+	ctx := context.Background()
+
+	for i := 1; i <= 5; i++ {
+		attempt, err := a.reserveLoginAttempt(ctx, testEmail, testIP)
+		if err != nil {
+			// The account is locked out after 3 failures; keep failing
+			// logins from the IP on other accounts.
+			attempt, err = a.reserveLoginAttempt(ctx, "bob@example.com", testIP)
+			if err != nil {
+				t.Fatalf("attempt %d: %v", i, err)
+			}
+		}
+		a.failLoginAttempt(ctx, attempt)
+
+		if locked := throttler.locked[accountKey] > 0; locked != (i >= 3) {
+			t.Fatalf("after %d failures: account locked = %v", i, locked)
+		}
+		if locked := throttler.locked[ipKey] > 0; locked != (i >= 5) {
+			t.Fatalf("after %d failures: IP locked = %v", i, locked)
+		}
+	}
+
+	if d := throttler.locked[accountKey]; d != testThrottle.LockoutDuration {
+		t.Errorf("account locked for %v, want %v", d, testThrottle.LockoutDuration)
+	}
+
+	_, err := a.reserveLoginAttempt(ctx, testEmail, "")
+	var throttled *ThrottledError
+	if !errors.As(err, &throttled) || throttled.RetryAfter != testThrottle.LockoutDuration {
+		t.Fatalf("reserveLoginAttempt of a locked account: err = %v", err)
+	}
+	if !errors.Is(err, ErrTooManyAttempts) {
+		t.Errorf("ThrottledError does not unwrap to ErrTooManyAttempts")
+	}
+}
+
+func TestFailLoginAttemptWithoutMaxAttempts(t *testing.T) {
+	throttler := newMemoryThrottler()
+	cfg := testThrottle
+	cfg.Account.MaxAttempts = 0
+	a := newThrottledAuth(throttler, cfg)
+	ctx := context.Background()
+
+	for i := 0; i < 10; i++ {
+		attempt, err := a.reserveLoginAttempt(ctx, testEmail, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.failLoginAttempt(ctx, attempt)
+	}
+
+	if _, locked := throttler.locked[accountKey]; locked {
+		t.Fatal("account locked without MaxAttempts")
+	}
+}
+
+func TestReserveLoginAttemptReleasesOnThrottle(t *testing.T) {
+	throttler := newMemoryThrottler()
+	throttler.wait[ipKey] = 2 * time.Second
+	a := newThrottledAuth(throttler, testThrottle)
+
+	_, err := a.reserveLoginAttempt(context.Background(), testEmail, testIP)
+
+	var throttled *ThrottledError
+	if !errors.As(err, &throttled) || throttled.RetryAfter != 2*time.Second {
+		t.Fatalf("reserveLoginAttempt: err = %v, want to retry after 2s", err)
+	}
+
+	// The account attempt reserved before the IP was throttled is released.
+	if n := len(throttler.failures[accountKey]); n != 0 {
+		t.Fatalf("%d account attempts left reserved, want 0", n)
+	}
+}
+
+func TestReserveLoginAttemptDisabled(t *testing.T) {
+	// Without a window the throttler is never called.
+	a := newThrottledAuth(nil, config.LoginThrottle{})
+	ctx := context.Background()
+
+	attempt, err := a.reserveLoginAttempt(ctx, testEmail, testIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.failLoginAttempt(ctx, attempt)
+	a.releaseLoginAttempt(ctx, attempt)
+	a.clearLoginFailures(ctx, testEmail)
+}
+
+func TestCheckAccount(t *testing.T) {
+	errStorage := errors.New("connection refused")
+
+	tests := []struct {
+		name         string
+		checkErr     error
+		wantFailures int
+	}{
+		{"correct password", nil, 0},
+		{"wrong password", ErrInvalidCredentials, 1},
+		{"wrong code", ErrInvalidMFACode, 1},
+		{"other error", errStorage, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			throttler := newMemoryThrottler()
+			a := newThrottledAuth(throttler, testThrottle)
+
+			err := a.checkAccount(context.Background(), testEmail, func() error { return tt.checkErr })
+			if !errors.Is(err, tt.checkErr) || (tt.checkErr == nil && err != nil) {
+				t.Fatalf("checkAccount: err = %v, want %v", err, tt.checkErr)
+			}
+
+			if n := len(throttler.failures[accountKey]); n != tt.wantFailures {
+				t.Fatalf("%d failures, want %d", n, tt.wantFailures)
+			}
+		})
+	}
+}
+
+func TestCheckAccountThrottled(t *testing.T) {
+	throttler := newMemoryThrottler()
+	throttler.locked[accountKey] = time.Minute
+	a := newThrottledAuth(throttler, testThrottle)
+
+	checked := false
+	err := a.checkAccount(context.Background(), testEmail, func() error {
+		checked = true
+		return nil
+	})
+
+	var throttled *ThrottledError
+	if !errors.As(err, &throttled) {
+		t.Fatalf("checkAccount: err = %v, want a ThrottledError", err)
+	}
+	if checked {
+		t.Fatal("check ran while the account was locked out")
+	}
+}
@@ -0,0 +1,224 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"github.com/Blxssy/social-media/auth-service/internal/storage"
+)
+
+const (
+	responseTypeCode = "code"
+	codeSize         = 32
+)
+
+// AuthorizationRequest holds the parameters of an authorization request.
+type AuthorizationRequest struct {
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Nonce               string
+}
+
+// Authorization is a checked authorization request. ExplicitRedirectURI
+// tells whether the request named RedirectURI, which the token request must
+// then repeat.
+type Authorization struct {
+	Client              *models.OAuthClient
+	RedirectURI         string
+	ExplicitRedirectURI bool
+	Scopes              []string
+	State               string
+	CodeChallenge       string
+	Nonce               string
+}
+
+// ValidateAuthorization checks an authorization request. If the client or
+// the redirect URI are invalid, it returns no Authorization: the error must
+// then be shown to the user rather than sent to a redirect URI that can't be
+// trusted. Other errors are returned along with the Authorization and belong
+// to its redirect URI, see ErrorRedirect.
+func (o *OAuth) ValidateAuthorization(ctx context.Context, req AuthorizationRequest) (*Authorization, error) {
+	client, err := o.client(ctx, req.ClientID)
+	if err != nil {
+		return nil, err
+	}
+
+	redirectURI := req.RedirectURI
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+
+	registered := false
+	for _, uri := range client.RedirectURIs {
+		registered = registered || matchRedirectURI(uri, redirectURI)
+	}
+	if !registered {
+		return nil, newError(CodeInvalidRequest, "redirect_uri is not registered for the client")
+	}
+
+	auth := &Authorization{
+		Client:              client,
+		RedirectURI:         redirectURI,
+		ExplicitRedirectURI: req.RedirectURI != "",
+		State:               req.State,
+		CodeChallenge:       req.CodeChallenge,
+		Nonce:               req.Nonce,
+	}
+
+	if req.ResponseType != responseTypeCode {
+		return auth, newError(CodeUnsupportedResponseType, "response_type must be code")
+	}
+
+	if !contains(client.GrantTypes, models.GrantAuthorizationCode) {
+		return auth, newError(CodeUnauthorizedClient, "the client may not use the authorization code grant")
+	}
+
+	if req.CodeChallenge == "" {
+		return auth, newError(CodeInvalidRequest, "code_challenge is required")
+	}
+	if req.CodeChallengeMethod != PKCEMethodS256 {
+		return auth, newError(CodeInvalidRequest, "code_challenge_method must be S256")
+	}
+	if !validPKCEString(req.CodeChallenge) {
+		return auth, newError(CodeInvalidRequest, "invalid code_challenge")
+	}
+
+	auth.Scopes = parseScope(req.Scope)
+	if len(auth.Scopes) == 0 {
+		auth.Scopes = client.Scopes
+	}
+	if !subset(auth.Scopes, client.Scopes) {
+		return auth, newError(CodeInvalidScope, "the client may not request these scopes")
+	}
+
+	if len(req.Nonce) > maxNonceLength {
+		return auth, newError(CodeInvalidRequest, "nonce is too long")
+	}
+
+	return auth, nil
+}
+
+// Consented reports whether the user already granted the client every scope
+// of the authorization, so the web app may skip asking.
+func (o *OAuth) Consented(ctx context.Context, userID uint, auth *Authorization) (bool, error) {
+	const op = "oauth.Consented"
+
+	consent, err := o.consents.Consent(ctx, userID, auth.Client.ClientID)
+	if err != nil {
+		if errors.Is(err, storage.ErrConsentNotFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return subset(auth.Scopes, consent.Scopes), nil
+}
+
+// Authorize records the decision of the user on an authorization request and
+// returns where to redirect the user to: the redirect URI of the client with
+// an authorization code, or with access_denied if the user declined.
+func (o *OAuth) Authorize(ctx context.Context, userID uint, req AuthorizationRequest, approved bool) (string, error) {
+	const op = "oauth.Authorize"
+
+	auth, err := o.ValidateAuthorization(ctx, req)
+	if err != nil {
+		if auth == nil {
+			return "", err
+		}
+		return o.ErrorRedirect(auth, err), nil
+	}
+
+	if !approved {
+		return o.ErrorRedirect(auth, newError(CodeAccessDenied, "the user declined the request")), nil
+	}
+
+	consent := &models.OAuthConsent{
+		UserID:   userID,
+		ClientID: auth.Client.ClientID,
+		Scopes:   auth.Scopes,
+	}
+	existing, err := o.consents.Consent(ctx, userID, auth.Client.ClientID)
+	if err == nil {
+		consent.Scopes = union(existing.Scopes, auth.Scopes)
+	} else if !errors.Is(err, storage.ErrConsentNotFound) {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := o.consents.SaveConsent(ctx, consent); err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	code, err := randomString(codeSize)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = o.codes.SaveAuthorizationCode(ctx, hashSecret(code), &models.AuthorizationCode{
+		ClientID:            auth.Client.ClientID,
+		UserID:              userID,
+		RedirectURI:         auth.RedirectURI,
+		ExplicitRedirectURI: auth.ExplicitRedirectURI,
+		Scope:               formatScope(auth.Scopes),
+		CodeChallenge:       auth.CodeChallenge,
+		CodeChallengeMethod: PKCEMethodS256,
+		Nonce:               auth.Nonce,
+	}, o.cfg.CodeTTL)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	o.log.Info("oauth consent granted",
+		slog.String("op", op),
+		slog.Uint64("user_id", uint64(userID)),
+		slog.String("client_id", auth.Client.ClientID),
+		slog.String("scope", formatScope(auth.Scopes)),
+	)
+
+	return o.redirect(auth, url.Values{"code": {code}}), nil
+}
+
+// ErrorRedirect returns the redirect URI of the authorization with err as
+// the error response (RFC 6749 section 4.1.2.1).
+func (o *OAuth) ErrorRedirect(auth *Authorization, err error) string {
+	params := url.Values{}
+
+	var oauthErr *Error
+	if errors.As(err, &oauthErr) {
+		params.Set("error", oauthErr.Code)
+		params.Set("error_description", oauthErr.Description)
+	} else {
+		params.Set("error", "server_error")
+	}
+
+	return o.redirect(auth, params)
+}
+
+// redirect adds params, the state and the issuer (RFC 9207) to the redirect
+// URI of the authorization.
+func (o *OAuth) redirect(auth *Authorization, params url.Values) string {
+	u, err := url.Parse(auth.RedirectURI)
+	if err != nil {
+		return auth.RedirectURI
+	}
+
+	q := u.Query()
+	for key, values := range params {
+		q[key] = values
+	}
+	if auth.State != "" {
+		q.Set("state", auth.State)
+	}
+	q.Set("iss", o.tokens.Issuer())
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
@@ -0,0 +1,224 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"github.com/Blxssy/social-media/auth-service/internal/storage"
+)
+
+const (
+	clientIDSize     = 16
+	clientSecretSize = 32
+
+	maxClientNameLength = 100
+	maxRedirectURIs     = 10
+)
+
+// Registration is the metadata a developer registers a client with
+// (RFC 7591). Public clients get no secret. GrantTypes default to
+// authorization_code and refresh_token, Scopes to every configured scope.
+type Registration struct {
+	Name         string
+	RedirectURIs []string
+	GrantTypes   []string
+	Scopes       []string
+	Public       bool
+}
+
+// RegisterClient registers a client owned by the user and returns it along
+// with its secret, which is only ever returned here. Public clients get no
+// secret. Users may register up to cfg.MaxClientsPerUser clients.
+func (o *OAuth) RegisterClient(ctx context.Context, ownerID uint, reg Registration) (*models.OAuthClient, string, error) {
+	const op = "oauth.RegisterClient"
+
+	if err := o.checkRegistration(&reg); err != nil {
+		return nil, "", err
+	}
+
+	if limit := o.cfg.MaxClientsPerUser; limit > 0 {
+		n, err := o.clients.CountClients(ctx, ownerID)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %w", op, err)
+		}
+		if n >= limit {
+			return nil, "", newError(CodeInvalidClientMetadata, "too many clients registered")
+		}
+	}
+
+	clientID, err := randomHex(clientIDSize)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	client := &models.OAuthClient{
+		ClientID:     clientID,
+		Name:         reg.Name,
+		OwnerID:      ownerID,
+		RedirectURIs: reg.RedirectURIs,
+		Scopes:       reg.Scopes,
+		GrantTypes:   reg.GrantTypes,
+		Public:       reg.Public,
+	}
+
+	var secret string
+	if !reg.Public {
+		secret, err = randomString(clientSecretSize)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %w", op, err)
+		}
+		client.SecretHash = hashSecret(secret)
+	}
+
+	if err := o.clients.SaveClient(ctx, client); err != nil {
+		return nil, "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	o.log.Info("oauth client registered",
+		slog.String("op", op),
+		slog.Uint64("owner_id", uint64(ownerID)),
+		slog.String("client_id", clientID),
+		slog.Bool("public", reg.Public),
+	)
+
+	return client, secret, nil
+}
+
+func (o *OAuth) checkRegistration(reg *Registration) error {
+	reg.Name = strings.TrimSpace(reg.Name)
+	if reg.Name == "" || len(reg.Name) > maxClientNameLength {
+		return newError(CodeInvalidClientMetadata, fmt.Sprintf("client_name must be 1 to %d characters", maxClientNameLength))
+	}
+
+	if len(reg.GrantTypes) == 0 {
+		reg.GrantTypes = []string{models.GrantAuthorizationCode, models.GrantRefreshToken}
+	}
+	for _, grant := range reg.GrantTypes {
+		switch grant {
+		case models.GrantAuthorizationCode, models.GrantRefreshToken:
+		case models.GrantClientCredentials:
+			if reg.Public {
+				return newError(CodeInvalidClientMetadata, "public clients can't use client_credentials")
+			}
+		default:
+			return newError(CodeInvalidClientMetadata, fmt.Sprintf("unsupported grant type %q", grant))
+		}
+	}
+
+	if contains(reg.GrantTypes, models.GrantAuthorizationCode) && len(reg.RedirectURIs) == 0 {
+		return newError(CodeInvalidRedirectURI, "redirect_uris are required for authorization_code")
+	}
+	if len(reg.RedirectURIs) > maxRedirectURIs {
+		return newError(CodeInvalidRedirectURI, fmt.Sprintf("at most %d redirect_uris are allowed", maxRedirectURIs))
+	}
+	for _, uri := range reg.RedirectURIs {
+		if err := checkRedirectURI(uri); err != nil {
+			return err
+		}
+	}
+
+	if len(reg.Scopes) == 0 {
+		reg.Scopes = o.scopeNames()
+	}
+	if !subset(reg.Scopes, o.scopeNames()) {
+		return newError(CodeInvalidClientMetadata, "unknown scope")
+	}
+
+	return nil
+}
+
+// checkRedirectURI allows https URIs, http URIs of the loopback interface for
+// native apps (RFC 8252) and private-use schemes in reverse domain notation,
+// such as com.example.app:/callback. Fragments are not allowed.
+func checkRedirectURI(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || u.Fragment != "" {
+		return newError(CodeInvalidRedirectURI, fmt.Sprintf("invalid redirect_uri %q", raw))
+	}
+
+	switch {
+	case u.Scheme == "https" && u.Host != "":
+		return nil
+	case u.Scheme == "http" && isLoopback(u.Hostname()):
+		return nil
+	case u.Scheme != "http" && u.Scheme != "https" && strings.Contains(u.Scheme, "."):
+		return nil
+	default:
+		return newError(CodeInvalidRedirectURI, fmt.Sprintf("redirect_uri %q must use https, the loopback interface or a private-use scheme", raw))
+	}
+}
+
+// matchRedirectURI compares a redirect URI with a registered one. The port of
+// loopback URIs may differ, since native apps listen on any free port.
+func matchRedirectURI(registered string, requested string) bool {
+	if registered == requested {
+		return true
+	}
+
+	r, err := url.Parse(registered)
+	if err != nil || r.Scheme != "http" || !isLoopback(r.Hostname()) {
+		return false
+	}
+
+	q, err := url.Parse(requested)
+	if err != nil {
+		return false
+	}
+
+	return q.Scheme == r.Scheme && q.Hostname() == r.Hostname() &&
+		q.Path == r.Path && q.RawQuery == r.RawQuery && q.Fragment == ""
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// client returns a registered client, or invalid_client.
+func (o *OAuth) client(ctx context.Context, clientID string) (*models.OAuthClient, error) {
+	if clientID == "" {
+		return nil, newError(CodeInvalidClient, "missing client_id")
+	}
+
+	client, err := o.clients.Client(ctx, clientID)
+	if err != nil {
+		if errors.Is(err, storage.ErrClientNotFound) {
+			return nil, newError(CodeInvalidClient, "unknown client")
+		}
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// authenticateClient checks the credentials of a client at the token and
+// revocation endpoints. Public clients have no secret to present.
+func (o *OAuth) authenticateClient(ctx context.Context, clientID string, secret string) (*models.OAuthClient, error) {
+	client, err := o.client(ctx, clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	if client.Public {
+		if secret != "" {
+			return nil, newError(CodeInvalidClient, "public clients have no secret")
+		}
+		return client, nil
+	}
+
+	if secret == "" || !secretMatches(secret, client.SecretHash) {
+		return nil, newError(CodeInvalidClient, "invalid client credentials")
+	}
+
+	return client, nil
+}
@@ -0,0 +1,75 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"github.com/Blxssy/social-media/auth-service/internal/storage"
+)
+
+// Consent is a consent of the user along with the client it was given to.
+type Consent struct {
+	Client  *models.OAuthClient
+	Consent *models.OAuthConsent
+}
+
+// Consents returns the clients the user granted access to.
+func (o *OAuth) Consents(ctx context.Context, userID uint) ([]Consent, error) {
+	const op = "oauth.Consents"
+
+	consents, err := o.consents.Consents(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	out := make([]Consent, 0, len(consents))
+	for _, consent := range consents {
+		client, err := o.clients.Client(ctx, consent.ClientID)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		out = append(out, Consent{Client: client, Consent: consent})
+	}
+
+	return out, nil
+}
+
+// RevokeConsent withdraws the access the user granted to the client and ends
+// every session of the client for the user.
+func (o *OAuth) RevokeConsent(ctx context.Context, userID uint, clientID string) error {
+	const op = "oauth.RevokeConsent"
+
+	if err := o.consents.DeleteConsent(ctx, userID, clientID); err != nil {
+		if errors.Is(err, storage.ErrConsentNotFound) {
+			return ErrConsentNotFound
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	sessions, err := o.sessions.Sessions(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	for _, session := range sessions {
+		if session.ClientID != clientID {
+			continue
+		}
+
+		err := o.sessions.RevokeSession(ctx, userID, session.ID)
+		if err != nil && !errors.Is(err, storage.ErrSessionNotFound) {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	o.log.Info("oauth consent revoked",
+		slog.String("op", op),
+		slog.Uint64("user_id", uint64(userID)),
+		slog.String("client_id", clientID),
+	)
+
+	return nil
+}
@@ -0,0 +1,36 @@
+package oauth
+
+import "errors"
+
+// Error codes of RFC 6749 and RFC 7591 the provider returns.
+const (
+	CodeInvalidRequest          = "invalid_request"
+	CodeInvalidClient           = "invalid_client"
+	CodeInvalidGrant            = "invalid_grant"
+	CodeUnauthorizedClient      = "unauthorized_client"
+	CodeUnsupportedGrantType    = "unsupported_grant_type"
+	CodeUnsupportedResponseType = "unsupported_response_type"
+	CodeInvalidScope            = "invalid_scope"
+	CodeAccessDenied            = "access_denied"
+	CodeInvalidRedirectURI      = "invalid_redirect_uri"
+	CodeInvalidClientMetadata   = "invalid_client_metadata"
+)
+
+// ErrConsentNotFound is returned when withdrawing a consent the user never
+// gave.
+var ErrConsentNotFound = errors.New("consent not found")
+
+// Error is an OAuth error response: Code is one of the codes above and
+// Description explains it to the developer of the client.
+type Error struct {
+	Code        string
+	Description string
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+func newError(code string, description string) *Error {
+	return &Error{Code: code, Description: description}
+}
@@ -0,0 +1,106 @@
+// Package oauth is the OAuth 2.1 provider of the auth-service. Third-party
+// apps registered by developers obtain tokens for a user with the
+// authorization code grant and PKCE, after the user consents in the web app,
+// or for themselves with the client_credentials grant. Their tokens carry
+// the granted scopes instead of the user's roles.
+//
+// On top of it sits OpenID Connect: authorizations with the openid scope
+// also yield an ID token, and the userinfo endpoint describes the user.
+package oauth
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/Blxssy/social-media/auth-service/internal/config"
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"github.com/Blxssy/social-media/auth-service/pkg/token"
+)
+
+type ClientStore interface {
+	SaveClient(ctx context.Context, client *models.OAuthClient) error
+	Client(ctx context.Context, clientID string) (*models.OAuthClient, error)
+	CountClients(ctx context.Context, ownerID uint) (int, error)
+}
+
+type ConsentStore interface {
+	Consent(ctx context.Context, uid uint, clientID string) (*models.OAuthConsent, error)
+	SaveConsent(ctx context.Context, consent *models.OAuthConsent) error
+	Consents(ctx context.Context, uid uint) ([]*models.OAuthConsent, error)
+	DeleteConsent(ctx context.Context, uid uint, clientID string) error
+}
+
+type CodeStore interface {
+	SaveAuthorizationCode(ctx context.Context, codeHash string, code *models.AuthorizationCode, ttl time.Duration) error
+	ConsumeAuthorizationCode(ctx context.Context, codeHash string, familyID string) (*models.AuthorizationCode, error)
+	ConsumedAuthorizationCode(ctx context.Context, codeHash string) (*models.ConsumedAuthorizationCode, error)
+}
+
+// SessionStore keeps the refresh token families of clients, as it does for
+// first-party sessions.
+type SessionStore interface {
+	SaveTokens(ctx context.Context, session *models.Session, pair *token.Pair) error
+	RotateRefreshToken(ctx context.Context, uid uint, sessionID string, oldID string, newID string, ip string) error
+	Sessions(ctx context.Context, uid uint) ([]*models.Session, error)
+	RevokeToken(ctx context.Context, tokenID string, ttl time.Duration) error
+	RevokeSession(ctx context.Context, uid uint, sessionID string) error
+	IsTokenRevoked(ctx context.Context, tokenID string, sessionID string) (bool, error)
+}
+
+type OAuth struct {
+	log      *slog.Logger
+	cfg      config.OAuth
+	clients  ClientStore
+	consents ConsentStore
+	codes    CodeStore
+	sessions SessionStore
+	users    UserStore
+	tokens   *token.Issuer
+}
+
+// Store is all the storage OAuth needs; New hands each part of it to the
+// code that uses it.
+type Store interface {
+	ClientStore
+	ConsentStore
+	CodeStore
+	SessionStore
+	UserStore
+}
+
+func New(log *slog.Logger, cfg config.OAuth, store Store, tokens *token.Issuer) *OAuth {
+	return &OAuth{
+		log:      log,
+		cfg:      cfg,
+		clients:  store,
+		consents: store,
+		codes:    store,
+		sessions: store,
+		users:    store,
+		tokens:   tokens,
+	}
+}
+
+// Scopes returns the configured scopes with their descriptions, in the
+// order of names. Unknown names are skipped.
+func (o *OAuth) Scopes(names []string) []config.OAuthScope {
+	scopes := make([]config.OAuthScope, 0, len(names))
+	for _, name := range names {
+		for _, scope := range o.cfg.Scopes {
+			if scope.Name == name {
+				scopes = append(scopes, scope)
+				break
+			}
+		}
+	}
+	return scopes
+}
+
+func (o *OAuth) scopeNames() []string {
+	names := make([]string, 0, len(o.cfg.Scopes))
+	for _, scope := range o.cfg.Scopes {
+		names = append(names, scope.Name)
+	}
+	return names
+}
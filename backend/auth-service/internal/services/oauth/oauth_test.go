@@ -0,0 +1,351 @@
+package oauth_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log/slog"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Blxssy/social-media/auth-service/internal/config"
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"github.com/Blxssy/social-media/auth-service/internal/services/oauth"
+	"github.com/Blxssy/social-media/auth-service/internal/services/oauth/oauthtest"
+	"github.com/Blxssy/social-media/auth-service/pkg/token"
+)
+
+const (
+	redirectURI  = "https://client.example.com/callback"
+	codeVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+// provider is the OAuth service with a confidential client registered by
+// its user.
+type provider struct {
+	*oauth.OAuth
+	tokens   *token.Issuer
+	store    *oauthtest.MemoryStore
+	user     *models.User
+	clientID string
+	secret   string
+}
+
+func newProvider(t *testing.T) *provider {
+	t.Helper()
+
+	keys, err := token.LoadKeyring(t.TempDir(), token.AlgorithmRS256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := token.NewIssuer(keys, token.Options{
+		Issuer:     "https://auth.example.com",
+		Audience:   "social-media",
+		AccessTTL:  15 * time.Minute,
+		RefreshTTL: time.Hour,
+		Leeway:     time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &models.User{Username: "alice", Email: "alice@example.com", EmailVerified: true}
+	user.ID = 42
+
+	store := oauthtest.NewMemoryStore(user)
+	cfg := config.OAuth{
+		ConsentURL: "https://app.example.com/oauth/consent",
+		CodeTTL:    time.Minute,
+		Scopes: []config.OAuthScope{
+			{Name: "posts:read", Description: "Read your posts"},
+		},
+	}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	o := oauth.New(log, cfg, store, tokens)
+
+	client, secret, err := o.RegisterClient(context.Background(), user.ID, oauth.Registration{
+		Name:         "Test app",
+		RedirectURIs: []string{redirectURI},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &provider{
+		OAuth:    o,
+		tokens:   tokens,
+		store:    store,
+		user:     user,
+		clientID: client.ClientID,
+		secret:   secret,
+	}
+}
+
+// authorize approves an authorization request of the client for the user
+// and returns the code the client is redirected back with.
+func (p *provider) authorize(t *testing.T) string {
+	t.Helper()
+
+	sum := sha256.Sum256([]byte(codeVerifier))
+	redirect, err := p.Authorize(context.Background(), p.user.ID, oauth.AuthorizationRequest{
+		ResponseType:        "code",
+		ClientID:            p.clientID,
+		RedirectURI:         redirectURI,
+		Scope:               "posts:read",
+		State:               "af0ifjsldkj",
+		CodeChallenge:       base64.RawURLEncoding.EncodeToString(sum[:]),
+		CodeChallengeMethod: oauth.PKCEMethodS256,
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(redirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(redirect, redirectURI+"?") || u.Query().Get("state") != "af0ifjsldkj" {
+		t.Fatalf("unexpected redirect %s", redirect)
+	}
+
+	code := u.Query().Get("code")
+	if code == "" {
+		t.Fatalf("no code in redirect %s", redirect)
+	}
+
+	return code
+}
+
+func (p *provider) exchange(code string, verifier string) (*oauth.TokenResponse, error) {
+	return p.Token(context.Background(), oauth.TokenRequest{
+		GrantType:    models.GrantAuthorizationCode,
+		ClientID:     p.clientID,
+		ClientSecret: p.secret,
+		Code:         code,
+		RedirectURI:  redirectURI,
+		CodeVerifier: verifier,
+	})
+}
+
+func (p *provider) refresh(refreshToken string) (*oauth.TokenResponse, error) {
+	return p.Token(context.Background(), oauth.TokenRequest{
+		GrantType:    models.GrantRefreshToken,
+		ClientID:     p.clientID,
+		ClientSecret: p.secret,
+		RefreshToken: refreshToken,
+	})
+}
+
+func wantOAuthError(t *testing.T, err error, code string) {
+	t.Helper()
+
+	var oauthErr *oauth.Error
+	if !errors.As(err, &oauthErr) || oauthErr.Code != code {
+		t.Fatalf("err = %v, want %s", err, code)
+	}
+}
+
+func TestAuthorizationCode(t *testing.T) {
+	p := newProvider(t)
+
+	resp, err := p.exchange(p.authorize(t), codeVerifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.AccessToken == "" || resp.RefreshToken == "" || resp.Scope != "posts:read" {
+		t.Fatalf("unexpected token response %+v", resp)
+	}
+
+	claims, err := p.tokens.ParseClaims(resp.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserID != p.user.ID || claims.ClientID != p.clientID || claims.Scope != "posts:read" {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+	if !p.store.HasSession(claims.FamilyID) {
+		t.Errorf("no session started for the client")
+	}
+
+	consented, err := p.Consents(context.Background(), p.user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(consented) != 1 || consented[0].Client.ClientID != p.clientID {
+		t.Errorf("consents = %+v, want one for the client", consented)
+	}
+
+	if _, err := p.refresh(resp.RefreshToken); err != nil {
+		t.Errorf("refresh: %v", err)
+	}
+}
+
+func TestAuthorizationCodePKCE(t *testing.T) {
+	tests := []struct {
+		name     string
+		verifier string
+		want     string
+	}{
+		{name: "missing verifier", verifier: "", want: oauth.CodeInvalidRequest},
+		{name: "another verifier", verifier: strings.Repeat("a", 43), want: oauth.CodeInvalidGrant},
+		{name: "verifier too short", verifier: "short", want: oauth.CodeInvalidGrant},
+		{name: "the challenge itself", verifier: func() string {
+			sum := sha256.Sum256([]byte(codeVerifier))
+			return base64.RawURLEncoding.EncodeToString(sum[:])
+		}(), want: oauth.CodeInvalidGrant},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newProvider(t)
+
+			_, err := p.exchange(p.authorize(t), tt.verifier)
+			wantOAuthError(t, err, tt.want)
+		})
+	}
+}
+
+func TestAuthorizationCodeReplay(t *testing.T) {
+	p := newProvider(t)
+	code := p.authorize(t)
+
+	resp, err := p.exchange(code, codeVerifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := p.tokens.ParseClaims(resp.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = p.exchange(code, codeVerifier)
+	wantOAuthError(t, err, oauth.CodeInvalidGrant)
+
+	// The code was most likely stolen: the session it started is over.
+	if p.store.HasSession(claims.FamilyID) {
+		t.Errorf("the session of the replayed code was not revoked")
+	}
+	_, err = p.refresh(resp.RefreshToken)
+	wantOAuthError(t, err, oauth.CodeInvalidGrant)
+}
+
+func TestClientAuthentication(t *testing.T) {
+	p := newProvider(t)
+
+	tests := []struct {
+		name     string
+		clientID string
+		secret   string
+	}{
+		{name: "wrong secret", clientID: p.clientID, secret: "wrong"},
+		{name: "no secret", clientID: p.clientID},
+		{name: "unknown client", clientID: "unknown", secret: p.secret},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := p.Token(context.Background(), oauth.TokenRequest{
+				GrantType:    models.GrantAuthorizationCode,
+				ClientID:     tt.clientID,
+				ClientSecret: tt.secret,
+				Code:         "code",
+				CodeVerifier: codeVerifier,
+			})
+			wantOAuthError(t, err, oauth.CodeInvalidClient)
+
+			err = p.Revoke(context.Background(), tt.clientID, tt.secret, "token")
+			wantOAuthError(t, err, oauth.CodeInvalidClient)
+		})
+	}
+}
+
+func TestRevokeRefreshToken(t *testing.T) {
+	p := newProvider(t)
+
+	resp, err := p.exchange(p.authorize(t), codeVerifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Revoke(context.Background(), p.clientID, p.secret, resp.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = p.refresh(resp.RefreshToken)
+	wantOAuthError(t, err, oauth.CodeInvalidGrant)
+
+	// Revoking again is not an error (RFC 7009 section 2.2).
+	if err := p.Revoke(context.Background(), p.clientID, p.secret, resp.RefreshToken); err != nil {
+		t.Errorf("revoke again: %v", err)
+	}
+}
+
+func TestRevokeAccessToken(t *testing.T) {
+	p := newProvider(t)
+
+	resp, err := p.exchange(p.authorize(t), codeVerifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := p.tokens.ParseClaims(resp.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Revoke(context.Background(), p.clientID, p.secret, resp.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+
+	revoked, err := p.store.IsTokenRevoked(context.Background(), claims.Id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !revoked {
+		t.Errorf("the access token was not revoked")
+	}
+	if !p.store.HasSession(claims.FamilyID) {
+		t.Errorf("revoking the access token ended its session")
+	}
+}
+
+func TestRevokeIgnoresOtherTokens(t *testing.T) {
+	p := newProvider(t)
+
+	resp, err := p.exchange(p.authorize(t), codeVerifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := p.tokens.ParseClaims(resp.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, otherSecret, err := p.RegisterClient(context.Background(), p.user.ID, oauth.Registration{
+		Name:         "Other app",
+		RedirectURIs: []string{redirectURI},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens of another client and invalid tokens are ignored without an
+	// error, as RFC 7009 asks.
+	for _, tok := range []string{resp.RefreshToken, "not-a-token"} {
+		if err := p.Revoke(context.Background(), other.ClientID, otherSecret, tok); err != nil {
+			t.Errorf("revoke: %v", err)
+		}
+	}
+
+	if !p.store.HasSession(claims.FamilyID) {
+		t.Errorf("another client revoked the session")
+	}
+	if _, err := p.refresh(resp.RefreshToken); err != nil {
+		t.Errorf("refresh: %v", err)
+	}
+}
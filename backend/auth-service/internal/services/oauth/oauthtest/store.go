@@ -0,0 +1,236 @@
+// Package oauthtest provides an in-memory store for tests of the OAuth
+// service and its HTTP endpoints.
+package oauthtest
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"github.com/Blxssy/social-media/auth-service/internal/storage"
+	"github.com/Blxssy/social-media/auth-service/pkg/token"
+)
+
+// MemoryStore keeps what the OAuth service stores in Postgres and Redis,
+// for a single user. It implements every store oauth.New takes.
+type MemoryStore struct {
+	mu       sync.Mutex
+	user     *models.User
+	clients  map[string]*models.OAuthClient
+	consents map[string]*models.OAuthConsent
+	codes    map[string]*models.AuthorizationCode
+	consumed map[string]*models.ConsumedAuthorizationCode
+	sessions map[string]*models.Session
+	refresh  map[string]string
+	revoked  map[string]bool
+}
+
+func NewMemoryStore(user *models.User) *MemoryStore {
+	return &MemoryStore{
+		user:     user,
+		clients:  make(map[string]*models.OAuthClient),
+		consents: make(map[string]*models.OAuthConsent),
+		codes:    make(map[string]*models.AuthorizationCode),
+		consumed: make(map[string]*models.ConsumedAuthorizationCode),
+		sessions: make(map[string]*models.Session),
+		refresh:  make(map[string]string),
+		revoked:  make(map[string]bool),
+	}
+}
+
+// HasSession reports whether the session exists and was not revoked.
+func (m *MemoryStore) HasSession(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.sessions[id]
+	return ok
+}
+
+func (m *MemoryStore) UserByID(ctx context.Context, uid uint) (*models.User, error) {
+	if uid != m.user.ID {
+		return nil, storage.ErrUserNotFound
+	}
+	return m.user, nil
+}
+
+func (m *MemoryStore) SaveClient(ctx context.Context, client *models.OAuthClient) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	client.CreatedAt = time.Now()
+	m.clients[client.ClientID] = client
+	return nil
+}
+
+func (m *MemoryStore) Client(ctx context.Context, clientID string) (*models.OAuthClient, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	client, ok := m.clients[clientID]
+	if !ok {
+		return nil, storage.ErrClientNotFound
+	}
+	return client, nil
+}
+
+func (m *MemoryStore) CountClients(ctx context.Context, ownerID uint) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for _, client := range m.clients {
+		if client.OwnerID == ownerID {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func consentKey(uid uint, clientID string) string {
+	return strconv.FormatUint(uint64(uid), 10) + ":" + clientID
+}
+
+func (m *MemoryStore) Consent(ctx context.Context, uid uint, clientID string) (*models.OAuthConsent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	consent, ok := m.consents[consentKey(uid, clientID)]
+	if !ok {
+		return nil, storage.ErrConsentNotFound
+	}
+	return consent, nil
+}
+
+func (m *MemoryStore) SaveConsent(ctx context.Context, consent *models.OAuthConsent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.consents[consentKey(consent.UserID, consent.ClientID)] = consent
+	return nil
+}
+
+func (m *MemoryStore) Consents(ctx context.Context, uid uint) ([]*models.OAuthConsent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var consents []*models.OAuthConsent
+	for _, consent := range m.consents {
+		if consent.UserID == uid {
+			consents = append(consents, consent)
+		}
+	}
+	return consents, nil
+}
+
+func (m *MemoryStore) DeleteConsent(ctx context.Context, uid uint, clientID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.consents[consentKey(uid, clientID)]; !ok {
+		return storage.ErrConsentNotFound
+	}
+	delete(m.consents, consentKey(uid, clientID))
+	return nil
+}
+
+func (m *MemoryStore) SaveAuthorizationCode(ctx context.Context, codeHash string, code *models.AuthorizationCode, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.codes[codeHash] = code
+	return nil
+}
+
+func (m *MemoryStore) ConsumeAuthorizationCode(ctx context.Context, codeHash string, familyID string) (*models.AuthorizationCode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	code, ok := m.codes[codeHash]
+	if !ok {
+		return nil, storage.ErrTokenNotFound
+	}
+	delete(m.codes, codeHash)
+	m.consumed[codeHash] = &models.ConsumedAuthorizationCode{AuthorizationCode: *code, FamilyID: familyID}
+	return code, nil
+}
+
+func (m *MemoryStore) ConsumedAuthorizationCode(ctx context.Context, codeHash string) (*models.ConsumedAuthorizationCode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	consumed, ok := m.consumed[codeHash]
+	if !ok {
+		return nil, storage.ErrTokenNotFound
+	}
+	return consumed, nil
+}
+
+func (m *MemoryStore) SaveTokens(ctx context.Context, session *models.Session, pair *token.Pair) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions[session.ID] = session
+	m.refresh[session.ID] = pair.RefreshID
+	return nil
+}
+
+func (m *MemoryStore) RotateRefreshToken(ctx context.Context, uid uint, sessionID string, oldID string, newID string, ip string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, ok := m.refresh[sessionID]
+	if !ok {
+		return storage.ErrTokenNotFound
+	}
+	if current != oldID {
+		delete(m.sessions, sessionID)
+		delete(m.refresh, sessionID)
+		return storage.ErrTokenReused
+	}
+	m.refresh[sessionID] = newID
+	return nil
+}
+
+func (m *MemoryStore) Sessions(ctx context.Context, uid uint) ([]*models.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var sessions []*models.Session
+	for _, session := range m.sessions {
+		if session.UserID == uid {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (m *MemoryStore) RevokeToken(ctx context.Context, tokenID string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.revoked[tokenID] = true
+	return nil
+}
+
+func (m *MemoryStore) RevokeSession(ctx context.Context, uid uint, sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.sessions[sessionID]; !ok {
+		return storage.ErrSessionNotFound
+	}
+	delete(m.sessions, sessionID)
+	delete(m.refresh, sessionID)
+	m.revoked[sessionID] = true
+	return nil
+}
+
+func (m *MemoryStore) IsTokenRevoked(ctx context.Context, tokenID string, sessionID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.revoked[tokenID] || m.revoked[sessionID], nil
+}
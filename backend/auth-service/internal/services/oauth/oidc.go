@@ -0,0 +1,117 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"github.com/Blxssy/social-media/auth-service/internal/storage"
+	"github.com/Blxssy/social-media/auth-service/pkg/token"
+)
+
+// OpenID Connect scopes. openid makes an authorization an OpenID Connect
+// one, issuing an ID token; profile and email select the claims released
+// about the user.
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+
+	maxNonceLength = 255
+)
+
+var (
+	// ErrInsufficientScope is returned by UserInfo for tokens of clients
+	// that were not granted the openid scope.
+	ErrInsufficientScope = errors.New("insufficient scope")
+	ErrUserNotFound      = errors.New("user not found")
+)
+
+type UserStore interface {
+	UserByID(ctx context.Context, uid uint) (*models.User, error)
+}
+
+// UserInfo are the claims about a user returned from the userinfo endpoint.
+type UserInfo struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email,omitempty"`
+	EmailVerified     *bool  `json:"email_verified,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+}
+
+// UserInfo returns the claims about userID the scopes of an access token
+// allow. Tokens of OAuth clients need the openid scope; first-party tokens,
+// which have no clientID, get every claim.
+func (o *OAuth) UserInfo(ctx context.Context, userID uint, clientID string, scopes []string) (*UserInfo, error) {
+	const op = "oauth.UserInfo"
+
+	if clientID == "" {
+		scopes = []string{ScopeOpenID, ScopeProfile, ScopeEmail}
+	}
+	if !contains(scopes, ScopeOpenID) {
+		return nil, ErrInsufficientScope
+	}
+
+	user, err := o.users.UserByID(ctx, userID)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	claims := userClaims(user, scopes)
+
+	return &UserInfo{
+		Subject:           strconv.FormatUint(uint64(user.ID), 10),
+		Email:             claims.Email,
+		EmailVerified:     claims.EmailVerified,
+		PreferredUsername: claims.PreferredUsername,
+	}, nil
+}
+
+// idToken issues the ID token of an OpenID Connect grant, or returns an
+// empty string if openid is not in scope.
+func (o *OAuth) idToken(ctx context.Context, userID uint, clientID string, scope string, nonce string) (string, error) {
+	scopes := parseScope(scope)
+	if userID == 0 || !contains(scopes, ScopeOpenID) {
+		return "", nil
+	}
+
+	user, err := o.users.UserByID(ctx, userID)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return "", newError(CodeInvalidGrant, "the user no longer exists")
+		}
+		return "", err
+	}
+
+	claims := userClaims(user, scopes)
+	claims.Nonce = nonce
+
+	return o.tokens.NewIDToken(userID, clientID, claims)
+}
+
+// userClaims are the claims about user released for scopes.
+func userClaims(user *models.User, scopes []string) *token.IDClaims {
+	claims := &token.IDClaims{}
+
+	if contains(scopes, ScopeProfile) {
+		claims.PreferredUsername = user.Username
+	}
+
+	if contains(scopes, ScopeEmail) {
+		verified := user.EmailVerified
+		claims.Email = user.Email
+		claims.EmailVerified = &verified
+	}
+
+	return claims
+}
+
+// SigningAlgorithm is the algorithm ID tokens are signed with.
+func (o *OAuth) SigningAlgorithm() string {
+	return o.tokens.SigningAlgorithm()
+}
@@ -0,0 +1,42 @@
+package oauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+)
+
+// PKCE (RFC 7636) is required for every authorization code. Only the S256
+// method is accepted, as OAuth 2.1 recommends.
+const (
+	PKCEMethodS256 = "S256"
+
+	pkceMinLength = 43
+	pkceMaxLength = 128
+)
+
+// validPKCEString reports whether s is a valid code verifier. Challenges of
+// the S256 method, 43 base64url characters, are valid ones too.
+func validPKCEString(s string) bool {
+	if len(s) < pkceMinLength || len(s) > pkceMaxLength {
+		return false
+	}
+
+	for _, c := range s {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case c == '-', c == '.', c == '_', c == '~':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func verifyPKCE(verifier string, challenge string) bool {
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
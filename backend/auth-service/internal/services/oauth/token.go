@@ -0,0 +1,313 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"github.com/Blxssy/social-media/auth-service/internal/storage"
+	"github.com/Blxssy/social-media/auth-service/pkg/token"
+)
+
+// TokenRequest holds the parameters of a token request. Only those of the
+// grant type are used.
+type TokenRequest struct {
+	GrantType    string
+	ClientID     string
+	ClientSecret string
+	Code         string
+	RedirectURI  string
+	CodeVerifier string
+	RefreshToken string
+	Scope        string
+	Client       models.ClientInfo
+}
+
+// TokenResponse is a successful token response (RFC 6749 section 5.1).
+type TokenResponse struct {
+	AccessToken  string
+	TokenType    string
+	ExpiresIn    time.Duration
+	RefreshToken string
+	Scope        string
+	IDToken      string
+}
+
+// Token authenticates the client and runs the grant of the request.
+func (o *OAuth) Token(ctx context.Context, req TokenRequest) (*TokenResponse, error) {
+	const op = "oauth.Token"
+
+	client, err := o.authenticateClient(ctx, req.ClientID, req.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	switch req.GrantType {
+	case models.GrantAuthorizationCode, models.GrantRefreshToken, models.GrantClientCredentials:
+	case "":
+		return nil, newError(CodeInvalidRequest, "missing grant_type")
+	default:
+		return nil, newError(CodeUnsupportedGrantType, fmt.Sprintf("unsupported grant_type %q", req.GrantType))
+	}
+
+	if !contains(client.GrantTypes, req.GrantType) {
+		return nil, newError(CodeUnauthorizedClient, fmt.Sprintf("the client may not use the %s grant", req.GrantType))
+	}
+
+	var resp *TokenResponse
+	switch req.GrantType {
+	case models.GrantAuthorizationCode:
+		resp, err = o.exchangeCode(ctx, client, req)
+	case models.GrantRefreshToken:
+		resp, err = o.refresh(ctx, client, req)
+	case models.GrantClientCredentials:
+		resp, err = o.clientCredentials(client, req)
+	}
+	if err != nil {
+		var oauthErr *Error
+		if errors.As(err, &oauthErr) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return resp, nil
+}
+
+// exchangeCode redeems an authorization code. It starts a session of the
+// client for the user if the client may refresh its tokens, and issues an ID
+// token carrying the nonce of the authorization request if openid was
+// granted. Presenting a code again ends the session it started.
+func (o *OAuth) exchangeCode(ctx context.Context, client *models.OAuthClient, req TokenRequest) (*TokenResponse, error) {
+	if req.Code == "" || req.CodeVerifier == "" {
+		return nil, newError(CodeInvalidRequest, "code and code_verifier are required")
+	}
+
+	// The session is named before the code is consumed, so that a replay of
+	// the code can end it.
+	var familyID string
+	if contains(client.GrantTypes, models.GrantRefreshToken) {
+		familyID = token.NewFamilyID()
+	}
+
+	codeHash := hashSecret(req.Code)
+
+	code, err := o.codes.ConsumeAuthorizationCode(ctx, codeHash, familyID)
+	if err != nil {
+		if errors.Is(err, storage.ErrTokenNotFound) {
+			if err := o.revokeReplayedCode(ctx, codeHash); err != nil {
+				return nil, err
+			}
+			return nil, newError(CodeInvalidGrant, "invalid or expired code")
+		}
+		return nil, err
+	}
+
+	if code.ClientID != client.ClientID {
+		return nil, newError(CodeInvalidGrant, "the code was issued to another client")
+	}
+
+	// A redirect_uri named in the authorization request must be repeated
+	// (RFC 6749 section 4.1.3); one that was left out may be too.
+	if (code.ExplicitRedirectURI || req.RedirectURI != "") && req.RedirectURI != code.RedirectURI {
+		return nil, newError(CodeInvalidGrant, "redirect_uri does not match the authorization request")
+	}
+
+	if !validPKCEString(req.CodeVerifier) || !verifyPKCE(req.CodeVerifier, code.CodeChallenge) {
+		return nil, newError(CodeInvalidGrant, "code_verifier does not match the code_challenge")
+	}
+
+	pair, err := o.tokens.GetClientTokens(code.UserID, client.ClientID, code.Scope, familyID)
+	if err != nil {
+		return nil, err
+	}
+
+	if familyID != "" {
+		now := time.Now()
+		session := &models.Session{
+			ID:         familyID,
+			UserID:     code.UserID,
+			ClientID:   client.ClientID,
+			UserAgent:  req.Client.UserAgent,
+			IP:         req.Client.IP,
+			CreatedAt:  now,
+			LastUsedAt: now,
+		}
+		if err := o.sessions.SaveTokens(ctx, session, pair); err != nil {
+			return nil, err
+		}
+	}
+
+	idToken, err := o.idToken(ctx, code.UserID, client.ClientID, code.Scope, code.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := o.tokenResponse(pair, code.Scope)
+	resp.IDToken = idToken
+
+	return resp, nil
+}
+
+// refresh rotates a refresh token of the client. The scope may be narrowed
+// but not widened; a new ID token, without nonce, comes along while openid
+// is in scope. Reusing a rotated refresh token revokes its session.
+func (o *OAuth) refresh(ctx context.Context, client *models.OAuthClient, req TokenRequest) (*TokenResponse, error) {
+	const op = "oauth.refresh"
+
+	claims, err := o.tokens.ParseRefreshToken(req.RefreshToken)
+	if err != nil || claims.ClientID != client.ClientID {
+		return nil, newError(CodeInvalidGrant, "invalid refresh token")
+	}
+
+	revoked, err := o.sessions.IsTokenRevoked(ctx, claims.Id, claims.FamilyID)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, newError(CodeInvalidGrant, "invalid refresh token")
+	}
+
+	scope := claims.Scope
+	if req.Scope != "" {
+		requested := parseScope(req.Scope)
+		if !subset(requested, parseScope(claims.Scope)) {
+			return nil, newError(CodeInvalidScope, "the scope exceeds the one originally granted")
+		}
+		scope = formatScope(requested)
+	}
+
+	pair, err := o.tokens.GetClientTokens(claims.UserID, client.ClientID, scope, claims.FamilyID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = o.sessions.RotateRefreshToken(ctx, claims.UserID, claims.FamilyID, claims.Id, pair.RefreshID, req.Client.IP)
+	if err != nil {
+		if errors.Is(err, storage.ErrTokenNotFound) {
+			return nil, newError(CodeInvalidGrant, "invalid refresh token")
+		}
+		if errors.Is(err, storage.ErrTokenReused) {
+			o.log.Warn("security event: refresh token reuse detected, token family revoked",
+				slog.String("op", op),
+				slog.String("event", "refresh_token_reuse"),
+				slog.Uint64("user_id", uint64(claims.UserID)),
+				slog.String("client_id", client.ClientID),
+				slog.String("family_id", claims.FamilyID),
+				slog.String("jti", claims.Id),
+			)
+			return nil, newError(CodeInvalidGrant, "refresh token reused")
+		}
+		return nil, err
+	}
+
+	idToken, err := o.idToken(ctx, claims.UserID, client.ClientID, scope, "")
+	if err != nil {
+		return nil, err
+	}
+
+	resp := o.tokenResponse(pair, scope)
+	resp.IDToken = idToken
+
+	return resp, nil
+}
+
+// revokeReplayedCode ends the session started with an authorization code
+// that is presented again, as the code was most likely stolen (RFC 6749,
+// section 4.1.2). Unknown codes are ignored.
+func (o *OAuth) revokeReplayedCode(ctx context.Context, codeHash string) error {
+	const op = "oauth.revokeReplayedCode"
+
+	consumed, err := o.codes.ConsumedAuthorizationCode(ctx, codeHash)
+	if err != nil {
+		if errors.Is(err, storage.ErrTokenNotFound) {
+			return nil
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	o.log.Warn("security event: authorization code replayed, its session revoked",
+		slog.String("client_id", consumed.ClientID),
+		slog.Uint64("user_id", uint64(consumed.UserID)),
+	)
+
+	if consumed.FamilyID == "" {
+		return nil
+	}
+
+	err = o.sessions.RevokeSession(ctx, consumed.UserID, consumed.FamilyID)
+	if err != nil && !errors.Is(err, storage.ErrSessionNotFound) {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// clientCredentials issues an access token for the client itself. No
+// refresh token is issued; the client simply asks again.
+func (o *OAuth) clientCredentials(client *models.OAuthClient, req TokenRequest) (*TokenResponse, error) {
+	scopes := parseScope(req.Scope)
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+	if !subset(scopes, client.Scopes) {
+		return nil, newError(CodeInvalidScope, "the client may not request these scopes")
+	}
+
+	scope := formatScope(scopes)
+
+	pair, err := o.tokens.GetClientCredentialsToken(client.ClientID, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	return o.tokenResponse(pair, scope), nil
+}
+
+func (o *OAuth) tokenResponse(pair *token.Pair, scope string) *TokenResponse {
+	return &TokenResponse{
+		AccessToken:  pair.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    o.tokens.AccessTTL(),
+		RefreshToken: pair.RefreshToken,
+		Scope:        scope,
+	}
+}
+
+// Revoke revokes a token of the client (RFC 7009). Revoking a refresh token
+// ends its session, including its access tokens. Tokens that are invalid or
+// belong to another client are ignored, as the RFC requires.
+func (o *OAuth) Revoke(ctx context.Context, clientID string, clientSecret string, tokenString string) error {
+	const op = "oauth.Revoke"
+
+	client, err := o.authenticateClient(ctx, clientID, clientSecret)
+	if err != nil {
+		return err
+	}
+
+	if tokenString == "" {
+		return newError(CodeInvalidRequest, "missing token")
+	}
+
+	claims, err := o.tokens.ParseClaims(tokenString)
+	if err != nil || claims.ClientID != client.ClientID || claims.Id == "" {
+		return nil
+	}
+
+	if claims.Type == token.TypeRefresh {
+		err := o.sessions.RevokeSession(ctx, claims.UserID, claims.FamilyID)
+		if err != nil && !errors.Is(err, storage.ErrSessionNotFound) {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		return nil
+	}
+
+	if err := o.sessions.RevokeToken(ctx, claims.Id, time.Until(time.Unix(claims.ExpiresAt, 0))); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
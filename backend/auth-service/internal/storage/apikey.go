@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	ErrAPIKeyExists   = errors.New("api key prefix taken")
+)
+
+// apiKeyTouchInterval limits how often LastUsedAt is written for a key in
+// busy use.
+const apiKeyTouchInterval = time.Minute
+
+// SaveAPIKey stores a new key. It returns ErrAPIKeyExists if another key has
+// the same prefix.
+func (s *storage) SaveAPIKey(ctx context.Context, key *models.APIKey) error {
+	if err := s.db.WithContext(ctx).Create(key).Error; err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return ErrAPIKeyExists
+		}
+		return err
+	}
+
+	return nil
+}
+
+// APIKeys returns the keys of the user that were not revoked, newest first.
+// Expired keys are included so their owner can see them.
+func (s *storage) APIKeys(ctx context.Context, uid uint) ([]*models.APIKey, error) {
+	var keys []*models.APIKey
+	err := s.db.WithContext(ctx).
+		Where("user_id = ? AND revoked_at IS NULL", uid).
+		Order("created_at DESC").
+		Find(&keys).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// APIKeyByPrefix returns the key with the given prefix, revoked or not.
+func (s *storage) APIKeyByPrefix(ctx context.Context, prefix string) (*models.APIKey, error) {
+	var key models.APIKey
+	if err := s.db.WithContext(ctx).Where("prefix = ?", prefix).First(&key).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrAPIKeyNotFound
+		}
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// RevokeAPIKey revokes a key of the user. It returns ErrAPIKeyNotFound if the
+// user has no such key or it is already revoked.
+func (s *storage) RevokeAPIKey(ctx context.Context, uid uint, id uint) error {
+	res := s.db.WithContext(ctx).Model(&models.APIKey{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", id, uid).
+		Update("revoked_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return ErrAPIKeyNotFound
+	}
+
+	return nil
+}
+
+// TouchAPIKey records that the key was used at usedAt, unless that was
+// already recorded less than apiKeyTouchInterval before.
+func (s *storage) TouchAPIKey(ctx context.Context, id uint, usedAt time.Time) error {
+	return s.db.WithContext(ctx).Model(&models.APIKey{}).
+		Where("id = ? AND (last_used_at IS NULL OR last_used_at < ?)", id, usedAt.Add(-apiKeyTouchInterval)).
+		Update("last_used_at", usedAt).Error
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrIdentityNotFound = errors.New("identity not found")
+	ErrIdentityExists   = errors.New("identity already linked")
+)
+
+// SaveIdentity links an identity to its user. It returns ErrIdentityExists
+// if the identity is linked to a user already, or the user has one of the
+// provider.
+func (s *storage) SaveIdentity(ctx context.Context, identity *models.Identity) error {
+	if err := s.db.WithContext(ctx).Create(identity).Error; err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return ErrIdentityExists
+		}
+		return err
+	}
+
+	return nil
+}
+
+// SaveFederatedUser creates a user who signs in with identity and has no
+// password, and links the identity to it.
+func (s *storage) SaveFederatedUser(ctx context.Context, user *models.User, identity *models.Identity) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			if errors.Is(err, gorm.ErrDuplicatedKey) {
+				return ErrUserExists
+			}
+			return err
+		}
+
+		identity.UserID = user.ID
+		if err := tx.Create(identity).Error; err != nil {
+			if errors.Is(err, gorm.ErrDuplicatedKey) {
+				return ErrIdentityExists
+			}
+			return err
+		}
+
+		return nil
+	})
+}
+
+// Identity returns the identity the provider knows by subject.
+func (s *storage) Identity(ctx context.Context, provider string, subject string) (*models.Identity, error) {
+	var identity models.Identity
+	err := s.db.WithContext(ctx).
+		Where("provider = ? AND subject = ?", provider, subject).
+		First(&identity).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrIdentityNotFound
+		}
+		return nil, err
+	}
+
+	return &identity, nil
+}
+
+// Identities returns the identities linked to the user.
+func (s *storage) Identities(ctx context.Context, uid uint) ([]*models.Identity, error) {
+	var identities []*models.Identity
+	err := s.db.WithContext(ctx).
+		Where("user_id = ?", uid).
+		Order("created_at").
+		Find(&identities).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return identities, nil
+}
+
+// DeleteIdentity unlinks the identity of the provider from the user.
+func (s *storage) DeleteIdentity(ctx context.Context, uid uint, provider string) error {
+	res := s.db.WithContext(ctx).
+		Where("user_id = ? AND provider = ?", uid, provider).
+		Delete(&models.Identity{})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return ErrIdentityNotFound
+	}
+
+	return nil
+}
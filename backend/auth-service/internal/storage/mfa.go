@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+)
+
+// SetTOTPSecret stores a secret the user still has to confirm with a code.
+// Two-factor authentication stays disabled until EnableTOTP.
+func (s *storage) SetTOTPSecret(ctx context.Context, uid uint, secret string) error {
+	res := s.db.WithContext(ctx).Model(&models.User{}).
+		Where("id = ?", uid).
+		Updates(map[string]interface{}{"totp_secret": secret, "totp_enabled": false})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+// EnableTOTP turns two-factor authentication on and replaces the recovery
+// codes of the user.
+func (s *storage) EnableTOTP(ctx context.Context, uid uint, codeHashes []string) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("id = ?", uid).Update("totp_enabled", true).Error; err != nil {
+			return err
+		}
+
+		return replaceRecoveryCodes(tx, uid, codeHashes)
+	})
+}
+
+// DisableTOTP turns two-factor authentication off and drops the secret and
+// recovery codes.
+func (s *storage) DisableTOTP(ctx context.Context, uid uint) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.User{}).
+			Where("id = ?", uid).
+			Updates(map[string]interface{}{"totp_secret": "", "totp_enabled": false}).Error
+		if err != nil {
+			return err
+		}
+
+		return replaceRecoveryCodes(tx, uid, nil)
+	})
+}
+
+// UseRecoveryCode marks an unused recovery code of the user as used and
+// reports whether there was one.
+func (s *storage) UseRecoveryCode(ctx context.Context, uid uint, codeHash string) (bool, error) {
+	res := s.db.WithContext(ctx).Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", uid, codeHash).
+		Update("used_at", time.Now())
+	if res.Error != nil {
+		return false, res.Error
+	}
+
+	return res.RowsAffected == 1, nil
+}
+
+func replaceRecoveryCodes(tx *gorm.DB, uid uint, codeHashes []string) error {
+	if err := tx.Where("user_id = ?", uid).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return err
+	}
+
+	if len(codeHashes) == 0 {
+		return nil
+	}
+
+	codes := make([]models.RecoveryCode, 0, len(codeHashes))
+	for _, hash := range codeHashes {
+		codes = append(codes, models.RecoveryCode{UserID: uid, CodeHash: hash})
+	}
+
+	return tx.Create(&codes).Error
+}
+
+// MarkTOTPUsed remembers that the code of the given time step was used and
+// reports whether it was still unused, so a code cannot be replayed.
+func (s *storage) MarkTOTPUsed(ctx context.Context, uid uint, step int64, ttl time.Duration) (bool, error) {
+	key := "totp_used:" + strconv.FormatUint(uint64(uid), 10) + ":" + strconv.FormatInt(step, 10)
+
+	return s.redis.SetNX(ctx, key, "1", ttl).Result()
+}
+
+// SaveMFATicket stores the hash of a ticket issued by a login that still
+// needs a second factor.
+func (s *storage) SaveMFATicket(ctx context.Context, ticketHash string, uid uint, ttl time.Duration) error {
+	_, err := s.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, mfaTicketKey(ticketHash), "user_id", strconv.FormatUint(uint64(uid), 10), "attempts", 0)
+		pipe.Expire(ctx, mfaTicketKey(ticketHash), ttl)
+		return nil
+	})
+	return err
+}
+
+// attemptMFAScript uses up one attempt of a ticket and returns its user id
+// and the attempts used so far. A missing ticket returns nil; one with no
+// attempts left is deleted and returns nil as well.
+var attemptMFAScript = redis.NewScript(`
+local uid = redis.call("HGET", KEYS[1], "user_id")
+if not uid then
+	return false
+end
+local attempts = redis.call("HINCRBY", KEYS[1], "attempts", 1)
+if attempts > tonumber(ARGV[1]) then
+	redis.call("DEL", KEYS[1])
+	return false
+end
+return {uid, attempts}
+`)
+
+// AttemptMFATicket uses up one of the maxAttempts attempts of a ticket before
+// its code is checked, so parallel requests can't try more codes than that.
+// It returns the id of the user the ticket was issued for and whether this
+// was the last attempt, or ErrTokenNotFound for a missing or exhausted
+// ticket.
+func (s *storage) AttemptMFATicket(ctx context.Context, ticketHash string, maxAttempts int) (uint, bool, error) {
+	res, err := attemptMFAScript.Run(ctx, s.redis, []string{mfaTicketKey(ticketHash)}, maxAttempts).Slice()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return 0, false, ErrTokenNotFound
+		}
+		return 0, false, err
+	}
+
+	value, _ := res[0].(string)
+	attempts, _ := res[1].(int64)
+
+	uid, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return uint(uid), attempts >= int64(maxAttempts), nil
+}
+
+// ConsumeMFATicket deletes a ticket and reports whether it still existed.
+func (s *storage) ConsumeMFATicket(ctx context.Context, ticketHash string) (bool, error) {
+	n, err := s.redis.Del(ctx, mfaTicketKey(ticketHash)).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+func mfaTicketKey(ticketHash string) string {
+	return "mfa_ticket:" + ticketHash
+}
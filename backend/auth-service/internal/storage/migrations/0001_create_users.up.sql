@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS users (
+    id             BIGSERIAL PRIMARY KEY,
+    created_at     TIMESTAMPTZ,
+    updated_at     TIMESTAMPTZ,
+    deleted_at     TIMESTAMPTZ,
+    username       TEXT,
+    email          TEXT,
+    email_verified BOOLEAN NOT NULL DEFAULT FALSE,
+    pass_hash      TEXT,
+    is_admin       BOOLEAN NOT NULL DEFAULT FALSE,
+    CONSTRAINT uni_users_email UNIQUE (email)
+);
+
+CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users (deleted_at);
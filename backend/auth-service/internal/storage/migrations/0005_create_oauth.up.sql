@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS oauth_clients (
+    id            BIGSERIAL PRIMARY KEY,
+    client_id     TEXT NOT NULL,
+    secret_hash   TEXT NOT NULL DEFAULT '',
+    name          TEXT NOT NULL,
+    owner_id      BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    redirect_uris TEXT NOT NULL DEFAULT '[]',
+    scopes        TEXT NOT NULL DEFAULT '[]',
+    grant_types   TEXT NOT NULL DEFAULT '[]',
+    public        BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_oauth_clients_client_id ON oauth_clients (client_id);
+CREATE INDEX IF NOT EXISTS idx_oauth_clients_owner_id ON oauth_clients (owner_id);
+
+CREATE TABLE IF NOT EXISTS oauth_consents (
+    user_id    BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    client_id  TEXT NOT NULL REFERENCES oauth_clients (client_id) ON DELETE CASCADE,
+    scopes     TEXT NOT NULL DEFAULT '[]',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, client_id)
+);
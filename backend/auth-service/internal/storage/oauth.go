@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrClientNotFound  = errors.New("oauth client not found")
+	ErrConsentNotFound = errors.New("oauth consent not found")
+)
+
+func (s *storage) SaveClient(ctx context.Context, client *models.OAuthClient) error {
+	return s.db.WithContext(ctx).Create(client).Error
+}
+
+func (s *storage) Client(ctx context.Context, clientID string) (*models.OAuthClient, error) {
+	var client models.OAuthClient
+	if err := s.db.WithContext(ctx).Where("client_id = ?", clientID).First(&client).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrClientNotFound
+		}
+		return nil, err
+	}
+
+	return &client, nil
+}
+
+// CountClients counts the clients the user registered.
+func (s *storage) CountClients(ctx context.Context, ownerID uint) (int, error) {
+	var n int64
+	err := s.db.WithContext(ctx).Model(&models.OAuthClient{}).
+		Where("owner_id = ?", ownerID).
+		Count(&n).Error
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+func (s *storage) Consent(ctx context.Context, uid uint, clientID string) (*models.OAuthConsent, error) {
+	var consent models.OAuthConsent
+	err := s.db.WithContext(ctx).
+		Where("user_id = ? AND client_id = ?", uid, clientID).
+		First(&consent).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrConsentNotFound
+		}
+		return nil, err
+	}
+
+	return &consent, nil
+}
+
+// SaveConsent creates the consent of the user to the client or replaces its
+// scopes.
+func (s *storage) SaveConsent(ctx context.Context, consent *models.OAuthConsent) error {
+	return s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "client_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"scopes", "updated_at"}),
+	}).Create(consent).Error
+}
+
+func (s *storage) Consents(ctx context.Context, uid uint) ([]*models.OAuthConsent, error) {
+	var consents []*models.OAuthConsent
+	err := s.db.WithContext(ctx).
+		Where("user_id = ?", uid).
+		Order("updated_at DESC").
+		Find(&consents).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return consents, nil
+}
+
+func (s *storage) DeleteConsent(ctx context.Context, uid uint, clientID string) error {
+	res := s.db.WithContext(ctx).
+		Where("user_id = ? AND client_id = ?", uid, clientID).
+		Delete(&models.OAuthConsent{})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return ErrConsentNotFound
+	}
+
+	return nil
+}
+
+// SaveAuthorizationCode stores what the code with the given hash stands for
+// until it is exchanged or ttl has passed.
+func (s *storage) SaveAuthorizationCode(ctx context.Context, codeHash string, code *models.AuthorizationCode, ttl time.Duration) error {
+	data, err := json.Marshal(code)
+	if err != nil {
+		return err
+	}
+
+	return s.redis.Set(ctx, authorizationCodeKey(codeHash), data, ttl).Err()
+}
+
+// consumeCodeScript deletes an authorization code and, in the same step,
+// leaves a marker of it holding the session its exchange starts.
+var consumeCodeScript = redis.NewScript(`
+local data = redis.call("GET", KEYS[1])
+if not data then
+	return false
+end
+redis.call("DEL", KEYS[1])
+redis.call("HSET", KEYS[2], "code", data, "family_id", ARGV[1])
+redis.call("PEXPIRE", KEYS[2], ARGV[2])
+return data
+`)
+
+// ConsumeAuthorizationCode deletes an authorization code and returns what it
+// stood for. A code can only be consumed once; afterwards
+// ConsumedAuthorizationCode reports the session familyID it started for as
+// long as refresh tokens live.
+func (s *storage) ConsumeAuthorizationCode(ctx context.Context, codeHash string, familyID string) (*models.AuthorizationCode, error) {
+	keys := []string{authorizationCodeKey(codeHash), consumedCodeKey(codeHash)}
+
+	data, err := consumeCodeScript.Run(ctx, s.redis, keys, familyID, s.refreshTTL.Milliseconds()).Text()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrTokenNotFound
+		}
+		return nil, err
+	}
+
+	var code models.AuthorizationCode
+	if err := json.Unmarshal([]byte(data), &code); err != nil {
+		return nil, err
+	}
+
+	return &code, nil
+}
+
+// ConsumedAuthorizationCode returns the marker of a code that has already
+// been exchanged, or ErrTokenNotFound.
+func (s *storage) ConsumedAuthorizationCode(ctx context.Context, codeHash string) (*models.ConsumedAuthorizationCode, error) {
+	fields, err := s.redis.HGetAll(ctx, consumedCodeKey(codeHash)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, ErrTokenNotFound
+	}
+
+	consumed := &models.ConsumedAuthorizationCode{FamilyID: fields["family_id"]}
+	if err := json.Unmarshal([]byte(fields["code"]), &consumed.AuthorizationCode); err != nil {
+		return nil, err
+	}
+
+	return consumed, nil
+}
+
+func authorizationCodeKey(codeHash string) string {
+	return "oauth_code:" + codeHash
+}
+
+func consumedCodeKey(codeHash string) string {
+	return "oauth_code_used:" + codeHash
+}
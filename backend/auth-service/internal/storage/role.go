@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrRoleNotFound = errors.New("role not found")
+
+// UserRoles returns the names of the roles assigned to the user. Users that
+// only have the legacy IsAdmin flag are reported with the admin role.
+func (s *storage) UserRoles(ctx context.Context, uid uint) ([]string, error) {
+	var user models.User
+	err := s.db.WithContext(ctx).Preload("Roles").First(&user, uid).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	roles := make([]string, 0, len(user.Roles)+1)
+	hasAdmin := false
+	for _, role := range user.Roles {
+		roles = append(roles, role.Name)
+		hasAdmin = hasAdmin || role.Name == models.RoleAdmin
+	}
+	if user.IsAdmin && !hasAdmin {
+		roles = append(roles, models.RoleAdmin)
+	}
+
+	return roles, nil
+}
+
+// Roles returns every role with its permissions.
+func (s *storage) Roles(ctx context.Context) ([]*models.Role, error) {
+	var roles []*models.Role
+	if err := s.db.WithContext(ctx).Preload("Permissions").Order("name").Find(&roles).Error; err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// RolesByName returns the roles with the given names and their permissions.
+func (s *storage) RolesByName(ctx context.Context, names []string) ([]*models.Role, error) {
+	var roles []*models.Role
+	err := s.db.WithContext(ctx).Preload("Permissions").
+		Where("name IN ?", names).Order("name").Find(&roles).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// AssignRole assigns the role to the user. Assigning a role twice is a no-op.
+func (s *storage) AssignRole(ctx context.Context, uid uint, roleName string) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user, role, err := findUserAndRole(tx, uid, roleName)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Model(user).Association("Roles").Append(role); err != nil {
+			return err
+		}
+
+		if role.Name == models.RoleAdmin {
+			return tx.Model(user).Update("is_admin", true).Error
+		}
+
+		return nil
+	})
+}
+
+// SaveUserWithRoles creates the user and assigns it the roles in one
+// transaction, so a user is never left without the roles it was created
+// with.
+func (s *storage) SaveUserWithRoles(ctx context.Context, user *models.User, roleNames []string) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		roles := make([]*models.Role, 0, len(roleNames))
+		for _, name := range roleNames {
+			var role models.Role
+			if err := tx.Where("name = ?", name).First(&role).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					return ErrRoleNotFound
+				}
+				return err
+			}
+			roles = append(roles, &role)
+
+			if role.Name == models.RoleAdmin {
+				user.IsAdmin = true
+			}
+		}
+
+		if err := tx.Create(user).Error; err != nil {
+			if errors.Is(err, gorm.ErrDuplicatedKey) {
+				return ErrUserExists
+			}
+			return err
+		}
+
+		if len(roles) == 0 {
+			return nil
+		}
+
+		return tx.Model(user).Association("Roles").Append(roles)
+	})
+}
+
+// RevokeRole takes the role away from the user.
+func (s *storage) RevokeRole(ctx context.Context, uid uint, roleName string) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user, role, err := findUserAndRole(tx, uid, roleName)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Model(user).Association("Roles").Delete(role); err != nil {
+			return err
+		}
+
+		if role.Name == models.RoleAdmin {
+			return tx.Model(user).Update("is_admin", false).Error
+		}
+
+		return nil
+	})
+}
+
+// HasPermission reports whether any role of the user grants the permission.
+func (s *storage) HasPermission(ctx context.Context, uid uint, permission string) (bool, error) {
+	roles, err := s.UserRoles(ctx, uid)
+	if err != nil {
+		return false, err
+	}
+
+	if len(roles) == 0 {
+		return false, nil
+	}
+
+	var count int64
+	err = s.db.WithContext(ctx).Table("roles").
+		Joins("JOIN role_permissions ON role_permissions.role_id = roles.id").
+		Joins("JOIN permissions ON permissions.id = role_permissions.permission_id").
+		Where("roles.name IN ? AND permissions.name = ?", roles, permission).
+		Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// SeedRoles creates the default roles and permissions that don't exist yet.
+// It is part of migrating the database, on startup or with "main migrate up".
+func SeedRoles(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, r := range models.DefaultRoles {
+			role := models.Role{Name: r.Name, Description: r.Description}
+			if err := tx.Where(models.Role{Name: r.Name}).FirstOrCreate(&role).Error; err != nil {
+				return err
+			}
+
+			for _, p := range r.Permissions {
+				permission := models.Permission{Name: p.Name, Description: p.Description}
+				if err := tx.Where(models.Permission{Name: p.Name}).FirstOrCreate(&permission).Error; err != nil {
+					return err
+				}
+
+				err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+					Table("role_permissions").
+					Create(map[string]interface{}{"role_id": role.ID, "permission_id": permission.ID}).Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+func findUserAndRole(tx *gorm.DB, uid uint, roleName string) (*models.User, *models.Role, error) {
+	var user models.User
+	if err := tx.First(&user, uid).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrUserNotFound
+		}
+		return nil, nil, err
+	}
+
+	var role models.Role
+	if err := tx.Where("name = ?", roleName).First(&role).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrRoleNotFound
+		}
+		return nil, nil, err
+	}
+
+	return &user, &role, nil
+}
@@ -0,0 +1,277 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"github.com/Blxssy/social-media/auth-service/pkg/token"
+	"github.com/go-redis/redis/v8"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// A session is the refresh token family issued at login: the session id is
+// the family id carried by every token of the session. It is kept in a Redis
+// hash together with the id of the family's current refresh token.
+
+// SaveTokens starts a new session whose current refresh token is the one of pair.
+func (s *storage) SaveTokens(ctx context.Context, session *models.Session, pair *token.Pair) error {
+	_, err := s.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, sessionKey(session.ID),
+			"refresh_id", pair.RefreshID,
+			"user_id", strconv.FormatUint(uint64(session.UserID), 10),
+			"client_id", session.ClientID,
+			"user_agent", session.UserAgent,
+			"ip", session.IP,
+			"created_at", strconv.FormatInt(session.CreatedAt.Unix(), 10),
+			"last_used_at", strconv.FormatInt(session.LastUsedAt.Unix(), 10),
+		)
+		pipe.Expire(ctx, sessionKey(session.ID), s.refreshTTL)
+		pipe.SAdd(ctx, userSessionsKey(session.UserID), session.ID)
+		pipe.Expire(ctx, userSessionsKey(session.UserID), s.refreshTTL)
+		return nil
+	})
+	return err
+}
+
+// rotateScript replaces the current refresh token of a session only if the
+// presented token is that one. Presenting any other token of the family means
+// it was already rotated, so the whole session is revoked.
+var rotateScript = redis.NewScript(`
+local current = redis.call("HGET", KEYS[1], "refresh_id")
+if not current then
+	return 0
+end
+if current ~= ARGV[1] then
+	redis.call("DEL", KEYS[1])
+	redis.call("SREM", KEYS[2], ARGV[4])
+	redis.call("SET", KEYS[3], "1", "PX", ARGV[5])
+	return -1
+end
+redis.call("HSET", KEYS[1], "refresh_id", ARGV[2], "last_used_at", ARGV[6], "ip", ARGV[7])
+redis.call("PEXPIRE", KEYS[1], ARGV[3])
+return 1
+`)
+
+// RotateRefreshToken makes newID the current refresh token of the session and
+// records its use from ip. It returns ErrTokenNotFound for an unknown or
+// expired session and ErrTokenReused, after revoking the session, when oldID
+// has already been rotated.
+func (s *storage) RotateRefreshToken(ctx context.Context, uid uint, sessionID string, oldID string, newID string, ip string) error {
+	keys := []string{sessionKey(sessionID), userSessionsKey(uid), revokedSessionKey(sessionID)}
+	ttl := s.refreshTTL.Milliseconds()
+	revokedTTL := s.accessTTL.Milliseconds()
+	now := time.Now().Unix()
+
+	res, err := rotateScript.Run(ctx, s.redis, keys, oldID, newID, ttl, sessionID, revokedTTL, now, ip).Int()
+	if err != nil {
+		return err
+	}
+
+	switch res {
+	case 0:
+		return ErrTokenNotFound
+	case -1:
+		return ErrTokenReused
+	}
+
+	return s.redis.Expire(ctx, userSessionsKey(uid), s.refreshTTL).Err()
+}
+
+// Sessions returns the active sessions of the user.
+func (s *storage) Sessions(ctx context.Context, uid uint) ([]*models.Session, error) {
+	ids, err := s.redis.SMembers(ctx, userSessionsKey(uid)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]*models.Session, 0, len(ids))
+	for _, id := range ids {
+		session, err := s.session(ctx, id)
+		if errors.Is(err, ErrSessionNotFound) {
+			// The session expired, forget about it.
+			s.redis.SRem(ctx, userSessionsKey(uid), id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+// CurrentRefreshID returns the jti of the refresh token the session can
+// currently be refreshed with. It returns ErrSessionNotFound once the session
+// has ended.
+func (s *storage) CurrentRefreshID(ctx context.Context, sessionID string) (string, error) {
+	id, err := s.redis.HGet(ctx, sessionKey(sessionID), "refresh_id").Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return "", ErrSessionNotFound
+		}
+		return "", err
+	}
+
+	return id, nil
+}
+
+// Session returns the session with the given id, whoever it belongs to, or
+// ErrSessionNotFound.
+func (s *storage) Session(ctx context.Context, sessionID string) (*models.Session, error) {
+	return s.session(ctx, sessionID)
+}
+
+func (s *storage) session(ctx context.Context, id string) (*models.Session, error) {
+	fields, err := s.redis.HGetAll(ctx, sessionKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fields) == 0 {
+		return nil, ErrSessionNotFound
+	}
+
+	uid, _ := strconv.ParseUint(fields["user_id"], 10, 64)
+	createdAt, _ := strconv.ParseInt(fields["created_at"], 10, 64)
+	lastUsedAt, _ := strconv.ParseInt(fields["last_used_at"], 10, 64)
+
+	return &models.Session{
+		ID:         id,
+		UserID:     uint(uid),
+		ClientID:   fields["client_id"],
+		UserAgent:  fields["user_agent"],
+		IP:         fields["ip"],
+		CreatedAt:  time.Unix(createdAt, 0),
+		LastUsedAt: time.Unix(lastUsedAt, 0),
+	}, nil
+}
+
+// RevokeToken puts a single token on the denylist until it would have expired.
+func (s *storage) RevokeToken(ctx context.Context, tokenID string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil
+	}
+	return s.redis.Set(ctx, revokedTokenKey(tokenID), "1", ttl).Err()
+}
+
+// RevokeSession ends a session of the user: its refresh token can no longer
+// be rotated and access tokens issued for it are denied until they would have
+// expired. It returns ErrSessionNotFound if the user has no such session.
+func (s *storage) RevokeSession(ctx context.Context, uid uint, sessionID string) error {
+	member, err := s.redis.SIsMember(ctx, userSessionsKey(uid), sessionID).Result()
+	if err != nil {
+		return err
+	}
+
+	if !member {
+		return ErrSessionNotFound
+	}
+
+	_, err = s.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, sessionKey(sessionID))
+		pipe.SRem(ctx, userSessionsKey(uid), sessionID)
+		pipe.Set(ctx, revokedSessionKey(sessionID), "1", s.accessTTL)
+		return nil
+	})
+	return err
+}
+
+// RevokeAllSessions ends every session of the user.
+func (s *storage) RevokeAllSessions(ctx context.Context, uid uint) error {
+	ids, err := s.redis.SMembers(ctx, userSessionsKey(uid)).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := s.RevokeSession(ctx, uid, id); err != nil && !errors.Is(err, ErrSessionNotFound) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *storage) IsTokenRevoked(ctx context.Context, tokenID string, sessionID string) (bool, error) {
+	keys := []string{revokedTokenKey(tokenID)}
+	if sessionID != "" {
+		keys = append(keys, revokedSessionKey(sessionID))
+	}
+
+	n, err := s.redis.Exists(ctx, keys...).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+// SaveOneTimeToken remembers a single-use token until it expires.
+func (s *storage) SaveOneTimeToken(ctx context.Context, tokenID string, ttl time.Duration) error {
+	return s.redis.Set(ctx, oneTimeTokenKey(tokenID), "1", ttl).Err()
+}
+
+// ConsumeOneTimeToken forgets a single-use token and reports whether it was
+// still unused.
+func (s *storage) ConsumeOneTimeToken(ctx context.Context, tokenID string) (bool, error) {
+	n, err := s.redis.Del(ctx, oneTimeTokenKey(tokenID)).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// SavePasswordResetToken stores the hash of a password reset token for uid.
+func (s *storage) SavePasswordResetToken(ctx context.Context, tokenHash string, uid uint, ttl time.Duration) error {
+	return s.redis.Set(ctx, passwordResetKey(tokenHash), strconv.FormatUint(uint64(uid), 10), ttl).Err()
+}
+
+// ConsumePasswordResetToken deletes a password reset token and returns the id
+// of the user it was issued for.
+func (s *storage) ConsumePasswordResetToken(ctx context.Context, tokenHash string) (uint, error) {
+	value, err := s.redis.GetDel(ctx, passwordResetKey(tokenHash)).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return 0, ErrTokenNotFound
+		}
+		return 0, err
+	}
+
+	uid, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint(uid), nil
+}
+
+func passwordResetKey(tokenHash string) string {
+	return "password_reset:" + tokenHash
+}
+
+func oneTimeTokenKey(tokenID string) string {
+	return "one_time_token:" + tokenID
+}
+
+func revokedTokenKey(tokenID string) string {
+	return "revoked_token:" + tokenID
+}
+
+func revokedSessionKey(sessionID string) string {
+	return "revoked_session:" + sessionID
+}
+
+func sessionKey(sessionID string) string {
+	return "session:" + sessionID
+}
+
+func userSessionsKey(uid uint) string {
+	return "user_sessions:" + strconv.FormatUint(uint64(uid), 10)
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"github.com/Blxssy/social-media/auth-service/pkg/token"
+)
+
+const (
+	sessionUID = 42
+	sessionID  = "family-1"
+)
+
+func newSessionStorage(t *testing.T) (*storage, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	s := &storage{redis: client, accessTTL: 15 * time.Minute, refreshTTL: time.Hour, now: time.Now}
+
+	now := time.Now()
+	session := &models.Session{ID: sessionID, UserID: sessionUID, IP: "192.0.2.1", CreatedAt: now, LastUsedAt: now}
+	if err := s.SaveTokens(context.Background(), session, &token.Pair{RefreshID: "r1", FamilyID: sessionID}); err != nil {
+		t.Fatal(err)
+	}
+
+	return s, mr
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	s, mr := newSessionStorage(t)
+	ctx := context.Background()
+
+	if err := s.RotateRefreshToken(ctx, sessionUID, sessionID, "r1", "r2", "192.0.2.2"); err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := s.CurrentRefreshID(ctx, sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != "r2" {
+		t.Errorf("current refresh id = %q, want r2", current)
+	}
+
+	sessions, err := s.Sessions(ctx, sessionUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].IP != "192.0.2.2" {
+		t.Errorf("sessions = %+v, want one used from 192.0.2.2", sessions)
+	}
+	if ttl := mr.TTL(sessionKey(sessionID)); ttl != time.Hour {
+		t.Errorf("session TTL = %v, want it renewed to 1h", ttl)
+	}
+
+	if err := s.RotateRefreshToken(ctx, sessionUID, sessionID, "r2", "r3", "192.0.2.2"); err != nil {
+		t.Errorf("rotate the new token: %v", err)
+	}
+}
+
+func TestRotateRefreshTokenReuse(t *testing.T) {
+	s, mr := newSessionStorage(t)
+	ctx := context.Background()
+
+	if err := s.RotateRefreshToken(ctx, sessionUID, sessionID, "r1", "r2", "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// r1 was rotated already: presenting it again means it leaked, so the
+	// whole family is revoked, including the current token r2.
+	err := s.RotateRefreshToken(ctx, sessionUID, sessionID, "r1", "r3", "198.51.100.7")
+	if !errors.Is(err, ErrTokenReused) {
+		t.Fatalf("reuse: err = %v, want ErrTokenReused", err)
+	}
+
+	if _, err := s.CurrentRefreshID(ctx, sessionID); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("CurrentRefreshID: err = %v, want ErrSessionNotFound", err)
+	}
+	if member, _ := s.redis.SIsMember(ctx, userSessionsKey(sessionUID), sessionID).Result(); member {
+		t.Errorf("the session is still listed for the user")
+	}
+
+	revoked, err := s.IsTokenRevoked(ctx, "access-1", sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !revoked {
+		t.Errorf("access tokens of the session are not revoked")
+	}
+	if ttl := mr.TTL(revokedSessionKey(sessionID)); ttl != 15*time.Minute {
+		t.Errorf("revocation TTL = %v, want the access token TTL", ttl)
+	}
+
+	if err := s.RotateRefreshToken(ctx, sessionUID, sessionID, "r2", "r4", "192.0.2.1"); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("rotate the current token after reuse: err = %v, want ErrTokenNotFound", err)
+	}
+}
+
+func TestRotateRefreshTokenUnknownSession(t *testing.T) {
+	s, _ := newSessionStorage(t)
+
+	err := s.RotateRefreshToken(context.Background(), sessionUID, "unknown", "r1", "r2", "192.0.2.1")
+	if !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("err = %v, want ErrTokenNotFound", err)
+	}
+}
+
+func TestRotateRefreshTokenConcurrent(t *testing.T) {
+	s, _ := newSessionStorage(t)
+	ctx := context.Background()
+
+	// Two refreshes racing with the same token: exactly one rotates it, the
+	// other is seen as a reuse and ends the session.
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = s.RotateRefreshToken(ctx, sessionUID, sessionID, "r1", []string{"r2a", "r2b"}[i], "192.0.2.1")
+		}(i)
+	}
+	wg.Wait()
+
+	var rotated, reused int
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			rotated++
+		case errors.Is(err, ErrTokenReused):
+			reused++
+		default:
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if rotated != 1 || reused != 1 {
+		t.Fatalf("rotated %d and reused %d times, want 1 and 1", rotated, reused)
+	}
+
+	if _, err := s.CurrentRefreshID(ctx, sessionID); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("CurrentRefreshID: err = %v, want ErrSessionNotFound", err)
+	}
+}
@@ -5,73 +5,170 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"time"
 
 	"github.com/Blxssy/social-media/auth-service/internal/config"
 	"github.com/Blxssy/social-media/auth-service/internal/models"
+	"github.com/Blxssy/social-media/auth-service/internal/storage/migrations"
 	"github.com/Blxssy/social-media/auth-service/pkg/token"
 	"github.com/go-redis/redis/v8"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
+var (
+	ErrTokenNotFound = errors.New("token not found")
+	ErrTokenReused   = errors.New("token reused")
+	ErrUserNotFound  = errors.New("user not found")
+	ErrUserExists    = errors.New("user already exists")
+)
+
 type Storage interface {
 	SaveUser(ctx context.Context, username string, email string, passHash []byte) (*models.User, error)
+	VerifyEmail(ctx context.Context, uid uint, email string) error
+	UpdatePassword(ctx context.Context, uid uint, passHash []byte) error
+	ReplacePasswordHash(ctx context.Context, uid uint, oldHash []byte, newHash []byte) error
+	UpdateEmail(ctx context.Context, uid uint, email string) error
 	User(ct context.Context, email string) (*models.User, error)
+	UserByID(ctx context.Context, uid uint) (*models.User, error)
 	IsAdmin(ct context.Context, userID int) (bool, error)
-	SaveTokens(ctx context.Context, uid uint, accessToken string, refreshToken string) error
+	SaveTokens(ctx context.Context, session *models.Session, pair *token.Pair) error
+	RotateRefreshToken(ctx context.Context, uid uint, sessionID string, oldID string, newID string, ip string) error
+	Sessions(ctx context.Context, uid uint) ([]*models.Session, error)
+	Session(ctx context.Context, sessionID string) (*models.Session, error)
+	CurrentRefreshID(ctx context.Context, sessionID string) (string, error)
+	RevokeToken(ctx context.Context, tokenID string, ttl time.Duration) error
+	RevokeSession(ctx context.Context, uid uint, sessionID string) error
+	RevokeAllSessions(ctx context.Context, uid uint) error
+	IsTokenRevoked(ctx context.Context, tokenID string, sessionID string) (bool, error)
+	SaveOneTimeToken(ctx context.Context, tokenID string, ttl time.Duration) error
+	ConsumeOneTimeToken(ctx context.Context, tokenID string) (bool, error)
+	SavePasswordResetToken(ctx context.Context, tokenHash string, uid uint, ttl time.Duration) error
+	ConsumePasswordResetToken(ctx context.Context, tokenHash string) (uint, error)
+	SetTOTPSecret(ctx context.Context, uid uint, secret string) error
+	EnableTOTP(ctx context.Context, uid uint, codeHashes []string) error
+	DisableTOTP(ctx context.Context, uid uint) error
+	UseRecoveryCode(ctx context.Context, uid uint, codeHash string) (bool, error)
+	MarkTOTPUsed(ctx context.Context, uid uint, step int64, ttl time.Duration) (bool, error)
+	SaveMFATicket(ctx context.Context, ticketHash string, uid uint, ttl time.Duration) error
+	AttemptMFATicket(ctx context.Context, ticketHash string, maxAttempts int) (uint, bool, error)
+	ConsumeMFATicket(ctx context.Context, ticketHash string) (bool, error)
+	ReserveLoginAttempt(ctx context.Context, key string, cfg config.LoginThrottle, limit config.ThrottleLimit) (string, time.Duration, error)
+	ReleaseLoginAttempt(ctx context.Context, key string, id string) error
+	LoginFailures(ctx context.Context, key string, window time.Duration) (int, error)
+	LockLogin(ctx context.Context, key string, duration time.Duration) error
+	ClearLoginFailures(ctx context.Context, key string) error
+	UserRoles(ctx context.Context, uid uint) ([]string, error)
+	Roles(ctx context.Context) ([]*models.Role, error)
+	RolesByName(ctx context.Context, names []string) ([]*models.Role, error)
+	AssignRole(ctx context.Context, uid uint, roleName string) error
+	SaveUserWithRoles(ctx context.Context, user *models.User, roleNames []string) error
+	RevokeRole(ctx context.Context, uid uint, roleName string) error
+	HasPermission(ctx context.Context, uid uint, permission string) (bool, error)
+	SaveAPIKey(ctx context.Context, key *models.APIKey) error
+	APIKeys(ctx context.Context, uid uint) ([]*models.APIKey, error)
+	APIKeyByPrefix(ctx context.Context, prefix string) (*models.APIKey, error)
+	RevokeAPIKey(ctx context.Context, uid uint, id uint) error
+	TouchAPIKey(ctx context.Context, id uint, usedAt time.Time) error
+	SaveClient(ctx context.Context, client *models.OAuthClient) error
+	Client(ctx context.Context, clientID string) (*models.OAuthClient, error)
+	CountClients(ctx context.Context, ownerID uint) (int, error)
+	Consent(ctx context.Context, uid uint, clientID string) (*models.OAuthConsent, error)
+	SaveConsent(ctx context.Context, consent *models.OAuthConsent) error
+	Consents(ctx context.Context, uid uint) ([]*models.OAuthConsent, error)
+	DeleteConsent(ctx context.Context, uid uint, clientID string) error
+	SaveAuthorizationCode(ctx context.Context, codeHash string, code *models.AuthorizationCode, ttl time.Duration) error
+	ConsumeAuthorizationCode(ctx context.Context, codeHash string, familyID string) (*models.AuthorizationCode, error)
+	ConsumedAuthorizationCode(ctx context.Context, codeHash string) (*models.ConsumedAuthorizationCode, error)
+	SaveIdentity(ctx context.Context, identity *models.Identity) error
+	SaveFederatedUser(ctx context.Context, user *models.User, identity *models.Identity) error
+	Identity(ctx context.Context, provider string, subject string) (*models.Identity, error)
+	Identities(ctx context.Context, uid uint) ([]*models.Identity, error)
+	DeleteIdentity(ctx context.Context, uid uint, provider string) error
 }
 
 type storage struct {
 	db    *gorm.DB
 	redis *redis.Client
+	// Sessions live as long as refresh tokens; revocations have to outlive
+	// the access tokens they deny.
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	// now is the clock of the login throttle.
+	now func() time.Time
 }
 
 func NewStorage(logger *slog.Logger, config *config.Config) Storage {
-	db, err := connectDatabase(config)
+	db, err := ConnectDatabase(config)
 	if err != nil {
 		logger.Error("Failure database connection")
 		panic(err)
 	}
 	logger.Info("Successfully connection to database")
 
-	db.Migrator().DropTable(&models.User{})
-	db.AutoMigrate(&models.User{})
+	if config.Database.Migration {
+		if err := migrateUp(logger, db); err != nil {
+			logger.Error("Failure migrating database")
+			panic(err)
+		}
 
-	passHash, _ := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.DefaultCost)
-	Admin := models.User{
-		Model:    gorm.Model{},
-		Username: "Anton",
-		Email:    "test@test.com",
-		PassHash: string(passHash),
-		IsAdmin:  true,
+		if err := SeedRoles(db); err != nil {
+			logger.Error("Failure seeding roles")
+			panic(err)
+		}
 	}
-	db.Create(&Admin)
 
-	addr := fmt.Sprintf("%s:%d", config.Redis.Host, config.Redis.Port)
-	redisClient := redis.NewClient(&redis.Options{
-		Addr: addr,
-	})
+	redisClient := NewRedisClient(config.Redis)
 
 	logger.Info("Successfully connected to redis")
 
 	return &storage{
-		db:    db,
-		redis: redisClient,
+		db:         db,
+		redis:      redisClient,
+		accessTTL:  config.Token.AccessTokenTTL,
+		refreshTTL: config.Token.RefreshTokenTTL,
+		now:        time.Now,
 	}
 }
 
-func connectDatabase(config *config.Config) (*gorm.DB, error) {
+func migrateUp(logger *slog.Logger, db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+
+	applied, err := migrations.Up(context.Background(), sqlDB)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range applied {
+		logger.Info("Applied migration", slog.Int64("version", m.Version), slog.String("name", m.Name))
+	}
+
+	return nil
+}
+
+// NewRedisClient connects to the configured Redis.
+func NewRedisClient(config config.Redis) *redis.Client {
+	addr := fmt.Sprintf("%s:%d", config.Host, config.Port)
+	return redis.NewClient(&redis.Options{
+		Addr: addr,
+	})
+}
+
+// ConnectDatabase opens the configured Postgres database.
+func ConnectDatabase(config *config.Config) (*gorm.DB, error) {
 	dsn := fmt.Sprintf("host=%s port=%s user=%s dbname=%s password=%s sslmode=disable",
 		config.Database.Host, config.Database.Port, config.Database.Username,
 		config.Database.Name, config.Database.Password)
-	return gorm.Open(postgres.Open(dsn))
+	return gorm.Open(postgres.Open(dsn), &gorm.Config{TranslateError: true})
 }
 
 func (s *storage) SaveUser(ctx context.Context, username string, email string, passHash []byte) (*models.User, error) {
 	u, _ := s.findByEmail(ctx, email)
 	if u != nil {
-		return nil, errors.New("User already exists")
+		return nil, ErrUserExists
 	}
 
 	user := &models.User{
@@ -82,6 +179,10 @@ func (s *storage) SaveUser(ctx context.Context, username string, email string, p
 
 	err := s.db.Create(user).Error
 	if err != nil {
+		// Another registration may have taken the email since the check.
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return nil, ErrUserExists
+		}
 		return nil, err
 	}
 
@@ -97,22 +198,105 @@ func (s *storage) User(ctx context.Context, email string) (*models.User, error)
 	return user, nil
 }
 
+func (s *storage) UserByID(ctx context.Context, uid uint) (*models.User, error) {
+	user, err := s.findByID(ctx, int(uid))
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// IsAdmin reports whether the user has the admin role. It predates roles and
+// is kept for callers that only need that one check.
 func (s *storage) IsAdmin(ctx context.Context, userID int) (bool, error) {
-	user, err := s.findByID(ctx, userID)
+	roles, err := s.UserRoles(ctx, uint(userID))
 	if err != nil {
 		return false, err
 	}
 
-	if user == nil {
-		return false, nil
+	for _, role := range roles {
+		if role == models.RoleAdmin {
+			return true, nil
+		}
 	}
 
-	return user.IsAdmin, nil
+	return false, nil
+}
+
+// VerifyEmail marks the email of the user as verified, provided it is still
+// the address the user has.
+func (s *storage) VerifyEmail(ctx context.Context, uid uint, email string) error {
+	res := s.db.WithContext(ctx).Model(&models.User{}).
+		Where("id = ? AND email = ?", uid, email).
+		Update("email_verified", true)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+func (s *storage) UpdatePassword(ctx context.Context, uid uint, passHash []byte) error {
+	res := s.db.WithContext(ctx).Model(&models.User{}).
+		Where("id = ?", uid).
+		Update("pass_hash", string(passHash))
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+// ReplacePasswordHash swaps the password hash of the user for a new hash of
+// the same password. Nothing is changed if the hash is no longer oldHash,
+// because the password was changed meanwhile.
+func (s *storage) ReplacePasswordHash(ctx context.Context, uid uint, oldHash []byte, newHash []byte) error {
+	return s.db.WithContext(ctx).Model(&models.User{}).
+		Where("id = ? AND pass_hash = ?", uid, string(oldHash)).
+		Update("pass_hash", string(newHash)).Error
+}
+
+// UpdateEmail replaces the email of the user with an address the user has
+// just verified.
+func (s *storage) UpdateEmail(ctx context.Context, uid uint, email string) error {
+	u, _ := s.findByEmail(ctx, email)
+	if u != nil {
+		return ErrUserExists
+	}
+
+	res := s.db.WithContext(ctx).Model(&models.User{}).
+		Where("id = ?", uid).
+		Updates(map[string]interface{}{"email": email, "email_verified": true})
+	if res.Error != nil {
+		// Another account may have taken the email since the check.
+		if errors.Is(res.Error, gorm.ErrDuplicatedKey) {
+			return ErrUserExists
+		}
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
 }
 
 func (s *storage) findByEmail(ctx context.Context, email string) (*models.User, error) {
 	var user models.User
-	if err := s.db.Where("email = ?", email).First(&user).Error; err != nil {
+	if err := s.db.WithContext(ctx).Where("email = ?", email).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
 		return nil, err
 	}
 	return &user, nil
@@ -120,16 +304,11 @@ func (s *storage) findByEmail(ctx context.Context, email string) (*models.User,
 
 func (s *storage) findByID(ctx context.Context, uid int) (*models.User, error) {
 	var user models.User
-	if err := s.db.Where("id = ?", uid).First(&user).Error; err != nil {
+	if err := s.db.WithContext(ctx).Where("id = ?", uid).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
 		return nil, err
 	}
 	return &user, nil
 }
-
-func (s *storage) SaveTokens(ctx context.Context, uid uint, accessToken string, refreshToken string) error {
-	err := s.redis.Set(ctx, "access_token:"+string(uid), accessToken, token.AccessTokenDuration).Err()
-	if err != nil {
-		return err
-	}
-	return s.redis.Set(ctx, "refresh_token:"+string(uid), refreshToken, token.RefreshTokenDuration).Err()
-}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"github.com/Blxssy/social-media/auth-service/internal/config"
+	"github.com/go-redis/redis/v8"
+)
+
+// Failed logins are kept in a sorted set per key, scored by the time of the
+// failure, which gives a sliding window: failures older than the window are
+// trimmed before counting. Attempts are added to it as failures when they
+// are reserved and removed again if they succeed, so parallel attempts can't
+// slip past the throttle.
+
+// reserveAttemptScript lets an attempt through unless the key is locked out
+// or has to wait after its last failure, and then records it. It returns the
+// milliseconds left to wait, 0 if the attempt was reserved.
+var reserveAttemptScript = redis.NewScript(`
+local locked = redis.call("PTTL", KEYS[2])
+if locked > 0 then
+	return locked
+end
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", "(" .. (now - window))
+local extra = redis.call("ZCARD", KEYS[1]) - tonumber(ARGV[3])
+local base = tonumber(ARGV[4])
+if extra > 0 and base > 0 then
+	local delay = tonumber(ARGV[5])
+	if extra < 32 then
+		delay = math.min(base * 2 ^ (extra - 1), delay)
+	end
+	local last = redis.call("ZRANGE", KEYS[1], -1, -1, "WITHSCORES")
+	local wait = tonumber(last[2]) + delay - now
+	if wait > 0 then
+		return math.ceil(wait)
+	end
+end
+redis.call("ZADD", KEYS[1], now, ARGV[6])
+redis.call("PEXPIRE", KEYS[1], window)
+return 0
+`)
+
+// ReserveLoginAttempt records an attempt for key as a failure, unless the
+// key is locked out or has to wait: after limit.FreeAttempts failures within
+// the window every attempt waits cfg.BaseDelay, doubled per failure up to
+// cfg.MaxDelay. It returns the id of the reserved attempt, or how long to
+// wait.
+func (s *storage) ReserveLoginAttempt(ctx context.Context, key string, cfg config.LoginThrottle, limit config.ThrottleLimit) (string, time.Duration, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", 0, err
+	}
+
+	now := s.now()
+	id := strconv.FormatInt(now.UnixNano(), 10) + "-" + hex.EncodeToString(suffix)
+
+	keys := []string{loginFailuresKey(key), loginLockoutKey(key)}
+	wait, err := reserveAttemptScript.Run(ctx, s.redis, keys,
+		now.UnixMilli(), cfg.Window.Milliseconds(), limit.FreeAttempts,
+		cfg.BaseDelay.Milliseconds(), cfg.MaxDelay.Milliseconds(), id).Int64()
+	if err != nil {
+		return "", 0, err
+	}
+
+	if wait > 0 {
+		return "", time.Duration(wait) * time.Millisecond, nil
+	}
+
+	return id, 0, nil
+}
+
+// ReleaseLoginAttempt forgets a reserved attempt that did not fail.
+func (s *storage) ReleaseLoginAttempt(ctx context.Context, key string, id string) error {
+	return s.redis.ZRem(ctx, loginFailuresKey(key), id).Err()
+}
+
+// LoginFailures returns how many logins failed for key within the window,
+// attempts still reserved included.
+func (s *storage) LoginFailures(ctx context.Context, key string, window time.Duration) (int, error) {
+	since := s.now().Add(-window).UnixMilli()
+
+	n, err := s.redis.ZCount(ctx, loginFailuresKey(key), strconv.FormatInt(since, 10), "+inf").Result()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+// LockLogin blocks logins for key for the given duration.
+func (s *storage) LockLogin(ctx context.Context, key string, duration time.Duration) error {
+	return s.redis.Set(ctx, loginLockoutKey(key), "1", duration).Err()
+}
+
+// ClearLoginFailures forgets the failures and lifts the lockout of key.
+func (s *storage) ClearLoginFailures(ctx context.Context, key string) error {
+	return s.redis.Del(ctx, loginFailuresKey(key), loginLockoutKey(key)).Err()
+}
+
+func loginFailuresKey(key string) string {
+	return "login_failures:" + key
+}
+
+func loginLockoutKey(key string) string {
+	return "login_lockout:" + key
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	"github.com/Blxssy/social-media/auth-service/internal/config"
+)
+
+const throttleKey = "email:alice@example.com"
+
+// clock is a time that tests move forward by hand.
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func newThrottleStorage(t *testing.T) (*storage, *clock) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	c := &clock{t: time.Unix(1700000000, 0)}
+
+	return &storage{redis: client, now: c.now}, c
+}
+
+func TestReserveLoginAttemptDelays(t *testing.T) {
+	s, c := newThrottleStorage(t)
+	ctx := context.Background()
+
+	cfg := config.LoginThrottle{Window: time.Hour, BaseDelay: time.Second, MaxDelay: 4 * time.Second}
+	limit := config.ThrottleLimit{FreeAttempts: 2}
+
+	// Each attempt is made after advancing the clock by after. Waits count
+	// from the last failure and double per failure beyond the free ones.
+	attempts := []struct {
+		after    time.Duration
+		wantWait time.Duration
+	}{
+		{0, 0},
+		{0, 0},
+		{0, 0},
+		{0, time.Second},
+		{time.Second, 0},
+		{0, 2 * time.Second},
+		{500 * time.Millisecond, 1500 * time.Millisecond},
+		{1500 * time.Millisecond, 0},
+		{0, 4 * time.Second},
+		{4 * time.Second, 0},
+		// Capped at MaxDelay.
+		{0, 4 * time.Second},
+	}
+
+	for i, a := range attempts {
+		c.t = c.t.Add(a.after)
+
+		id, wait, err := s.ReserveLoginAttempt(ctx, throttleKey, cfg, limit)
+		if err != nil {
+			t.Fatalf("attempt %d: %v", i, err)
+		}
+		if wait != a.wantWait {
+			t.Fatalf("attempt %d: wait = %v, want %v", i, wait, a.wantWait)
+		}
+		if (id == "") != (wait > 0) {
+			t.Fatalf("attempt %d: id = %q with wait %v", i, id, wait)
+		}
+	}
+}
+
+func TestReleaseLoginAttempt(t *testing.T) {
+	s, _ := newThrottleStorage(t)
+	ctx := context.Background()
+
+	cfg := config.LoginThrottle{Window: time.Hour, BaseDelay: time.Second, MaxDelay: time.Minute}
+	limit := config.ThrottleLimit{FreeAttempts: 1}
+
+	// Released attempts did not fail, so they never add up to a delay.
+	for i := 0; i < 5; i++ {
+		id, wait, err := s.ReserveLoginAttempt(ctx, throttleKey, cfg, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait != 0 {
+			t.Fatalf("attempt %d: wait = %v after releasing every attempt", i, wait)
+		}
+
+		failures, err := s.LoginFailures(ctx, throttleKey, cfg.Window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failures != 1 {
+			t.Fatalf("attempt %d: %d failures while reserved, want 1", i, failures)
+		}
+
+		if err := s.ReleaseLoginAttempt(ctx, throttleKey, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	failures, err := s.LoginFailures(ctx, throttleKey, cfg.Window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures != 0 {
+		t.Fatalf("%d failures after releasing every attempt, want 0", failures)
+	}
+}
+
+func TestReserveLoginAttemptSlidingWindow(t *testing.T) {
+	s, c := newThrottleStorage(t)
+	ctx := context.Background()
+
+	cfg := config.LoginThrottle{Window: time.Minute, BaseDelay: time.Second, MaxDelay: time.Minute}
+	limit := config.ThrottleLimit{}
+
+	if _, wait, err := s.ReserveLoginAttempt(ctx, throttleKey, cfg, limit); err != nil || wait != 0 {
+		t.Fatalf("first attempt: wait = %v, err = %v", wait, err)
+	}
+	if _, wait, err := s.ReserveLoginAttempt(ctx, throttleKey, cfg, limit); err != nil || wait != time.Second {
+		t.Fatalf("second attempt: wait = %v, err = %v, want 1s", wait, err)
+	}
+
+	// The first failure falls out of the window.
+	c.t = c.t.Add(time.Minute + time.Millisecond)
+
+	if _, wait, err := s.ReserveLoginAttempt(ctx, throttleKey, cfg, limit); err != nil || wait != 0 {
+		t.Fatalf("attempt after the window: wait = %v, err = %v", wait, err)
+	}
+
+	failures, err := s.LoginFailures(ctx, throttleKey, cfg.Window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures != 1 {
+		t.Fatalf("%d failures within the window, want 1", failures)
+	}
+}
+
+func TestLockLogin(t *testing.T) {
+	s, _ := newThrottleStorage(t)
+	ctx := context.Background()
+
+	cfg := config.LoginThrottle{Window: time.Hour, BaseDelay: time.Second, MaxDelay: time.Minute}
+	limit := config.ThrottleLimit{FreeAttempts: 5}
+
+	if err := s.LockLogin(ctx, throttleKey, 10*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	id, wait, err := s.ReserveLoginAttempt(ctx, throttleKey, cfg, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "" || wait != 10*time.Minute {
+		t.Fatalf("locked out attempt: id = %q, wait = %v, want to wait 10m", id, wait)
+	}
+
+	// Other keys are not locked out.
+	if _, wait, err := s.ReserveLoginAttempt(ctx, "ip:192.0.2.1", cfg, limit); err != nil || wait != 0 {
+		t.Fatalf("attempt of another key: wait = %v, err = %v", wait, err)
+	}
+
+	if err := s.ClearLoginFailures(ctx, throttleKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, wait, err := s.ReserveLoginAttempt(ctx, throttleKey, cfg, limit); err != nil || wait != 0 {
+		t.Fatalf("attempt after clearing the lockout: wait = %v, err = %v", wait, err)
+	}
+}
@@ -0,0 +1,117 @@
+package validation
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	BreachFormatPlain = "plain"
+	BreachFormatSHA1  = "sha1"
+)
+
+// BreachList holds passwords known from common password lists or data
+// breaches. Only the first 8 bytes of each SHA-1 digest are kept, sorted, so
+// a million passwords take 8 MB and a lookup is a binary search. The chance
+// of two passwords sharing a prefix is negligible at that size.
+type BreachList struct {
+	prefixes []uint64
+}
+
+// LoadBreachList reads a password list. In the plain format every line is a
+// password. In the sha1 format every line is an uppercase or lowercase
+// SHA-1 hex digest, optionally followed by ":count" as in the Have I Been
+// Pwned downloads; digests seen fewer than minCount times are skipped.
+func LoadBreachList(path string, format string, minCount int) (*BreachList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var prefixes []uint64
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		switch format {
+		case BreachFormatPlain:
+			prefixes = append(prefixes, passwordPrefix(line))
+		case BreachFormatSHA1:
+			prefix, count, err := parseSHA1Line(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+			}
+			if count >= minCount {
+				prefixes = append(prefixes, prefix)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported breach list format %q", format)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	slices.Sort(prefixes)
+
+	return &BreachList{prefixes: slices.Clip(slices.Compact(prefixes))}, nil
+}
+
+// Contains reports whether the password, or its lowercase form, is listed.
+func (b *BreachList) Contains(password string) bool {
+	if b.contains(passwordPrefix(password)) {
+		return true
+	}
+
+	lower := strings.ToLower(password)
+	return lower != password && b.contains(passwordPrefix(lower))
+}
+
+// Len is the number of distinct passwords in the list.
+func (b *BreachList) Len() int {
+	return len(b.prefixes)
+}
+
+func (b *BreachList) contains(prefix uint64) bool {
+	_, found := slices.BinarySearch(b.prefixes, prefix)
+	return found
+}
+
+func passwordPrefix(password string) uint64 {
+	sum := sha1.Sum([]byte(password))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func parseSHA1Line(line string) (uint64, int, error) {
+	digest, countStr, hasCount := strings.Cut(line, ":")
+	if len(digest) != sha1.Size*2 {
+		return 0, 0, fmt.Errorf("invalid SHA-1 digest %q", digest)
+	}
+
+	raw, err := hex.DecodeString(digest)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid SHA-1 digest %q", digest)
+	}
+
+	count := 1
+	if hasCount {
+		count, err = strconv.Atoi(strings.TrimSpace(countStr))
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid count %q", countStr)
+		}
+	}
+
+	return binary.BigEndian.Uint64(raw[:8]), count, nil
+}
@@ -0,0 +1,179 @@
+package validation_test
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Blxssy/social-media/auth-service/internal/validation"
+)
+
+// writeList writes a password list with one line per entry.
+func writeList(t *testing.T, lines ...string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "passwords.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestLoadBreachListPlain(t *testing.T) {
+	path := writeList(t, "password", "  qwerty  ", "", "letmein", "password")
+
+	list, err := validation.LoadBreachList(path, validation.BreachFormatPlain, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if list.Len() != 3 {
+		t.Errorf("Len = %d, want 3 distinct passwords", list.Len())
+	}
+
+	tests := []struct {
+		password string
+		want     bool
+	}{
+		{"password", true},
+		{"qwerty", true},
+		{"letmein", true},
+		// Uppercase variants of listed passwords are breached too.
+		{"PASSWORD", true},
+		{"LetMeIn", true},
+		{"password1", false},
+		{"correct horse battery staple", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := list.Contains(tt.password); got != tt.want {
+			t.Errorf("Contains(%q) = %v, want %v", tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestLoadBreachListSHA1(t *testing.T) {
+	path := writeList(t,
+		strings.ToUpper(sha1Hex("password"))+":10",
+		sha1Hex("qwerty")+":2",
+		sha1Hex("letmein"),
+	)
+
+	tests := []struct {
+		minCount int
+		want     map[string]bool
+	}{
+		{0, map[string]bool{"password": true, "qwerty": true, "letmein": true}},
+		// A digest without a count was seen once.
+		{2, map[string]bool{"password": true, "qwerty": true, "letmein": false}},
+		{3, map[string]bool{"password": true, "qwerty": false, "letmein": false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("minCount %d", tt.minCount), func(t *testing.T) {
+			list, err := validation.LoadBreachList(path, validation.BreachFormatSHA1, tt.minCount)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for password, want := range tt.want {
+				if got := list.Contains(password); got != want {
+					t.Errorf("Contains(%q) = %v, want %v", password, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestBreachListSearch checks the binary search over a list far larger than
+// its unsorted input could pass by chance.
+func TestBreachListSearch(t *testing.T) {
+	var lines []string
+	for i := 0; i < 5000; i++ {
+		lines = append(lines, sha1Hex(fmt.Sprintf("password%d", i)))
+	}
+
+	list, err := validation.LoadBreachList(writeList(t, lines...), validation.BreachFormatSHA1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if list.Len() != 5000 {
+		t.Fatalf("Len = %d, want 5000", list.Len())
+	}
+
+	for i := 0; i < 5000; i++ {
+		if password := fmt.Sprintf("password%d", i); !list.Contains(password) {
+			t.Fatalf("Contains(%q) = false", password)
+		}
+	}
+
+	for i := 5000; i < 10000; i++ {
+		if password := fmt.Sprintf("password%d", i); list.Contains(password) {
+			t.Fatalf("Contains(%q) = true", password)
+		}
+	}
+}
+
+// TestBreachListMatchesPrefix checks that only the first 8 bytes of a digest
+// are compared.
+func TestBreachListMatchesPrefix(t *testing.T) {
+	digest := sha1Hex("password")
+	other := digest[:16] + strings.Repeat("0", len(digest)-16)
+
+	list, err := validation.LoadBreachList(writeList(t, other), validation.BreachFormatSHA1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !list.Contains("password") {
+		t.Fatal("a digest sharing the 8 byte prefix did not match")
+	}
+}
+
+func TestLoadBreachListRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		line   string
+	}{
+		{"short digest", validation.BreachFormatSHA1, sha1Hex("password")[:39]},
+		{"not hex", validation.BreachFormatSHA1, strings.Repeat("z", 40)},
+		{"invalid count", validation.BreachFormatSHA1, sha1Hex("password") + ":many"},
+		{"unsupported format", "md5", "password"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := validation.LoadBreachList(writeList(t, tt.line), tt.format, 0); err == nil {
+				t.Fatal("LoadBreachList accepted the list")
+			}
+		})
+	}
+
+	if _, err := validation.LoadBreachList(filepath.Join(t.TempDir(), "missing.txt"), validation.BreachFormatPlain, 0); err == nil {
+		t.Fatal("LoadBreachList accepted a missing file")
+	}
+}
+
+func TestShippedBreachList(t *testing.T) {
+	list, err := validation.LoadBreachList("../../data/common-passwords.txt", validation.BreachFormatPlain, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !list.Contains("123456") || !list.Contains("password") {
+		t.Fatal("the shipped list misses the most common passwords")
+	}
+}
@@ -0,0 +1,211 @@
+// Package validation checks and normalizes user input of the auth-service.
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Blxssy/social-media/auth-service/internal/config"
+)
+
+const (
+	// maxEmailLength is the longest address SMTP can deliver to (RFC 5321).
+	maxEmailLength = 254
+
+	minUsernameLength = 3
+
+	// bcryptMaxBytes is how much of a password bcrypt looks at. Longer
+	// passwords would silently share a hash with their first 72 bytes.
+	bcryptMaxBytes = 72
+)
+
+// MaxUsernameLength is the longest username CheckUsername accepts.
+const MaxUsernameLength = 30
+
+// reservedUsernames could be mistaken for the service itself or its staff.
+var reservedUsernames = map[string]bool{
+	"admin": true, "administrator": true, "api": true, "auth": true,
+	"help": true, "info": true, "mod": true, "moderator": true,
+	"null": true, "undefined": true, "root": true, "security": true,
+	"staff": true, "support": true, "system": true, "official": true,
+	"me": true, "settings": true, "login": true, "logout": true,
+	"register": true, "signup": true, "signin": true, "www": true,
+}
+
+// NormalizeEmail parses a bare RFC 5322 address ("user@example.com", without
+// a display name) and returns it trimmed and lowercased.
+func NormalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return "", errors.New("missing email")
+	}
+
+	if len(email) > maxEmailLength {
+		return "", fmt.Errorf("email must be at most %d characters", maxEmailLength)
+	}
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email {
+		return "", errors.New("invalid email address")
+	}
+
+	domain := email[strings.LastIndexByte(email, '@')+1:]
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, "[") {
+		return "", errors.New("invalid email domain")
+	}
+
+	return strings.ToLower(email), nil
+}
+
+// CheckUsername returns every rule the username breaks: 3 to 30 letters,
+// digits, underscores or dots, starting with a letter or digit, without
+// consecutive dots and not a reserved word.
+func CheckUsername(username string) []string {
+	if username == "" {
+		return []string{"missing username"}
+	}
+
+	var problems []string
+
+	if n := utf8.RuneCountInString(username); n < minUsernameLength || n > MaxUsernameLength {
+		problems = append(problems, fmt.Sprintf("username must be %d to %d characters", minUsernameLength, MaxUsernameLength))
+	}
+
+	for _, r := range username {
+		if !isUsernameRune(r) {
+			problems = append(problems, "username may only contain letters, digits, underscores and dots")
+			break
+		}
+	}
+
+	if first, _ := utf8.DecodeRuneInString(username); !unicode.IsLetter(first) && !unicode.IsDigit(first) {
+		problems = append(problems, "username must start with a letter or digit")
+	}
+
+	if strings.Contains(username, "..") || strings.HasSuffix(username, ".") {
+		problems = append(problems, "username must not end with a dot or contain consecutive dots")
+	}
+
+	if reservedUsernames[strings.ToLower(username)] {
+		problems = append(problems, "username is reserved")
+	}
+
+	return problems
+}
+
+func isUsernameRune(r rune) bool {
+	return r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.')
+}
+
+// PasswordPolicy checks new passwords against config.PasswordPolicy.
+type PasswordPolicy struct {
+	cfg    config.PasswordPolicy
+	breach *BreachList
+}
+
+// NewPasswordPolicy creates the policy and loads its breach list, if one is
+// configured. It fails when the list is required but missing or smaller than
+// cfg.BreachList.MinPasswords.
+func NewPasswordPolicy(cfg config.PasswordPolicy) (*PasswordPolicy, error) {
+	if cfg.MaxBytes <= 0 || cfg.MaxBytes > bcryptMaxBytes {
+		cfg.MaxBytes = bcryptMaxBytes
+	}
+
+	p := &PasswordPolicy{cfg: cfg}
+
+	if cfg.BreachList.Path == "" && cfg.BreachList.MinPasswords > 0 {
+		return nil, errors.New("a breach list is required: set breachList.path")
+	}
+
+	if cfg.BreachList.Path != "" {
+		format := cfg.BreachList.Format
+		if format == "" {
+			format = BreachFormatPlain
+		}
+
+		breach, err := LoadBreachList(cfg.BreachList.Path, format, cfg.BreachList.MinCount)
+		if err != nil {
+			return nil, fmt.Errorf("load breach list: %w", err)
+		}
+		p.breach = breach
+
+		if n := breach.Len(); n < cfg.BreachList.MinPasswords {
+			return nil, fmt.Errorf("breach list %s has %d passwords, at least %d are required", cfg.BreachList.Path, n, cfg.BreachList.MinPasswords)
+		}
+	}
+
+	return p, nil
+}
+
+// BreachListSize is the number of passwords in the breach list, zero when
+// none is configured.
+func (p *PasswordPolicy) BreachListSize() int {
+	if p.breach == nil {
+		return 0
+	}
+	return p.breach.Len()
+}
+
+// Check returns every rule of the policy the password breaks.
+func (p *PasswordPolicy) Check(password string) []string {
+	if password == "" {
+		return []string{"missing password"}
+	}
+
+	var problems []string
+
+	if utf8.RuneCountInString(password) < p.cfg.MinLength {
+		problems = append(problems, fmt.Sprintf("password must be at least %d characters", p.cfg.MinLength))
+	}
+
+	if problem := p.CheckLength(password); problem != "" {
+		problems = append(problems, problem)
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+
+	if p.cfg.RequireUpper && !upper {
+		problems = append(problems, "password must contain an uppercase letter")
+	}
+	if p.cfg.RequireLower && !lower {
+		problems = append(problems, "password must contain a lowercase letter")
+	}
+	if p.cfg.RequireDigit && !digit {
+		problems = append(problems, "password must contain a digit")
+	}
+	if p.cfg.RequireSymbol && !symbol {
+		problems = append(problems, "password must contain a symbol")
+	}
+
+	if p.breach != nil && p.breach.Contains(password) {
+		problems = append(problems, "password is too common or appeared in a data breach")
+	}
+
+	return problems
+}
+
+// CheckLength only checks the maximum length. It applies to passwords that
+// are checked against a stored hash, which older policies may have allowed
+// to be weak but never longer.
+func (p *PasswordPolicy) CheckLength(password string) string {
+	if len(password) > p.cfg.MaxBytes {
+		return fmt.Sprintf("password must be at most %d bytes", p.cfg.MaxBytes)
+	}
+	return ""
+}
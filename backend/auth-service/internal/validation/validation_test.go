@@ -0,0 +1,190 @@
+package validation_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Blxssy/social-media/auth-service/internal/config"
+	"github.com/Blxssy/social-media/auth-service/internal/validation"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		name    string
+		email   string
+		want    string
+		wantErr bool
+	}{
+		{name: "plain", email: "alice@example.com", want: "alice@example.com"},
+		{name: "lowercased", email: "Alice@Example.COM", want: "alice@example.com"},
+		{name: "trimmed", email: "  alice@example.com\n", want: "alice@example.com"},
+		{name: "plus tag", email: "alice+news@mail.example.com", want: "alice+news@mail.example.com"},
+		{name: "empty", email: "   ", wantErr: true},
+		{name: "no at sign", email: "alice.example.com", wantErr: true},
+		{name: "no local part", email: "@example.com", wantErr: true},
+		{name: "display name", email: "Alice <alice@example.com>", wantErr: true},
+		{name: "angle brackets", email: "<alice@example.com>", wantErr: true},
+		{name: "two addresses", email: "alice@example.com, bob@example.com", wantErr: true},
+		{name: "dotless domain", email: "alice@localhost", wantErr: true},
+		{name: "address literal", email: "alice@[192.0.2.1]", wantErr: true},
+		{name: "too long", email: strings.Repeat("a", 64) + "@" + strings.Repeat("b", 186) + ".com", wantErr: true},
+		{name: "longest", email: strings.Repeat("a", 64) + "@" + strings.Repeat("b", 185) + ".com", want: strings.Repeat("a", 64) + "@" + strings.Repeat("b", 185) + ".com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validation.NormalizeEmail(tt.email)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("NormalizeEmail(%q) = %q, want an error", tt.email, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("NormalizeEmail(%q) = %q, want %q", tt.email, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckUsername(t *testing.T) {
+	const (
+		length   = "username must be 3 to 30 characters"
+		charset  = "username may only contain letters, digits, underscores and dots"
+		start    = "username must start with a letter or digit"
+		dots     = "username must not end with a dot or contain consecutive dots"
+		reserved = "username is reserved"
+	)
+
+	tests := []struct {
+		name     string
+		username string
+		want     []string
+	}{
+		{name: "valid", username: "alice_w.99"},
+		{name: "starts with a digit", username: "99alice"},
+		{name: "shortest", username: "abc"},
+		{name: "longest", username: strings.Repeat("a", 30)},
+		{name: "missing", username: "", want: []string{"missing username"}},
+		{name: "too short", username: "ab", want: []string{length}},
+		{name: "too long", username: strings.Repeat("a", 31), want: []string{length}},
+		{name: "space", username: "alice w", want: []string{charset}},
+		{name: "hyphen", username: "alice-w", want: []string{charset}},
+		{name: "non-ASCII letter", username: "alicé", want: []string{charset}},
+		{name: "starts with an underscore", username: "_alice", want: []string{start}},
+		{name: "starts with a dot", username: ".alice", want: []string{start}},
+		{name: "consecutive dots", username: "alice..w", want: []string{dots}},
+		{name: "ends with a dot", username: "alice.", want: []string{dots}},
+		{name: "reserved", username: "admin", want: []string{reserved}},
+		{name: "reserved in another case", username: "Support", want: []string{reserved}},
+		{name: "several rules", username: "-a", want: []string{length, charset, start}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validation.CheckUsername(tt.username); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CheckUsername(%q) = %q, want %q", tt.username, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	const (
+		minLength = "password must be at least 10 characters"
+		maxBytes  = "password must be at most 72 bytes"
+		upper     = "password must contain an uppercase letter"
+		lower     = "password must contain a lowercase letter"
+		digit     = "password must contain a digit"
+		symbol    = "password must contain a symbol"
+		breached  = "password is too common or appeared in a data breach"
+	)
+
+	policy, err := validation.NewPasswordPolicy(config.PasswordPolicy{
+		MinLength:     10,
+		MaxBytes:      100, // capped to what bcrypt looks at
+		RequireUpper:  true,
+		RequireLower:  true,
+		RequireDigit:  true,
+		RequireSymbol: true,
+		BreachList:    config.BreachList{Path: writeList(t, "Password123!")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		want     []string
+	}{
+		{name: "valid", password: "Correct-Horse-7"},
+		{name: "symbol is a space", password: "Correct Horse 7"},
+		{name: "multibyte characters count once", password: "Ünïcödé-pä7"},
+		{name: "missing", password: "", want: []string{"missing password"}},
+		{name: "too short", password: "Short-7", want: []string{minLength}},
+		{name: "too long", password: "Aa1!" + strings.Repeat("a", 69), want: []string{maxBytes}},
+		{name: "no uppercase letter", password: "correct-horse-7", want: []string{upper}},
+		{name: "no lowercase letter", password: "CORRECT-HORSE-7", want: []string{lower}},
+		{name: "no digit", password: "Correct-Horse-X", want: []string{digit}},
+		{name: "no symbol", password: "CorrectHorse7", want: []string{symbol}},
+		{name: "breached", password: "Password123!", want: []string{breached}},
+		{name: "several rules", password: "abc", want: []string{minLength, upper, digit, symbol}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.Check(tt.password); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Check(%q) = %q, want %q", tt.password, got, tt.want)
+			}
+		})
+	}
+
+	if policy.BreachListSize() != 1 {
+		t.Errorf("BreachListSize = %d, want 1", policy.BreachListSize())
+	}
+}
+
+func TestPasswordPolicyDefaults(t *testing.T) {
+	// Without requirements any non-empty password up to 72 bytes passes.
+	policy, err := validation.NewPasswordPolicy(config.PasswordPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := policy.Check("a"); got != nil {
+		t.Errorf("Check = %q, want no problems", got)
+	}
+	if got := policy.CheckLength(strings.Repeat("a", 73)); got == "" {
+		t.Error("CheckLength accepted 73 bytes")
+	}
+	if policy.BreachListSize() != 0 {
+		t.Errorf("BreachListSize = %d, want 0", policy.BreachListSize())
+	}
+}
+
+func TestPasswordPolicyMinPasswords(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    config.BreachList
+		wantErr bool
+	}{
+		{name: "not required", list: config.BreachList{}},
+		{name: "required but missing", list: config.BreachList{MinPasswords: 1}, wantErr: true},
+		{name: "too small", list: config.BreachList{Path: writeList(t, "123456", "password"), MinPasswords: 3}, wantErr: true},
+		{name: "large enough", list: config.BreachList{Path: writeList(t, "123456", "password", "qwerty"), MinPasswords: 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := validation.NewPasswordPolicy(config.PasswordPolicy{BreachList: tt.list})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package authn
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Policy says who may call a method.
+type Policy struct {
+	kind       policyKind
+	permission string
+}
+
+type policyKind int
+
+const (
+	public policyKind = iota
+	authenticated
+	session
+	admin
+	service
+	permission
+)
+
+var (
+	// Public methods can be called by anyone. A valid access token still
+	// puts its principal into the context.
+	Public = Policy{kind: public}
+	// Authenticated methods require a valid access token or API key of a
+	// user. Tokens OAuth clients hold for themselves are refused.
+	Authenticated = Policy{kind: authenticated}
+	// Session methods require a valid access token of a user who signed in
+	// to our own apps. API keys and tokens of OAuth clients are refused.
+	Session = Policy{kind: session}
+	// Admin methods require a principal with the admin role. API keys and
+	// OAuth clients have no roles, so they are refused as well.
+	Admin = Policy{kind: admin}
+	// Service methods are for other services, such as token introspection.
+	// They require the admin role or the ScopeIntrospect scope, which the
+	// API keys of services carry.
+	Service = Policy{kind: service}
+)
+
+// Permission methods require a user signed in to our own apps whose roles
+// grant the permission, as the PermissionChecker of the interceptor tells.
+// API keys and OAuth clients have no roles, so they are refused.
+func Permission(name string) Policy {
+	return Policy{kind: permission, permission: name}
+}
+
+// PermissionChecker tells whether the roles of a principal grant a
+// permission.
+type PermissionChecker interface {
+	HasPermission(ctx context.Context, p *Principal, permission string) (bool, error)
+}
+
+// ScopeIntrospect lets an API key call Service methods.
+const ScopeIntrospect = "tokens:introspect"
+
+// APIKeyHeader is the metadata an API key may be sent in instead of the
+// authorization metadata.
+const APIKeyHeader = "x-api-key"
+
+// Verifier turns a bearer token or API key into the principal it belongs to.
+type Verifier interface {
+	Verify(ctx context.Context, token string) (*Principal, error)
+}
+
+// Methods maps full method names ("/package.Service/Method") to their
+// policy.
+type Methods map[string]Policy
+
+// Interceptor authenticates gRPC calls with the "authorization: Bearer"
+// metadata, or the APIKeyHeader one, and enforces the policy of the called
+// method. Methods missing from the table get the default policy.
+type Interceptor struct {
+	verifier      Verifier
+	permissions   PermissionChecker
+	methods       Methods
+	defaultPolicy Policy
+}
+
+// NewInterceptor creates the interceptor. Without a PermissionChecker,
+// methods with a Permission policy are refused to everyone.
+func NewInterceptor(verifier Verifier, permissions PermissionChecker, methods Methods, defaultPolicy Policy) *Interceptor {
+	return &Interceptor{
+		verifier:      verifier,
+		permissions:   permissions,
+		methods:       methods,
+		defaultPolicy: defaultPolicy,
+	}
+}
+
+func (i *Interceptor) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := i.authorize(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+func (i *Interceptor) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := i.authorize(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+
+		return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+func (i *Interceptor) authorize(ctx context.Context, method string) (context.Context, error) {
+	policy, ok := i.methods[method]
+	if !ok {
+		policy = i.defaultPolicy
+	}
+
+	token, err := BearerToken(ctx)
+	if errors.Is(err, ErrMissingToken) {
+		if key, ok := APIKey(ctx); ok {
+			token, err = key, nil
+		}
+	}
+	if err != nil {
+		if policy == Public {
+			return ctx, nil
+		}
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	principal, err := i.verifier.Verify(ctx, token)
+	if err != nil {
+		if policy == Public {
+			return ctx, nil
+		}
+		return nil, status.Error(codes.Unauthenticated, "invalid access token")
+	}
+
+	if policy != Public && policy != Service && !principal.ActsForUser() {
+		return nil, status.Error(codes.PermissionDenied, "a user is required")
+	}
+
+	if (policy == Session || policy.kind == permission) && !principal.FirstParty() {
+		return nil, status.Error(codes.PermissionDenied, "a signed in user is required")
+	}
+
+	if policy.kind == permission {
+		if err := i.checkPermission(ctx, principal, policy.permission); err != nil {
+			return nil, err
+		}
+	}
+
+	if policy == Admin && !principal.IsAdmin() {
+		return nil, status.Error(codes.PermissionDenied, "admin access required")
+	}
+
+	if policy == Service && !principal.IsService() {
+		return nil, status.Error(codes.PermissionDenied, "service access required")
+	}
+
+	return NewContext(ctx, principal), nil
+}
+
+func (i *Interceptor) checkPermission(ctx context.Context, p *Principal, permission string) error {
+	if i.permissions == nil {
+		return status.Error(codes.PermissionDenied, "permission "+permission+" required")
+	}
+
+	allowed, err := i.permissions.HasPermission(ctx, p, permission)
+	if err != nil {
+		return status.Error(codes.Internal, "failed to check permission")
+	}
+	if !allowed {
+		return status.Error(codes.PermissionDenied, "permission "+permission+" required")
+	}
+
+	return nil
+}
+
+// BearerToken returns the token of the "authorization: Bearer <token>"
+// metadata.
+func BearerToken(ctx context.Context) (string, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", ErrMissingToken
+	}
+
+	values := md.Get("authorization")
+	if len(values) == 0 || values[0] == "" {
+		return "", ErrMissingToken
+	}
+
+	parts := strings.SplitN(values[0], " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") || parts[1] == "" {
+		return "", ErrInvalidHeader
+	}
+
+	return parts[1], nil
+}
+
+// APIKey returns the key of the APIKeyHeader metadata.
+func APIKey(ctx context.Context) (string, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", false
+	}
+
+	values := md.Get(APIKeyHeader)
+	if len(values) == 0 || values[0] == "" {
+		return "", false
+	}
+
+	return values[0], true
+}
+
+// serverStream overrides the context of a stream with the one carrying the
+// principal.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,197 @@
+package authn_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/Blxssy/social-media/auth-service/pkg/authn"
+)
+
+// verifier knows the principal of each of its tokens.
+type verifier map[string]*authn.Principal
+
+func (v verifier) Verify(_ context.Context, token string) (*authn.Principal, error) {
+	p, ok := v[token]
+	if !ok {
+		return nil, errors.New("invalid token")
+	}
+	return p, nil
+}
+
+// rolePermissions are the permissions granted by each role.
+var rolePermissions = map[string][]string{
+	authn.RoleAdmin: {permUnlock},
+	"support":       {permUnlock},
+}
+
+const permUnlock = "logins:unlock"
+
+func (v verifier) HasPermission(_ context.Context, p *authn.Principal, permission string) (bool, error) {
+	for _, role := range p.Roles {
+		perms, ok := rolePermissions[role]
+		if !ok {
+			return false, errors.New("unknown role")
+		}
+		for _, perm := range perms {
+			if perm == permission {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+var principals = verifier{
+	"user":        {UserID: 1, SessionID: "s1"},
+	"admin":       {UserID: 2, Roles: []string{authn.RoleAdmin}, SessionID: "s2"},
+	"api-key":     {UserID: 1, APIKey: true, Scopes: []string{"posts:read"}},
+	"service-key": {UserID: 3, APIKey: true, Scopes: []string{authn.ScopeIntrospect}},
+	"third-party": {UserID: 1, ClientID: "app", Scopes: []string{"posts:read"}},
+	"client":      {Client: true, ClientID: "app"},
+	"client-introspect": {
+		Client: true, ClientID: "service", Scopes: []string{authn.ScopeIntrospect},
+	},
+	"no-user":     {SessionID: "s3"},
+	"support":     {UserID: 4, Roles: []string{"support"}, SessionID: "s4"},
+	"support-key": {UserID: 4, Roles: []string{"support"}, APIKey: true},
+	"broken-role": {UserID: 5, Roles: []string{"broken"}, SessionID: "s5"},
+}
+
+var policies = authn.Methods{
+	"/test.Service/Public":        authn.Public,
+	"/test.Service/Authenticated": authn.Authenticated,
+	"/test.Service/Session":       authn.Session,
+	"/test.Service/Admin":         authn.Admin,
+	"/test.Service/Service":       authn.Service,
+	"/test.Service/Permission":    authn.Permission(permUnlock),
+}
+
+// call makes a unary call of method with md and returns the principal the
+// handler saw.
+func call(method string, md metadata.MD) (*authn.Principal, error) {
+	interceptor := authn.NewInterceptor(principals, principals, policies, authn.Session).UnaryServerInterceptor()
+
+	ctx := context.Background()
+	if md != nil {
+		ctx = metadata.NewIncomingContext(ctx, md)
+	}
+
+	var got *authn.Principal
+	_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		got, _ = authn.FromContext(ctx)
+		return nil, nil
+	})
+
+	return got, err
+}
+
+func bearer(token string) metadata.MD {
+	return metadata.Pairs("authorization", "Bearer "+token)
+}
+
+func TestInterceptorPolicies(t *testing.T) {
+	const (
+		ok              = codes.OK
+		unauthenticated = codes.Unauthenticated
+		denied          = codes.PermissionDenied
+		internal        = codes.Internal
+	)
+
+	// want lists the outcome per policy, in the order Public,
+	// Authenticated, Session, Admin, Service, Permission.
+	tests := []struct {
+		name  string
+		md    metadata.MD
+		token string
+		want  [6]codes.Code
+	}{
+		{name: "user", md: bearer("user"), token: "user", want: [6]codes.Code{ok, ok, ok, denied, denied, denied}},
+		{name: "admin", md: bearer("admin"), token: "admin", want: [6]codes.Code{ok, ok, ok, ok, ok, ok}},
+		{name: "api key", md: metadata.Pairs(authn.APIKeyHeader, "api-key"), token: "api-key", want: [6]codes.Code{ok, ok, denied, denied, denied, denied}},
+		{name: "api key as bearer", md: bearer("api-key"), token: "api-key", want: [6]codes.Code{ok, ok, denied, denied, denied, denied}},
+		{name: "service api key", md: metadata.Pairs(authn.APIKeyHeader, "service-key"), token: "service-key", want: [6]codes.Code{ok, ok, denied, denied, ok, denied}},
+		{name: "third-party app", md: bearer("third-party"), token: "third-party", want: [6]codes.Code{ok, ok, denied, denied, denied, denied}},
+		{name: "client", md: bearer("client"), token: "client", want: [6]codes.Code{ok, denied, denied, denied, denied, denied}},
+		{name: "client with introspect scope", md: bearer("client-introspect"), token: "client-introspect", want: [6]codes.Code{ok, denied, denied, denied, ok, denied}},
+		{name: "principal without user", md: bearer("no-user"), token: "no-user", want: [6]codes.Code{ok, denied, denied, denied, denied, denied}},
+		{name: "support", md: bearer("support"), token: "support", want: [6]codes.Code{ok, ok, ok, denied, denied, ok}},
+		{name: "support api key", md: metadata.Pairs(authn.APIKeyHeader, "support-key"), token: "support-key", want: [6]codes.Code{ok, ok, denied, denied, denied, denied}},
+		{name: "failing permission check", md: bearer("broken-role"), token: "broken-role", want: [6]codes.Code{ok, ok, ok, denied, denied, internal}},
+		{name: "missing", md: nil, want: [6]codes.Code{ok, unauthenticated, unauthenticated, unauthenticated, unauthenticated, unauthenticated}},
+		{name: "empty metadata", md: metadata.MD{}, want: [6]codes.Code{ok, unauthenticated, unauthenticated, unauthenticated, unauthenticated, unauthenticated}},
+		{name: "invalid token", md: bearer("forged"), want: [6]codes.Code{ok, unauthenticated, unauthenticated, unauthenticated, unauthenticated, unauthenticated}},
+		{name: "malformed header", md: metadata.Pairs("authorization", "Basic dXNlcg=="), want: [6]codes.Code{ok, unauthenticated, unauthenticated, unauthenticated, unauthenticated, unauthenticated}},
+	}
+
+	methods := []string{"Public", "Authenticated", "Session", "Admin", "Service", "Permission"}
+
+	for _, tt := range tests {
+		for i, method := range methods {
+			t.Run(tt.name+"/"+method, func(t *testing.T) {
+				got, err := call("/test.Service/"+method, tt.md)
+				if code := status.Code(err); code != tt.want[i] {
+					t.Fatalf("code = %v, want %v (err %v)", code, tt.want[i], err)
+				}
+				if err != nil {
+					return
+				}
+
+				// The handler gets the principal of a valid token, even
+				// for public methods.
+				if want := principals[tt.token]; got != want {
+					t.Errorf("principal = %+v, want %+v", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestInterceptorDefaultPolicy(t *testing.T) {
+	// Methods missing from the table get the default policy, Session here.
+	if _, err := call("/test.Service/Unlisted", bearer("api-key")); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("api key: err = %v, want PermissionDenied", err)
+	}
+	if _, err := call("/test.Service/Unlisted", bearer("user")); err != nil {
+		t.Errorf("user: %v", err)
+	}
+}
+
+func TestActsForUser(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		want  bool
+	}{
+		{name: "user", token: "user", want: true},
+		{name: "api key", token: "api-key", want: true},
+		{name: "third-party app", token: "third-party", want: true},
+		{name: "client", token: "client", want: false},
+		{name: "no user", token: "no-user", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := principals[tt.token].ActsForUser(); got != tt.want {
+				t.Errorf("ActsForUser = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInterceptorWithoutPermissionChecker(t *testing.T) {
+	interceptor := authn.NewInterceptor(principals, nil, policies, authn.Session).UnaryServerInterceptor()
+
+	ctx := metadata.NewIncomingContext(context.Background(), bearer("admin"))
+	_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/test.Service/Permission"}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("err = %v, want PermissionDenied", err)
+	}
+}
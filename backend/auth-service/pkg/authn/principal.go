@@ -0,0 +1,98 @@
+package authn
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RoleAdmin is the role of admins, who may call Admin methods. The role
+// models of services using authn must name their admin role after it.
+const RoleAdmin = "admin"
+
+// Principal is the authenticated caller of a request. Callers with an API
+// key act for the key's owner but only carry the key's scopes: they have no
+// roles and no session. ExpiresAt is zero for API keys that never expire.
+// Likewise, third-party apps with an OAuth token have their ClientID set and
+// only carry the scopes the user granted. With a token of the
+// client_credentials grant they act for no user: Client is set and UserID is
+// zero. Such principals are only let through to Public and Service methods.
+type Principal struct {
+	UserID    uint
+	Roles     []string
+	Scopes    []string
+	APIKey    bool
+	Client    bool
+	ClientID  string
+	SessionID string
+	TokenID   string
+	ExpiresAt time.Time
+}
+
+// HasRole reports whether the principal has role.
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope reports whether the API key or OAuth token of the principal
+// grants scope.
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// FirstParty reports whether the principal is a user signed in to our own
+// apps, rather than an API key or a third-party app.
+func (p *Principal) FirstParty() bool {
+	return !p.APIKey && p.ClientID == ""
+}
+
+// ActsForUser reports whether the principal acts for the user UserID, as
+// every principal but those of OAuth clients acting for themselves does.
+func (p *Principal) ActsForUser() bool {
+	return !p.Client && p.UserID != 0
+}
+
+func (p *Principal) IsAdmin() bool {
+	return p.HasRole(RoleAdmin)
+}
+
+// IsService reports whether the principal may call Service methods.
+func (p *Principal) IsService() bool {
+	return p.IsAdmin() || p.HasScope(ScopeIntrospect)
+}
+
+type principalKey struct{}
+
+// NewContext returns a copy of ctx carrying p.
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal stored by the interceptor, if any.
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+// Require returns the principal of ctx or an Unauthenticated error. Handlers
+// of methods marked Authenticated in the method table use it to get the
+// caller.
+func Require(ctx context.Context) (*Principal, error) {
+	p, ok := FromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "authentication required")
+	}
+	return p, nil
+}
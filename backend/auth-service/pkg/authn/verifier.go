@@ -0,0 +1,74 @@
+package authn
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	pb "github.com/Blxssy/social-media/auth-service/api/auth"
+	"github.com/Blxssy/social-media/auth-service/pkg/token"
+	"google.golang.org/grpc/metadata"
+)
+
+var (
+	ErrMissingToken  = errors.New("missing access token")
+	ErrInvalidHeader = errors.New("invalid authorization header format")
+	ErrInvalidToken  = errors.New("invalid access token")
+)
+
+// IntrospectionVerifier verifies access tokens and API keys through the
+// Introspect RPC of the auth-service, so services outside of it need neither
+// keys nor Redis. Introspect only answers callers that authenticate
+// themselves, so the verifier sends apiKey, an API key of the service with
+// the ScopeIntrospect scope.
+type IntrospectionVerifier struct {
+	client pb.AuthServiceClient
+	apiKey string
+}
+
+func NewIntrospectionVerifier(client pb.AuthServiceClient, apiKey string) *IntrospectionVerifier {
+	return &IntrospectionVerifier{client: client, apiKey: apiKey}
+}
+
+func (v *IntrospectionVerifier) Verify(ctx context.Context, accessToken string) (*Principal, error) {
+	ctx = metadata.AppendToOutgoingContext(ctx, APIKeyHeader, v.apiKey)
+
+	resp, err := v.client.Introspect(ctx, &pb.IntrospectRequest{
+		Token:         accessToken,
+		TokenTypeHint: "access_token",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !resp.GetActive() {
+		return nil, ErrInvalidToken
+	}
+
+	switch resp.GetTokenType() {
+	case token.TypeAccess:
+		return &Principal{
+			UserID:    uint(resp.GetUserId()),
+			Roles:     resp.GetRoles(),
+			Scopes:    resp.GetScopes(),
+			Client:    resp.GetSub() == token.ClientSubject(resp.GetClientId()),
+			ClientID:  resp.GetClientId(),
+			SessionID: resp.GetSessionId(),
+			TokenID:   resp.GetJti(),
+			ExpiresAt: time.Unix(resp.GetExp(), 0),
+		}, nil
+	case token.TypeAPIKey:
+		p := &Principal{
+			UserID:  uint(resp.GetUserId()),
+			Scopes:  resp.GetScopes(),
+			APIKey:  true,
+			TokenID: resp.GetJti(),
+		}
+		if resp.GetExp() != 0 {
+			p.ExpiresAt = time.Unix(resp.GetExp(), 0)
+		}
+		return p, nil
+	default:
+		return nil, ErrInvalidToken
+	}
+}
@@ -0,0 +1,45 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// File writes every email to its own .eml file in a directory, which is handy
+// for local development.
+type File struct {
+	dir  string
+	from string
+}
+
+func NewFile(dir, from string) (*File, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &File{dir: dir, from: from}, nil
+}
+
+func (m *File) Send(ctx context.Context, msg Message) error {
+	const op = "mailer.File.Send"
+
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), sanitize(msg.To))
+	if err := os.WriteFile(filepath.Join(m.dir, name), format(m.from, msg), 0o644); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == os.PathSeparator {
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,17 @@
+package mailer
+
+import (
+	"context"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers emails to users.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
@@ -0,0 +1,140 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultSMTPTimeout bounds the delivery of an email when NewSMTP is given
+// no timeout.
+const defaultSMTPTimeout = 10 * time.Second
+
+// SMTP sends emails through an SMTP server, upgrading the connection with
+// STARTTLS when the server supports it. Each email is delivered within the
+// deadline of the context passed to Send and at most timeout.
+type SMTP struct {
+	host    string
+	addr    string
+	from    string
+	auth    smtp.Auth
+	timeout time.Duration
+}
+
+func NewSMTP(host string, port int, username, password, from string, timeout time.Duration) *SMTP {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	if timeout <= 0 {
+		timeout = defaultSMTPTimeout
+	}
+
+	return &SMTP{
+		host:    host,
+		addr:    net.JoinHostPort(host, strconv.Itoa(port)),
+		from:    from,
+		auth:    auth,
+		timeout: timeout,
+	}
+}
+
+func (m *SMTP) Send(ctx context.Context, msg Message) error {
+	const op = "mailer.SMTP.Send"
+
+	if err := m.send(ctx, msg); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// send does what smtp.SendMail does, which cannot be given a deadline.
+func (m *SMTP) send(ctx context.Context, msg Message) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", m.addr)
+	if err != nil {
+		return err
+	}
+
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return err
+	}
+
+	// A canceled request stops the delivery before its deadline.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+			return err
+		}
+	}
+
+	if m.auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(m.auth); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(m.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(msg.To); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(format(m.from, msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+func format(from string, msg Message) []byte {
+	var b strings.Builder
+
+	b.WriteString("From: " + header(from) + "\r\n")
+	b.WriteString("To: " + header(msg.To) + "\r\n")
+	b.WriteString("Subject: " + header(msg.Subject) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	return []byte(b.String())
+}
+
+// header drops line breaks so a value cannot inject extra headers.
+func header(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
@@ -0,0 +1,138 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpServer listens on a local port and handles each connection with
+// serve.
+func smtpServer(t *testing.T, serve func(conn net.Conn)) (string, int) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	n, _ := strconv.Atoi(port)
+
+	return host, n
+}
+
+func TestSMTPSend(t *testing.T) {
+	received := make(chan string, 1)
+
+	host, port := smtpServer(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+
+		reply("220 localhost ESMTP")
+		var data strings.Builder
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"):
+				reply("250 localhost")
+			case strings.HasPrefix(cmd, "MAIL"), strings.HasPrefix(cmd, "RCPT"):
+				reply("250 OK")
+			case cmd == "DATA":
+				reply("354 go ahead")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				received <- data.String()
+				reply("250 OK")
+			case cmd == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("502 unknown command")
+			}
+		}
+	})
+
+	m := NewSMTP(host, port, "", "", "noreply@example.com", time.Second)
+	err := m.Send(context.Background(), Message{To: "alice@example.com", Subject: "Hello", Body: "Hi Alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data := <-received; !strings.Contains(data, "Subject: Hello\r\n") || !strings.Contains(data, "Hi Alice") {
+		t.Errorf("unexpected message %q", data)
+	}
+}
+
+func TestSMTPSendHungServer(t *testing.T) {
+	// The server accepts connections but never greets.
+	host, port := smtpServer(t, func(conn net.Conn) {
+		conn.Read(make([]byte, 1))
+	})
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		ctx     func() (context.Context, context.CancelFunc)
+	}{
+		{
+			name:    "timeout",
+			timeout: 100 * time.Millisecond,
+			ctx:     func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) },
+		},
+		{
+			name:    "request deadline",
+			timeout: time.Minute,
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 100*time.Millisecond)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := tt.ctx()
+			defer cancel()
+
+			done := make(chan error, 1)
+			go func() {
+				done <- NewSMTP(host, port, "", "", "noreply@example.com", tt.timeout).Send(ctx, Message{To: "alice@example.com"})
+			}()
+
+			select {
+			case err := <-done:
+				if err == nil {
+					t.Fatal("Send succeeded without a server reply")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Send blocked on a hung server")
+			}
+		})
+	}
+}
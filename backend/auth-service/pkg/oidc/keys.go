@@ -0,0 +1,265 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+)
+
+type key struct {
+	alg    string
+	public crypto.PublicKey
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// key returns the signing key with kid, fetching the keys of the provider
+// when they are missing, stale, or don't include kid. After a fetch, failed
+// or not, the provider is not asked again for minRefetchInterval unless the
+// keys are stale.
+func (p *Provider) key(ctx context.Context, kid string) (*key, error) {
+	p.mu.Lock()
+	now := p.now()
+	k, ok := p.keys[kid]
+	stale := p.keys == nil || now.Sub(p.fetchedAt) > keysTTL
+	recent := !p.attemptedAt.IsZero() && now.Sub(p.attemptedAt) < minRefetchInterval
+	fetchErr := p.fetchErr
+	p.mu.Unlock()
+
+	if ok && !stale {
+		return k, nil
+	}
+
+	if recent {
+		// Keep verifying with the keys there are while the provider is
+		// unreachable, without asking it again for every token.
+		if ok {
+			return k, nil
+		}
+		if fetchErr != nil {
+			return nil, fetchErr
+		}
+		return nil, ErrUnknownKey
+	}
+
+	if err := p.refreshKeys(ctx); err != nil {
+		if ok {
+			return k, nil
+		}
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	k, ok = p.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	return k, nil
+}
+
+// refreshKeys fetches the keys of the provider without holding p.mu.
+// Concurrent callers share a single fetch, which carries on when the caller
+// that started it gives up; the timeout of the HTTP client bounds it.
+func (p *Provider) refreshKeys(ctx context.Context) error {
+	ch := p.fetches.DoChan("keys", func() (interface{}, error) {
+		keys, err := p.fetchKeys(context.WithoutCancel(ctx))
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		p.attemptedAt = p.now()
+		p.fetchErr = err
+		if err == nil {
+			p.keys = keys
+			p.fetchedAt = p.attemptedAt
+		}
+
+		return nil, err
+	})
+
+	select {
+	case res := <-ch:
+		return res.Err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fetchKeys fetches the JWK Set of the provider. Only refreshKeys calls it,
+// so there is a single fetch at a time.
+func (p *Provider) fetchKeys(ctx context.Context) (map[string]*key, error) {
+	p.mu.Lock()
+	jwksURL := p.jwksURL
+	p.mu.Unlock()
+
+	if jwksURL == "" {
+		var err error
+		jwksURL, err = p.discoverJWKSURL(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		p.mu.Lock()
+		p.jwksURL = jwksURL
+		p.mu.Unlock()
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(ctx, jwksURL, &set); err != nil {
+		return nil, fmt.Errorf("oidc: fetch keys: %w", err)
+	}
+
+	keys := make(map[string]*key, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		public, err := jwk.publicKey()
+		if err != nil {
+			// Skip keys of types we don't know rather than failing on them.
+			continue
+		}
+		keys[jwk.Kid] = &key{alg: jwk.Alg, public: public}
+	}
+
+	return keys, nil
+}
+
+// discoverJWKSURL reads jwks_uri from the discovery document of the issuer.
+func (p *Provider) discoverJWKSURL(ctx context.Context) (string, error) {
+	var doc struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+
+	url := strings.TrimSuffix(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, url, &doc); err != nil {
+		return "", fmt.Errorf("oidc: discovery: %w", err)
+	}
+
+	if doc.Issuer != p.cfg.Issuer {
+		return "", fmt.Errorf("oidc: discovery document is for issuer %q", doc.Issuer)
+	}
+	if doc.JWKSURI == "" {
+		return "", errors.New("oidc: discovery document has no jwks_uri")
+	}
+
+	return doc.JWKSURI, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(v)
+}
+
+func (jwk *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
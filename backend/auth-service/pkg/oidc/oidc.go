@@ -0,0 +1,260 @@
+// Package oidc verifies ID tokens issued by external OpenID Connect
+// providers, so users can sign in with an account they already have there.
+//
+// A Provider trusts a single issuer. Its signing keys are fetched from the
+// JWKS URL, which is looked up in the issuer's discovery document unless
+// configured, and refetched when a token names a key that is not known yet.
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultLeeway = time.Minute
+
+	// keysTTL is how long fetched keys are used before they are refetched.
+	keysTTL = time.Hour
+	// minRefetchInterval limits how often tokens with an unknown kid, or
+	// any token while the provider is unreachable, make a Provider refetch
+	// its keys.
+	minRefetchInterval = time.Minute
+
+	maxResponseSize = 1 << 20
+)
+
+var (
+	ErrInvalidToken    = errors.New("invalid id token")
+	ErrExpired         = errors.New("id token is expired")
+	ErrInvalidIssuer   = errors.New("unexpected id token issuer")
+	ErrInvalidAudience = errors.New("unexpected id token audience")
+	ErrInvalidNonce    = errors.New("id token nonce does not match")
+	ErrUnknownKey      = errors.New("unknown signing key")
+)
+
+// algorithms are the signing algorithms accepted from providers. Symmetric
+// algorithms and "none" are never accepted.
+var algorithms = map[string]bool{
+	"RS256": true, "RS384": true, "RS512": true,
+	"PS256": true, "PS384": true, "PS512": true,
+	"ES256": true, "ES384": true, "ES512": true,
+	"EdDSA": true,
+}
+
+// Config describes a provider. ClientID is the client id this service is
+// registered with at the provider, which its ID tokens must be addressed
+// to. JWKSURL is optional. A zero Leeway means one minute.
+type Config struct {
+	Issuer   string
+	ClientID string
+	JWKSURL  string
+	Leeway   time.Duration
+}
+
+// Claims are the claims of a verified ID token.
+type Claims struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+}
+
+type Provider struct {
+	cfg    Config
+	client *http.Client
+	now    func() time.Time
+
+	fetches singleflight.Group
+
+	// fetchedAt is when keys were fetched, attemptedAt when a fetch last
+	// finished, successfully or with fetchErr.
+	mu          sync.Mutex
+	jwksURL     string
+	keys        map[string]*key
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	fetchErr    error
+}
+
+// NewProvider returns a Provider fetching keys with client, or
+// http.DefaultClient if client is nil.
+func NewProvider(cfg Config, client *http.Client) (*Provider, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" {
+		return nil, errors.New("oidc: issuer and client id must be set")
+	}
+	if cfg.Leeway == 0 {
+		cfg.Leeway = defaultLeeway
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &Provider{
+		cfg:     cfg,
+		client:  client,
+		now:     time.Now,
+		jwksURL: cfg.JWKSURL,
+	}, nil
+}
+
+// Verify checks the signature, issuer, audience and validity period of an
+// ID token and returns its claims. The token must carry nonce, the one the
+// client sent to the provider, so that a token issued for another sign-in
+// is refused.
+func (p *Provider) Verify(ctx context.Context, rawIDToken string, nonce string) (*Claims, error) {
+	var claims idTokenClaims
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+
+	_, err := parser.ParseWithClaims(rawIDToken, &claims, func(t *jwt.Token) (interface{}, error) {
+		alg := t.Method.Alg()
+		if !algorithms[alg] {
+			return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+		}
+
+		kid, _ := t.Header["kid"].(string)
+		k, err := p.key(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		if k.alg != "" && k.alg != alg {
+			return nil, fmt.Errorf("key %q does not sign with %s", kid, alg)
+		}
+
+		return k.public, nil
+	})
+	if err != nil {
+		var validationErr *jwt.ValidationError
+		if errors.As(err, &validationErr) && validationErr.Inner != nil {
+			if errors.Is(validationErr.Inner, ErrUnknownKey) {
+				return nil, ErrUnknownKey
+			}
+			return nil, fmt.Errorf("%w: %v", ErrInvalidToken, validationErr.Inner)
+		}
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	if err := p.validate(&claims, nonce); err != nil {
+		return nil, err
+	}
+
+	return &Claims{
+		Subject:           claims.Subject,
+		Email:             claims.Email,
+		EmailVerified:     bool(claims.EmailVerified),
+		Name:              claims.Name,
+		PreferredUsername: claims.PreferredUsername,
+	}, nil
+}
+
+// validate checks the claims as OpenID Connect Core section 3.1.3.7
+// requires.
+func (p *Provider) validate(claims *idTokenClaims, nonce string) error {
+	now := p.now().Unix()
+	leeway := int64(p.cfg.Leeway.Seconds())
+
+	if claims.Issuer != p.cfg.Issuer {
+		return ErrInvalidIssuer
+	}
+
+	if !claims.Audience.contains(p.cfg.ClientID) {
+		return ErrInvalidAudience
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.cfg.ClientID {
+		return ErrInvalidAudience
+	}
+
+	if claims.ExpiresAt == 0 || now > claims.ExpiresAt+leeway {
+		return ErrExpired
+	}
+	if claims.IssuedAt == 0 || now < claims.IssuedAt-leeway {
+		return fmt.Errorf("%w: issued in the future", ErrInvalidToken)
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore-leeway {
+		return fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	}
+
+	if claims.Subject == "" {
+		return fmt.Errorf("%w: missing sub", ErrInvalidToken)
+	}
+
+	if nonce == "" || claims.Nonce != nonce {
+		return ErrInvalidNonce
+	}
+
+	return nil
+}
+
+type idTokenClaims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	AuthorizedParty   string   `json:"azp"`
+	ExpiresAt         int64    `json:"exp"`
+	IssuedAt          int64    `json:"iat"`
+	NotBefore         int64    `json:"nbf"`
+	Nonce             string   `json:"nonce"`
+	Email             string   `json:"email"`
+	EmailVerified     flexBool `json:"email_verified"`
+	Name              string   `json:"name"`
+	PreferredUsername string   `json:"preferred_username"`
+}
+
+// Valid is required by jwt.Claims; validate does the checking.
+func (c *idTokenClaims) Valid() error {
+	return nil
+}
+
+// audience is the aud claim, which is a single string or an array.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+
+	return nil
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// flexBool also accepts "true" and "false" as strings, which some providers
+// send for email_verified.
+type flexBool bool
+
+func (b *flexBool) UnmarshalJSON(data []byte) error {
+	switch strings.Trim(string(data), `"`) {
+	case "true":
+		*b = true
+	case "false", "null":
+		*b = false
+	default:
+		return fmt.Errorf("invalid boolean %s", data)
+	}
+	return nil
+}
@@ -0,0 +1,354 @@
+package oidc_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+
+	"github.com/Blxssy/social-media/auth-service/pkg/oidc"
+)
+
+const (
+	clientID = "social-media"
+	keyID    = "test-key"
+	nonce    = "n-0S6_WzA2Mj"
+)
+
+// issuer is an identity provider serving its discovery document and JWKS
+// on an httptest server. While down is set its JWKS fails; jwksRequests
+// counts the requests for it.
+type issuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	down         atomic.Bool
+	jwksRequests atomic.Int32
+}
+
+func newIssuer(t *testing.T) *issuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iss := &issuer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{
+			"issuer":   iss.URL,
+			"jwks_uri": iss.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		iss.jwksRequests.Add(1)
+		if iss.down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": keyID,
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+
+	iss.Server = httptest.NewServer(mux)
+	t.Cleanup(iss.Close)
+
+	return iss
+}
+
+// claims returns valid claims of an ID token of the issuer.
+func (iss *issuer) claims() jwt.MapClaims {
+	now := time.Now()
+
+	return jwt.MapClaims{
+		"iss":            iss.URL,
+		"sub":            "248289761001",
+		"aud":            clientID,
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          nonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+	}
+}
+
+// sign signs claims with the key of the issuer.
+func (iss *issuer) sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	tok.Header["kid"] = keyID
+
+	raw, err := tok.SignedString(iss.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return raw
+}
+
+func (iss *issuer) provider(t *testing.T) *oidc.Provider {
+	t.Helper()
+
+	provider, err := oidc.NewProvider(oidc.Config{Issuer: iss.URL, ClientID: clientID}, iss.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return provider
+}
+
+func TestVerify(t *testing.T) {
+	iss := newIssuer(t)
+
+	claims, err := iss.provider(t).Verify(context.Background(), iss.sign(t, iss.claims()), nonce)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	if claims.Subject != "248289761001" {
+		t.Errorf("subject = %q, want 248289761001", claims.Subject)
+	}
+	if claims.Email != "alice@example.com" || !claims.EmailVerified {
+		t.Errorf("email = %q verified %v, want alice@example.com verified", claims.Email, claims.EmailVerified)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	iss := newIssuer(t)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token func() string
+		nonce string
+		want  error
+		// reason is part of the message of err, for errors a token can
+		// fail with in several ways.
+		reason string
+	}{
+		{
+			name:  "nonce mismatch",
+			token: func() string { return iss.sign(t, iss.claims()) },
+			nonce: "another-nonce",
+			want:  oidc.ErrInvalidNonce,
+		},
+		{
+			name:  "missing nonce",
+			token: func() string { return iss.sign(t, iss.claims()) },
+			nonce: "",
+			want:  oidc.ErrInvalidNonce,
+		},
+		{
+			name: "token without nonce",
+			token: func() string {
+				claims := iss.claims()
+				delete(claims, "nonce")
+				return iss.sign(t, claims)
+			},
+			nonce: nonce,
+			want:  oidc.ErrInvalidNonce,
+		},
+		{
+			name: "wrong audience",
+			token: func() string {
+				claims := iss.claims()
+				claims["aud"] = "another-client"
+				return iss.sign(t, claims)
+			},
+			nonce: nonce,
+			want:  oidc.ErrInvalidAudience,
+		},
+		{
+			name: "wrong issuer",
+			token: func() string {
+				claims := iss.claims()
+				claims["iss"] = "https://evil.example.com"
+				return iss.sign(t, claims)
+			},
+			nonce: nonce,
+			want:  oidc.ErrInvalidIssuer,
+		},
+		{
+			name: "expired",
+			token: func() string {
+				claims := iss.claims()
+				claims["iat"] = time.Now().Add(-2 * time.Hour).Unix()
+				claims["exp"] = time.Now().Add(-time.Hour).Unix()
+				return iss.sign(t, claims)
+			},
+			nonce: nonce,
+			want:  oidc.ErrExpired,
+		},
+		{
+			name: "unknown kid",
+			token: func() string {
+				tok := jwt.NewWithClaims(jwt.SigningMethodRS256, iss.claims())
+				tok.Header["kid"] = "another-key"
+				raw, err := tok.SignedString(otherKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return raw
+			},
+			nonce: nonce,
+			want:  oidc.ErrUnknownKey,
+		},
+		{
+			name: "wrong signature",
+			token: func() string {
+				tok := jwt.NewWithClaims(jwt.SigningMethodRS256, iss.claims())
+				tok.Header["kid"] = keyID
+				raw, err := tok.SignedString(otherKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return raw
+			},
+			nonce: nonce,
+			want:  oidc.ErrInvalidToken,
+		},
+		{
+			name: "HS256",
+			token: func() string {
+				// Signed with the public key as the HMAC secret, as a
+				// client that confuses algorithms would check it.
+				tok := jwt.NewWithClaims(jwt.SigningMethodHS256, iss.claims())
+				tok.Header["kid"] = keyID
+				raw, err := tok.SignedString(iss.key.N.Bytes())
+				if err != nil {
+					t.Fatal(err)
+				}
+				return raw
+			},
+			nonce:  nonce,
+			want:   oidc.ErrInvalidToken,
+			reason: `unsupported signing algorithm "HS256"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := iss.provider(t).Verify(context.Background(), tt.token(), tt.nonce)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Verify: err = %v, want %v", err, tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.reason) {
+				t.Fatalf("Verify: err = %v, want it to mention %s", err, tt.reason)
+			}
+		})
+	}
+}
+
+// signUnknown signs valid claims with a key the issuer doesn't publish.
+func (iss *issuer) signUnknown(t *testing.T, kid string) string {
+	t.Helper()
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, iss.claims())
+	tok.Header["kid"] = kid
+
+	raw, err := tok.SignedString(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return raw
+}
+
+func TestVerifySharesKeyFetches(t *testing.T) {
+	iss := newIssuer(t)
+	provider := iss.provider(t)
+	raw := iss.sign(t, iss.claims())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := provider.Verify(context.Background(), raw, nonce); err != nil {
+				t.Errorf("Verify: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := iss.jwksRequests.Load(); n != 1 {
+		t.Errorf("fetched the keys %d times, want 1", n)
+	}
+}
+
+func TestVerifyBacksOffUnknownKeys(t *testing.T) {
+	iss := newIssuer(t)
+	provider := iss.provider(t)
+
+	if _, err := provider.Verify(context.Background(), iss.sign(t, iss.claims()), nonce); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	// Tokens with random kids don't make the provider refetch its keys
+	// again and again.
+	for _, kid := range []string{"random-1", "random-2", "random-3"} {
+		_, err := provider.Verify(context.Background(), iss.signUnknown(t, kid), nonce)
+		if !errors.Is(err, oidc.ErrUnknownKey) {
+			t.Fatalf("Verify with kid %s: err = %v, want %v", kid, err, oidc.ErrUnknownKey)
+		}
+	}
+
+	if n := iss.jwksRequests.Load(); n != 1 {
+		t.Errorf("fetched the keys %d times, want 1", n)
+	}
+}
+
+func TestVerifyBacksOffFailedFetches(t *testing.T) {
+	iss := newIssuer(t)
+	iss.down.Store(true)
+	provider := iss.provider(t)
+
+	raw := iss.sign(t, iss.claims())
+	for i := 0; i < 3; i++ {
+		if _, err := provider.Verify(context.Background(), raw, nonce); err == nil {
+			t.Fatal("Verify succeeded while the provider is down")
+		}
+	}
+
+	if n := iss.jwksRequests.Load(); n != 1 {
+		t.Errorf("fetched the keys %d times, want 1", n)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
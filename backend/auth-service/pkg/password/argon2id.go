@@ -0,0 +1,127 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const argon2idID = "argon2id"
+
+// Argon2id hashes passwords with Argon2id. Memory is in KiB. Hashes look like
+// $argon2id$v=19$m=19456,t=2,p=1$salt$hash with unpadded base64 salt and
+// hash.
+type Argon2id struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// NewArgon2id fills parameters left zero with the OWASP recommended minimum
+// of 19 MiB memory, 2 iterations and 1 thread.
+func NewArgon2id(params Argon2id) *Argon2id {
+	if params.Memory == 0 {
+		params.Memory = 19 * 1024
+	}
+	if params.Iterations == 0 {
+		params.Iterations = 2
+	}
+	if params.Parallelism == 0 {
+		params.Parallelism = 1
+	}
+	if params.SaltLength == 0 {
+		params.SaltLength = 16
+	}
+	if params.KeyLength == 0 {
+		params.KeyLength = 32
+	}
+
+	return &params
+}
+
+func (a *Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, a.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, a.Iterations, a.Memory, a.Parallelism, a.KeyLength)
+
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idID, argon2.Version, a.Memory, a.Iterations, a.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (a *Argon2id) Verify(password string, encoded string) (bool, error) {
+	h, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	key := argon2.IDKey([]byte(password), h.salt, h.params.Iterations, h.params.Memory, h.params.Parallelism, uint32(len(h.key)))
+
+	return subtle.ConstantTimeCompare(key, h.key) == 1, nil
+}
+
+func (a *Argon2id) NeedsRehash(encoded string) bool {
+	h, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+
+	return h.version != argon2.Version ||
+		h.params.Memory != a.Memory ||
+		h.params.Iterations != a.Iterations ||
+		h.params.Parallelism != a.Parallelism ||
+		uint32(len(h.salt)) != a.SaltLength ||
+		uint32(len(h.key)) != a.KeyLength
+}
+
+type argon2idHash struct {
+	version int
+	params  Argon2id
+	salt    []byte
+	key     []byte
+}
+
+func decodeArgon2id(encoded string) (*argon2idHash, error) {
+	if algorithm(encoded) != argon2idID {
+		return nil, ErrUnknownAlgorithm
+	}
+
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, hash
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return nil, ErrMalformedHash
+	}
+
+	var h argon2idHash
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &h.version); err != nil {
+		return nil, ErrMalformedHash
+	}
+
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.params.Memory, &h.params.Iterations, &h.params.Parallelism)
+	if err != nil || h.params.Memory == 0 || h.params.Iterations == 0 || h.params.Parallelism == 0 {
+		return nil, ErrMalformedHash
+	}
+
+	h.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, ErrMalformedHash
+	}
+
+	h.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(h.key) == 0 {
+		return nil, ErrMalformedHash
+	}
+
+	return &h, nil
+}
@@ -0,0 +1,65 @@
+package password
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Bcrypt hashes passwords with bcrypt. Its hashes keep bcrypt's own
+// $2b$cost$ format, which predates PHC and which PHC parsers accept. Only the
+// first 72 bytes of a password are used.
+type Bcrypt struct {
+	Cost int
+}
+
+func NewBcrypt(cost int) *Bcrypt {
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+
+	return &Bcrypt{Cost: cost}
+}
+
+func (b *Bcrypt) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+func (b *Bcrypt) Verify(password string, encoded string) (bool, error) {
+	if !isBcrypt(encoded) {
+		return false, ErrUnknownAlgorithm
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	if err != nil {
+		return false, ErrMalformedHash
+	}
+
+	return true, nil
+}
+
+func (b *Bcrypt) NeedsRehash(encoded string) bool {
+	if !isBcrypt(encoded) {
+		return true
+	}
+
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != b.Cost
+}
+
+func isBcrypt(encoded string) bool {
+	switch algorithm(encoded) {
+	case "2a", "2b", "2y":
+		return true
+	default:
+		return false
+	}
+}
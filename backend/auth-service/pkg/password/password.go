@@ -0,0 +1,74 @@
+// Package password hashes passwords for storage. Hashes are self-describing
+// strings in the PHC format ($id$params$salt$hash), so the algorithm and
+// parameters a hash was made with can be read back from it and outdated
+// hashes replaced when the user next signs in.
+package password
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrUnknownAlgorithm = errors.New("unknown password hash algorithm")
+	ErrMalformedHash    = errors.New("malformed password hash")
+)
+
+// Hasher hashes and verifies passwords.
+//
+// Verify returns ErrUnknownAlgorithm for hashes made by another algorithm.
+// NeedsRehash reports whether a hash should be replaced because it uses
+// another algorithm or older parameters than new hashes would.
+type Hasher interface {
+	Hash(password string) (string, error)
+	Verify(password string, encoded string) (bool, error)
+	NeedsRehash(encoded string) bool
+}
+
+// Chain hashes with its preferred hasher and verifies hashes of any of its
+// hashers. Every hash not made by the preferred hasher with its current
+// parameters needs a rehash.
+type Chain struct {
+	preferred Hasher
+	hashers   []Hasher
+}
+
+// NewChain returns a Chain that hashes with preferred and still accepts
+// hashes made by legacy.
+func NewChain(preferred Hasher, legacy ...Hasher) *Chain {
+	return &Chain{
+		preferred: preferred,
+		hashers:   append([]Hasher{preferred}, legacy...),
+	}
+}
+
+func (c *Chain) Hash(password string) (string, error) {
+	return c.preferred.Hash(password)
+}
+
+func (c *Chain) Verify(password string, encoded string) (bool, error) {
+	for _, h := range c.hashers {
+		ok, err := h.Verify(password, encoded)
+		if errors.Is(err, ErrUnknownAlgorithm) {
+			continue
+		}
+		return ok, err
+	}
+
+	return false, ErrUnknownAlgorithm
+}
+
+func (c *Chain) NeedsRehash(encoded string) bool {
+	return c.preferred.NeedsRehash(encoded)
+}
+
+// algorithm returns the identifier a hash starts with, such as "argon2id"
+// or "2b".
+func algorithm(encoded string) string {
+	if !strings.HasPrefix(encoded, "$") {
+		return ""
+	}
+
+	id, _, _ := strings.Cut(encoded[1:], "$")
+	return id
+}
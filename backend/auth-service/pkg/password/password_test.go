@@ -0,0 +1,224 @@
+package password_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/Blxssy/social-media/auth-service/pkg/password"
+)
+
+// Cheap parameters keep the tests fast; the format does not depend on them.
+var testArgon2id = password.Argon2id{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestArgon2idRoundTrip(t *testing.T) {
+	hasher := password.NewArgon2id(testArgon2id)
+
+	encoded, err := hasher.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("hash %q is not in the PHC format", encoded)
+	}
+	if parts := strings.Split(encoded, "$"); len(parts) != 6 {
+		t.Fatalf("hash %q has %d parts, want 6", encoded, len(parts))
+	}
+
+	ok, err := hasher.Verify("correct horse", encoded)
+	if err != nil || !ok {
+		t.Fatalf("Verify(correct password) = %v, %v", ok, err)
+	}
+
+	ok, err = hasher.Verify("wrong horse", encoded)
+	if err != nil || ok {
+		t.Fatalf("Verify(wrong password) = %v, %v", ok, err)
+	}
+
+	if hasher.NeedsRehash(encoded) {
+		t.Error("fresh hash needs a rehash")
+	}
+
+	again, err := hasher.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == encoded {
+		t.Error("two hashes of a password share the salt")
+	}
+}
+
+// TestArgon2idVerifyUsesHashParameters checks that hashes are verified with
+// the parameters they were made with, not the current ones.
+func TestArgon2idVerifyUsesHashParameters(t *testing.T) {
+	encoded, err := password.NewArgon2id(testArgon2id).Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := testArgon2id
+	current.Memory = 128
+	current.Iterations = 2
+	current.KeyLength = 16
+
+	ok, err := password.NewArgon2id(current).Verify("correct horse", encoded)
+	if err != nil || !ok {
+		t.Fatalf("Verify = %v, %v", ok, err)
+	}
+}
+
+func TestArgon2idNeedsRehash(t *testing.T) {
+	encoded, err := password.NewArgon2id(testArgon2id).Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(p *password.Argon2id)
+		want   bool
+	}{
+		{"same parameters", func(p *password.Argon2id) {}, false},
+		{"memory", func(p *password.Argon2id) { p.Memory = 128 }, true},
+		{"iterations", func(p *password.Argon2id) { p.Iterations = 2 }, true},
+		{"parallelism", func(p *password.Argon2id) { p.Parallelism = 2 }, true},
+		{"salt length", func(p *password.Argon2id) { p.SaltLength = 32 }, true},
+		{"key length", func(p *password.Argon2id) { p.KeyLength = 64 }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := testArgon2id
+			tt.modify(&params)
+
+			if got := password.NewArgon2id(params).NeedsRehash(encoded); got != tt.want {
+				t.Fatalf("NeedsRehash = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	old := strings.Replace(encoded, "$v=19$", "$v=16$", 1)
+	if !password.NewArgon2id(testArgon2id).NeedsRehash(old) {
+		t.Error("hash of an older Argon2 version does not need a rehash")
+	}
+}
+
+func TestArgon2idMalformedHashes(t *testing.T) {
+	hasher := password.NewArgon2id(testArgon2id)
+
+	tests := []struct {
+		name    string
+		encoded string
+		want    error
+	}{
+		{"bcrypt", "$2b$04$abcdefghijklmnopqrstuu", password.ErrUnknownAlgorithm},
+		{"not PHC", "argon2id", password.ErrUnknownAlgorithm},
+		{"empty", "", password.ErrUnknownAlgorithm},
+		{"missing hash", "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA", password.ErrMalformedHash},
+		{"missing version", "$argon2id$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$aGFzaA", password.ErrMalformedHash},
+		{"bad parameters", "$argon2id$v=19$m=64$c2FsdHNhbHRzYWx0c2FsdA$aGFzaA", password.ErrMalformedHash},
+		{"zero iterations", "$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHRzYWx0c2FsdA$aGFzaA", password.ErrMalformedHash},
+		{"bad salt", "$argon2id$v=19$m=64,t=1,p=1$!!!$aGFzaA", password.ErrMalformedHash},
+		{"empty hash", "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$", password.ErrMalformedHash},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := hasher.Verify("correct horse", tt.encoded)
+			if ok || !errors.Is(err, tt.want) {
+				t.Fatalf("Verify = %v, %v, want %v", ok, err, tt.want)
+			}
+
+			if !hasher.NeedsRehash(tt.encoded) {
+				t.Fatal("unreadable hash does not need a rehash")
+			}
+		})
+	}
+}
+
+func TestBcrypt(t *testing.T) {
+	hasher := password.NewBcrypt(bcrypt.MinCost)
+
+	encoded, err := hasher.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(encoded, "$2a$04$") {
+		t.Fatalf("hash %q is not a bcrypt hash of cost 4", encoded)
+	}
+
+	if ok, err := hasher.Verify("correct horse", encoded); err != nil || !ok {
+		t.Fatalf("Verify(correct password) = %v, %v", ok, err)
+	}
+	if ok, err := hasher.Verify("wrong horse", encoded); err != nil || ok {
+		t.Fatalf("Verify(wrong password) = %v, %v", ok, err)
+	}
+
+	if hasher.NeedsRehash(encoded) {
+		t.Error("fresh hash needs a rehash")
+	}
+	if !password.NewBcrypt(bcrypt.MinCost + 1).NeedsRehash(encoded) {
+		t.Error("hash of a lower cost does not need a rehash")
+	}
+
+	argon, err := password.NewArgon2id(testArgon2id).Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hasher.Verify("correct horse", argon); !errors.Is(err, password.ErrUnknownAlgorithm) {
+		t.Errorf("Verify(argon2id hash): err = %v, want %v", err, password.ErrUnknownAlgorithm)
+	}
+	if !hasher.NeedsRehash(argon) {
+		t.Error("argon2id hash does not need a bcrypt rehash")
+	}
+}
+
+func TestChain(t *testing.T) {
+	legacy := password.NewBcrypt(bcrypt.MinCost)
+	chain := password.NewChain(password.NewArgon2id(testArgon2id), legacy)
+
+	legacyHash, err := legacy.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := chain.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		t.Fatalf("Chain hashed with %q, want the preferred argon2id", hash)
+	}
+
+	tests := []struct {
+		name       string
+		encoded    string
+		password   string
+		wantOK     bool
+		wantErr    error
+		wantRehash bool
+	}{
+		{"preferred hash", hash, "correct horse", true, nil, false},
+		{"preferred hash, wrong password", hash, "wrong horse", false, nil, false},
+		{"legacy hash", legacyHash, "correct horse", true, nil, true},
+		{"legacy hash, wrong password", legacyHash, "wrong horse", false, nil, true},
+		{"unknown algorithm", "$md5$abc", "correct horse", false, password.ErrUnknownAlgorithm, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := chain.Verify(tt.password, tt.encoded)
+			if ok != tt.wantOK || !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify = %v, %v, want %v, %v", ok, err, tt.wantOK, tt.wantErr)
+			}
+
+			if got := chain.NeedsRehash(tt.encoded); got != tt.wantRehash {
+				t.Fatalf("NeedsRehash = %v, want %v", got, tt.wantRehash)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Blxssy/social-media/auth-service/pkg/authn"
+)
+
+type remoteIPKey struct{}
+
+// HTTPMiddleware is the first stage for an HTTP route. The route is named
+// by its pattern, such as "POST /oauth/token", where gRPC rules name a
+// method. Limited requests are answered with 429 Too Many Requests and a
+// Retry-After header. A nil Limiter lets every request through.
+func (l *Limiter) HTTPMiddleware(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), remoteIPKey{}, remoteIP(r))
+
+		if ok, retryAfter := l.allowByIP(ctx, pattern); !ok {
+			writeTooManyRequests(w, retryAfter)
+			return
+		}
+
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// AllowHTTPCaller is the second stage for an HTTP route whose handler
+// authenticates the caller itself, called once it has. It writes the 429
+// response and returns false when the caller is limited.
+func (l *Limiter) AllowHTTPCaller(w http.ResponseWriter, r *http.Request, pattern string, p *authn.Principal) bool {
+	if l == nil {
+		return true
+	}
+
+	ctx := authn.NewContext(context.WithValue(r.Context(), remoteIPKey{}, remoteIP(r)), p)
+
+	ok, retryAfter := l.allowByCaller(ctx, pattern)
+	if !ok {
+		writeTooManyRequests(w, retryAfter)
+	}
+
+	return ok
+}
+
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+
+	return r.RemoteAddr
+}
+
+func writeTooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+}
@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Blxssy/social-media/auth-service/pkg/authn"
+)
+
+const (
+	tokenPattern    = "POST /oauth/token"
+	registerPattern = "POST /oauth/register"
+)
+
+func newHTTPLimiter(t *testing.T) *Limiter {
+	t.Helper()
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	l, err := New(log, NewMemoryStore(),
+		Rule{Key: KeyIP, Limit: Limit{Rate: 100, Period: time.Second}},
+		map[string]Rule{
+			tokenPattern:    {Key: KeyIP, Limit: Limit{Rate: 2, Period: time.Minute}},
+			registerPattern: {Key: KeyUser, Limit: Limit{Rate: 1, Period: time.Hour}},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return l
+}
+
+func serve(h http.HandlerFunc, remoteAddr string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.RemoteAddr = remoteAddr
+
+	rec := httptest.NewRecorder()
+	h(rec, req)
+
+	return rec
+}
+
+func TestHTTPMiddleware(t *testing.T) {
+	l := newHTTPLimiter(t)
+	h := l.HTTPMiddleware(tokenPattern, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	for i := 0; i < 2; i++ {
+		if rec := serve(h, "192.0.2.1:1234"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d, want 200", i, rec.Code)
+		}
+	}
+
+	rec := serve(h, "192.0.2.1:5678")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want 429", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "30" {
+		t.Errorf("Retry-After = %q, want 30", rec.Header().Get("Retry-After"))
+	}
+
+	if rec := serve(h, "192.0.2.2:1234"); rec.Code != http.StatusOK {
+		t.Errorf("another IP: status %d, want 200", rec.Code)
+	}
+}
+
+func TestHTTPMiddlewareNilLimiter(t *testing.T) {
+	var l *Limiter
+	h := l.HTTPMiddleware(tokenPattern, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	if rec := serve(h, "192.0.2.1:1234"); rec.Code != http.StatusOK {
+		t.Errorf("status %d, want 200", rec.Code)
+	}
+}
+
+func TestAllowHTTPCaller(t *testing.T) {
+	l := newHTTPLimiter(t)
+	alice := &authn.Principal{UserID: 1}
+	bob := &authn.Principal{UserID: 2}
+
+	h := func(p *authn.Principal) http.HandlerFunc {
+		return l.HTTPMiddleware(registerPattern, func(w http.ResponseWriter, r *http.Request) {
+			if !l.AllowHTTPCaller(w, r, registerPattern, p) {
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		})
+	}
+
+	if rec := serve(h(alice), "192.0.2.1:1234"); rec.Code != http.StatusCreated {
+		t.Fatalf("status %d, want 201", rec.Code)
+	}
+	if rec := serve(h(alice), "192.0.2.2:1234"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("same user from another IP: status %d, want 429", rec.Code)
+	}
+	if rec := serve(h(bob), "192.0.2.1:1234"); rec.Code != http.StatusCreated {
+		t.Fatalf("another user: status %d, want 201", rec.Code)
+	}
+}
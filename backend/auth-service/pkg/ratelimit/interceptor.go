@@ -0,0 +1,239 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/Blxssy/social-media/auth-service/pkg/authn"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// What a rule counts requests by. Callers are identified by the principal
+// authn authenticated them as: KeyUser counts apps with a token of the
+// client_credentials grant by their client, and KeyAPIKey counts callers
+// without an API key by their IP, as it does unauthenticated ones.
+const (
+	KeyIP     = "ip"
+	KeyUser   = "user"
+	KeyAPIKey = "api_key"
+)
+
+// Rule limits one method. Key is one of KeyIP, KeyUser or KeyAPIKey.
+type Rule struct {
+	Key   string
+	Limit Limit
+}
+
+// Limiter is a gRPC interceptor that applies a Rule per full method name
+// ("/package.Service/Method"), falling back to a default rule. It limits
+// HTTP routes the same way, see HTTPMiddleware.
+//
+// It runs in two stages around the authentication interceptor. The first,
+// installed before it, applies rules keyed by IP, so floods are turned away
+// before any credentials are checked. Rules keyed by the caller can only be
+// applied once the caller is known, by the second stage installed after
+// authentication; until then their calls count against the default rule by
+// IP, so invalid credentials can't be sent without limit either.
+type Limiter struct {
+	log         *slog.Logger
+	store       Store
+	defaultRule Rule
+	rules       map[string]Rule
+}
+
+// New creates a Limiter. It fails on a rule with an unknown key or a period
+// under a millisecond, rather than limit by IP or not at all.
+func New(log *slog.Logger, store Store, defaultRule Rule, rules map[string]Rule) (*Limiter, error) {
+	if err := defaultRule.validate(); err != nil {
+		return nil, fmt.Errorf("default rule: %w", err)
+	}
+	for method, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("rule for %s: %w", method, err)
+		}
+	}
+
+	return &Limiter{
+		log:         log,
+		store:       store,
+		defaultRule: defaultRule,
+		rules:       rules,
+	}, nil
+}
+
+// validate checks the key and period of a rule that limits at all.
+func (r Rule) validate() error {
+	if r.Limit.Rate <= 0 {
+		return nil
+	}
+
+	switch r.Key {
+	case KeyIP, KeyUser, KeyAPIKey:
+	default:
+		return fmt.Errorf("unknown key %q, want %q, %q or %q", r.Key, KeyIP, KeyUser, KeyAPIKey)
+	}
+
+	if r.Limit.Period < time.Millisecond {
+		return fmt.Errorf("period %v is under 1ms", r.Limit.Period)
+	}
+
+	return nil
+}
+
+// UnaryServerInterceptor is the first stage, to be installed before
+// authentication.
+func (l *Limiter) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if ok, retryAfter := l.allowByIP(ctx, info.FullMethod); !ok {
+			return nil, exhausted(retryAfter)
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor is the first stage for streams. Like the second
+// stage it limits opening streams, not the messages sent on them.
+func (l *Limiter) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if ok, retryAfter := l.allowByIP(ss.Context(), info.FullMethod); !ok {
+			return exhausted(retryAfter)
+		}
+
+		return handler(srv, ss)
+	}
+}
+
+// CallerUnaryServerInterceptor is the second stage, to be installed after
+// authentication.
+func (l *Limiter) CallerUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if ok, retryAfter := l.allowByCaller(ctx, info.FullMethod); !ok {
+			return nil, exhausted(retryAfter)
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// CallerStreamServerInterceptor is the second stage for streams.
+func (l *Limiter) CallerStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if ok, retryAfter := l.allowByCaller(ss.Context(), info.FullMethod); !ok {
+			return exhausted(retryAfter)
+		}
+
+		return handler(srv, ss)
+	}
+}
+
+func (l *Limiter) rule(method string) Rule {
+	if rule, ok := l.rules[method]; ok {
+		return rule
+	}
+	return l.defaultRule
+}
+
+// allowByIP applies the rule of the method if it is keyed by IP, and the
+// default rule by IP otherwise.
+func (l *Limiter) allowByIP(ctx context.Context, method string) (bool, time.Duration) {
+	rule := l.rule(method)
+	if rule.Key != KeyIP {
+		rule = l.defaultRule
+		rule.Key = KeyIP
+	}
+
+	return l.allow(ctx, method, rule)
+}
+
+// allowByCaller applies the rule of the method if it is keyed by the caller.
+func (l *Limiter) allowByCaller(ctx context.Context, method string) (bool, time.Duration) {
+	rule := l.rule(method)
+	if rule.Key == KeyIP {
+		return true, 0
+	}
+
+	return l.allow(ctx, method, rule)
+}
+
+// allow takes a token for the caller of ctx from the bucket of the method
+// and, when it is empty, reports how long until the next token.
+func (l *Limiter) allow(ctx context.Context, method string, rule Rule) (bool, time.Duration) {
+	const op = "ratelimit.allow"
+
+	if rule.Limit.Unlimited() {
+		return true, 0
+	}
+
+	key := method + ":" + l.key(ctx, rule.Key)
+
+	allowed, retryAfter, err := l.store.Allow(ctx, key, rule.Limit)
+	if err != nil {
+		// An unavailable store must not take the service down with it.
+		l.log.With(slog.String("op", op)).
+			Error("failed to check rate limit", slog.String("error", err.Error()))
+		return true, 0
+	}
+
+	return allowed, retryAfter
+}
+
+func (l *Limiter) key(ctx context.Context, kind string) string {
+	if p, ok := authn.FromContext(ctx); ok {
+		switch {
+		case kind == KeyUser && p.Client:
+			return "client:" + p.ClientID
+		case kind == KeyUser:
+			return "user:" + strconv.FormatUint(uint64(p.UserID), 10)
+		case kind == KeyAPIKey && p.APIKey:
+			// The id of the key, never the secret itself.
+			return "api_key:" + p.TokenID
+		}
+	}
+
+	return "ip:" + peerIP(ctx)
+}
+
+// peerIP returns the IP of the gRPC peer or, for HTTP requests, the one
+// HTTPMiddleware put into ctx.
+func peerIP(ctx context.Context) string {
+	if ip, ok := ctx.Value(remoteIPKey{}).(string); ok {
+		return ip
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+
+	addr := p.Addr.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return addr
+}
+
+// exhausted reports a limited request as ResourceExhausted with a RetryInfo
+// detail telling the client when to try again.
+func exhausted(retryAfter time.Duration) error {
+	st := status.New(codes.ResourceExhausted, "rate limit exceeded")
+
+	detailed, err := st.WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(retryAfter),
+	})
+	if err != nil {
+		return st.Err()
+	}
+
+	return detailed.Err()
+}
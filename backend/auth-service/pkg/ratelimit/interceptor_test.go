@@ -0,0 +1,41 @@
+package ratelimit
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestNewValidatesRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    Rule
+		wantErr bool
+	}{
+		{name: "ip", rule: Rule{Key: KeyIP, Limit: Limit{Rate: 10, Period: time.Second}}},
+		{name: "user", rule: Rule{Key: KeyUser, Limit: Limit{Rate: 10, Period: time.Millisecond}}},
+		{name: "api key", rule: Rule{Key: KeyAPIKey, Limit: Limit{Rate: 10, Period: time.Minute}}},
+		{name: "unlimited without key", rule: Rule{}},
+		{name: "unknown key", rule: Rule{Key: "users", Limit: Limit{Rate: 10, Period: time.Second}}, wantErr: true},
+		{name: "missing key", rule: Rule{Limit: Limit{Rate: 10, Period: time.Second}}, wantErr: true},
+		{name: "period under 1ms", rule: Rule{Key: KeyIP, Limit: Limit{Rate: 10, Period: 500 * time.Microsecond}}, wantErr: true},
+		{name: "missing period", rule: Rule{Key: KeyIP, Limit: Limit{Rate: 10}}, wantErr: true},
+	}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(log, NewMemoryStore(), Rule{}, map[string]Rule{"/auth.AuthService/Login": tt.rule})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("rule: err = %v, want an error: %v", err, tt.wantErr)
+			}
+
+			_, err = New(log, NewMemoryStore(), tt.rule, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("default rule: err = %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often the memory store drops buckets that have
+// filled up again, which are indistinguishable from missing ones.
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+// MemoryStore keeps buckets in process memory. Each replica limits on its
+// own, use RedisStore to share limits between replicas.
+type MemoryStore struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		now:       time.Now,
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+func (s *MemoryStore) Allow(_ context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	if limit.Unlimited() {
+		return true, 0, nil
+	}
+
+	now := s.now()
+	burst := float64(limit.burst())
+	rate := limit.perMillisecond()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) >= sweepInterval {
+		s.sweep(now)
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, updated: now}
+		s.buckets[key] = b
+	}
+
+	// Count fractions of a millisecond too: calls closer together than that
+	// would otherwise never refill the bucket.
+	elapsed := float64(now.Sub(b.updated)) / float64(time.Millisecond)
+	b.tokens = math.Min(burst, b.tokens+elapsed*rate)
+	b.updated = now
+
+	if b.tokens < 1 {
+		wait := time.Duration(math.Ceil((1-b.tokens)/rate)) * time.Millisecond
+		return false, wait, nil
+	}
+
+	b.tokens--
+	b.full = now.Add(time.Duration((burst - b.tokens) / rate * float64(time.Millisecond)))
+
+	return true, 0, nil
+}
+
+func (s *MemoryStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if now.After(b.full) {
+			delete(s.buckets, key)
+		}
+	}
+	s.lastSweep = now
+}
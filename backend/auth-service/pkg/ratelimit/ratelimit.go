@@ -0,0 +1,43 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Limit is a token bucket: Rate tokens are added every Period up to Burst,
+// and every request takes one. A zero Rate means unlimited.
+type Limit struct {
+	Rate   int
+	Period time.Duration
+	Burst  int
+}
+
+// Unlimited reports whether the limit lets every request through.
+func (l Limit) Unlimited() bool {
+	return l.Rate <= 0 || l.Period <= 0
+}
+
+func (l Limit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Rate
+}
+
+// perMillisecond is how many tokens the bucket gains per millisecond.
+func (l Limit) perMillisecond() float64 {
+	return float64(l.Rate) / float64(l.Period.Milliseconds())
+}
+
+// fillTime is how long an empty bucket takes to fill up.
+func (l Limit) fillTime() time.Duration {
+	return time.Duration(float64(l.burst()) / float64(l.Rate) * float64(l.Period))
+}
+
+// Store keeps the token buckets. Allow takes a token from the bucket of key
+// and, when it is empty, reports how long until the next token. Unlimited
+// limits let every request through.
+type Store interface {
+	Allow(ctx context.Context, key string, limit Limit) (bool, time.Duration, error)
+}
@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// allowScript refills the bucket for the time passed since it was last
+// touched and takes a token. It returns {allowed, milliseconds to wait}.
+var allowScript = redis.NewScript(`
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local tokens = tonumber(bucket[1])
+local updated = tonumber(bucket[2])
+if tokens == nil or updated == nil then
+	tokens = burst
+	updated = now
+end
+
+tokens = math.min(burst, tokens + math.max(0, now - updated) * rate)
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tokens, 'updated', now)
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+
+return {allowed, wait}
+`)
+
+// RedisStore keeps buckets in Redis so replicas share one limit per key.
+type RedisStore struct {
+	client redis.UniversalClient
+	now    func() time.Time
+}
+
+func NewRedisStore(client redis.UniversalClient) *RedisStore {
+	return &RedisStore{client: client, now: time.Now}
+}
+
+func (s *RedisStore) Allow(ctx context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	if limit.Unlimited() {
+		return true, 0, nil
+	}
+
+	// A bucket that has not been touched for fillTime is full again, so it
+	// can expire.
+	ttl := limit.fillTime() + time.Second
+
+	res, err := allowScript.Run(ctx, s.client, []string{"rate_limit:" + key},
+		strconv.FormatFloat(limit.perMillisecond(), 'g', -1, 64),
+		limit.burst(),
+		s.now().UnixMilli(),
+		ttl.Milliseconds(),
+	).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+
+	return res[0] == 1, time.Duration(res[1]) * time.Millisecond, nil
+}
@@ -0,0 +1,194 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// clock is a time that tests move forward by hand.
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+// call is one Allow call, made after advancing the clock by after.
+type call struct {
+	after       time.Duration
+	wantAllowed bool
+	wantWait    time.Duration
+}
+
+var storeTests = []struct {
+	name  string
+	limit Limit
+	calls []call
+}{
+	{
+		name:  "burst",
+		limit: Limit{Rate: 1, Period: time.Second, Burst: 3},
+		calls: []call{
+			{wantAllowed: true},
+			{wantAllowed: true},
+			{wantAllowed: true},
+			{wantAllowed: false, wantWait: time.Second},
+		},
+	},
+	{
+		name:  "burst defaults to rate",
+		limit: Limit{Rate: 2, Period: time.Second},
+		calls: []call{
+			{wantAllowed: true},
+			{wantAllowed: true},
+			{wantAllowed: false, wantWait: 500 * time.Millisecond},
+		},
+	},
+	{
+		name:  "wait shrinks as the bucket refills",
+		limit: Limit{Rate: 1, Period: time.Second, Burst: 1},
+		calls: []call{
+			{wantAllowed: true},
+			{after: 500 * time.Millisecond, wantAllowed: false, wantWait: 500 * time.Millisecond},
+			{after: 250 * time.Millisecond, wantAllowed: false, wantWait: 250 * time.Millisecond},
+		},
+	},
+	{
+		name:  "refill",
+		limit: Limit{Rate: 1, Period: time.Second, Burst: 1},
+		calls: []call{
+			{wantAllowed: true},
+			{wantAllowed: false, wantWait: time.Second},
+			{after: time.Second, wantAllowed: true},
+			{wantAllowed: false, wantWait: time.Second},
+		},
+	},
+	{
+		name:  "refill stops at burst",
+		limit: Limit{Rate: 1, Period: time.Second, Burst: 2},
+		calls: []call{
+			{wantAllowed: true},
+			{after: time.Hour, wantAllowed: true},
+			{wantAllowed: true},
+			{wantAllowed: false, wantWait: time.Second},
+		},
+	},
+	{
+		name:  "zero rate is unlimited",
+		limit: Limit{Rate: 0, Period: time.Second},
+		calls: []call{
+			{wantAllowed: true},
+			{wantAllowed: true},
+			{wantAllowed: true},
+		},
+	},
+}
+
+func TestMemoryStore(t *testing.T) {
+	for _, tt := range storeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &clock{t: time.Unix(1700000000, 0)}
+			store := NewMemoryStore()
+			store.now = c.now
+
+			runCalls(t, store, c, tt.limit, tt.calls)
+		})
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	for _, tt := range storeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &clock{t: time.Unix(1700000000, 0)}
+			store := NewRedisStore(newRedisClient(t))
+			store.now = c.now
+
+			runCalls(t, store, c, tt.limit, tt.calls)
+		})
+	}
+}
+
+// TestMemoryStoreRefillsBetweenCloseCalls checks that calls less than a
+// millisecond apart still refill the bucket.
+func TestMemoryStoreRefillsBetweenCloseCalls(t *testing.T) {
+	c := &clock{t: time.Unix(1700000000, 0)}
+	store := NewMemoryStore()
+	store.now = c.now
+
+	limit := Limit{Rate: 1000, Period: time.Second, Burst: 1}
+
+	// A call every half a millisecond gets every other token.
+	allowedCalls := 0
+	for i := 0; i < 100; i++ {
+		c.t = c.t.Add(time.Millisecond / 2)
+
+		allowed, _, err := store.Allow(context.Background(), "ip:192.0.2.1", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed {
+			allowedCalls++
+		}
+	}
+
+	if allowedCalls != 50 {
+		t.Fatalf("%d of 100 calls allowed, want 50", allowedCalls)
+	}
+}
+
+func TestStoresKeepKeysApart(t *testing.T) {
+	limit := Limit{Rate: 1, Period: time.Minute}
+
+	stores := map[string]Store{
+		"memory": NewMemoryStore(),
+		"redis":  NewRedisStore(newRedisClient(t)),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			for _, key := range []string{"ip:192.0.2.1", "ip:192.0.2.2"} {
+				allowed, _, err := store.Allow(context.Background(), key, limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !allowed {
+					t.Fatalf("%s was limited by another key", key)
+				}
+			}
+		})
+	}
+}
+
+func runCalls(t *testing.T, store Store, c *clock, limit Limit, calls []call) {
+	t.Helper()
+
+	for i, call := range calls {
+		c.t = c.t.Add(call.after)
+
+		allowed, wait, err := store.Allow(context.Background(), "ip:192.0.2.1", limit)
+		if err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+		if allowed != call.wantAllowed {
+			t.Fatalf("call %d: allowed = %v, want %v", i, allowed, call.wantAllowed)
+		}
+		if wait != call.wantWait {
+			t.Fatalf("call %d: wait = %v, want %v", i, wait, call.wantWait)
+		}
+	}
+}
+
+func newRedisClient(t *testing.T) *redis.Client {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
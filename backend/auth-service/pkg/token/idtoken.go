@@ -0,0 +1,49 @@
+package token
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// IDClaims are the claims of an OpenID Connect ID token. The audience of an
+// ID token is the client it was issued to, so it is never accepted where an
+// access token is expected. EmailVerified is a pointer so that it is left
+// out, rather than reported false, when the email scope was not granted.
+type IDClaims struct {
+	Nonce             string `json:"nonce,omitempty"`
+	Email             string `json:"email,omitempty"`
+	EmailVerified     *bool  `json:"email_verified,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	jwt.StandardClaims
+}
+
+// NewIDToken signs an ID token about userID for clientID. It is valid as
+// long as an access token.
+func (i *Issuer) NewIDToken(userID uint, clientID string, claims *IDClaims) (string, error) {
+	now := i.now()
+	claims.StandardClaims = jwt.StandardClaims{
+		Id:        newID(),
+		Subject:   strconv.FormatUint(uint64(userID), 10),
+		Issuer:    i.opts.Issuer,
+		Audience:  clientID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(i.opts.AccessTTL).Unix(),
+	}
+
+	key := i.keys.Active()
+	if key == nil {
+		return "", errors.New("no active signing key")
+	}
+
+	token := jwt.NewWithClaims(key.SigningMethod(), claims)
+	token.Header["kid"] = key.ID
+
+	return token.SignedString(key.Private)
+}
+
+// SigningAlgorithm is the algorithm new tokens are signed with.
+func (i *Issuer) SigningAlgorithm() string {
+	return i.keys.algorithm
+}
@@ -0,0 +1,543 @@
+package token
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	AlgorithmRS256 = "RS256"
+	AlgorithmEdDSA = "EdDSA"
+
+	rsaKeyBits = 2048
+	keyFileExt = ".pem"
+
+	// kidTimeLayout starts the kid of generated keys, so that every replica
+	// agrees on when a key was created.
+	kidTimeLayout = "20060102T150405Z"
+
+	// rotationCheckInterval is how often RunRotation reloads the key
+	// directory, so keys rotated by another replica are picked up.
+	rotationCheckInterval = time.Minute
+
+	// The rotation lock is a file in the key directory. A lock older than
+	// lockStaleAfter was left by a replica that died and is broken.
+	lockFileName   = "rotate.lock"
+	lockStaleAfter = time.Minute
+	lockRetryEvery = 100 * time.Millisecond
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// Key is a signing key identified by the kid header of the tokens it signs.
+// Keys loaded from a public key file can only verify.
+type Key struct {
+	ID        string
+	Algorithm string
+	Private   crypto.Signer
+	Public    crypto.PublicKey
+	CreatedAt time.Time
+}
+
+// Keyring holds every key that may have signed a still valid token. The
+// newest private key of the configured algorithm signs new tokens; older keys
+// keep verifying until retain has passed since they were superseded, after
+// which rotation removes them from the key directory. Replicas sharing the
+// directory rotate one at a time, under a lock file.
+type Keyring struct {
+	mu        sync.RWMutex
+	dir       string
+	algorithm string
+	retain    time.Duration
+	keys      map[string]*Key
+	active    *Key
+}
+
+// LoadKeyring loads every PEM key in dir. If dir holds no private key for
+// algorithm, one is generated.
+func LoadKeyring(dir string, algorithm string, retain time.Duration) (*Keyring, error) {
+	if algorithm != AlgorithmRS256 && algorithm != AlgorithmEdDSA {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	k := &Keyring{
+		dir:       dir,
+		algorithm: algorithm,
+		retain:    retain,
+	}
+
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+
+	if k.Active() == nil {
+		// Replicas starting together must not each generate a key.
+		err := k.withLock(func() error {
+			if err := k.Reload(); err != nil {
+				return err
+			}
+			if k.Active() != nil {
+				return nil
+			}
+			_, err := k.rotate()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return k, nil
+}
+
+// Reload re-reads the key directory.
+func (k *Keyring) Reload() error {
+	entries, err := os.ReadDir(k.dir)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]*Key, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != keyFileExt {
+			continue
+		}
+
+		key, err := readKey(filepath.Join(k.dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("load key %s: %w", entry.Name(), err)
+		}
+		keys[key.ID] = key
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.keys = keys
+	k.active = nil
+	for _, key := range keys {
+		if key.Private == nil || key.Algorithm != k.algorithm {
+			continue
+		}
+		if k.active == nil || key.CreatedAt.After(k.active.CreatedAt) {
+			k.active = key
+		}
+	}
+
+	return nil
+}
+
+// Rotate generates a new signing key, makes it active and removes keys that
+// were superseded more than retain ago.
+func (k *Keyring) Rotate() (*Key, error) {
+	var key *Key
+	err := k.withLock(func() error {
+		if err := k.Reload(); err != nil {
+			return err
+		}
+		var err error
+		key, err = k.rotate()
+		return err
+	})
+	return key, err
+}
+
+// rotate does the work of Rotate. Callers hold the rotation lock.
+func (k *Keyring) rotate() (*Key, error) {
+	key, err := generateKey(k.algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeKey(filepath.Join(k.dir, key.ID+keyFileExt), key); err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	if k.keys == nil {
+		k.keys = make(map[string]*Key)
+	}
+	k.keys[key.ID] = key
+	k.active = key
+	k.mu.Unlock()
+
+	return key, k.prune()
+}
+
+// RunRotation rotates the active key once it is older than interval and keeps
+// the keyring in sync with the key directory. It returns when ctx is done.
+func (k *Keyring) RunRotation(ctx context.Context, interval time.Duration, log *slog.Logger) {
+	const op = "token.RunRotation"
+
+	log = log.With(slog.String("op", op))
+
+	ticker := time.NewTicker(rotationCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := k.Reload(); err != nil {
+			log.Error("failed to reload signing keys", slog.String("error", err.Error()))
+			continue
+		}
+
+		if !k.due(interval) {
+			continue
+		}
+
+		var key *Key
+		err := k.withLock(func() error {
+			// Another replica may have rotated while we waited for the lock.
+			if err := k.Reload(); err != nil {
+				return err
+			}
+			if !k.due(interval) {
+				return nil
+			}
+			var err error
+			key, err = k.rotate()
+			return err
+		})
+		if err != nil {
+			log.Error("failed to rotate signing key", slog.String("error", err.Error()))
+			continue
+		}
+
+		if key != nil {
+			log.Info("signing key rotated", slog.String("kid", key.ID))
+		}
+	}
+}
+
+// due reports whether the active key is older than interval.
+func (k *Keyring) due(interval time.Duration) bool {
+	active := k.Active()
+	return active == nil || time.Since(active.CreatedAt) >= interval
+}
+
+// withLock runs fn holding the rotation lock of the key directory, waiting
+// for other replicas to release it.
+func (k *Keyring) withLock(fn func() error) error {
+	path := filepath.Join(k.dir, lockFileName)
+
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err == nil {
+			f.Close()
+			break
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > lockStaleAfter {
+			breakStaleLock(path)
+			continue
+		}
+
+		time.Sleep(lockRetryEvery)
+	}
+	defer os.Remove(path)
+
+	return fn()
+}
+
+// breakStaleLock removes the lock of a replica that died holding it. Other
+// replicas may be breaking it too, so it is first renamed to a name of its
+// own: only one rename succeeds. Should the lock have been taken again
+// meanwhile, the fresh lock that was renamed is put back.
+func breakStaleLock(path string) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return
+	}
+
+	stale := path + "." + hex.EncodeToString(suffix)
+	if err := os.Rename(path, stale); err != nil {
+		return
+	}
+	defer os.Remove(stale)
+
+	if info, err := os.Stat(stale); err == nil && time.Since(info.ModTime()) <= lockStaleAfter {
+		os.Link(stale, path)
+	}
+}
+
+// Active returns the key new tokens are signed with.
+func (k *Keyring) Active() *Key {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.active
+}
+
+// Key returns the key with the given kid.
+func (k *Keyring) Key(id string) (*Key, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	return key, nil
+}
+
+// JWKS returns the public part of every key as a JSON Web Key Set (RFC 7517).
+func (k *Keyring) JWKS() JSONWebKeySet {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	set := JSONWebKeySet{Keys: make([]JSONWebKey, 0, len(k.keys))}
+	for _, key := range k.sortedKeys() {
+		set.Keys = append(set.Keys, key.JWK())
+	}
+
+	return set
+}
+
+func (k *Keyring) prune() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	keys := k.sortedKeys()
+	for i := 1; i < len(keys); i++ {
+		// A key is superseded when the next newer key was created. Both times
+		// come from the kids, so every replica prunes the same keys.
+		supersededAt := keys[i-1].CreatedAt
+		if keys[i] == k.active || time.Since(supersededAt) < k.retain || time.Since(keys[i].CreatedAt) < k.retain {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(k.dir, keys[i].ID+keyFileExt)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(k.keys, keys[i].ID)
+	}
+
+	return nil
+}
+
+// sortedKeys returns the keys from newest to oldest. Callers hold k.mu.
+func (k *Keyring) sortedKeys() []*Key {
+	keys := make([]*Key, 0, len(k.keys))
+	for _, key := range k.keys {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].ID > keys[j].ID
+		}
+		return keys[i].CreatedAt.After(keys[j].CreatedAt)
+	})
+
+	return keys
+}
+
+// SigningMethod returns the JWT signing method of the key.
+func (key *Key) SigningMethod() jwt.SigningMethod {
+	if key.Algorithm == AlgorithmEdDSA {
+		return jwt.SigningMethodEdDSA
+	}
+	return jwt.SigningMethodRS256
+}
+
+// JSONWebKeySet is a JWK Set as served from /.well-known/jwks.json.
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JSONWebKey is the public part of a signing key.
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// JWK returns the public part of the key.
+func (key *Key) JWK() JSONWebKey {
+	jwk := JSONWebKey{
+		Kid: key.ID,
+		Use: "sig",
+		Alg: key.Algorithm,
+	}
+
+	switch pub := key.Public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	}
+
+	return jwk
+}
+
+func generateKey(algorithm string) (*Key, error) {
+	var (
+		private crypto.Signer
+		err     error
+	)
+
+	switch algorithm {
+	case AlgorithmRS256:
+		private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case AlgorithmEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		err = fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+
+	return &Key{
+		ID:        now.Format(kidTimeLayout) + "-" + hex.EncodeToString(suffix),
+		Algorithm: algorithm,
+		Private:   private,
+		Public:    private.Public(),
+		CreatedAt: now,
+	}, nil
+}
+
+func writeKey(path string, key *Key) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key.Private)
+	if err != nil {
+		return err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	// Other replicas may read the directory at any time: the key only
+	// appears under its name once it is complete.
+	f, err := os.CreateTemp(filepath.Dir(path), ".key-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// keyCreatedAt returns the creation time in the kid of a generated key. The
+// modification time of the file is only used for keys added by hand, whose
+// kid has none, as it changes when keys are copied between replicas.
+func keyCreatedAt(id string, modTime time.Time) time.Time {
+	prefix, _, _ := strings.Cut(id, "-")
+	if t, err := time.Parse(kidTimeLayout, prefix); err == nil {
+		return t
+	}
+	return modTime
+}
+
+func readKey(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	id := strings.TrimSuffix(filepath.Base(path), keyFileExt)
+	key := &Key{
+		ID:        id,
+		CreatedAt: keyCreatedAt(id, info.ModTime()),
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := parsed.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("unsupported private key type")
+		}
+		key.Private = signer
+		key.Public = signer.Public()
+	case "PUBLIC KEY":
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key.Public = parsed
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+
+	switch key.Public.(type) {
+	case *rsa.PublicKey:
+		key.Algorithm = AlgorithmRS256
+	case ed25519.PublicKey:
+		key.Algorithm = AlgorithmEdDSA
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+
+	return key, nil
+}
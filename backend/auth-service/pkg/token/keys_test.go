@@ -0,0 +1,442 @@
+package token
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func TestLoadKeyringGeneratesKey(t *testing.T) {
+	for _, algorithm := range []string{AlgorithmRS256, AlgorithmEdDSA} {
+		t.Run(algorithm, func(t *testing.T) {
+			dir := t.TempDir()
+
+			keys, err := LoadKeyring(dir, algorithm, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			active := keys.Active()
+			if active == nil || active.Private == nil {
+				t.Fatal("no active signing key was generated")
+			}
+			if active.Algorithm != algorithm {
+				t.Errorf("algorithm = %s, want %s", active.Algorithm, algorithm)
+			}
+			if _, err := os.Stat(filepath.Join(dir, active.ID+keyFileExt)); err != nil {
+				t.Errorf("key file not written: %v", err)
+			}
+
+			// Loading the directory again picks the key up rather than
+			// generating another one.
+			again, err := LoadKeyring(dir, algorithm, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again.Active().ID != active.ID {
+				t.Errorf("reloaded active key = %s, want %s", again.Active().ID, active.ID)
+			}
+			if !again.Active().CreatedAt.Equal(active.CreatedAt) {
+				t.Errorf("reloaded key created at %s, want %s", again.Active().CreatedAt, active.CreatedAt)
+			}
+			if n := len(again.JWKS().Keys); n != 1 {
+				t.Errorf("JWKS has %d keys, want 1", n)
+			}
+		})
+	}
+}
+
+func TestLoadKeyringRejectsUnsupportedAlgorithm(t *testing.T) {
+	if _, err := LoadKeyring(t.TempDir(), "HS256", time.Hour); err == nil {
+		t.Fatal("LoadKeyring accepted HS256")
+	}
+}
+
+func TestLoadKeyringPublicKey(t *testing.T) {
+	dir := t.TempDir()
+
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, "partner"+keyFileExt), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := LoadKeyring(dir, AlgorithmEdDSA, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A public key verifies but can't sign, so a private key is generated.
+	key, err := keys.Key("partner")
+	if err != nil {
+		t.Fatalf("public key not loaded: %v", err)
+	}
+	if key.Private != nil || key.Algorithm != AlgorithmEdDSA {
+		t.Errorf("public key loaded as %+v", key)
+	}
+	if keys.Active() == nil || keys.Active().ID == "partner" {
+		t.Error("the public key was made the active key")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	keys, err := LoadKeyring(t.TempDir(), AlgorithmEdDSA, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := keys.Active()
+
+	key, err := keys.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key.ID == old.ID || keys.Active().ID != key.ID {
+		t.Fatalf("active key = %s after rotating from %s to %s", keys.Active().ID, old.ID, key.ID)
+	}
+
+	// The old key keeps verifying the tokens it signed.
+	if _, err := keys.Key(old.ID); err != nil {
+		t.Errorf("old key dropped right after rotation: %v", err)
+	}
+	if n := len(keys.JWKS().Keys); n != 2 {
+		t.Errorf("JWKS has %d keys, want 2", n)
+	}
+}
+
+func TestRotatePrunesKeysAfterRetain(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	oldest := writeTestKey(t, dir, now.Add(-3*time.Hour))
+	older := writeTestKey(t, dir, now.Add(-2*time.Hour))
+
+	keys, err := LoadKeyring(dir, AlgorithmEdDSA, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.Active().ID != older.ID {
+		t.Fatalf("active key = %s, want the newest key %s", keys.Active().ID, older.ID)
+	}
+
+	if _, err := keys.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// oldest was superseded by older two hours ago, more than retain.
+	if _, err := keys.Key(oldest.ID); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("key superseded before retain is still loaded: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, oldest.ID+keyFileExt)); !os.IsNotExist(err) {
+		t.Errorf("key superseded before retain is still on disk: %v", err)
+	}
+
+	// older was only superseded now, whatever its age.
+	if _, err := keys.Key(older.ID); err != nil {
+		t.Errorf("key superseded just now was pruned: %v", err)
+	}
+}
+
+func TestRotateWaitsForLock(t *testing.T) {
+	dir := t.TempDir()
+
+	keys, err := LoadKeyring(dir, AlgorithmEdDSA, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock := filepath.Join(dir, lockFileName)
+	if err := os.WriteFile(lock, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := keys.Rotate()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Rotate did not wait for the lock held by another replica: %v", err)
+	case <-time.After(3 * lockRetryEvery):
+	}
+
+	if err := os.Remove(lock); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Rotate did not take the released lock")
+	}
+
+	if _, err := os.Stat(lock); !os.IsNotExist(err) {
+		t.Errorf("lock file left behind: %v", err)
+	}
+}
+
+func TestRotateBreaksStaleLock(t *testing.T) {
+	dir := t.TempDir()
+
+	keys, err := LoadKeyring(dir, AlgorithmEdDSA, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock := filepath.Join(dir, lockFileName)
+	if err := os.WriteFile(lock, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	stale := time.Now().Add(-2 * lockStaleAfter)
+	if err := os.Chtimes(lock, stale, stale); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := keys.Rotate()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Rotate waited for a stale lock")
+	}
+}
+
+func TestBreakStaleLockKeepsFreshLock(t *testing.T) {
+	dir := t.TempDir()
+
+	// Another replica broke the stale lock and took it again between our
+	// check and our attempt to break it: its lock must survive.
+	lock := filepath.Join(dir, lockFileName)
+	if err := os.WriteFile(lock, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	breakStaleLock(lock)
+
+	if _, err := os.Stat(lock); err != nil {
+		t.Fatalf("a fresh lock was broken: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory has %d entries, want only the lock", len(entries))
+	}
+}
+
+func TestLoadKeyringConcurrentStart(t *testing.T) {
+	dir := t.TempDir()
+
+	// Replicas starting together read the directory while one of them
+	// writes the first key: none may see a partial key file.
+	const replicas = 8
+	ids := make(chan string, replicas)
+	errs := make(chan error, replicas)
+	for i := 0; i < replicas; i++ {
+		go func() {
+			keys, err := LoadKeyring(dir, AlgorithmRS256, time.Hour)
+			if err != nil {
+				errs <- err
+				return
+			}
+			ids <- keys.Active().ID
+		}()
+	}
+
+	var first string
+	for i := 0; i < replicas; i++ {
+		select {
+		case err := <-errs:
+			t.Fatal(err)
+		case id := <-ids:
+			if first == "" {
+				first = id
+			} else if id != first {
+				t.Errorf("replicas sign with %s and %s, want one key", first, id)
+			}
+		}
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || filepath.Ext(matches[0]) != keyFileExt {
+		t.Errorf("key directory holds %v, want a single key", matches)
+	}
+}
+
+func TestParseRejectsUnknownKeys(t *testing.T) {
+	keys, err := LoadKeyring(t.TempDir(), AlgorithmRS256, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := newTestIssuer(t, keys)
+
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey := keys.Active()
+
+	tests := []struct {
+		name   string
+		method jwt.SigningMethod
+		kid    interface{}
+		key    interface{}
+		// reason is part of the message of the error, as jwt does not
+		// unwrap the errors of keyFunc.
+		reason string
+	}{
+		{"unknown kid", jwt.SigningMethodEdDSA, "another-key", otherKey, ErrUnknownKey.Error()},
+		{"missing kid", jwt.SigningMethodEdDSA, nil, otherKey, ErrUnknownKey.Error()},
+		{"EdDSA with the kid of an RS256 key", jwt.SigningMethodEdDSA, rsaKey.ID, otherKey, "unexpected signing method"},
+		{"HS256 keyed with the public key", jwt.SigningMethodHS256, rsaKey.ID, x509.MarshalPKCS1PublicKey(rsaKey.Public.(*rsa.PublicKey)), "unexpected signing method"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims(issuer)
+			tok := jwt.NewWithClaims(tt.method, claims)
+			if tt.kid != nil {
+				tok.Header["kid"] = tt.kid
+			}
+			raw, err := tok.SignedString(tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = issuer.ParseClaims(raw)
+			if err == nil {
+				t.Fatal("ParseClaims accepted the token")
+			}
+			if !strings.Contains(err.Error(), tt.reason) {
+				t.Fatalf("ParseClaims: err = %v, want it to mention %s", err, tt.reason)
+			}
+		})
+	}
+
+	// The same claims signed by the active key are accepted.
+	tok := jwt.NewWithClaims(rsaKey.SigningMethod(), validClaims(issuer))
+	tok.Header["kid"] = rsaKey.ID
+	raw, err := tok.SignedString(rsaKey.Private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := issuer.ParseClaims(raw); err != nil {
+		t.Fatalf("ParseClaims: %v", err)
+	}
+}
+
+func TestParseAfterRotation(t *testing.T) {
+	keys, err := LoadKeyring(t.TempDir(), AlgorithmEdDSA, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := newTestIssuer(t, keys)
+
+	before, _, err := issuer.NewToken(1, TypeAccess, "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := keys.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+
+	after, _, err := issuer.NewToken(1, TypeAccess, "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, raw := range map[string]string{"before": before, "after": after} {
+		if _, err := issuer.ParseClaims(raw); err != nil {
+			t.Errorf("token signed %s rotation: %v", name, err)
+		}
+	}
+}
+
+// writeTestKey writes an EdDSA key to dir as if it was generated at
+// createdAt.
+func writeTestKey(t *testing.T, dir string, createdAt time.Time) *Key {
+	t.Helper()
+
+	key, err := generateKey(AlgorithmEdDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key.CreatedAt = createdAt.UTC().Truncate(time.Second)
+	key.ID = key.CreatedAt.Format(kidTimeLayout) + "-0000beef"
+
+	if err := writeKey(filepath.Join(dir, key.ID+keyFileExt), key); err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func newTestIssuer(t *testing.T, keys *Keyring) *Issuer {
+	t.Helper()
+
+	issuer, err := NewIssuer(keys, Options{
+		Issuer:     "https://auth.example.com",
+		Audience:   "social-media",
+		AccessTTL:  15 * time.Minute,
+		RefreshTTL: time.Hour,
+		Leeway:     30 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return issuer
+}
+
+// validClaims returns the claims of an access token issuer accepts.
+func validClaims(issuer *Issuer) *Claims {
+	now := time.Now()
+
+	return &Claims{
+		UserID: 1,
+		Type:   TypeAccess,
+		StandardClaims: jwt.StandardClaims{
+			Id:        newID(),
+			Issuer:    issuer.opts.Issuer,
+			Audience:  issuer.opts.Audience,
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(time.Minute).Unix(),
+		},
+	}
+}
@@ -1,155 +1,347 @@
 package token
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
-	"os"
 	"time"
 
 	"github.com/golang-jwt/jwt"
 )
 
-const AccessTokenDuration = time.Minute * 15
-const RefreshTokenDuration = time.Hour * 24 * 7
-
-func InitJWTKey() {
-	jwtKey = []byte(os.Getenv("JWT_KEY"))
-}
+const (
+	TypeAccess      = "access"
+	TypeRefresh     = "refresh"
+	TypeVerifyEmail = "verify_email"
+	TypeChangeEmail = "change_email"
+	// TypeAPIKey is reported by introspection for API keys, which are not
+	// tokens of this package.
+	TypeAPIKey = "api_key"
+)
 
-var jwtKey []byte
+var (
+	ErrInvalidToken    = errors.New("invalid token")
+	ErrExpired         = errors.New("token is expired")
+	ErrNotValidYet     = errors.New("token is not valid yet")
+	ErrInvalidIssuer   = errors.New("unexpected token issuer")
+	ErrInvalidAudience = errors.New("unexpected token audience")
+)
 
+// Claims are carried by every token this package issues. The token id (jti)
+// lives in StandardClaims.Id; FamilyID groups every refresh token obtained by
+// rotating the one issued at login. Email is only set on verification tokens,
+// Roles only on access tokens of first-party sessions.
+//
+// Tokens issued to an OAuth client carry its ClientID and the granted Scope,
+// a space-separated list as in RFC 6749, and no roles. Tokens of the
+// client_credentials grant act for the client alone: they have no UserID and
+// their subject (sub) is ClientSubject of the client, see ForClient.
 type Claims struct {
-	UserID uint `json:"user_id"`
+	UserID   uint     `json:"user_id"`
+	Type     string   `json:"typ"`
+	FamilyID string   `json:"fid,omitempty"`
+	Email    string   `json:"email,omitempty"`
+	Roles    []string `json:"roles,omitempty"`
+	ClientID string   `json:"client_id,omitempty"`
+	Scope    string   `json:"scope,omitempty"`
 	jwt.StandardClaims
 }
 
-func GetNewTokens(userID uint) (string, string, error) {
-	// TODO: Вынести TTL в конфиг
-	accessToken, err := NewToken(userID, AccessTokenDuration)
+// Pair is a freshly issued access/refresh token pair.
+type Pair struct {
+	AccessToken  string
+	RefreshToken string
+	RefreshID    string
+	FamilyID     string
+}
+
+// Options configure an Issuer. Issuer and Audience are set as the iss and aud
+// claims of every token and required when parsing. Leeway is the clock skew
+// tolerated when checking exp, nbf and iat.
+type Options struct {
+	Issuer     string
+	Audience   string
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+	Leeway     time.Duration
+}
+
+// Issuer signs tokens with the active key of its keyring and verifies them
+// with any key of it.
+type Issuer struct {
+	keys   *Keyring
+	opts   Options
+	parser *jwt.Parser
+	now    func() time.Time
+}
+
+func NewIssuer(keys *Keyring, opts Options) (*Issuer, error) {
+	if opts.Issuer == "" || opts.Audience == "" {
+		return nil, errors.New("token issuer and audience must be set")
+	}
+	if opts.AccessTTL <= 0 || opts.RefreshTTL <= 0 {
+		return nil, errors.New("token TTLs must be positive")
+	}
+
+	return &Issuer{
+		keys: keys,
+		opts: opts,
+		// The registered claims are checked by validate, with leeway.
+		parser: &jwt.Parser{SkipClaimsValidation: true},
+		now:    time.Now,
+	}, nil
+}
+
+// Issuer is the iss claim of the tokens.
+func (i *Issuer) Issuer() string {
+	return i.opts.Issuer
+}
+
+// AccessTTL is how long access tokens are valid.
+func (i *Issuer) AccessTTL() time.Duration {
+	return i.opts.AccessTTL
+}
+
+// RefreshTTL is how long refresh tokens are valid.
+func (i *Issuer) RefreshTTL() time.Duration {
+	return i.opts.RefreshTTL
+}
+
+// JWKS returns the public signing keys as a JSON Web Key Set.
+func (i *Issuer) JWKS() JSONWebKeySet {
+	return i.keys.JWKS()
+}
+
+// NewFamilyID returns an identifier for a new refresh token family.
+func NewFamilyID() string {
+	return newID()
+}
+
+// GetNewTokens issues a token pair of the family. roles are embedded in the
+// access token.
+func (i *Issuer) GetNewTokens(userID uint, familyID string, roles []string) (*Pair, error) {
+	accessToken, _, err := i.sign(&Claims{
+		UserID:   userID,
+		Type:     TypeAccess,
+		FamilyID: familyID,
+		Roles:    roles,
+	}, i.opts.AccessTTL)
 	if err != nil {
-		log.Fatal(err)
-		return "", "", nil
+		return nil, err
 	}
 
-	refreshToken, err := NewToken(userID, RefreshTokenDuration)
+	refreshToken, refreshID, err := i.NewToken(userID, TypeRefresh, familyID, i.opts.RefreshTTL)
 	if err != nil {
-		log.Fatal(err)
-		return "", "", nil
+		return nil, err
 	}
 
-	return accessToken, refreshToken, nil
+	return &Pair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		RefreshID:    refreshID,
+		FamilyID:     familyID,
+	}, nil
+}
+
+// ClientSubject is the subject of tokens that act for the OAuth client
+// clientID rather than for a user.
+func ClientSubject(clientID string) string {
+	return "client:" + clientID
+}
+
+// ForClient reports whether the token acts for its OAuth client alone.
+func (c *Claims) ForClient() bool {
+	return c.ClientID != "" && c.UserID == 0 && c.Subject == ClientSubject(c.ClientID)
 }
 
-func NewToken(userID uint, ttl time.Duration) (string, error) {
-	expirationTime := time.Now().Add(ttl)
+// GetClientCredentialsToken issues the access token of the
+// client_credentials grant to clientID. It has no refresh token.
+func (i *Issuer) GetClientCredentialsToken(clientID string, scope string) (*Pair, error) {
 	claims := &Claims{
-		UserID: userID,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
-		},
+		Type:     TypeAccess,
+		ClientID: clientID,
+		Scope:    scope,
 	}
+	claims.Subject = ClientSubject(clientID)
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
+	accessToken, _, err := i.sign(claims, i.opts.AccessTTL)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return tokenString, nil
+	return &Pair{AccessToken: accessToken}, nil
 }
 
-func UpdateToken(refreshTokenString string) (string, string, error) {
-	claims := &Claims{}
-	refreshToken, err := jwt.ParseWithClaims(refreshTokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
+// GetClientTokens issues the tokens of an OAuth grant to clientID. A refresh
+// token of the family is only issued when familyID is set.
+func (i *Issuer) GetClientTokens(userID uint, clientID string, scope string, familyID string) (*Pair, error) {
+	accessToken, _, err := i.sign(&Claims{
+		UserID:   userID,
+		Type:     TypeAccess,
+		FamilyID: familyID,
+		ClientID: clientID,
+		Scope:    scope,
+	}, i.opts.AccessTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	pair := &Pair{
+		AccessToken: accessToken,
+		FamilyID:    familyID,
+	}
+	if familyID == "" {
+		return pair, nil
+	}
+
+	pair.RefreshToken, pair.RefreshID, err = i.sign(&Claims{
+		UserID:   userID,
+		Type:     TypeRefresh,
+		FamilyID: familyID,
+		ClientID: clientID,
+		Scope:    scope,
+	}, i.opts.RefreshTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	return pair, nil
+}
+
+// NewToken signs a token of the given type and returns it along with its jti.
+func (i *Issuer) NewToken(userID uint, tokenType string, familyID string, ttl time.Duration) (string, string, error) {
+	return i.sign(&Claims{
+		UserID:   userID,
+		Type:     tokenType,
+		FamilyID: familyID,
+	}, ttl)
+}
+
+// NewVerificationToken signs a token proving that whoever holds it received
+// an email sent to email, and returns it along with its jti. tokenType is
+// TypeVerifyEmail or TypeChangeEmail.
+func (i *Issuer) NewVerificationToken(userID uint, tokenType string, email string, ttl time.Duration) (string, string, error) {
+	return i.sign(&Claims{
+		UserID: userID,
+		Type:   tokenType,
+		Email:  email,
+	}, ttl)
+}
+
+func (i *Issuer) sign(claims *Claims, ttl time.Duration) (string, string, error) {
+	now := i.now()
+	id := newID()
+	claims.StandardClaims = jwt.StandardClaims{
+		Id:        id,
+		Subject:   claims.Subject,
+		Issuer:    i.opts.Issuer,
+		Audience:  i.opts.Audience,
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}
+
+	key := i.keys.Active()
+	if key == nil {
+		return "", "", errors.New("no active signing key")
+	}
+
+	token := jwt.NewWithClaims(key.SigningMethod(), claims)
+	token.Header["kid"] = key.ID
+	tokenString, err := token.SignedString(key.Private)
 	if err != nil {
 		return "", "", err
 	}
 
-	if !refreshToken.Valid {
-		return "", "", errors.New("invalid refresh token")
+	return tokenString, id, nil
+}
+
+// ParseRefreshToken validates a refresh token and returns its claims, from
+// which the next pair of its family is issued with GetNewTokens.
+func (i *Issuer) ParseRefreshToken(refreshTokenString string) (*Claims, error) {
+	claims, err := i.ParseClaims(refreshTokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Type != TypeRefresh || claims.FamilyID == "" || claims.Id == "" {
+		return nil, errors.New("invalid refresh token")
 	}
 
-	return GetNewTokens(claims.UserID)
+	return claims, nil
 }
 
-func ValidateToken(refreshToken string) bool {
+// ParseClaims verifies the signature, issuer, audience and validity period of
+// a token and returns its claims.
+func (i *Issuer) ParseClaims(tokenString string) (*Claims, error) {
 	claims := &Claims{}
-	_, err := jwt.ParseWithClaims(refreshToken, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
+	token, err := i.parser.ParseWithClaims(tokenString, claims, i.keyFunc)
 	if err != nil {
-		return false
+		return nil, err
 	}
-	return true
+
+	if !token.Valid {
+		return nil, ErrInvalidToken
+	}
+
+	if err := i.validate(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
 }
 
-func VerifyToken(tokenString string) (uint, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// Проверяем, что метод подписи совпадает с ожидаемым
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return jwtKey, nil
-	})
+// validate checks the registered claims. exp and iat are required; nbf is
+// optional for tokens issued before it was set.
+func (i *Issuer) validate(claims *Claims) error {
+	now := i.now().Unix()
+	leeway := int64(i.opts.Leeway.Seconds())
 
-	if err != nil {
-		return 0, err
+	if claims.ExpiresAt == 0 || now > claims.ExpiresAt+leeway {
+		return ErrExpired
+	}
+
+	if claims.NotBefore != 0 && now < claims.NotBefore-leeway {
+		return ErrNotValidYet
 	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		if userIDFloat, ok := claims["user_id"].(float64); ok {
-			userID := uint(userIDFloat)
-			return userID, nil
-		}
-		return 0, fmt.Errorf("user_id not found in token claims")
+	if claims.IssuedAt == 0 || now < claims.IssuedAt-leeway {
+		return ErrNotValidYet
 	}
 
-	return 0, fmt.Errorf("invalid token")
+	if claims.Issuer != i.opts.Issuer {
+		return ErrInvalidIssuer
+	}
+
+	if claims.Audience != i.opts.Audience {
+		return ErrInvalidAudience
+	}
+
+	return nil
 }
 
-//func ParseToken(r *http.Request) (uint, error) {
-//	authHeader := r.Header.Get("Authorization")
-//
-//	if authHeader == "" {
-//		return 0, errors.New("Empty token")
-//	}
-//
-//	parts := strings.Split(authHeader, " ")
-//	if len(parts) != 2 || parts[0] != "Bearer" {
-//		return 0, errors.New("Invalid Authorization header format")
-//	}
-//
-//	accessToken := parts[1]
-//
-//	userID, err := VerifyToken(accessToken)
-//	if err != nil {
-//		return 0, err
-//	}
-//
-//	return userID, nil
-//}
-
-func ParseToken(accessToken string) (uint, error) {
-	//authHeader := r.Header.Get("Authorization")
-	//
-	//if authHeader == "" {
-	//	return 0, errors.New("Empty token")
-	//}
-	//
-	//parts := strings.Split(authHeader, " ")
-	//if len(parts) != 2 || parts[0] != "Bearer" {
-	//	return 0, errors.New("Invalid Authorization header format")
-	//}
-	//
-	//accessToken := parts[1]
-
-	userID, err := VerifyToken(accessToken)
+// keyFunc picks the verification key by the kid header and makes sure the
+// token is signed with that key's algorithm.
+func (i *Issuer) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, err := i.keys.Key(kid)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	return userID, nil
+	// Проверяем, что метод подписи совпадает с ожидаемым
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	return key.Public, nil
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
 }
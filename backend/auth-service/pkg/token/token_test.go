@@ -0,0 +1,83 @@
+package token
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	keys, err := LoadKeyring(t.TempDir(), AlgorithmEdDSA, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := newTestIssuer(t, keys)
+
+	now := time.Unix(1700000000, 0)
+	issuer.now = func() time.Time { return now }
+
+	// leeway is the 30 seconds of newTestIssuer.
+	leeway := int64(issuer.opts.Leeway.Seconds())
+	unix := now.Unix()
+
+	tests := []struct {
+		name   string
+		modify func(c *Claims)
+		want   error
+	}{
+		{"valid", func(c *Claims) {}, nil},
+		{"expired within leeway", func(c *Claims) { c.ExpiresAt = unix - leeway }, nil},
+		{"expired beyond leeway", func(c *Claims) { c.ExpiresAt = unix - leeway - 1 }, ErrExpired},
+		{"missing exp", func(c *Claims) { c.ExpiresAt = 0 }, ErrExpired},
+		{"nbf within leeway", func(c *Claims) { c.NotBefore = unix + leeway }, nil},
+		{"nbf beyond leeway", func(c *Claims) { c.NotBefore = unix + leeway + 1 }, ErrNotValidYet},
+		{"missing nbf", func(c *Claims) { c.NotBefore = 0 }, nil},
+		{"iat within leeway", func(c *Claims) { c.IssuedAt = unix + leeway }, nil},
+		{"iat beyond leeway", func(c *Claims) { c.IssuedAt = unix + leeway + 1 }, ErrNotValidYet},
+		{"missing iat", func(c *Claims) { c.IssuedAt = 0 }, ErrNotValidYet},
+		{"issuer mismatch", func(c *Claims) { c.Issuer = "https://evil.example.com" }, ErrInvalidIssuer},
+		{"missing issuer", func(c *Claims) { c.Issuer = "" }, ErrInvalidIssuer},
+		{"audience mismatch", func(c *Claims) { c.Audience = "another-service" }, ErrInvalidAudience},
+		{"missing audience", func(c *Claims) { c.Audience = "" }, ErrInvalidAudience},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims(issuer)
+			claims.IssuedAt = unix
+			claims.NotBefore = unix
+			claims.ExpiresAt = unix + 60
+			tt.modify(claims)
+
+			if err := issuer.validate(claims); !errors.Is(err, tt.want) {
+				t.Fatalf("validate: err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// TestParseClaimsValidates checks that ParseClaims, which skips the claims
+// validation of jwt, runs validate.
+func TestParseClaimsValidates(t *testing.T) {
+	keys, err := LoadKeyring(t.TempDir(), AlgorithmEdDSA, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := newTestIssuer(t, keys)
+
+	raw, _, err := issuer.NewToken(1, TypeAccess, "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := issuer.ParseClaims(raw); err != nil {
+		t.Fatalf("ParseClaims: %v", err)
+	}
+
+	later := time.Now().Add(time.Minute + issuer.opts.Leeway + time.Second)
+	issuer.now = func() time.Time { return later }
+
+	if _, err := issuer.ParseClaims(raw); !errors.Is(err, ErrExpired) {
+		t.Fatalf("ParseClaims: err = %v, want %v", err, ErrExpired)
+	}
+}
@@ -0,0 +1,136 @@
+package totp_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Blxssy/social-media/auth-service/pkg/totp"
+)
+
+// rfcSecret is the SHA1 seed of RFC 6238 Appendix B, "12345678901234567890",
+// base32 encoded.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestCode checks the SHA1 test vectors of RFC 6238 Appendix B. The RFC lists
+// 8 digit codes; 6 digit codes are their last 6 digits.
+func TestCode(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		code, err := totp.Code(rfcSecret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatalf("Code(%d): %v", tt.unix, err)
+		}
+		if code != tt.want {
+			t.Errorf("Code(%d) = %s, want %s", tt.unix, code, tt.want)
+		}
+	}
+}
+
+func TestCodeAcceptsLowercaseAndPaddedSecrets(t *testing.T) {
+	for _, secret := range []string{"gezdgnbvgy3tqojqgezdgnbvgy3tqojq", rfcSecret + "===="} {
+		code, err := totp.Code(secret, time.Unix(59, 0))
+		if err != nil {
+			t.Fatalf("Code(%q): %v", secret, err)
+		}
+		if code != "287082" {
+			t.Errorf("Code(%q) = %s, want 287082", secret, code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	// 1111111111 is the 37037037th time step, 1111111110 to 1111111139.
+	now := time.Unix(1111111111, 0)
+	const step = 37037037
+
+	tests := []struct {
+		name     string
+		codeAt   time.Time
+		skew     int
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", now, 0, step, true},
+		{"same step, later", now.Add(20 * time.Second), 0, step, true},
+		{"previous step without skew", now.Add(-totp.Period), 0, 0, false},
+		{"previous step within skew", now.Add(-totp.Period), 1, step - 1, true},
+		{"next step within skew", now.Add(totp.Period), 1, step + 1, true},
+		{"two steps back, skew 1", now.Add(-2 * totp.Period), 1, 0, false},
+		{"two steps ahead, skew 1", now.Add(2 * totp.Period), 1, 0, false},
+		{"two steps back, skew 2", now.Add(-2 * totp.Period), 2, step - 2, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := totp.Code(rfcSecret, tt.codeAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotStep, ok := totp.Validate(rfcSecret, code, now, tt.skew)
+			if ok != tt.wantOK || gotStep != tt.wantStep {
+				t.Fatalf("Validate = %d, %v, want %d, %v", gotStep, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestValidateRejectsMalformedInput(t *testing.T) {
+	now := time.Unix(59, 0)
+
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+	}{
+		{"wrong code", rfcSecret, "123456"},
+		{"8 digit code", rfcSecret, "94287082"},
+		{"short code", rfcSecret, "28708"},
+		{"empty code", rfcSecret, ""},
+		{"invalid secret", "not base32!", "287082"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := totp.Validate(tt.secret, tt.code, now, 1); ok {
+				t.Fatalf("Validate(%q, %q) accepted", tt.secret, tt.code)
+			}
+		})
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The code of a fresh secret validates against itself.
+	now := time.Now()
+	code, err := totp.Code(secret, now)
+	if err != nil {
+		t.Fatalf("Code: %v", err)
+	}
+	if _, ok := totp.Validate(secret, code, now, 0); !ok {
+		t.Fatal("code of a generated secret does not validate")
+	}
+
+	other, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == secret {
+		t.Fatal("GenerateSecret returned the same secret twice")
+	}
+}